@@ -1,9 +1,8 @@
 package example
 
 const (
-	lrPrefix = "ex"
-	lrTokenType = "ExampleToken"
-	lrTrace = true
+	lrPrefix    = "ex"
+	lrTokenType = "Tok"
 )
 
 func start() *Grammar {
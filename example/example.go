@@ -0,0 +1,46 @@
+// Package example parses grammars written in the format of the file
+// grammar, which holds the grammar of that format itself.  Its parser
+// is generated by gen from _input.go.
+package example
+
+//go:generate gen -o parse.go lr _input.go
+
+// Grammar is a parsed grammar.
+type Grammar struct {
+	rules []*Rule
+}
+
+// Rule is a rule of a grammar: its symbol, the Go type of its value,
+// the symbols it matches with the variables they're bound to, and the
+// code computing its value.
+type Rule struct {
+	symbol  string
+	typ     string
+	pattern []string
+	vars    []string
+	code    string
+}
+
+// Parse parses the grammar src.
+func Parse(src []byte) (*Grammar, error) {
+	lex := NewLexer(src)
+	p := exNewParser()
+	var err error
+	perr := p.ParseFunc(func() Tok {
+		var tok Tok
+		if err == nil {
+			err = lex.Read(&tok)
+		}
+		if err != nil {
+			tok.id = tEOF
+		}
+		return tok
+	})
+	if err != nil {
+		return nil, err
+	}
+	if perr != nil {
+		return nil, perr
+	}
+	return p.Result(), nil
+}
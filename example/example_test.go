@@ -0,0 +1,42 @@
+package example
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestParseGrammar parses the grammar of the grammar format, written
+// in that format.
+func TestParseGrammar(t *testing.T) {
+	src, err := os.ReadFile("grammar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rule := range g.rules {
+		got = append(got, rule.symbol+" -> "+strings.Join(rule.pattern, " "))
+	}
+	want := []string{
+		"start -> rules",
+		"rules -> rules rule",
+		"rules -> rule",
+		"rule -> id id = patterns ;",
+		"patterns -> patterns patcode",
+		"patterns -> patcode",
+		"patcode -> pattern code",
+		"pattern -> pattern id",
+		"pattern -> id",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rules:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if _, err := Parse([]byte("start int = A=x { return A")); err == nil {
+		t.Error("parsed unterminated code")
+	}
+}
@@ -1,13 +1,36 @@
+package example
+
+import (
+	"bytes"
+	"fmt"
+)
+
 func isWhitespace(c byte) bool {
 	return c == ' ' || c == '\t' || c == '\n'
 }
 
+// lexer splits a grammar into tokens.
 type lexer struct {
-	r *bytereader.Reader
+	src []byte
+	pos int
 }
 
-func NewLexer(r io.Reader) *lexer {
-	return &lexer{bytereader.NewReader(bufio.NewReader(r))}
+func NewLexer(src []byte) *lexer {
+	return &lexer{src: src}
+}
+
+// next returns the next byte of input, or 0 at its end.
+func (r *lexer) next() byte {
+	r.pos++
+	if r.pos > len(r.src) {
+		return 0
+	}
+	return r.src[r.pos-1]
+}
+
+// back undoes the last call to next.
+func (r *lexer) back() {
+	r.pos--
 }
 
 type TokenId int
@@ -21,8 +44,9 @@ const (
 	tCode
 )
 
+// Tok is a token of a grammar, found at byte offset Pos.
 type Tok struct {
-	Pos  bytereader.Pos
+	Pos  int
 	id   TokenId
 	data string
 }
@@ -43,10 +67,11 @@ func (t Tok) String() string {
 	panic("not reached")
 }
 
-func (t *Tok) Id() string {
+// ParseId returns the terminal of the parser's grammar the token is.
+func (t Tok) ParseId() string {
 	switch t.id {
 	case tEOF:
-		return "$"
+		return "EOF"
 	case tSemi:
 		return ";"
 	case tEquals:
@@ -60,63 +85,65 @@ func (t *Tok) Id() string {
 	}
 }
 
-func (r *lexer) Read(tok *Tok) {
-	for isWhitespace(r.r.Next()) {
+func (r *lexer) Read(tok *Tok) error {
+	for isWhitespace(r.next()) {
 	}
-	r.r.Back()
+	r.back()
 
-	tok.Pos = r.r.Pos
-	switch r.r.Next() {
+	tok.Pos = r.pos
+	switch r.next() {
 	case 0:
 		tok.id = tEOF
 		tok.data = ""
-		return
+		return nil
 	case ';':
 		tok.id = tSemi
 		tok.data = ""
-		return
+		return nil
 	case '=':
 		tok.id = tEquals
 		tok.data = ""
-		return
+		return nil
 	case '{':
+		code, err := r.ReadCode()
 		tok.id = tCode
-		tok.data = r.ReadCode()
-		return
+		tok.data = code
+		return err
 	default:
-		r.r.Back()
+		r.back()
 	}
 
 	var buf bytes.Buffer
 	for {
-		b := r.r.Next()
+		b := r.next()
 		if isWhitespace(b) || b == 0 {
+			r.back()
 			tok.id = tIdent
 			tok.data = buf.String()
-			if tok.data[0] == '\'' && tok.data[len(tok.data)-1] == '\'' {
+			if len(tok.data) > 1 && tok.data[0] == '\'' && tok.data[len(tok.data)-1] == '\'' {
 				tok.data = tok.data[1 : len(tok.data)-1]
 			}
-			return
+			return nil
 		}
 		buf.WriteByte(b)
 	}
 }
 
-func (r *lexer) ReadCode() string {
+func (r *lexer) ReadCode() (string, error) {
 	braces := 1
 	var buf bytes.Buffer
 	for {
-		b := r.r.Next()
+		b := r.next()
 		switch b {
 		case 0:
-			panic("unexpected EOF while scanning code")
+			return "", fmt.Errorf("%d: unexpected EOF while scanning code", r.pos)
 		case '{':
 			braces++
 		case '}':
 			braces--
 		}
 		if braces == 0 {
-			return buf.String()
+			return buf.String(), nil
 		}
 		buf.WriteByte(b)
 	}
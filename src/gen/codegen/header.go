@@ -0,0 +1,23 @@
+package codegen
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+)
+
+// Version identifies this version of gen in the headers of its output.
+// Output depends only on the input and the version, so a change to the
+// output should come with a new version.
+const Version = "0.1"
+
+// Stamp prefixes the generated source src with a header marking it as
+// generated from input, with a hash of its content for spotting later
+// edits.  Only the base name of input appears, keeping the output
+// independent of where it was generated.
+func Stamp(src []byte, input string) []byte {
+	sum := sha256.Sum256(src)
+	header := fmt.Sprintf("// Code generated by gen %s from %s. DO NOT EDIT.\n// Content hash: %x\n\n",
+		Version, filepath.Base(input), sum[:8])
+	return append([]byte(header), src...)
+}
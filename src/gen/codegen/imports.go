@@ -0,0 +1,121 @@
+package codegen
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KnownImports maps package names to the import paths FixImports adds
+// for them.
+var KnownImports = map[string]string{
+	"bufio":   "bufio",
+	"bytes":   "bytes",
+	"errors":  "errors",
+	"fmt":     "fmt",
+	"io":      "io",
+	"math":    "math",
+	"sort":    "sort",
+	"strconv": "strconv",
+	"strings": "strings",
+	"unicode": "unicode",
+	"utf8":    "unicode/utf8",
+}
+
+// FixImports adds imports of the KnownImports packages that the source
+// refers to but doesn't import, as when user code copied into the
+// output uses a package the rest of it doesn't, and drops imports the
+// source makes twice.  The imports are changed without moving any
+// lines, so line numbers into the raw source stay valid.  Source that
+// doesn't parse is left for Fmt to report.
+func (w *Writer) FixImports() {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", w.Raw(), 0)
+	if err != nil {
+		return
+	}
+
+	// Imports repeated, as when the grammar imports a package the
+	// template does too, are blanked out.
+	src := append([]byte{}, w.Raw()...)
+	blank := func(from, to token.Pos) {
+		for i := fset.Position(from).Offset; i < fset.Position(to).Offset; i++ {
+			if src[i] != '\n' {
+				src[i] = ' '
+			}
+		}
+	}
+	imported := make(map[string]bool)
+	specs := make(map[string]bool)
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || d.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range d.Specs {
+			imp := spec.(*ast.ImportSpec)
+			p, _ := strconv.Unquote(imp.Path.Value)
+			name := path.Base(p)
+			if imp.Name != nil {
+				name = imp.Name.Name
+			}
+			key := name + " " + p
+			if specs[key] {
+				if d.Lparen.IsValid() {
+					blank(imp.Pos(), imp.End())
+				} else {
+					blank(d.Pos(), d.End())
+				}
+				continue
+			}
+			specs[key] = true
+			imported[name] = true
+		}
+	}
+	missing := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			// Names that resolve to nothing in the file, and so might
+			// be packages, have no Obj.
+			if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil && !imported[x.Name] {
+				if p, ok := KnownImports[x.Name]; ok {
+					missing[strconv.Quote(p)] = true
+				}
+			}
+		}
+		return true
+	})
+	var adds []string
+	for spec := range missing {
+		adds = append(adds, spec)
+	}
+	sort.Strings(adds)
+
+	// Add to the first import group if there is one, relying on
+	// newlines within it acting as semicolons; otherwise follow the
+	// package clause on its line.
+	var at int
+	var text string
+	for _, decl := range f.Decls {
+		if len(adds) == 0 {
+			break
+		}
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT && d.Lparen.IsValid() {
+			at = fset.Position(d.Lparen).Offset + 1
+			text = strings.Join(adds, "; ") + ";"
+			break
+		}
+	}
+	if text == "" && len(adds) > 0 {
+		at = fset.Position(f.Name.End()).Offset
+		text = "; import (" + strings.Join(adds, "; ") + ")"
+	}
+	w.Buffer.Reset()
+	w.Buffer.Write(src[:at])
+	w.Buffer.WriteString(text)
+	w.Buffer.Write(src[at:])
+}
@@ -0,0 +1,56 @@
+package codegen
+
+import (
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestFixImports checks the imports FixImports leaves source with, and
+// that it keeps the source's lines where they were.
+func TestFixImports(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		want []string
+	}{
+		// A known package used but not imported is imported.
+		{"package p\n\nvar x = strings.TrimSpace(\"\")\n", []string{"strings"}},
+		{"package p\n\nimport (\n\t\"fmt\"\n)\n\nvar x = fmt.Sprint(strings.TrimSpace(\"\"))\n", []string{"strings", "fmt"}},
+		{"package p\n\nvar x = utf8.RuneLen('x')\n", []string{"unicode/utf8"}},
+		// Names declared in the file, and unknown packages, aren't.
+		{"package p\n\ntype T struct{ x int }\n\nvar strings T\n\nvar x = strings.x\n", nil},
+		{"package p\n\nvar x = foo.Bar\n", nil},
+		// An import under another name doesn't count.
+		{"package p\n\nimport s \"strings\"\n\nvar x = s.TrimSpace(strings.ToLower(\"\"))\n", []string{"strings", "s strings"}},
+		// Repeated imports are dropped.
+		{"package p\n\nimport \"fmt\"\n\nimport (\n\t\"fmt\"\n\t\"sort\"\n)\n\nvar x = fmt.Sprint(sort.Ints)\n", []string{"fmt", "sort"}},
+		{"package p\n\nimport (\n\t\"fmt\"\n)\n\nimport \"fmt\"\n\nvar x = fmt.Sprint()\n", []string{"fmt"}},
+	} {
+		w := &Writer{}
+		w.WriteString(test.src)
+		w.FixImports()
+		src := string(w.Raw())
+
+		f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
+		if err != nil {
+			t.Errorf("%q: %s", test.src, err)
+			continue
+		}
+		var got []string
+		for _, imp := range f.Imports {
+			p, _ := strconv.Unquote(imp.Path.Value)
+			if imp.Name != nil {
+				p = imp.Name.Name + " " + p
+			}
+			got = append(got, p)
+		}
+		if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+			t.Errorf("%q: imports %q, want %q", test.src, got, test.want)
+		}
+		if strings.Count(src, "\n") != strings.Count(test.src, "\n") {
+			t.Errorf("%q: lines moved:\n%s", test.src, src)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package codegen
+
+import (
+	"log"
+	"os"
+)
+
+// Logger is the interface of the loggers the generators report to,
+// which a *log.Logger satisfies.
+type Logger interface {
+	Println(v ...interface{})
+	Printf(format string, v ...interface{})
+}
+
+// Level is the severity of a logged message.
+type Level int
+
+const (
+	// LevelDebug is the log of the generation process, given by -v.
+	LevelDebug Level = iota - 1
+	// LevelInfo is for messages of interest that aren't problems; it's
+	// the default level.
+	LevelInfo
+	// LevelWarn is for problems that don't stop generation, like
+	// conflicts in a parse table.
+	LevelWarn
+	// LevelError is for problems that do; logging only at it silences
+	// everything else.
+	LevelError
+)
+
+// Log passes the messages at or above a level on to a Logger, dropping
+// the rest.
+type Log struct {
+	Out   Logger
+	Level Level
+}
+
+// NewLog returns a Log of the messages at or above level, writing them
+// to out or, if out is nil, to stderr.
+func NewLog(out Logger, level Level) *Log {
+	if out == nil {
+		out = log.New(os.Stderr, "", 0)
+	}
+	return &Log{Out: out, Level: level}
+}
+
+// Enabled reports whether messages at level are logged.
+func (l *Log) Enabled(level Level) bool {
+	return level >= l.Level
+}
+
+// At returns the Logger for messages at level, or nil if they aren't
+// logged, to be checked before doing the work of a message.
+func (l *Log) At(level Level) Logger {
+	if !l.Enabled(level) {
+		return nil
+	}
+	return l.Out
+}
+
+// Printf logs a message at level.
+func (l *Log) Printf(level Level, format string, v ...interface{}) {
+	if l.Enabled(level) {
+		l.Out.Printf(format, v...)
+	}
+}
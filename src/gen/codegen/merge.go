@@ -0,0 +1,123 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"sort"
+)
+
+// Merge emits the imports and top-level declarations of several
+// generated Go source files, so that they can be combined into one
+// after the caller has written a package clause.  Imports and
+// declarations appearing in more than one file are emitted once; it's
+// an error for two files to declare the same name differently.
+func (w *Writer) Merge(srcs ...[]byte) error {
+	fset := token.NewFileSet()
+	imports := make(map[string]bool)
+	decls := make(map[string]string)
+	var body bytes.Buffer
+
+	for i, src := range srcs {
+		f, err := parser.ParseFile(fset, fmt.Sprintf("<source %d>", i), src, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		for _, imp := range f.Imports {
+			imports[nodeStr(fset, imp)] = true
+		}
+
+		for _, decl := range f.Decls {
+			if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+				continue
+			}
+			text := nodeStr(fset, &printer.CommentedNode{Node: decl, Comments: f.Comments})
+			names := declNames(decl)
+			dup := len(names) > 0
+			for _, name := range names {
+				prev, seen := decls[name]
+				if seen && prev != text {
+					return fmt.Errorf("conflicting declarations of %s", name)
+				}
+				dup = dup && seen
+				decls[name] = text
+			}
+			if !dup {
+				body.WriteString(text)
+				body.WriteString("\n\n")
+			}
+		}
+	}
+
+	if len(imports) > 0 {
+		var specs []string
+		for spec := range imports {
+			specs = append(specs, spec)
+		}
+		sort.Strings(specs)
+		w.Line("import (")
+		for _, spec := range specs {
+			w.Line(spec)
+		}
+		w.Line(")")
+		w.Line("")
+	}
+	w.Write(body.Bytes())
+	return nil
+}
+
+// declNames returns the names a top-level declaration declares, with
+// methods named after their receiver type.
+func declNames(decl ast.Decl) []string {
+	var names []string
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		name := d.Name.Name
+		if d.Recv != nil && len(d.Recv.List) > 0 {
+			name = recvName(d.Recv.List[0].Type) + "." + name
+		}
+		names = append(names, name)
+	case *ast.GenDecl:
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				names = append(names, s.Name.Name)
+			case *ast.ValueSpec:
+				for _, n := range s.Names {
+					if n.Name != "_" {
+						names = append(names, n.Name)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// recvName names the type of a method receiver, ignoring pointers and
+// type parameters.
+func recvName(e ast.Expr) string {
+	switch t := e.(type) {
+	case *ast.StarExpr:
+		return recvName(t.X)
+	case *ast.IndexExpr:
+		return recvName(t.X)
+	case *ast.IndexListExpr:
+		return recvName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// nodeStr prints an ast node.
+func nodeStr(fset *token.FileSet, n interface{}) string {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, n); err != nil {
+		panic(err)
+	}
+	return buf.String()
+}
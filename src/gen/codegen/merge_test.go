@@ -0,0 +1,32 @@
+package codegen
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMerge checks that Merge emits declarations and imports shared by
+// its sources once, and rejects conflicting ones.
+func TestMerge(t *testing.T) {
+	a := "package p\n\nimport \"fmt\"\n\nfunc f() { fmt.Println() }\n\ntype T int\n"
+	b := "package p\n\nimport \"fmt\"\n\ntype T int\n\nvar x = fmt.Sprint()\n"
+	w := &Writer{}
+	w.Line("package p")
+	if err := w.Merge([]byte(a), []byte(b)); err != nil {
+		t.Fatal(err)
+	}
+	src, err := w.Fmt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s, want := range map[string]int{`"fmt"`: 1, "type T int": 1, "func f()": 1, "var x": 1} {
+		if n := strings.Count(string(src), s); n != want {
+			t.Errorf("merged source has %q %d times, want %d:\n%s", s, n, want, src)
+		}
+	}
+
+	c := "package p\n\ntype T string\n"
+	if err := (&Writer{}).Merge([]byte(a), []byte(c)); err == nil || !strings.Contains(err.Error(), "conflicting declarations of T") {
+		t.Errorf("merging conflicting types: error %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// Split is the inverse of Merge: it moves the top-level declarations
+// of the Go source src that declare any of names into a file of their
+// own in the same package, returning the formatted source of the rest
+// and of the moved declarations.  Both files get the imports of src
+// that they use.
+func Split(src []byte, names map[string]bool) (rest, moved []byte, err error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+
+	var restBuf, movedBuf bytes.Buffer
+	fmt.Fprintf(&movedBuf, "package %s\n\n", f.Name.Name)
+	movedBuf.WriteString("import (\n")
+	for _, imp := range f.Imports {
+		fmt.Fprintf(&movedBuf, "%s\n", src[offset(imp.Pos()):offset(imp.End())])
+	}
+	movedBuf.WriteString(")\n")
+	last := 0
+	for _, decl := range f.Decls {
+		match := false
+		for _, name := range declNames(decl) {
+			match = match || names[name]
+		}
+		if !match {
+			continue
+		}
+		start := decl.Pos()
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			if d.Doc != nil {
+				start = d.Doc.Pos()
+			}
+		case *ast.FuncDecl:
+			if d.Doc != nil {
+				start = d.Doc.Pos()
+			}
+		}
+		restBuf.Write(src[last:offset(start)])
+		movedBuf.WriteString("\n")
+		movedBuf.Write(src[offset(start):offset(decl.End())])
+		movedBuf.WriteString("\n")
+		last = offset(decl.End())
+	}
+	restBuf.Write(src[last:])
+
+	if rest, err = dropUnusedImports(restBuf.Bytes()); err != nil {
+		return nil, nil, err
+	}
+	if moved, err = dropUnusedImports(movedBuf.Bytes()); err != nil {
+		return nil, nil, err
+	}
+	return rest, moved, nil
+}
+
+// dropUnusedImports removes the imports src doesn't refer to, and
+// formats it.
+func dropUnusedImports(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil {
+				used[x.Name] = true
+			}
+		}
+		return true
+	})
+
+	var decls []ast.Decl
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || d.Tok != token.IMPORT {
+			decls = append(decls, decl)
+			continue
+		}
+		var specs []ast.Spec
+		for _, spec := range d.Specs {
+			imp := spec.(*ast.ImportSpec)
+			p, _ := strconv.Unquote(imp.Path.Value)
+			name := importName(p)
+			if imp.Name != nil {
+				name = imp.Name.Name
+			}
+			if used[name] || name == "_" || name == "." {
+				specs = append(specs, spec)
+			}
+		}
+		if len(specs) > 0 {
+			d.Specs = specs
+			decls = append(decls, d)
+		}
+	}
+	f.Decls = decls
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+// importName guesses the name of the package imported by path: its
+// last element, skipping a major version suffix.
+func importName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = elems[len(elems)-2]
+	}
+	return name
+}
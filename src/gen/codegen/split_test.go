@@ -0,0 +1,76 @@
+package codegen
+
+import (
+	"strings"
+	"testing"
+)
+
+const splitSrc = `package p
+
+import (
+	"fmt"
+	"strings"
+)
+
+// T is a type.
+type T struct{}
+
+func (T) String() string { return fmt.Sprint("T") }
+
+// rules are moved.
+var rules = []string{strings.ToUpper("x")}
+
+func f() {}
+`
+
+// TestSplit checks that Split moves the declarations it's given, with
+// their comments, and the imports each part uses.
+func TestSplit(t *testing.T) {
+	for _, test := range []struct {
+		names           []string
+		rest, moved     []string
+		restNot, movNot []string
+	}{
+		{
+			names:   []string{"rules"},
+			rest:    []string{"type T struct{}", `"fmt"`, "func f() {}"},
+			restNot: []string{"rules", `"strings"`},
+			moved:   []string{"// rules are moved.", "var rules", `"strings"`},
+			movNot:  []string{"type T", `"fmt"`},
+		},
+		{
+			// Methods are named after their receiver type.
+			names:   []string{"T", "T.String"},
+			rest:    []string{"var rules", `"strings"`},
+			restNot: []string{"String()", `"fmt"`},
+			moved:   []string{"// T is a type.", "type T struct{}", "func (T) String()", `"fmt"`},
+			movNot:  []string{"rules", `"strings"`},
+		},
+	} {
+		names := make(map[string]bool)
+		for _, name := range test.names {
+			names[name] = true
+		}
+		rest, moved, err := Split([]byte(splitSrc), names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func(part string, src []byte, has, hasNot []string) {
+			if !strings.HasPrefix(string(src), "package p\n") {
+				t.Errorf("%v: %s lacks the package clause:\n%s", test.names, part, src)
+			}
+			for _, s := range has {
+				if !strings.Contains(string(src), s) {
+					t.Errorf("%v: %s lacks %q:\n%s", test.names, part, s, src)
+				}
+			}
+			for _, s := range hasNot {
+				if strings.Contains(string(src), s) {
+					t.Errorf("%v: %s has %q:\n%s", test.names, part, s, src)
+				}
+			}
+		}
+		check("rest", rest, test.rest, test.restNot)
+		check("moved", moved, test.moved, test.movNot)
+	}
+}
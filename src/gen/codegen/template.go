@@ -0,0 +1,22 @@
+package codegen
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Template returns the text of the template name: the contents of the
+// file name in dir, which lets projects override the templates gen
+// uses, or def if dir is empty or has no such file.
+func Template(dir, name, def string) (string, error) {
+	if dir == "" {
+		return def, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return def, nil
+	} else if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
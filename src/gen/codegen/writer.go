@@ -3,14 +3,85 @@ package codegen
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"go/format"
+	"go/scanner"
 	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 )
 
 // Writer accumulates written source code.
 type Writer struct {
 	bytes.Buffer
+
+	// sites records, for each line of output, the place in the
+	// generator that began writing it.
+	sites []string
+}
+
+// Write appends p to the output, recording the call site of any lines
+// it begins.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.record(string(p))
+	return w.Buffer.Write(p)
+}
+
+// WriteString is Write for strings.
+func (w *Writer) WriteString(s string) (int, error) {
+	w.record(s)
+	return w.Buffer.WriteString(s)
+}
+
+// record notes the call site of the lines s begins.
+func (w *Writer) record(s string) {
+	n := strings.Count(strings.TrimSuffix(s, "\n"), "\n")
+	if w.Len() == 0 || w.Bytes()[w.Len()-1] == '\n' {
+		n++
+	}
+	if n == 0 || len(s) == 0 {
+		return
+	}
+	site := callSite()
+	for i := 0; i < n; i++ {
+		w.sites = append(w.sites, site)
+	}
+}
+
+// callerPkgs are the packages whose frames callSite skips to find the
+// generator code that wrote some output.
+var callerPkgs = map[string]bool{
+	"gen/codegen":   true,
+	"bytes":         true,
+	"fmt":           true,
+	"io":            true,
+	"reflect":       true,
+	"runtime":       true,
+	"text/template": true,
+}
+
+// callSite returns the file:line of the generator code writing output.
+func callSite() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		f, more := frames.Next()
+		pkg := f.Function
+		if i := strings.LastIndex(pkg, "/"); i >= 0 {
+			pkg = pkg[:i] + strings.SplitN(pkg[i:], ".", 2)[0]
+		} else {
+			pkg = strings.SplitN(pkg, ".", 2)[0]
+		}
+		if !callerPkgs[pkg] {
+			return filepath.Join(filepath.Base(filepath.Dir(f.File)), filepath.Base(f.File)) + fmt.Sprintf(":%d", f.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
 }
 
 // Line emits a line of text.
@@ -23,13 +94,110 @@ func (w *Writer) Linef(format string, a ...interface{}) {
 	fmt.Fprintf(w, format+"\n", a...)
 }
 
+// Lines returns the number of complete lines written so far.
+func (w *Writer) Lines() int {
+	return bytes.Count(w.Bytes(), []byte("\n"))
+}
+
 // Raw returns the raw generated source, useful for debugging.
 func (w *Writer) Raw() []byte {
 	return w.Bytes()
 }
 
-// Fmt returns the gofmt-formatted source.  It can return an error
-// if the generated source fails to parse.
+// Unformatted returns the raw generated source under a banner saying
+// so, in place of Fmt, for inspecting output that doesn't format.  The
+// banner is a single line, so line n of the raw source is line n+1.
+func (w *Writer) Unformatted() []byte {
+	return append([]byte("// Unformatted output of gen -raw, for debugging. DO NOT EDIT.\n"), w.Raw()...)
+}
+
+// Fmt returns the gofmt-formatted source.  It can return a
+// *FormatError if the generated source fails to parse.
 func (w *Writer) Fmt() ([]byte, error) {
-	return format.Source(w.Raw())
+	src, err := format.Source(w.Raw())
+	if err != nil {
+		return nil, w.formatError(err)
+	}
+	return src, nil
+}
+
+// FormatError reports generated source that failed to parse, which is
+// a bug in the generator.
+type FormatError struct {
+	Err error
+	// Src is the unformatted source.
+	Src []byte
+	// Path is a file holding Src, roughly indented, if one could be
+	// written.
+	Path string
+	// Line is the line of Src at fault, and Site the place in the
+	// generator that wrote it, if known.
+	Line int
+	Site string
+}
+
+// formatContext is the number of lines shown around a FormatError.
+const formatContext = 3
+
+func (e *FormatError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "error formatting generated code: %s", e.Err)
+	if e.Site != "" {
+		fmt.Fprintf(&buf, "\nline written by %s", e.Site)
+	}
+	if e.Line > 0 {
+		lines := strings.Split(strings.TrimSuffix(string(indent(e.Src)), "\n"), "\n")
+		for i := max(e.Line-formatContext, 1); i <= min(e.Line+formatContext, len(lines)); i++ {
+			mark := " "
+			if i == e.Line {
+				mark = ">"
+			}
+			fmt.Fprintf(&buf, "\n%s%5d  %s", mark, i, lines[i-1])
+		}
+	}
+	if e.Path != "" {
+		fmt.Fprintf(&buf, "\nfull output in %s", e.Path)
+	}
+	return buf.String()
+}
+
+// formatError builds the FormatError for err, writing the raw source
+// to a temporary file for inspection.
+func (w *Writer) formatError(err error) *FormatError {
+	e := &FormatError{Err: err, Src: w.Raw()}
+	var list scanner.ErrorList
+	if errors.As(err, &list) && len(list) > 0 {
+		e.Line = list[0].Pos.Line
+		if e.Line > 0 && e.Line <= len(w.sites) {
+			e.Site = w.sites[e.Line-1]
+		}
+	}
+	if f, err := os.CreateTemp("", "gen-*.go"); err == nil {
+		if _, err := f.Write(indent(e.Src)); err == nil {
+			e.Path = f.Name()
+		}
+		f.Close()
+	}
+	return e
+}
+
+// indent reindents src by counting brackets, which keeps its lines
+// where they were and makes the output readable when it isn't valid
+// enough for gofmt.
+func indent(src []byte) []byte {
+	var buf bytes.Buffer
+	depth := 0
+	for _, line := range strings.Split(strings.TrimSuffix(string(src), "\n"), "\n") {
+		line = strings.TrimLeft(line, " \t")
+		closing := len(line) - len(strings.TrimLeft(line, "})]"))
+		for i := 0; i < depth-closing; i++ {
+			buf.WriteByte('\t')
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		depth += strings.Count(line, "{") + strings.Count(line, "(") + strings.Count(line, "[")
+		depth -= strings.Count(line, "}") + strings.Count(line, ")") + strings.Count(line, "]")
+		depth = max(depth, 0)
+	}
+	return buf.Bytes()
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configName is the name of the project config file, looked for in
+// the current directory and its parents.
+const configName = "gen.json"
+
+// config holds a project's defaults for gen, as in
+//
+//	{
+//		"flags": {"strict": true, "prefix": "calc"},
+//		"inputs": [
+//			{"file": "calc/tokens", "mode": "lex", "flags": {"o": "calc/lex.go"}},
+//			{"file": "calc/_grammar.go", "mode": "lr", "flags": {"o": "calc/parse.go"}}
+//		]
+//	}
+//
+// Flags hold defaults for the command-line flags of the same names,
+// and Inputs the files gen processes when run without arguments, each
+// with further flags of its own.  Paths are relative to the config
+// file, and flags given on the command line take precedence.
+type config struct {
+	Flags  map[string]interface{} `json:"flags"`
+	Inputs []configInput          `json:"inputs"`
+
+	// file is the path of the config file, and dir its directory.
+	file, dir string
+}
+
+type configInput struct {
+	File  string                 `json:"file"`
+	Mode  string                 `json:"mode"`
+	Flags map[string]interface{} `json:"flags"`
+}
+
+// pathFlags are the flags whose values are paths.
+var pathFlags = map[string]bool{
+	"o":         true,
+	"dir":       true,
+	"profile":   true,
+	"templates": true,
+}
+
+// findConfig loads the config at path or, if path is empty, the
+// nearest config file, if any.
+func findConfig(path string) (*config, error) {
+	if path == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		for dir := wd; ; dir = filepath.Dir(dir) {
+			if _, err := os.Stat(filepath.Join(dir, configName)); err == nil {
+				path = filepath.Join(dir, configName)
+				if rel, err := filepath.Rel(wd, path); err == nil {
+					path = rel
+				}
+				break
+			}
+			if dir == filepath.Dir(dir) {
+				return nil, nil
+			}
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg := &config{file: path, dir: filepath.Dir(path)}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, &inputError{path, err}
+	}
+	for _, in := range cfg.Inputs {
+		if in.File == "" || in.Mode == "" {
+			return nil, &inputError{path, fmt.Errorf("inputs need a file and a mode")}
+		}
+	}
+	return cfg, nil
+}
+
+// input returns the config's entry for running mode on infile, if any.
+func (c *config) input(mode, infile string) *configInput {
+	abs, err := filepath.Abs(infile)
+	if err != nil {
+		return nil
+	}
+	for i, in := range c.Inputs {
+		if other, err := filepath.Abs(c.path(in.File)); err == nil && other == abs && in.Mode == mode {
+			return &c.Inputs[i]
+		}
+	}
+	return nil
+}
+
+// path resolves a path relative to the config file.
+func (c *config) path(p string) string {
+	if p == "-" || filepath.IsAbs(p) {
+		return p
+	}
+	joined := filepath.Join(c.dir, p)
+	if strings.HasSuffix(p, "/") {
+		// A trailing slash marks an output directory.
+		joined += "/"
+	}
+	return joined
+}
+
+// setFlags sets the flags not set on the command line, which are in
+// explicit, to the values in flags.  It returns a function restoring
+// their previous values.
+func (c *config) setFlags(flags map[string]interface{}, explicit map[string]bool) (restore func(), err error) {
+	var names []string
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	old := make(map[string]string)
+	restore = func() {
+		for name, value := range old {
+			flag.Set(name, value)
+		}
+	}
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil {
+			return restore, usageError(fmt.Sprintf("%s: unknown flag %q", c.file, name))
+		}
+		if explicit[name] {
+			continue
+		}
+		value := fmt.Sprint(flags[name])
+		if n, ok := flags[name].(float64); ok {
+			// JSON numbers are floats, which Sprint writes large
+			// ones of in exponent form.
+			value = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		if pathFlags[name] {
+			value = c.path(value)
+		}
+		old[name] = f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			return restore, usageError(fmt.Sprintf("%s: flag %s: %s", c.file, name, err))
+		}
+	}
+	return restore, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes data to path, making its directory.
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFindConfig checks that the nearest config is found from a
+// subdirectory, with paths resolved against its directory, that one
+// given by path is read wherever it's named, and that bad configs are
+// reported with their paths.
+func TestFindConfig(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, configName),
+		`{"flags": {"strict": true}, "inputs": [{"file": "calc/_grammar.go", "mode": "lr"}]}`)
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0777); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(sub)
+
+	cfg, err := findConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("..", "..", configName); cfg == nil || cfg.file != want {
+		t.Fatalf("found config %+v, want %s", cfg, want)
+	}
+	if got, want := cfg.path(cfg.Inputs[0].File), filepath.Join("..", "..", "calc", "_grammar.go"); got != want {
+		t.Errorf("input path %s, want %s", got, want)
+	}
+	if in := cfg.input("lr", filepath.Join(root, "calc", "_grammar.go")); in != &cfg.Inputs[0] {
+		t.Errorf("no input found for the grammar by its absolute path")
+	}
+	if in := cfg.input("lex", filepath.Join(root, "calc", "_grammar.go")); in != nil {
+		t.Errorf("input found for another mode")
+	}
+
+	other := filepath.Join(root, "conf", "other.json")
+	writeFile(t, other, `{"flags": {"prefix": "calc"}}`)
+	if cfg, err = findConfig(other); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.file != other || cfg.dir != filepath.Dir(other) || cfg.Flags["prefix"] != "calc" {
+		t.Errorf("config given by path is %+v", cfg)
+	}
+
+	for _, test := range []struct {
+		config, err string
+	}{
+		{`{"flag": {}}`, `json: unknown field "flag"`},
+		{`{"inputs": [{"file": "x"}]}`, "inputs need a file and a mode"},
+	} {
+		writeFile(t, other, test.config)
+		_, err := findConfig(other)
+		if want := other + ": " + test.err; err == nil || err.Error() != want {
+			t.Errorf("%s: error %v, want %s", test.config, err, want)
+		}
+	}
+	if _, err := findConfig(filepath.Join(root, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing config: error %v", err)
+	}
+}
+
+// TestSetFlags checks the flags a config sets, and the errors it gives
+// for bad ones, which name the config file.
+func TestSetFlags(t *testing.T) {
+	cfg := &config{file: filepath.Join("conf", "my.json"), dir: "conf"}
+	restore, err := cfg.setFlags(map[string]interface{}{
+		"depth":  float64(1000000),
+		"o":      "out/",
+		"strict": true,
+		"prefix": "calc",
+	}, map[string]bool{"prefix": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *depth != 1000000 || *outpath != filepath.Join("conf", "out")+"/" || !*strict || *prefix != "" {
+		t.Errorf("flags set to depth %d, o %s, strict %v, prefix %q", *depth, *outpath, *strict, *prefix)
+	}
+	restore()
+	if *depth != 5 || *outpath != "-" || *strict {
+		t.Errorf("flags restored to depth %d, o %s, strict %v", *depth, *outpath, *strict)
+	}
+
+	for _, test := range []struct {
+		flags map[string]interface{}
+		err   string
+	}{
+		{map[string]interface{}{"nope": true}, `conf/my.json: unknown flag "nope"`},
+		{map[string]interface{}{"depth": 1.5}, `conf/my.json: flag depth: parse error`},
+	} {
+		restore, err := cfg.setFlags(test.flags, nil)
+		restore()
+		if err == nil || !strings.HasPrefix(err.Error(), filepath.FromSlash(test.err)) {
+			t.Errorf("%v: error %v, want %s", test.flags, err, test.err)
+		}
+	}
+}
+
+// TestConfigPath checks the resolution of paths in a config against
+// its directory.
+func TestConfigPath(t *testing.T) {
+	cfg := &config{dir: "conf"}
+	for _, test := range []struct {
+		path, want string
+	}{
+		{"x.go", filepath.Join("conf", "x.go")},
+		{"../x.go", "x.go"},
+		{"out/", filepath.Join("conf", "out") + "/"},
+		{"-", "-"},
+		{"/abs/x.go", "/abs/x.go"},
+	} {
+		if got := cfg.path(test.path); got != test.want {
+			t.Errorf("path(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// diffLine is a line of a diff, with op one of ' ', '-' or '+'.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// splitLines splits data into lines, keeping their newlines.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// diffLines computes the changes from a to b.  Regenerated code mostly
+// differs in a few places, so the common prefix and suffix are trimmed
+// before finding the longest common subsequence of the rest.
+func diffLines(a, b []string) []diffLine {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// ma[i:] and mb[j:].
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []diffLine
+	for _, l := range a[:pre] {
+		lines = append(lines, diffLine{' ', l})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			lines = append(lines, diffLine{' ', ma[i]})
+			i++
+			j++
+		case j == len(mb) || i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', ma[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', mb[j]})
+			j++
+		}
+	}
+	for _, l := range a[len(a)-suf:] {
+		lines = append(lines, diffLine{' ', l})
+	}
+	return lines
+}
+
+// unifiedDiff returns a unified diff from a, named aName, to b, named
+// bName, or nil if they're the same.
+func unifiedDiff(aName, bName string, a, b []byte) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	// aPos[k] and bPos[k] count the lines of a and b before lines[k].
+	aPos := make([]int, len(lines)+1)
+	bPos := make([]int, len(lines)+1)
+	for k, l := range lines {
+		aPos[k+1], bPos[k+1] = aPos[k], bPos[k]
+		if l.op != '+' {
+			aPos[k+1]++
+		}
+		if l.op != '-' {
+			bPos[k+1]++
+		}
+	}
+	// hunkRange formats the start and length of a hunk's lines.
+	hunkRange := func(pos []int, start, end int) string {
+		n := pos[end] - pos[start]
+		if n == 0 {
+			return fmt.Sprintf("%d,0", pos[start])
+		}
+		return fmt.Sprintf("%d,%d", pos[start]+1, n)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+	for k := 0; k < len(lines); {
+		if lines[k].op == ' ' {
+			k++
+			continue
+		}
+		// Gather the changes close enough to share context.
+		last := k
+		for i := k + 1; i < len(lines) && i <= last+2*diffContext; i++ {
+			if lines[i].op != ' ' {
+				last = i
+			}
+		}
+		start := max(k-diffContext, 0)
+		end := min(last+1+diffContext, len(lines))
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(aPos, start, end), hunkRange(bPos, start, end))
+		for _, l := range lines[start:end] {
+			buf.WriteByte(l.op)
+			buf.WriteString(l.text)
+			if l.text[len(l.text)-1] != '\n' {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+	return buf.Bytes()
+}
@@ -1,30 +1,225 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
 
+	"gen/codegen"
 	"gen/lex"
+	"gen/ll"
 	"gen/lr"
+	"gen/scaffold"
 )
 
-var outpath = flag.String("o", "-", "output path")
+var outpath = flag.String("o", "-", "output path, or a directory in which to derive output names from the inputs")
+var diff = flag.Bool("diff", false, "write nothing, instead printing a diff from each output file to what would be generated")
 var verbose = flag.Bool("v", false, "verbose output")
+var quiet = flag.Bool("q", false, "quiet: write nothing to stderr but errors")
+var configPath = flag.String("config", "", "path of the project config file (default: the nearest "+configName+")")
+var pkg = flag.String("pkg", "", "output package name (lex: defaults to the tokens file's, or main; lr: defaults to the grammar's)")
+var prefix = flag.String("prefix", "", "lr: type prefix, for grammars that don't set lrPrefix")
+var tokenType = flag.String("tokentype", "", "lr: token type, for grammars that don't set lrTokenType")
+var dir = flag.String("dir", "", "output package directory (lr: defaults to the grammar's; a parser output elsewhere imports the grammar's package, whose other files must declare its helpers)")
+var graph = flag.Bool("graph", false, "lex, lr: output a graphviz graph of the symbol machine or the parser's states")
+var errorMode = flag.String("errors", "", "lex: generate lexOrError, returning tError for unlexable input; one of byte, skip")
+var newlines = flag.String("newlines", "", "lex: make newlines tokens rather than white space; one of each, collapse (runs of blank lines into one)")
+var skipBOM = flag.Bool("skipbom", false, "lex: generate code to skip a leading byte order mark")
+var skipShebang = flag.Bool("skipshebang", false, "lex: generate code to skip a leading #! line")
+var single = flag.Bool("single", false, "lr: also generate the lexer for the grammar's tokens file, in the same output file")
+var strict = flag.Bool("strict", false, "lr: treat grammar warnings and conflicts as errors")
+var tags = flag.String("tags", "", "lr: comma-separated build tags selecting the files of a grammar directory")
+var exclude = flag.String("exclude", "", "lr: pattern of file names to leave out of a grammar directory")
+var intern = flag.Bool("intern", false, "lex: intern the text of identifiers in the generated scan function")
+var tokenPkg = flag.String("tokenpkg", "", "lex, tokens: import path of the shared token package, which lexers import rather than declaring their tokens")
+var tokenizer = flag.Bool("tokenizer", false, "lex: generate a Tokenizer type reading tokens from an io.Reader")
+var actions = flag.Bool("actions", false, "lr: write the rules and their actions to a file of their own, named after the output with _actions added")
+var driverCmd = flag.Bool("driver", false, "lr: also write a command parsing files of the language and printing their trees, as cmd/NAME/main.go beside the output, unless it exists")
+var ruleIds = flag.String("ruleids", "", "lr: file of rule IDs, kept up to date so that rules keep their IDs as the grammar changes")
+var raw = flag.Bool("raw", false, "lex, lr: write the generated code unformatted, for debugging output that fails to format")
+var stats = flag.Bool("stats", false, "lr: report the size and cost of generating the parser to stderr")
+var report = flag.Bool("report", false, "lr: report the grammar's size, recursion and class (LL(1), LR(0), SLR(1), LALR(1)), and the actions of the parse table that can never be used, and the rules never reduced as a result, to stderr")
+var profile = flag.String("profile", "", "lr: token corpus used to order parser states")
+var templates = flag.String("templates", "", "lex, lr: directory of templates overriding the built-in ones (lex.tmpl, parse.tmpl, generic.tmpl)")
+var depth = flag.Int("depth", 5, "prove: maximum parse tree depth to explore")
+var format = flag.String("format", "", "export: output notation, one of ebnf (default), antlr, yacc\nimport: input notation, yacc (default)")
 
+// Exit codes, distinguishing the kinds of failure for scripts.
+const (
+	exitFailure  = 1 // I/O and other failures
+	exitUsage    = 2 // bad flags or arguments
+	exitInput    = 3 // an input file that doesn't parse or is invalid
+	exitConflict = 4 // a grammar with conflicts or ambiguities
+	exitCodegen  = 5 // generated code that fails to format
+	exitStale    = 6 // -diff found output that's out of date
+)
+
+// stale is set when -diff finds an output file that differs.
+var stale bool
+
+// usageError is an error in the command line.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// inputError is an error in the input file; such errors are reported
+// as "file:line: message", adding the file name when the message
+// doesn't start with a position or the file name already.
+type inputError struct {
+	path string
+	err  error
+}
+
+var positioned = regexp.MustCompile(`^[^:\s]+:\d+`)
+
+func (e *inputError) Error() string {
+	msg := e.err.Error()
+	if positioned.MatchString(msg) || strings.HasPrefix(msg, e.path+":") {
+		return msg
+	}
+	return e.path + ": " + msg
+}
+
+func (e *inputError) Unwrap() error { return e.err }
+
+// exitCode gives the exit code for err.
+func exitCode(err error) int {
+	var usage usageError
+	var conflict *lr.ConflictError
+	var formatErr *codegen.FormatError
+	var input *inputError
+	switch {
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.As(err, &conflict):
+		return exitConflict
+	case errors.As(err, &formatErr):
+		return exitCodegen
+	case errors.As(err, &input):
+		return exitInput
+	}
+	return exitFailure
+}
+
+// check exits with a "gen: "-prefixed message on stderr if err is set.
 func check(err error) {
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "gen: %s\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// checkInput is check for errors from processing infile.
+func checkInput(infile string, err error) {
+	var pathErr *os.PathError
+	if err != nil && !errors.As(err, &pathErr) {
+		err = &inputError{infile, err}
+	}
+	check(err)
+}
+
+// logLevel returns the level of the messages the generators log, as
+// given by -q and -v.
+func logLevel() codegen.Level {
+	if *quiet {
+		return codegen.LevelError
+	}
+	if *verbose {
+		return codegen.LevelDebug
+	}
+	return codegen.LevelInfo
+}
+
+// reportStats writes the statistics of an lr run to stderr.
+func reportStats(stats *lr.Stats, elapsed time.Duration) {
+	// The memory obtained from the OS only grows, so it stands in for
+	// the peak use.
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(os.Stderr, "rules:      %d\n", stats.Rules)
+	fmt.Fprintf(os.Stderr, "states:     %d\n", stats.States)
+	fmt.Fprintf(os.Stderr, "actions:    %d\n", stats.Actions)
+	fmt.Fprintf(os.Stderr, "conflicts:  %d\n", stats.Conflicts)
+	fmt.Fprintf(os.Stderr, "output:     %d bytes\n", stats.Bytes)
+	fmt.Fprintf(os.Stderr, "time:       %s\n", elapsed)
+	fmt.Fprintf(os.Stderr, "memory:     %d KB\n", mem.Sys/1024)
+}
+
+// splitList splits a comma-separated flag value.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// outputExts gives the file extensions of export formats.
+var outputExts = map[string]string{
+	"":      ".ebnf",
+	"ebnf":  ".ebnf",
+	"antlr": ".g4",
+	"yacc":  ".y",
+}
+
+// outputPath returns the path the output of mode for infile goes to:
+// the -o flag, or if that names a directory, a file in it named after
+// the input, as in foo_lex.go and foo_parse.go.
+func outputPath(mode, infile string) string {
+	fi, err := os.Stat(*outpath)
+	if *outpath == "-" || (err != nil || !fi.IsDir()) && !strings.HasSuffix(*outpath, "/") {
+		return *outpath
 	}
+
+	name := filepath.Base(infile)
+	if infile == "-" {
+		name = "stdin"
+	}
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	name = strings.TrimPrefix(name, "_")
+	switch mode {
+	case "lex":
+		name += "_lex.go"
+	case "tokens":
+		name += "_tokens.go"
+	case "lr", "ll":
+		name += "_parse.go"
+	case "import":
+		// The leading underscore hides the grammar from the go tool.
+		name = "_" + name + ".go"
+	case "export":
+		name += outputExts[*format]
+	default:
+		name += "_" + mode + ".txt"
+	}
+	return filepath.Join(*outpath, name)
 }
 
-func output(data []byte) error {
+// output writes data to path, or stdout if path is "-".  With -diff
+// it instead prints how the file at path differs from data.
+func output(data []byte, path string) error {
+	if *diff {
+		return diffOutput(data, path)
+	}
+
 	f := os.Stdout
 	var err error
 
-	if *outpath != "-" {
-		f, err = os.Create(*outpath)
+	if path != "-" {
+		if err = os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+		f, err = os.Create(path)
 		if err != nil {
 			return err
 		}
@@ -40,18 +235,92 @@ func output(data []byte) error {
 		if err != nil {
 			return err
 		}
+		if *verbose {
+			written = append(written, path)
+		}
 	}
 
 	return nil
 }
 
+// outputDriver writes the driver generated with -driver to
+// cmd/NAME/main.go in the directory of the output path, NAME being
+// that of the directory, unless a driver's there already: it's meant
+// to be edited.
+func outputDriver(data []byte, path string) error {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	driverPath := filepath.Join(dir, "cmd", filepath.Base(dir), "main.go")
+	if _, err := os.Stat(driverPath); err == nil {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "gen: leaving the existing driver %s\n", driverPath)
+		}
+		return nil
+	}
+	return output(data, driverPath)
+}
+
+// diffOutput prints a diff from the file at path, which may not yet
+// exist, to data.
+func diffOutput(data []byte, path string) error {
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if d := unifiedDiff(path, path+" (generated)", old, data); d != nil {
+		stale = true
+		_, err = os.Stdout.Write(d)
+		return err
+	}
+	return nil
+}
+
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, `usage: gen [FLAGS] MODE INFILE
+		fmt.Fprintf(os.Stderr, `usage: gen [FLAGS] MODE INFILE...
 
 MODE is one of
-  lex  generate a lexer
-  lr   generate an lr parser
+  lex     generate a lexer
+  tokens  generate the token package shared by lexers and parsers, with -tokenpkg
+  lr      generate an lr parser from a grammar file or directory
+  ll      generate a recursive descent parser from a file of syntax functions
+  check   check a tokens file for lexing pitfalls
+  prove   check an lr grammar for ambiguity by brute force
+  lint    check an lr grammar for style and safety problems
+  advise  report which of the ll and lr backends can parse an lr grammar,
+          and the changes each would need
+  export  convert an lr grammar to another notation
+  import  convert another notation to an lr grammar
+  init    create a new example project in the directory INFILE
+  repl    try out lines of input typed at a prompt against an lr grammar,
+          as in: gen repl GRAMMAR [TOKENS]
+  lexdiff report the files of a corpus that two tokens files lex differently,
+          as in: gen lexdiff OLD_TOKENS NEW_TOKENS CORPUS
+  explain show the steps of an lr grammar's parse of an input, and its tree,
+          as in: gen explain GRAMMAR "a + b * c"
+
+Several inputs may be given if -o is "-" or a directory, and several
+modes each followed by its inputs and flags, as in
+  gen lex tokens -o lex.go lr _grammar.go -o parse.go
+where the flags after a mode apply to its inputs alone, and an input
+named like a mode is taken as one if the file exists.  An INFILE of
+- is standard input, which for lr is taken to be in the current
+directory.
+
+Defaults for the flags are read from the nearest `+configName+` config
+file, which may also list the inputs to process when gen is run
+without arguments.
+
+With -diff nothing is written: the differences between the existing
+output files and what would be generated are printed, for checking
+that generated code is up to date.
+
+Errors are reported on stderr as "gen: file:line: message".  The exit
+status is 1 for I/O failures, 2 for usage errors, 3 for invalid input,
+4 for grammar conflicts, 5 for generated code that fails to format
+and 6 if -diff found differences.
 
 FLAGS are
 `)
@@ -59,24 +328,279 @@ FLAGS are
 	}
 
 	flag.Parse()
-	if flag.NArg() < 2 {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	cfg, err := findConfig(*configPath)
+	check(err)
+	if cfg != nil {
+		_, err := cfg.setFlags(cfg.Flags, explicit)
+		check(err)
+	}
+
+	switch {
+	case flag.NArg() == 0 && cfg != nil && len(cfg.Inputs) > 0:
+		for _, in := range cfg.Inputs {
+			runConfigured(cfg, explicit, in.Mode, cfg.path(in.File))
+		}
+	case flag.NArg() < 2:
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
+	case flag.Arg(0) == "repl":
+		repl(flag.Args()[1:])
+	case flag.Arg(0) == "explain":
+		explain(flag.Args()[1:])
+	case flag.Arg(0) == "lexdiff":
+		if flag.NArg() != 4 {
+			check(usageError("lexdiff takes two tokens files and a corpus"))
+		}
+		data, err := lex.Diff(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		check(output(data, "-"))
+		check(err)
+	default:
+		groups, err := parseGroups(flag.Args())
+		check(err)
+		for _, g := range groups {
+			runGroup(cfg, explicit, g)
+		}
+	}
+	reportWritten()
+	if stale {
+		os.Exit(exitStale)
 	}
+}
 
-	mode := flag.Arg(0)
-	infile := flag.Arg(1)
+// repl runs the repl mode, whose arguments are a grammar and optionally
+// its tokens file, on standard input.
+func repl(args []string) {
+	if len(args) > 2 {
+		check(usageError("repl takes a grammar and optionally its tokens file"))
+	}
+	var tokens string
+	if len(args) == 2 {
+		tokens = args[1]
+	}
+	if args[0] == "-" || tokens == "-" {
+		check(usageError("repl reads its input lines from standard input, not the grammar"))
+	}
+	if *quiet && *verbose {
+		check(usageError("-q can't be used with -v"))
+	}
+	opts := &lr.Options{
+		Verbose: *verbose,
+		Level:   logLevel(),
+		Strict:  *strict,
+		Tags:    splitList(*tags),
+		Exclude: *exclude,
+	}
+	checkInput(args[0], lr.Repl(args[0], opts, tokens, os.Stdin, os.Stdout))
+}
+
+// explain runs the explain mode, whose arguments are a grammar and the
+// input to parse, which may be split over several arguments.
+func explain(args []string) {
+	if len(args) < 2 {
+		check(usageError("explain takes a grammar and an input"))
+	}
+	if *quiet && *verbose {
+		check(usageError("-q can't be used with -v"))
+	}
+	in, name := input(args[0])
+	opts := &lr.Options{
+		Input:   in,
+		Verbose: *verbose,
+		Level:   logLevel(),
+		Strict:  *strict,
+		Tags:    splitList(*tags),
+		Exclude: *exclude,
+	}
+	data, err := lr.Explain(name, opts, strings.Join(args[1:], " "))
+	check(output(data, "-"))
+	checkInput(name, err)
+}
+
+// runConfigured runs mode on infile with the flags the config, if any,
+// gives the input.
+func runConfigured(cfg *config, explicit map[string]bool, mode, infile string) {
+	if cfg != nil {
+		if in := cfg.input(mode, infile); in != nil {
+			restore, err := cfg.setFlags(in.Flags, explicit)
+			check(err)
+			defer restore()
+		}
+	}
+	if *diff && *outpath == "-" {
+		check(usageError("-diff needs an output path given with -o"))
+	}
+	if *quiet && *verbose {
+		check(usageError("-q can't be used with -v"))
+	}
+	run(mode, infile)
+}
+
+// stdin holds standard input, read in full the first time an input
+// is given as -.
+var stdin []byte
+var stdinRead bool
+
+// input returns a reader of the input infile if it's standard input,
+// given as -, or else nil, along with the name of the input for
+// messages.
+func input(infile string) (io.Reader, string) {
+	if infile != "-" {
+		return nil, infile
+	}
+	if !stdinRead {
+		var err error
+		stdin, err = io.ReadAll(os.Stdin)
+		check(err)
+		stdinRead = true
+	}
+	return bytes.NewReader(stdin), "<stdin>"
+}
+
+// run runs mode on one input file, or standard input if infile is -.
+func run(mode, infile string) {
+	in, name := input(infile)
+	lexOpts := &lex.Options{
+		Input:        in,
+		Verbose:      *verbose,
+		Package:      *pkg,
+		Graph:        *graph,
+		ErrorMode:    *errorMode,
+		Newlines:     *newlines,
+		SkipBOM:      *skipBOM,
+		SkipShebang:  *skipShebang,
+		Intern:       *intern,
+		Tokenizer:    *tokenizer,
+		TokenPackage: *tokenPkg,
+		Templates:    *templates,
+		Raw:          *raw,
+	}
 
 	switch mode {
 	case "lex":
-		data, err := lex.Main(infile, *verbose)
-		check(err)
-		check(output(data))
+		data, err := lex.Main(name, lexOpts)
+		checkInput(name, err)
+		check(output(data, outputPath(mode, infile)))
 	case "lr":
-		data, err := lr.Main(infile, *verbose)
-		check(err)
-		check(output(data))
+		opts := &lr.Options{
+			Input:     in,
+			Verbose:   *verbose,
+			Level:     logLevel(),
+			Package:   *pkg,
+			Prefix:    *prefix,
+			TokenType: *tokenType,
+			Dir:       *dir,
+			Graph:     *graph,
+			Profile:   *profile,
+			Strict:    *strict,
+			Tags:      splitList(*tags),
+			Exclude:   *exclude,
+			Templates: *templates,
+			Raw:       *raw,
+		}
+		if *single {
+			if *raw {
+				check(usageError("-raw can't be used with -single"))
+			}
+			opts.Lexer = lexOpts
+		}
+		if *stats {
+			opts.Stats = &lr.Stats{}
+		}
+		var reportData []byte
+		if *report {
+			opts.Report = &reportData
+		}
+		path := outputPath(mode, infile)
+		var actionsData []byte
+		if *actions {
+			if path == "-" {
+				check(usageError("-actions needs an output path given with -o"))
+			}
+			opts.Actions = &actionsData
+		}
+		var driverData []byte
+		if *driverCmd {
+			if path == "-" {
+				check(usageError("-driver needs an output path given with -o"))
+			}
+			opts.Driver = &driverData
+		}
+		var ids []byte
+		if *ruleIds != "" {
+			var err error
+			if ids, err = os.ReadFile(*ruleIds); err != nil && !os.IsNotExist(err) {
+				check(err)
+			}
+			opts.RuleIds = &ids
+		}
+		start := time.Now()
+		data, err := lr.Main(name, opts)
+		checkInput(name, err)
+		if *stats {
+			reportStats(opts.Stats, time.Since(start))
+		}
+		if *report {
+			os.Stderr.Write(reportData)
+		}
+		check(output(data, path))
+		if *ruleIds != "" {
+			check(output(ids, *ruleIds))
+		}
+		if *actions {
+			check(output(actionsData, strings.TrimSuffix(path, ".go")+"_actions.go"))
+		}
+		if *driverCmd {
+			check(outputDriver(driverData, path))
+		}
+	case "ll":
+		// The ll generator's log is its trace, at the debug level.
+		cg := ll.LexCodeGen{Log: codegen.NewLog(nil, logLevel()).At(codegen.LevelDebug)}
+		data, err := ll.Main(cg, name, in)
+		checkInput(name, err)
+		check(output(data, outputPath(mode, infile)))
+	case "tokens":
+		data, err := lex.TokensMain(name, lexOpts)
+		checkInput(name, err)
+		check(output(data, outputPath(mode, infile)))
+	case "check":
+		data, err := lex.CheckMain(name, in)
+		check(output(data, outputPath(mode, infile)))
+		checkInput(name, err)
+	case "prove":
+		data, err := lr.Prove(name, in, *depth)
+		check(output(data, outputPath(mode, infile)))
+		checkInput(name, err)
+	case "lint":
+		data, err := lr.Lint(name, in)
+		check(output(data, outputPath(mode, infile)))
+		checkInput(name, err)
+	case "advise":
+		data, err := lr.Advise(name, in)
+		checkInput(name, err)
+		check(output(data, outputPath(mode, infile)))
+	case "export":
+		data, err := lr.Export(name, in, *format)
+		checkInput(name, err)
+		check(output(data, outputPath(mode, infile)))
+	case "import":
+		if *format != "" && *format != "yacc" {
+			check(usageError(fmt.Sprintf("unknown import format %q", *format)))
+		}
+		importPkg := *pkg
+		if importPkg == "" {
+			importPkg = "main"
+		}
+		data, err := lr.Import(name, in, importPkg)
+		checkInput(name, err)
+		check(output(data, outputPath(mode, infile)))
+	case "init":
+		if in != nil {
+			check(usageError("init needs a directory, not standard input"))
+		}
+		checkInput(infile, scaffold.Init(infile))
 	default:
-		check(fmt.Errorf("unknown mode %q", mode))
+		check(usageError(fmt.Sprintf("unknown mode %q", mode)))
 	}
 }
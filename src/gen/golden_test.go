@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"go/build"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gen/lex"
+	"gen/lr"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with the current output")
+
+// goldenTests are the generations whose output is checked against the
+// golden files in testdata, which are named after the test.
+var goldenTests = []struct {
+	name string
+	gen  func() ([]byte, error)
+}{
+	{"calc_lex", func() ([]byte, error) {
+		return lex.Main("testdata/calc.tokens", &lex.Options{})
+	}},
+	{"calc_lex_errors", func() ([]byte, error) {
+		return lex.Main("testdata/calc.tokens", &lex.Options{ErrorMode: "skip", SkipBOM: true, Intern: true})
+	}},
+	{"calc_parse", func() ([]byte, error) {
+		return lr.Main("testdata/_calc.go", &lr.Options{})
+	}},
+	{"calc_single", func() ([]byte, error) {
+		return lr.Main("testdata/_calc.go", &lr.Options{Lexer: &lex.Options{}})
+	}},
+	{"generic_parse", func() ([]byte, error) {
+		return lr.Main("testdata/_generic.go", &lr.Options{})
+	}},
+	{"reloc_parse", relocParse},
+}
+
+// relocParse generates the parser of testdata/reloc/_expr.go into the
+// parser subdirectory of its package.  go/build gives packages under
+// testdata no import path, so the package is copied into a GOPATH of
+// its own first.
+func relocParse() ([]byte, error) {
+	gopath, err := os.MkdirTemp("", "gen-reloc")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(gopath)
+	dir := filepath.Join(gopath, "src", "reloc")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"ast.go", "_expr.go"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "reloc", name))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			return nil, err
+		}
+	}
+	defer func(old string) { build.Default.GOPATH = old }(build.Default.GOPATH)
+	build.Default.GOPATH = gopath
+	return lr.Main(filepath.Join(dir, "_expr.go"), &lr.Options{Dir: filepath.Join(dir, "parser"), Package: "parser"})
+}
+
+// TestGolden runs generation on the example inputs in testdata and
+// compares the output to the golden files there, so that changes to
+// the generated code show up as diffs to them.  Run with -update to
+// rewrite the golden files after an intended change.
+func TestGolden(t *testing.T) {
+	for _, test := range goldenTests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.gen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", test.name+".golden")
+			if *update {
+				if err := os.WriteFile(path, got, 0666); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := unifiedDiff(path, test.name+" output", want, got); d != nil {
+				t.Errorf("output differs from %s; run with -update if intended:\n%s", path, d)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// modes are the modes gen runs in.
+var modes = map[string]bool{
+	"lex":    true,
+	"tokens": true,
+	"lr":     true,
+	"ll":     true,
+	"check":  true,
+	"prove":  true,
+	"lint":   true,
+	"advise": true,
+	"export": true,
+	"import": true,
+	"init":   true,
+}
+
+// group is a mode and the inputs to run it on, from a command line
+// like
+//
+//	gen lex tokens -o lex.go lr _grammar.go -o parse.go
+//
+// which holds a group per mode.  Flags given within a group apply to
+// it alone, taking precedence over the flags before the first mode.
+// An input named like a mode, such as a file called lr, is taken as
+// an input if it exists rather than starting a group; one that
+// doesn't exist yet can be given as ./lr.
+type group struct {
+	mode    string
+	infiles []string
+	// flags are the group's flags, by name.
+	flags map[string]string
+}
+
+// parseGroups splits the arguments after the leading flags into
+// groups.  A new group starts at the name of a mode following the
+// inputs of the last, unless a file of that name exists.
+func parseGroups(args []string) ([]*group, error) {
+	var groups []*group
+	var g *group
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case g == nil || modes[arg] && len(g.infiles) > 0 && !exists(arg):
+			if !modes[arg] {
+				return nil, usageError(fmt.Sprintf("unknown mode %q", arg))
+			}
+			g = &group{mode: arg, flags: make(map[string]string)}
+			groups = append(groups, g)
+		case len(arg) > 1 && arg[0] == '-':
+			name := strings.TrimLeft(arg, "-")
+			value, hasValue := "", false
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value, hasValue = name[:eq], name[eq+1:], true
+			}
+			f := flag.Lookup(name)
+			if f == nil {
+				return nil, usageError(fmt.Sprintf("unknown flag -%s in the arguments of %s", name, g.mode))
+			}
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				if !hasValue {
+					value = "true"
+				}
+			} else if !hasValue {
+				if i+1 == len(args) {
+					return nil, usageError(fmt.Sprintf("flag -%s needs a value", name))
+				}
+				i++
+				value = args[i]
+			}
+			g.flags[name] = value
+		default:
+			g.infiles = append(g.infiles, arg)
+		}
+	}
+	for _, g := range groups {
+		if len(g.infiles) == 0 {
+			return nil, usageError(fmt.Sprintf("no inputs given for %s", g.mode))
+		}
+	}
+	return groups, nil
+}
+
+// exists reports whether there's a file at path.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// runGroup runs the mode of g on each of its inputs, with its flags
+// set for the duration.
+func runGroup(cfg *config, explicit map[string]bool, g *group) {
+	groupExplicit := make(map[string]bool)
+	for name := range explicit {
+		groupExplicit[name] = true
+	}
+	for name, value := range g.flags {
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			check(usageError(fmt.Sprintf("flag -%s: %s", name, err)))
+		}
+		defer flag.Set(name, old)
+		groupExplicit[name] = true
+	}
+
+	if len(g.infiles) > 1 && *outpath != "-" && outputPath(g.mode, g.infiles[0]) == *outpath {
+		check(usageError("-o must be a directory for several inputs"))
+	}
+	for _, infile := range g.infiles {
+		runConfigured(cfg, groupExplicit, g.mode, infile)
+	}
+}
+
+// written records the files written, for the summary printed with -v.
+var written []string
+
+// reportWritten prints the files written to stderr.
+func reportWritten() {
+	for _, path := range written {
+		fmt.Fprintf(os.Stderr, "wrote %s\n", path)
+	}
+}
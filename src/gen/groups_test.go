@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseGroups checks how arguments are split into groups, and
+// that an existing file named like a mode is an input rather than
+// the start of a group.
+func TestParseGroups(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "check"), "")
+	t.Chdir(dir)
+
+	for _, test := range []struct {
+		args string
+		// want is each group's mode, flags and inputs, or the error.
+		want string
+	}{
+		{"lex tokens -o lex.go lr _grammar.go -o parse.go", "lex map[o:lex.go] [tokens]; lr map[o:parse.go] [_grammar.go]"},
+		{"lr a.go -strict b.go", "lr map[strict:true] [a.go b.go]"},
+		{"lr a.go -prefix=calc", "lr map[prefix:calc] [a.go]"},
+		{"lint a.go check", "lint map[] [a.go check]"},
+		{"lint a.go prove b.go", "lint map[] [a.go]; prove map[] [b.go]"},
+		{"lr check", "lr map[] [check]"},
+		{"lr a.go lint", "no inputs given for lint"},
+		{"x.go", `unknown mode "x.go"`},
+		{"lr -nope a.go", "unknown flag -nope in the arguments of lr"},
+		{"lr a.go -o", "flag -o needs a value"},
+	} {
+		groups, err := parseGroups(strings.Fields(test.args))
+		var got []string
+		if err != nil {
+			got = []string{err.Error()}
+		}
+		for _, g := range groups {
+			got = append(got, fmt.Sprintf("%s %v %v", g.mode, g.flags, g.infiles))
+		}
+		if strings.Join(got, "; ") != test.want {
+			t.Errorf("%s: got %s, want %s", test.args, strings.Join(got, "; "), test.want)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gen/lex"
+	"gen/lr"
+)
+
+// driver is the main package built around a generated calculator,
+// which lexes each line of its input and prints the parse's result or
+// error.
+const driver = `package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// reader is the lexer's ByteReader over a string.
+type reader struct {
+	s   string
+	pos int
+}
+
+func (r *reader) Next() byte {
+	r.pos++
+	if r.pos > len(r.s) {
+		return 0
+	}
+	return r.s[r.pos-1]
+}
+
+func (r *reader) Back(n int) {
+	r.pos -= n
+}
+
+func (r *reader) Offset() int {
+	return r.pos
+}
+
+func eval(line string) (int, error) {
+	r := &reader{s: line}
+	p := calcNewParser()
+	err := p.ParseFunc(func() Token {
+		for r.pos < len(r.s) && r.s[r.pos] == ' ' {
+			r.pos++
+		}
+		pos := r.pos
+		tok := scan(r)
+		return Token{Kind: TokNames[tok.Id], Text: tok.Text, Pos: pos}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return p.Result(), nil
+}
+
+func main() {
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		if n, err := eval(s.Text()); err != nil {
+			fmt.Println("error:", err)
+		} else {
+			fmt.Println(n)
+		}
+	}
+}
+`
+
+// integrationInputs are lines for the calculator, and what it prints
+// for each.
+var integrationInputs = []struct {
+	in, out string
+}{
+	{"1 + 2 * 3", "7"},
+	{"(1 + 2) * 3", "9"},
+	{"8 / 2 / 2", "2"},
+	{"let x = 10 - 4 / 2", "8"},
+	{"(", "error: unexpected token EOF: expected an expression"},
+	{"let x = )", "error: unexpected token ): expected a value to assign"},
+	{"1 +", "error: unexpected token: EOF; expected one of '(', a number"},
+	{"1 2", "error: unexpected token: 2; expected one of '*', '+', '-', '/', end of input"},
+}
+
+// buildProgram builds files, the sources of a main package, into a
+// program, returning its path.  It's built in a temporary GOPATH
+// workspace, as generic parsers import this tree's runtime package,
+// with the go build flags given.  The test is skipped in short mode,
+// or without a go tool.
+func buildProgram(t *testing.T, files map[string]string, flags ...string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds programs; skipped in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go tool to build with")
+	}
+
+	gopath := t.TempDir()
+	dir := filepath.Join(gopath, "src", "prog")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bin := filepath.Join(gopath, "prog")
+	build := exec.Command(goTool, append(append([]string{"build", "-o", bin}, flags...), ".")...)
+	build.Dir = dir
+	build.Env = append(os.Environ(),
+		"GOPATH="+gopath+string(filepath.ListSeparator)+os.Getenv("GOPATH"),
+		"GO111MODULE=off")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building generated code: %s\n%s", err, out)
+	}
+	return bin
+}
+
+// TestIntegration builds the calculator in testdata, with its lexer,
+// into a program and checks the results of running inputs through
+// it, catching generated code that doesn't compile or misparses.
+func TestIntegration(t *testing.T) {
+	for _, grammar := range []string{"_calc.go", "_generic.go"} {
+		t.Run(grammar, func(t *testing.T) {
+			code, err := lr.Main(filepath.Join("testdata", grammar), &lr.Options{
+				Package: "main",
+				Prefix:  "calc",
+				Lexer:   &lex.Options{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			bin := buildProgram(t, map[string]string{"parse.go": string(code), "main.go": driver})
+
+			var in []string
+			for _, test := range integrationInputs {
+				in = append(in, test.in)
+			}
+			run := exec.Command(bin)
+			run.Stdin = strings.NewReader(strings.Join(in, "\n") + "\n")
+			out, err := run.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+			if len(lines) != len(integrationInputs) {
+				t.Fatalf("got %d lines of output, want %d:\n%s", len(lines), len(integrationInputs), out)
+			}
+			for i, test := range integrationInputs {
+				if lines[i] != test.out {
+					t.Errorf("%q printed %q, want %q", test.in, lines[i], test.out)
+				}
+			}
+		})
+	}
+}
+
+// concurrentDriver is the main package built around the parser of
+// testdata/_decls.go.  For each line of its input, and each number of
+// pieces it's asked for, it parses the line's tokens concurrently,
+// printing the number of pieces parsed and the merged results, or the
+// error.
+const concurrentDriver = `package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+func tokens(line string) []Token {
+	var toks []Token
+	for _, word := range strings.Fields(line) {
+		kind := word
+		switch {
+		case word == "let":
+		case unicode.IsDigit(rune(word[0])):
+			kind = "number"
+		case unicode.IsLetter(rune(word[0])):
+			kind = "ident"
+		}
+		toks = append(toks, Token{Kind: kind, Text: word})
+	}
+	return append(toks, Token{Kind: "EOF"})
+}
+
+func main() {
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		toks := tokens(s.Text())
+		for _, n := range []int{-1, 0, 1, 3, 100} {
+			results, err := declsParseConcurrent(toks, n)
+			if err != nil {
+				fmt.Printf("n=%d error: %v\n", n, err)
+				continue
+			}
+			var merged []int
+			for _, r := range results {
+				merged = append(merged, r...)
+			}
+			fmt.Printf("n=%d pieces=%d %v\n", n, len(results), merged)
+		}
+	}
+}
+`
+
+// TestConcurrent builds a parser splitting lists of declarations at
+// their let keywords, with the race detector where it's supported, and
+// checks the merged results of parsing in up to several pieces.
+func TestConcurrent(t *testing.T) {
+	code, err := lr.Main(filepath.Join("testdata", "_decls.go"), &lr.Options{
+		Package: "main",
+		Prefix:  "decls",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags []string
+	if out, err := exec.Command("go", "env", "CGO_ENABLED").Output(); err == nil && strings.TrimSpace(string(out)) == "1" {
+		flags = append(flags, "-race")
+	}
+	bin := buildProgram(t, map[string]string{"parse.go": string(code), "main.go": concurrentDriver}, flags...)
+
+	in := "let a = 1 ; let b = 2 + 3 ; let c = 4 ; let d = 5 + 6 + 7 ; let e = 8 ; let f = 9 ;\n" +
+		"let a = 1 ; let b = ; let c = 2 ;\n"
+	run := exec.Command(bin)
+	run.Stdin = strings.NewReader(in)
+	out, err := run.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	want := `n=-1 pieces=1 [1 5 4 18 8 9]
+n=0 pieces=1 [1 5 4 18 8 9]
+n=1 pieces=1 [1 5 4 18 8 9]
+n=3 pieces=3 [1 5 4 18 8 9]
+n=100 pieces=6 [1 5 4 18 8 9]
+`
+	got := string(out)
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(strings.TrimPrefix(got, want)), "\n") {
+		if !strings.Contains(line, "error: ") {
+			t.Errorf("bad input parsed: %s", line)
+		}
+	}
+}
+
+// guardDriver is the main package built around the parser of
+// testdata/_guard.go, which prints the statements parsed from each
+// line of its input and the errors recovered from.
+const guardDriver = `package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		var toks []Token
+		for _, word := range strings.Fields(s.Text()) {
+			kind := word
+			if word != ";" {
+				kind = "number"
+			}
+			toks = append(toks, Token{Kind: kind, Text: word})
+		}
+		p := guardNewParser()
+		err := p.ParseTokens(append(toks, Token{Kind: "EOF"}))
+		fmt.Printf("%q %v\n", p.Result(), err)
+	}
+}
+`
+
+// TestPredicateRecovery checks that a token whose rule's predicate
+// fails, where there's no other action to take, is recovered from like
+// any unexpected token, in both kinds of parser.
+func TestPredicateRecovery(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "_guard.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, generic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("generic=%v", generic), func(t *testing.T) {
+			grammar := string(src)
+			if generic {
+				grammar = strings.Replace(grammar, "package guard\n", "package guard\n\nvar lrGeneric = true\n", 1)
+			}
+			path := filepath.Join(t.TempDir(), "_guard.go")
+			if err := os.WriteFile(path, []byte(grammar), 0666); err != nil {
+				t.Fatal(err)
+			}
+			code, err := lr.Main(path, &lr.Options{Package: "main", Prefix: "guard"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			bin := buildProgram(t, map[string]string{"parse.go": string(code), "main.go": guardDriver})
+
+			run := exec.Command(bin)
+			run.Stdin = strings.NewReader("1 ; 2 ;\n1 ; 0 ; 2 ;\n")
+			out, err := run.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s\n%s", err, out)
+			}
+			want := `["1" "2"] <nil>
+["1" "bad ;" "2"] unexpected token: ;; expected one of ;
+`
+			if string(out) != want {
+				t.Errorf("got\n%swant\n%s", out, want)
+			}
+		})
+	}
+}
+
+// treeDriver is the main package built around the parser of
+// testdata/_tree.go, which prints the tree of each line of its input,
+// built in an arena shared by the parses and released after each.
+const treeDriver = `package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	arena := &treeArena{}
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		var toks []Token
+		for _, word := range strings.Fields(s.Text()) {
+			kind := word
+			if word[0] >= '0' && word[0] <= '9' {
+				kind = "number"
+			}
+			toks = append(toks, Token{Kind: kind, Text: word})
+		}
+		p := treeNewParser()
+		p.Arena = arena
+		if err := p.ParseTokens(append(toks, Token{Kind: "EOF"})); err != nil {
+			fmt.Println("error:", err)
+			continue
+		}
+		treeDumpTree(os.Stdout, p.Result())
+		p.Release()
+	}
+}
+`
+
+// TestArena checks that parses sharing an Arena, each released in turn,
+// build their trees whole, in both kinds of parser.
+func TestArena(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("testdata", "_tree.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, generic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("generic=%v", generic), func(t *testing.T) {
+			grammar := string(src)
+			if generic {
+				grammar = strings.Replace(grammar, "package tree\n", "package tree\n\nvar lrGeneric = true\n", 1)
+			}
+			path := filepath.Join(t.TempDir(), "_tree.go")
+			if err := os.WriteFile(path, []byte(grammar), 0666); err != nil {
+				t.Fatal(err)
+			}
+			code, err := lr.Main(path, &lr.Options{Package: "main", Prefix: "tree"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			bin := buildProgram(t, map[string]string{"parse.go": string(code), "main.go": treeDriver})
+
+			run := exec.Command(bin)
+			run.Stdin = strings.NewReader("[ 1 ] , 2 , 3\n[ 4 ] , 5\n")
+			out, err := run.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s\n%s", err, out)
+			}
+			want := `((("[" "1" "]")
+    ","
+    "2")
+  ","
+  "3")
+(("[" "4" "]")
+  ","
+  "5")
+`
+			if string(out) != want {
+				t.Errorf("got\n%swant\n%s", out, want)
+			}
+		})
+	}
+}
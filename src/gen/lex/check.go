@@ -0,0 +1,98 @@
+package lex
+
+// Analysis of tokens files for surprising lexing behavior.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// isIdent reports whether s scans as a single identifier.
+func isIdent(s string) bool {
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Check analyzes tokens, returning a report of notes and problems and
+// the number of problems.  Notes describe legitimate but possibly
+// surprising behavior; problems are tokens that can never be lexed.
+func Check(tokens []*Token) ([]byte, int) {
+	buf := &bytes.Buffer{}
+	problems := 0
+	problem := func(format string, a ...interface{}) {
+		problems++
+		fmt.Fprintf(buf, "error: "+format+"\n", a...)
+	}
+	note := func(format string, a ...interface{}) {
+		fmt.Fprintf(buf, "note: "+format+"\n", a...)
+	}
+
+	names := make(map[string]*Token)
+	values := make(map[string]*Token)
+	for _, t := range tokens {
+		if other := names[t.name]; other != nil {
+			problem("token name %s is declared twice", t.name)
+		}
+		names[t.name] = t
+		if other := values[t.value]; other != nil {
+			problem("%s and %s both have value %q", other.name, t.name, t.value)
+		}
+		values[t.value] = t
+
+		if t.block == BlockKeyword && !isIdent(t.value) {
+			problem("keyword %s (%q) isn't an identifier, so will never be matched", t.name, t.value)
+		}
+	}
+
+	for _, kw := range tokens {
+		if kw.block != BlockKeyword {
+			continue
+		}
+		for _, other := range tokens {
+			if other.block == BlockKeyword && other != kw && strings.HasPrefix(other.value, kw.value) {
+				note("keyword %s (%q) is a prefix of keyword %s (%q); keywords match whole identifiers, so %q alone is still %s",
+					kw.name, kw.value, other.name, other.value, kw.value, kw.name)
+			}
+		}
+	}
+
+	if problems == 0 && buf.Len() == 0 {
+		buf.WriteString("no issues found\n")
+	}
+	return buf.Bytes(), problems
+}
+
+// CheckMain loads the tokens file infile, or if in is non-nil reads
+// it from in, and reports on it via Check.  It returns a non-nil error
+// along with the report if problems were found.
+func CheckMain(infile string, in io.Reader) ([]byte, error) {
+	if in == nil {
+		f, err := os.Open(infile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+	tokens, _, err := ReadTokens(in, infile)
+	if err != nil {
+		return nil, err
+	}
+
+	report, problems := Check(tokens)
+	if problems > 0 {
+		if problems == 1 {
+			return report, fmt.Errorf("%s: 1 problem found", infile)
+		}
+		return report, fmt.Errorf("%s: %d problems found", infile, problems)
+	}
+	return report, nil
+}
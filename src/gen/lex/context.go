@@ -0,0 +1,142 @@
+package lex
+
+// Support for trailing context, which makes a token match only where
+// the input after it does, or doesn't, continue in a given way.
+//
+// In the tokens format, a word starting with a slash after a symbol,
+// word symbol or value gives its trailing context, as in
+//   Number number /!.
+// for a number not followed by a dot.  After the slash comes an
+// optional ! negating the context, and then either literal text or a
+// class of bytes like [0-9a-f]; the text can't include white space.
+// The context is only looked at, and isn't part of the token.
+//
+// A symbol out of its context doesn't match at all, even where a
+// shorter symbol would, so lex returns tNone for it.  A value out of
+// its context is given back for the kinds of value after it to try.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gen/codegen"
+)
+
+// trailing is a token's trailing context.
+type trailing struct {
+	// text is the literal text the input must continue with, if the
+	// context isn't a class.
+	text string
+	// class is a set of byte ranges, as lo-hi pairs, one of which the
+	// next byte must fall in.
+	class []byte
+	// negate inverts the context: the input must not continue so.
+	negate bool
+}
+
+// parseTrailing parses a trailing context word like /!. or /[0-9].
+func parseTrailing(word string) (*trailing, error) {
+	t := &trailing{}
+	spec := strings.TrimPrefix(word, "/")
+	if strings.HasPrefix(spec, "!") {
+		t.negate = true
+		spec = spec[1:]
+	}
+	if len(spec) > 2 && spec[0] == '[' && spec[len(spec)-1] == ']' {
+		body := spec[1 : len(spec)-1]
+		for i := 0; i < len(body); i++ {
+			lo, hi := body[i], body[i]
+			if i+2 < len(body) && body[i+1] == '-' {
+				hi = body[i+2]
+				i += 2
+			}
+			if lo > hi {
+				return nil, fmt.Errorf("bad range %c-%c in trailing context %s", lo, hi, word)
+			}
+			t.class = append(t.class, lo, hi)
+		}
+		return t, nil
+	}
+	if spec == "" {
+		return nil, fmt.Errorf("empty trailing context %s", word)
+	}
+	t.text = spec
+	return t, nil
+}
+
+// check returns the start of an if statement whose body runs when the
+// input matches the context, or if fail is set, when it doesn't.  The
+// caller writes the body and the closing brace.
+func (t *trailing) check(fail bool) string {
+	if t.class == nil {
+		cond := "followedBy(r, " + strconv.Quote(t.text) + ")"
+		if t.negate != fail {
+			cond = "!" + cond
+		}
+		return "if " + cond + " {"
+	}
+	var ranges []string
+	for i := 0; i < len(t.class); i += 2 {
+		lo, hi := t.class[i], t.class[i+1]
+		if lo == hi {
+			ranges = append(ranges, fmt.Sprintf("next == %q", lo))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("next >= %q && next <= %q", lo, hi))
+		}
+	}
+	cond := strings.Join(ranges, " || ")
+	if t.negate != fail {
+		cond = "!(" + cond + ")"
+	}
+	return "if next := peek(r); " + cond + " {"
+}
+
+// matches reports whether rest, the input after a token, is in the
+// token's context.
+func (t *trailing) matches(rest string) bool {
+	if t.class == nil {
+		return strings.HasPrefix(rest, t.text) != t.negate
+	}
+	in := false
+	if rest != "" {
+		for i := 0; i < len(t.class); i += 2 {
+			in = in || rest[0] >= t.class[i] && rest[0] <= t.class[i+1]
+		}
+	}
+	return in != t.negate
+}
+
+// hasTrailing reports whether any of tokens has trailing context.
+func hasTrailing(tokens []*Token) bool {
+	for _, t := range tokens {
+		if t.context != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTrailingHelpers writes the functions checking trailing context
+// without consuming input.
+func writeTrailingHelpers(w *codegen.Writer) {
+	w.Line(`// peek returns the next byte without consuming it.
+func peek(r ByteReader) byte {
+	c := r.Next()
+	r.Back(1)
+	return c
+}
+
+// followedBy reports whether the input continues with text, without
+// consuming it.
+func followedBy(r ByteReader, text string) bool {
+	match := true
+	n := 0
+	for match && n < len(text) {
+		match = r.Next() == text[n]
+		n++
+	}
+	r.Back(n)
+	return match
+}`)
+}
@@ -0,0 +1,123 @@
+package lex
+
+// Comparison of the token streams of two tokens files over a corpus,
+// for checking that changes to a lexer keep it lexing real inputs the
+// same.
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadScanner reads the tokens file at path into a Scanner.
+func loadScanner(path string) (*Scanner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens, _, err := ReadTokens(f, path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewScanner(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return s, nil
+}
+
+// describe returns l as shown in a report: the token as the parser
+// sees it, with its text if that differs.
+func (l Lexeme) describe() string {
+	if l.Text == "" || l.Text == l.Token.value {
+		return l.Token.Display()
+	}
+	return fmt.Sprintf("%s %q", l.Token.Display(), l.Text)
+}
+
+// position returns the line and column of offset in src.
+func position(src string, offset int) (line, col int) {
+	line = 1 + strings.Count(src[:offset], "\n")
+	col = offset - strings.LastIndex(src[:offset], "\n")
+	return line, col
+}
+
+// diffInput compares the tokens the two scanners find in src, returning
+// a description of the first difference, or "" if there's none.
+func diffInput(src string, before, after *Scanner) string {
+	oldLex, oldErr := before.Scan(src)
+	newLex, newErr := after.Scan(src)
+	for i := 0; i < len(oldLex) || i < len(newLex); i++ {
+		switch {
+		case i == len(oldLex):
+			line, col := position(src, newLex[i].Offset)
+			return fmt.Sprintf("%d:%d: %s, now %s", line, col, oldErr, newLex[i].describe())
+		case i == len(newLex):
+			line, col := position(src, oldLex[i].Offset)
+			return fmt.Sprintf("%d:%d: %s, now %s", line, col, oldLex[i].describe(), newErr)
+		}
+		o, n := oldLex[i], newLex[i]
+		if o.Offset != n.Offset || o.Text != n.Text || o.Token.value != n.Token.value {
+			line, col := position(src, min(o.Offset, n.Offset))
+			return fmt.Sprintf("%d:%d: %s, now %s", line, col, o.describe(), n.describe())
+		}
+	}
+	if (oldErr == nil) != (newErr == nil) {
+		return fmt.Sprintf("%v, now %v", oldErr, newErr)
+	}
+	return ""
+}
+
+// Diff lexes each file of corpus, a file or a directory of them, with
+// both the tokens files oldPath and newPath, and reports the files
+// whose tokens differ, with the first difference in each.  The tokens
+// are compared as the parser sees them, by their values and text, so
+// that renaming a token isn't a change.  It returns the report and a
+// non-nil error if any file differs.
+func Diff(oldPath, newPath, corpus string) ([]byte, error) {
+	before, err := loadScanner(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	after, err := loadScanner(newPath)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	files, changed := 0, 0
+	err = filepath.WalkDir(corpus, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != corpus && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files++
+		if d := diffInput(string(src), before, after); d != "" {
+			changed++
+			fmt.Fprintf(buf, "%s:%s\n", path, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(buf, "checked %d files, %d changed\n", files, changed)
+	if changed > 0 {
+		return buf.Bytes(), fmt.Errorf("%d of %d files lex differently", changed, files)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,46 @@
+package lex
+
+import (
+	"fmt"
+	"sort"
+
+	"gen/codegen"
+)
+
+// writeGraph writes the states under s as graphviz nodes and edges,
+// returning the id of s's node.
+func (s *symM) writeGraph(w *codegen.Writer, nextId *int) int {
+	id := *nextId
+	*nextId++
+	if s.accept != "" {
+		w.Linef("s%d [label=%q, shape=doublecircle]", id, s.accept)
+	} else {
+		w.Linef("s%d [label=\"\"]", id)
+	}
+
+	var keys []byte
+	for char := range s.next {
+		keys = append(keys, char)
+	}
+	sort.Sort(Chars(keys))
+	for _, char := range keys {
+		target := s.next[char].writeGraph(w, nextId)
+		w.Linef("s%d -> s%d [label=%q]", id, target, fmt.Sprintf("%c", char))
+	}
+	return id
+}
+
+// Graph returns a graphviz graph of the machine recognizing the
+// symbol and word symbol tokens.
+func Graph(tokens []*Token) []byte {
+	sm := newMachine(tokens, false)
+
+	w := &codegen.Writer{}
+	w.Line("digraph G {")
+	w.Line("node [fontsize=10, shape=circle, height=0.25]")
+	w.Line("edge [fontsize=10]")
+	nextId := 0
+	sm.writeGraph(w, &nextId)
+	w.Line("}")
+	return w.Raw()
+}
@@ -2,10 +2,15 @@ package lex
 
 import (
 	"bufio"
+	"fmt"
+	"go/token"
 	"io"
-	"log"
 	"os"
+	"path"
 	"sort"
+	"strconv"
+	"strings"
+	"text/template"
 
 	"gen/codegen"
 )
@@ -16,56 +21,312 @@ const (
 	BlockSpecial BlockId = iota
 	BlockSymbol
 	BlockKeyword
+	BlockWordSymbol
+	BlockValue
 )
 
 type Token struct {
 	name, value string
 	block       BlockId
+	// display, if set, is the token's name in messages for users.
+	display string
+	// context, if set, is the token's trailing context; see
+	// context.go.
+	context *trailing
+	// mode is the lexer mode the token is declared in, or "" for the
+	// default mode; see modes.go.
+	mode string
 }
 
-// ReadTokens parses the tokens format.
-func ReadTokens(r io.Reader) []*Token {
+// Name returns the token's name, as in tName in the lexer.
+func (t *Token) Name() string { return t.name }
+
+// Block returns the kind of block the token was declared in.
+func (t *Token) Block() BlockId { return t.block }
+
+// Mode returns the lexer mode the token is lexed in, or "" for the
+// default mode.
+func (t *Token) Mode() string { return t.mode }
+
+// Value returns the token's value: the text it matches, or for
+// specials and values, the name the parser knows it by.
+func (t *Token) Value() string { return t.value }
+
+// Display returns the token's name as shown to users, as in error
+// messages.  It's the display name given in the tokens file if any,
+// and otherwise the quoted text of symbols and keywords, or the value
+// of specials and values.
+func (t *Token) Display() string {
+	switch {
+	case t.display != "":
+		return t.display
+	case t.block == BlockSpecial || t.block == BlockValue:
+		return t.value
+	}
+	return "'" + t.value + "'"
+}
+
+// Class is a named set of tokens, declared in the tokens format by a
+// line like
+//   class AssignOp = '=' '+=' '-='
+// and usable as a single terminal in grammars.
+type Class struct {
+	Name    string
+	Members []string
+}
+
+// unquote strips the quotes from a 'quoted' token value.
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// fields splits a line of the tokens format into words at white space,
+// except that a word like 'else if' or "end of file", running from a
+// quote to the same quote followed by white space, is kept whole.
+func fields(line string) []string {
+	var words []string
+	for {
+		line = strings.TrimLeft(line, " \t\r")
+		if line == "" {
+			return words
+		}
+		end := strings.IndexAny(line, " \t\r")
+		if end < 0 {
+			end = len(line)
+		}
+		if q := line[0]; q == '\'' || q == '"' {
+			for i := 1; i < len(line); i++ {
+				if line[i] == q && (i+1 == len(line) || strings.IndexByte(" \t\r", line[i+1]) >= 0) {
+					end = i + 1
+					break
+				}
+			}
+		}
+		words = append(words, line[:end])
+		line = line[end:]
+	}
+}
+
+// ReadTokens parses the tokens format.  The specials None, EOF and
+// Error needn't be declared: lexers declare them regardless.  A
+// token's value may be quoted, as in
+//   ElseIf 'else if'
+// to include white space, and may be followed by a double-quoted
+// display name, as in
+//   LBrace { "opening brace"
+// for error messages to use in place of the value, and by a trailing
+// context like /!. as described in context.go.  A line like
+//   package calc
+// names the package of the generated lexer, and one like
+//   newlines collapse
+// makes newlines tokens, as with Options.Newlines.  A line like
+//   mode text
+// puts the tokens after it in a lexer mode of their own, as described
+// in modes.go.  The filename is used only in error messages.
+func ReadTokens(r io.Reader, filename string) ([]*Token, []*Class, error) {
+	f, err := readTokens(r, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.newlines != "" {
+		f.tokens = addNewline(f.tokens)
+	}
+	return f.tokens, f.classes, nil
+}
+
+// tokensFile is the content of a tokens file.
+type tokensFile struct {
+	tokens  []*Token
+	classes []*Class
+	// pkg is the package named by a package line, if any.
+	pkg string
+	// newlines is the mode given by a newlines line, if any.
+	newlines string
+}
+
+// readTokens parses the tokens format, as described for ReadTokens.
+func readTokens(r io.Reader, filename string) (*tokensFile, error) {
 	var tokens []*Token
+	var classes []*Class
+	var pkg, newlines string
+	var modes []string
+	// mode is the lexer mode of the tokens being declared.
+	var mode string
 	var id BlockId
+	// name is a token name awaiting its value.
+	var name string
+	pos := token.Position{Filename: filename}
 	s := bufio.NewScanner(r)
-	s.Split(bufio.ScanWords)
 	for s.Scan() {
-		name := s.Text()
-		if name[len(name)-1] == ':' {
-			name = name[:len(name)-1]
-			switch name {
-			case "specials":
-				id = BlockSpecial
-			case "symbols":
-				id = BlockSymbol
-			case "keywords":
-				id = BlockKeyword
-			default:
-				log.Fatalf("unknown block %q", name)
+		pos.Line++
+		words := fields(s.Text())
+		if len(words) > 0 && words[0] == "package" && name == "" {
+			if len(words) != 2 || !token.IsIdentifier(words[1]) || pkg != "" {
+				return nil, fmt.Errorf("%s: bad package declaration %q", pos, s.Text())
+			}
+			pkg = words[1]
+			continue
+		}
+		if len(words) > 0 && words[0] == "newlines" && name == "" {
+			if len(words) != 2 || !isNewlinesMode(words[1]) || newlines != "" {
+				return nil, fmt.Errorf("%s: bad newlines declaration %q", pos, s.Text())
+			}
+			newlines = words[1]
+			continue
+		}
+		if len(words) > 0 && words[0] == "mode" && name == "" {
+			if len(words) != 2 || !token.IsIdentifier(words[1]) {
+				return nil, fmt.Errorf("%s: bad mode declaration %q", pos, s.Text())
+			}
+			mode = words[1]
+			for _, m := range modes {
+				if m == mode {
+					return nil, fmt.Errorf("%s: mode %s is declared twice", pos, mode)
+				}
 			}
+			modes = append(modes, mode)
+			continue
+		}
+		if len(words) > 0 && words[0] == "class" && name == "" {
+			if len(words) < 3 || words[2] != "=" {
+				return nil, fmt.Errorf("%s: bad class declaration %q", pos, s.Text())
+			}
+			class := &Class{Name: words[1]}
+			for _, member := range words[3:] {
+				class.Members = append(class.Members, unquote(member))
+			}
+			classes = append(classes, class)
 			continue
 		}
 
-		if !s.Scan() {
-			break
+		for _, word := range words {
+			if name != "" {
+				tokens = append(tokens, &Token{name: name, value: unquote(word), block: id, mode: mode})
+				name = ""
+				continue
+			}
+			if word[0] == '"' {
+				display, err := strconv.Unquote(word)
+				if err != nil || display == "" {
+					return nil, fmt.Errorf("%s: bad display name %s", pos, word)
+				}
+				if len(tokens) == 0 || tokens[len(tokens)-1].display != "" {
+					return nil, fmt.Errorf("%s: display name %s doesn't follow a token", pos, word)
+				}
+				tokens[len(tokens)-1].display = display
+				continue
+			}
+			if word[0] == '/' {
+				if len(tokens) == 0 || tokens[len(tokens)-1].context != nil {
+					return nil, fmt.Errorf("%s: trailing context %s doesn't follow a token", pos, word)
+				}
+				tok := tokens[len(tokens)-1]
+				if tok.block == BlockSpecial || tok.block == BlockKeyword {
+					return nil, fmt.Errorf("%s: token %s can't have trailing context", pos, tok.name)
+				}
+				context, err := parseTrailing(word)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", pos, err)
+				}
+				tok.context = context
+				continue
+			}
+			if word[len(word)-1] == ':' {
+				switch word[:len(word)-1] {
+				case "specials":
+					id = BlockSpecial
+				case "symbols":
+					id = BlockSymbol
+				case "keywords":
+					id = BlockKeyword
+				case "wordsymbols":
+					id = BlockWordSymbol
+				case "values":
+					id = BlockValue
+				default:
+					return nil, fmt.Errorf("%s: unknown block %q", pos, word[:len(word)-1])
+				}
+				continue
+			}
+			name = word
 		}
-		value := s.Text()
-		tokens = append(tokens, &Token{name, value, id})
 	}
 	if err := s.Err(); err != nil {
-		panic(err)
+		return nil, err
+	}
+	if name != "" {
+		return nil, fmt.Errorf("%s: token %s has no value", pos, name)
+	}
+	for _, m := range modes {
+		if len(modeTokens(tokens, m)) == 0 {
+			return nil, fmt.Errorf("%s: mode %s has no tokens", filename, m)
+		}
+	}
+	return &tokensFile{tokens, classes, pkg, newlines}, nil
+}
+
+// hasToken reports whether tokens includes one with the given name.
+func hasToken(tokens []*Token, name string) bool {
+	for _, t := range tokens {
+		if t.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addSpecials adds the special tokens the generated code relies on
+// that tokens doesn't declare: None, which lex returns for input that
+// doesn't start a token, and EOF go first, so that the zero TokenId is
+// tNone, and Error, which lexOrError returns, goes last.  Error's value
+// isn't "error", which lr parsers reserve for their recovery rules: a
+// parser seeing it would take the bad input for a recovery already
+// made, rather than reporting it and recovering.
+func addSpecials(tokens []*Token) []*Token {
+	var first []*Token
+	if !hasToken(tokens, "None") {
+		first = append(first, &Token{name: "None", value: "none", block: BlockSpecial})
+	}
+	if !hasToken(tokens, "EOF") {
+		first = append(first, &Token{name: "EOF", value: "EOF", block: BlockSpecial})
+	}
+	tokens = append(first, tokens...)
+	if !hasToken(tokens, "Error") {
+		tokens = append(tokens, &Token{name: "Error", value: "invalid", block: BlockSpecial, display: "invalid input"})
 	}
 	return tokens
 }
 
-// writeTokenIds writes the "tFoo, tBar" constant list.
-func writeTokenIds(w *codegen.Writer, tokens []*Token) {
+// isNewlinesMode reports whether mode is a mode for Options.Newlines.
+func isNewlinesMode(mode string) bool {
+	return mode == "each" || mode == "collapse"
+}
+
+// addNewline adds the Newline special token, whose value is a newline
+// so grammars can write it as '\n', unless tokens has a token of that
+// value.
+func addNewline(tokens []*Token) []*Token {
+	for _, t := range tokens {
+		if t.value == "\n" {
+			return tokens
+		}
+	}
+	return append(tokens, &Token{name: "Newline", value: "\n", block: BlockSpecial, display: "newline"})
+}
+
+// writeTokenIds writes the "tFoo, tBar" constant list, with the
+// names prefixed by tp: t in a lexer, or T in a token package, where
+// they're exported.
+func writeTokenIds(w *codegen.Writer, tokens []*Token, tp string) {
 	w.Line("const (")
 	for i, t := range tokens {
 		if i == 0 {
-			w.Linef("t%s TokenId = iota", t.name)
+			w.Linef("%s%s TokenId = iota", tp, t.name)
 		} else {
-			w.Linef("t%s", t.name)
+			w.Linef("%s%s", tp, t.name)
 		}
 	}
 	w.Line(")")
@@ -76,29 +337,79 @@ func writeTokenIds(w *codegen.Writer, tokens []*Token) {
 func writeTokenNames(w *codegen.Writer, tokens []*Token) {
 	w.Line("var TokNames = []string{")
 	for _, t := range tokens {
-		w.Linef("\"%s\",", t.value)
+		w.Linef("%q,", t.value)
+	}
+	w.Line("}")
+}
+
+// writeTokenDisplay writes an array mapping TokenId integers to the
+// tokens' names as shown to users.
+func writeTokenDisplay(w *codegen.Writer, tokens []*Token) {
+	w.Line("var TokDisplay = []string{")
+	for _, t := range tokens {
+		w.Linef("%q,", t.Display())
 	}
 	w.Line("}")
 }
 
 // writeTokenLookup writes a map of string names to token ids.
 // E.g. "eof" => tEOF.
-func writeTokenLookup(w *codegen.Writer, tokens []*Token) {
+func writeTokenLookup(w *codegen.Writer, tokens []*Token, tp string) {
 	w.Line("var TokIds = map[string]TokenId{")
 	for _, t := range tokens {
-		w.Linef("%q: t%s,", t.value, t.name)
+		w.Linef("%q: %s%s,", t.value, tp, t.name)
 	}
 	w.Line("}")
 }
 
+// blockPredicates name the functions reporting whether a TokenId is
+// of a kind of token, and the blocks declaring that kind.
+var blockPredicates = []struct {
+	name, doc string
+	blocks    []BlockId
+}{
+	{"IsSpecial", "a special token, like tEOF", []BlockId{BlockSpecial}},
+	{"IsSymbol", "a symbol or word symbol", []BlockId{BlockSymbol, BlockWordSymbol}},
+	{"IsKeyword", "a keyword", []BlockId{BlockKeyword}},
+	{"IsValue", "a token carrying a value, like an identifier", []BlockId{BlockValue}},
+}
+
+// writeBlockPredicates writes the blockPredicates functions.  Token IDs
+// are prefixed by tp, as in writeTokenIds.
+func writeBlockPredicates(w *codegen.Writer, tokens []*Token, tp string) {
+	for i, pred := range blockPredicates {
+		if i > 0 {
+			w.Line("")
+		}
+		var ids []string
+		for _, t := range tokens {
+			for _, block := range pred.blocks {
+				if t.block == block {
+					ids = append(ids, tp+t.name)
+				}
+			}
+		}
+		w.Linef("// %s reports whether id is %s.", pred.name, pred.doc)
+		w.Linef("func %s(id TokenId) bool {", pred.name)
+		if len(ids) > 0 {
+			w.Line("switch id {")
+			w.Linef("case %s:", strings.Join(ids, ", "))
+			w.Line("return true")
+			w.Line("}")
+		}
+		w.Line("return false")
+		w.Line("}")
+	}
+}
+
 // writeKeywords writes a map mapping keyword names to their TokenIds.
 // It only does this for tokens in the "keyword" block.  This is used
 // to distinguish plain identifiers ("foo") from keywords ("for").
-func writeKeywords(w *codegen.Writer, tokens []*Token) {
+func writeKeywords(w *codegen.Writer, tokens []*Token, tp string) {
 	w.Line("var Keywords = map[string]TokenId{")
 	for _, t := range tokens {
 		if t.block == BlockKeyword {
-			w.Linef("%q: t%s,", t.value, t.name)
+			w.Linef("%q: %s%s,", t.value, tp, t.name)
 		}
 	}
 	w.Line("}")
@@ -106,12 +417,25 @@ func writeKeywords(w *codegen.Writer, tokens []*Token) {
 
 type symM struct {
 	accept string
+	// context is the trailing context of accept, if any.
+	context *trailing
+	// skipSpace is set when accept is a newline that swallows the
+	// white space and newlines after it.
+	skipSpace bool
 	next   map[byte]*symM
+	// word is set when accept is a word symbol, which only matches
+	// if not followed by more identifier characters.
+	word bool
+	// inWord is set when the state is on the path to a word symbol.
+	inWord bool
 }
 
-func (s *symM) add(input string, accept string) {
+func (s *symM) add(input string, accept string, word bool, context *trailing) {
+	s.inWord = s.inWord || word
 	if input == "" {
 		s.accept = accept
+		s.word = word
+		s.context = context
 		return
 	}
 	if s.next == nil {
@@ -122,7 +446,28 @@ func (s *symM) add(input string, accept string) {
 		ns = &symM{}
 		s.next[input[0]] = ns
 	}
-	ns.add(input[1:], accept)
+	ns.add(input[1:], accept, word, context)
+}
+
+// newMachine builds the recognizer machine for the symbols and word
+// symbols among tokens, and a newline token if any, which collapses
+// runs of blank lines into one if collapse is set.
+func newMachine(tokens []*Token, collapse bool) *symM {
+	sm := &symM{}
+	for _, tok := range tokens {
+		switch tok.block {
+		case BlockSpecial:
+			if tok.value == "\n" {
+				sm.add(tok.value, tok.name, false, nil)
+				sm.next['\n'].skipSpace = collapse
+			}
+		case BlockSymbol:
+			sm.add(tok.value, tok.name, false, tok.context)
+		case BlockWordSymbol:
+			sm.add(tok.value, tok.name, true, tok.context)
+		}
+	}
+	return sm
 }
 
 type Chars []byte
@@ -131,7 +476,55 @@ func (c Chars) Len() int           { return len(c) }
 func (c Chars) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
 func (c Chars) Less(i, j int) bool { return c[i] < c[j] }
 
-func (s *symM) writeSwitch(w *codegen.Writer, top bool) {
+// writeBack writes code backing up n bytes.
+func writeBack(w *codegen.Writer, n int) {
+	if n > 0 {
+		w.Linef("r.Back(%d)", n)
+	}
+}
+
+// failFunc writes the code for when the machine fails to match a
+// token, n bytes into the input.  The code gives back input to match
+// the longest token matched on the way, or if none, all of it.
+type failFunc func(w *codegen.Writer, n int)
+
+// failNone is the failFunc for when no token matched on the way.
+func failNone(w *codegen.Writer, n int) {
+	writeBack(w, n)
+	w.Line("// It's up to the caller to figure it out.")
+	w.Line("return tNone")
+}
+
+// writeAccept writes code returning the token accepted by s, which is
+// depth bytes into the input, or if it turns out not to match, the
+// code written by fail.
+func (s *symM) writeAccept(w *codegen.Writer, depth int, fail failFunc) {
+	if s.word {
+		w.Line("if isWordByte(r.Next()) {")
+		w.Line("// Part of a longer identifier.")
+		fail(w, depth+1)
+		w.Line("}")
+		w.Line("r.Back(1)")
+	}
+	if s.skipSpace {
+		w.Line("// Collapse a run of blank lines into one token.")
+		w.Linef("for c := r.Next(); %s || c == '\\n'; c = r.Next() {", spaceCond(true))
+		w.Line("}")
+		w.Line("r.Back(1)")
+	}
+	if s.context != nil {
+		w.Line(s.context.check(true))
+		w.Line("// Not in its trailing context.")
+		fail(w, depth)
+		w.Line("}")
+	}
+	w.Linef("return t%s", s.accept)
+}
+
+// writeSwitch writes the code matching the tokens that continue from
+// s, which is depth bytes into the input, with fail writing the code
+// for when none does.
+func (s *symM) writeSwitch(w *codegen.Writer, top bool, depth int, fail failFunc) {
 	if s.next != nil {
 		w.Line("switch r.Next() {")
 
@@ -145,69 +538,360 @@ func (s *symM) writeSwitch(w *codegen.Writer, top bool) {
 			w.Line("case 0: return tEOF")
 		}
 
+		// Past an accepting state, failing backs up to its token.
+		next := fail
+		if s.accept != "" {
+			next = func(w *codegen.Writer, n int) {
+				writeBack(w, n-depth)
+				s.writeAccept(w, depth, fail)
+			}
+		}
 		for _, char := range keys {
-			w.Linef("case '%c':", char)
-			s.next[char].writeSwitch(w, false)
+			w.Linef("case %q:", char)
+			s.next[char].writeSwitch(w, false, depth+1, next)
 		}
 
 		w.Linef("default:")
-		w.Line("r.Back()")
 		if s.accept != "" {
-			w.Linef("return t%s", s.accept)
+			w.Line("r.Back(1)")
+			s.writeAccept(w, depth, fail)
 		} else {
-			w.Line("// It's up to the caller to figure it out.")
-			w.Line("return tNone")
+			fail(w, depth+1)
 		}
 		w.Line("}")
 	} else {
-		w.Linef("return t%s", s.accept)
+		s.writeAccept(w, depth, fail)
 	}
 }
 
-// writeMachine writes out the recognizer machine, which handles
-// symbols but not keywords.
-func writeMachine(w *codegen.Writer, tokens []*Token) {
-	var sm symM
-	for _, tok := range tokens {
-		if tok.block != BlockSymbol {
-			continue
-		}
-		sm.add(tok.value, tok.name)
+// writePreamble writes the skipPreamble function, which skips an
+// optional byte order mark and/or "#!" line.
+func writePreamble(w *codegen.Writer, bom, shebang bool) {
+	w.Line("// skipPreamble skips the optional preamble of a file.  Call it")
+	w.Line("// once, before the first call to lex.")
+	w.Line("func skipPreamble(r ByteReader) {")
+	if bom {
+		w.Line(`// Skip a UTF-8 byte order mark.
+if r.Next() != 0xEF {
+	r.Back(1)
+} else if r.Next() != 0xBB {
+	r.Back(2)
+} else if r.Next() != 0xBF {
+	r.Back(3)
+}`)
+	}
+	if shebang {
+		w.Line(`// Skip a "#!" line, leaving the newline.
+if r.Next() != '#' {
+	r.Back(1)
+} else if r.Next() != '!' {
+	r.Back(2)
+} else {
+	for c := r.Next(); c != '\n' && c != 0; c = r.Next() {
+	}
+	r.Back(1)
+}`)
+	}
+	w.Line("}")
+}
+
+// spaceCond returns the condition on c that holds for the white space
+// the lexer skips: spaces, tabs, carriage returns, and unless newlines
+// are tokens, newlines.
+func spaceCond(newlines bool) string {
+	if newlines {
+		return `c == ' ' || c == '\t' || c == '\r'`
+	}
+	return `c == ' ' || c == '\t' || c == '\n' || c == '\r'`
+}
+
+// writeMachine writes out the recognizer machine of the default lexer
+// mode, which handles symbols and word symbols but not keywords.
+// Newlines are as in Options.Newlines.
+func writeMachine(w *codegen.Writer, tokens []*Token, errorMode, newlines string) {
+	sm := newMachine(modeTokens(tokens, ""), newlines == "collapse")
+
+	if sm.inWord || errorMode != "" || hasValues(tokens) || len(tokenModes(tokens)) > 0 {
+		w.Line(`// isWordByte reports whether c may continue an identifier.
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' || c >= 0x80
+}
+`)
+	}
+
+	if hasTrailing(tokens) {
+		writeTrailingHelpers(w)
+		w.Line("")
 	}
 
 	w.Line("func lex(r ByteReader) TokenId {")
-	sm.writeSwitch(w, true)
+	sm.writeSwitch(w, true, 0, failNone)
 	w.Line("}")
+
+	if errorMode != "" {
+		w.Line("")
+		writeErrorLex(w, errorMode)
+	}
 }
 
-func Main(infile string, verbose bool) ([]byte, error) {
-	ftokens, err := os.Open(infile)
-	if err != nil {
-		return nil, err
+// writeErrorLex writes lexOrError, which wraps lex to turn input that
+// can't start any token into tError.  With errorMode "byte" the error
+// covers the offending byte; with "skip" it extends to the next
+// whitespace.
+func writeErrorLex(w *codegen.Writer, errorMode string) {
+	w.Line(`// lexOrError is like lex, but rather than returning tNone for input
+// that can't start an identifier or number, it consumes the offending
+// input and returns tError along with it.  The error begins wherever
+// the reader was before the call.
+func lexOrError(r ByteReader) (TokenId, []byte) {
+	id := lex(r)
+	if id != tNone {
+		return id, nil
+	}
+	c := r.Next()
+	r.Back(1)
+	if c == 0 || isWordByte(c) || c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+		// It's up to the caller to figure it out.
+		return tNone, nil
+	}
+	text := []byte{r.Next()}`)
+	if errorMode == "skip" {
+		w.Line(`for {
+		c := r.Next()
+		if c == 0 || c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			r.Back(1)
+			break
+		}
+		text = append(text, c)
+	}`)
 	}
-	tokens := ReadTokens(ftokens)
+	w.Line(`return tError, text
+}`)
+}
 
-	w := &codegen.Writer{}
-	w.Line("package main")
-	w.Line(`// ByteReader is the interface expected by the lex function.
+// Options controls Main.
+type Options struct {
+	// Input, if non-nil, is read in place of the tokens file, whose
+	// name then only identifies the input in messages and the
+	// output's header.
+	Input io.Reader
+	// Verbose enables logging of the generation process.
+	Verbose bool
+	// Package, if non-empty, is the package of the lexer, overriding
+	// the tokens file's package line.  The default is main.
+	Package string
+	// Graph requests a graphviz graph of the symbol machine in place
+	// of the lexer.
+	Graph bool
+	// ErrorMode, if non-empty, requests a lexOrError function that
+	// returns tError for unlexable input.  It is "byte" to cover just
+	// the offending byte or "skip" to extend to the next whitespace.
+	ErrorMode string
+	// Newlines, if non-empty, makes newlines tokens, tNewline, rather
+	// than white space, for languages with a statement per line.  It
+	// is "each" for a token per newline or "collapse" for one per run
+	// of newlines and blank lines.  It overrides the tokens file's
+	// newlines line.
+	Newlines string
+	// SkipBOM and SkipShebang request a skipPreamble function that
+	// skips a leading UTF-8 byte order mark and a leading "#!" line
+	// respectively.
+	SkipBOM     bool
+	SkipShebang bool
+	// Intern requests that the scan function intern the text of
+	// identifiers, so repeated identifiers share storage.
+	Intern bool
+	// Tokenizer requests a Tokenizer type reading the tokens of an
+	// io.Reader with the scan function, for users of the lexer that
+	// don't need a parser.
+	Tokenizer bool
+	// TokenPackage, if non-empty, is the import path of the package
+	// generated by TokensMain holding the token definitions, which the
+	// lexer then imports rather than declaring them itself.
+	TokenPackage string
+	// Templates, if non-empty, is a directory whose lex.tmpl file, if
+	// any, replaces the preamble template; see lexPreamble.
+	Templates string
+	// Raw skips formatting the output, returning the unformatted
+	// source for debugging; see codegen.Writer.Unformatted.
+	Raw bool
+}
+
+// lexPreamble is the template for the start of a lexer, up to the
+// token definitions.  It's executed with the Package, Intern and
+// TokenPackage options, and TokenName, the name of the token package.
+const lexPreamble = `package {{.Package}}
+{{if .Intern}}import "sync"{{end}}
+{{if .TokenPackage}}import "{{.TokenPackage}}"{{end}}
+// ByteReader is the interface expected by the lex function.
 type ByteReader interface {
   // Next reads another byte.  It should return 0 on EOF and panic on error.
   Next() byte
-  // Back backs up by one byte.
-  Back()
+  // Back backs up by n bytes, which may be more than one when backing
+  // out of a partially matched token, but never past the start of the
+  // token.
+  Back(n int)
+  // Offset returns the offset in the input of the next byte Next
+  // reads, for positions in error messages.
+  Offset() int
 }
-`)
-	w.Line("type TokenId int")
 
-	writeTokenIds(w, tokens)
-	w.Line("")
-	writeTokenNames(w, tokens)
-	w.Line("")
-	writeTokenLookup(w, tokens)
+type TokenId {{if .TokenPackage}}= {{.TokenName}}.TokenId{{else}}int{{end}}`
+
+// loadTokens reads the tokens file infile, adding the tokens opts
+// calls for.  The package and newlines mode it returns are those the
+// lexer uses, from opts or the tokens file.
+func loadTokens(infile string, opts *Options) (*tokensFile, error) {
+	r := opts.Input
+	if r == nil {
+		ftokens, err := os.Open(infile)
+		if err != nil {
+			return nil, err
+		}
+		defer ftokens.Close()
+		r = ftokens
+	}
+	f, err := readTokens(r, infile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.ErrorMode {
+	case "", "byte", "skip":
+	default:
+		return nil, fmt.Errorf("unknown error mode %q", opts.ErrorMode)
+	}
+	if opts.Newlines != "" {
+		if !isNewlinesMode(opts.Newlines) {
+			return nil, fmt.Errorf("unknown newlines mode %q", opts.Newlines)
+		}
+		f.newlines = opts.Newlines
+	}
+	if f.newlines != "" {
+		f.tokens = addNewline(f.tokens)
+	}
+	f.tokens = addSpecials(f.tokens)
+
+	if opts.Package != "" {
+		f.pkg = opts.Package
+	}
+	if f.pkg == "" {
+		f.pkg = "main"
+	}
+	if !token.IsIdentifier(f.pkg) {
+		return nil, fmt.Errorf("bad package name %q", f.pkg)
+	}
+	return f, nil
+}
+
+// Main generates a lexer from the tokens file infile.
+func Main(infile string, opts *Options) ([]byte, error) {
+	f, err := loadTokens(infile, opts)
+	if err != nil {
+		return nil, err
+	}
+	tokens := f.tokens
+	if opts.Graph {
+		return Graph(modeTokens(tokens, "")), nil
+	}
+	modes := tokenModes(tokens)
+
+	intern := false
+	if opts.Intern {
+		for _, t := range tokens {
+			if t.block == BlockValue && t.value == "ident" {
+				intern = true
+			}
+		}
+		if !intern {
+			return nil, fmt.Errorf("%s: interning needs an ident token in a values block", infile)
+		}
+	}
+
+	if opts.Tokenizer && !hasValues(tokens) && len(modes) == 0 {
+		return nil, fmt.Errorf("%s: the tokenizer needs tokens in a values block, for the scan function", infile)
+	}
+
+	text, err := codegen.Template(opts.Templates, "lex.tmpl", lexPreamble)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("lex").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	w := &codegen.Writer{}
+	data := struct {
+		Package      string
+		Intern       bool
+		TokenPackage string
+		TokenName    string
+	}{f.pkg, intern, opts.TokenPackage, path.Base(opts.TokenPackage)}
+	if err := tmpl.Execute(w, data); err != nil {
+		return nil, err
+	}
 	w.Line("")
-	writeKeywords(w, tokens)
+
+	shared := opts.TokenPackage != ""
+	if shared {
+		writeTokenAliases(w, tokens, data.TokenName)
+	} else {
+		writeTokenIds(w, tokens, "t")
+		w.Line("")
+		writeTokenNames(w, tokens)
+		w.Line("")
+		writeTokenDisplay(w, tokens)
+		w.Line("")
+		writeTokenLookup(w, tokens, "t")
+		w.Line("")
+		writeKeywords(w, tokens, "t")
+		w.Line("")
+		writeBlockPredicates(w, tokens, "t")
+	}
 	w.Line("")
-	writeMachine(w, tokens)
+	writeMachine(w, tokens, opts.ErrorMode, f.newlines)
+	if hasValues(tokens) || len(modes) > 0 {
+		w.Line("")
+		if !shared {
+			writeTok(w)
+		}
+		if err := writeScan(w, modeTokens(tokens, ""), intern, f.newlines != ""); err != nil {
+			return nil, err
+		}
+		if len(modes) > 0 {
+			if err := writeModes(w, tokens, modes, intern, f.newlines != ""); err != nil {
+				return nil, err
+			}
+		}
+		if intern {
+			w.Line("")
+			writeIntern(w)
+		}
+		if !shared {
+			w.Line("")
+			writeConstructors(w, tokens, "t")
+		}
+	}
+	if opts.SkipBOM || opts.SkipShebang {
+		w.Line("")
+		writePreamble(w, opts.SkipBOM, opts.SkipShebang)
+	}
+	if opts.Tokenizer {
+		w.Line("")
+		writeTokenizer(w, opts.SkipBOM || opts.SkipShebang, f.newlines != "", len(modes) > 0)
+	}
 
-	return w.Fmt()
+	// NewTok's import of strconv, and the tokenizer's imports, are
+	// left to FixImports, rather than the preamble template, which
+	// users may replace.
+	w.FixImports()
+	if opts.Raw {
+		return w.Unformatted(), nil
+	}
+	code, err := w.Fmt()
+	if err != nil {
+		return nil, err
+	}
+	return codegen.Stamp(code, infile), nil
 }
@@ -0,0 +1,308 @@
+package lex
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestErrorValue checks that Error's value isn't the "error" terminal
+// of lr's recovery rules, which a grammar's tokens would then shadow.
+func TestErrorValue(t *testing.T) {
+	for _, tok := range addSpecials([]*Token{{name: "Num", value: "number"}}) {
+		if tok.value == "error" {
+			t.Errorf("%s has the value of lr's recovery terminal", tok.name)
+		}
+	}
+}
+
+// readTest is a tokens file, and what ReadTokens reads from it: the
+// tokens, one per line, followed by the classes, or the error.
+type readTest struct {
+	in, want string
+}
+
+// formatToken formats a token as its name and value, followed by its
+// display name, mode and trailing context where it has them.
+func formatToken(t *Token) string {
+	s := t.name + " " + t.value
+	if t.display != "" {
+		s += fmt.Sprintf(" %q", t.display)
+	}
+	if t.mode != "" {
+		s += " mode=" + t.mode
+	}
+	if c := t.context; c != nil {
+		s += fmt.Sprintf(" /text=%q class=%q negate=%v", c.text, c.class, c.negate)
+	}
+	return s
+}
+
+// checkReadTokens checks what ReadTokens reads from the inputs of
+// tests.
+func checkReadTokens(t *testing.T, tests []readTest) {
+	t.Helper()
+	for _, test := range tests {
+		tokens, classes, err := ReadTokens(strings.NewReader(test.in), "x")
+		var got string
+		if err != nil {
+			got = err.Error()
+		} else {
+			var lines []string
+			for _, tok := range tokens {
+				lines = append(lines, formatToken(tok))
+			}
+			for _, c := range classes {
+				lines = append(lines, c.Name+": "+strings.Join(c.Members, " "))
+			}
+			got = strings.Join(lines, "\n")
+		}
+		if got != test.want {
+			t.Errorf("%q:\ngot  %q\nwant %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestClasses(t *testing.T) {
+	checkReadTokens(t, []readTest{
+		{"class op = + - '*'\nsymbols:\n  Plus +\n", "Plus +\nop: + - *"},
+		{"class op =\n", "op: "},
+		{"class op + -\n", "x:1: bad class declaration \"class op + -\""},
+	})
+}
+
+// scanTokens has symbols sharing prefixes, which the lexer backs up
+// over, and tokens with trailing context.
+const scanTokens = `symbols:
+  Dot .
+  Ellipsis ...
+  Minus -
+  Arrow -> /!>
+values:
+  Num number /![a-z]
+  Ident ident
+`
+
+// scanTests are inputs for the lexer of scanTokens, and the tokens
+// they lex to, as value, text and offset, or the error.
+var scanTests = []struct {
+	in, want string
+}{
+	{". .. ...", `. "." 0, . "." 2, . "." 3, ... "..." 5`},
+	{"....", `... "..." 0, . "." 3`},
+	{"a->b", `ident "a" 0, -> "->" 1, ident "b" 3`},
+	{"a - > b", `ident "a" 0, - "-" 2; offset 4: no token starts with '>'`},
+	{"a->>b", `ident "a" 0, - "-" 1; offset 2: no token starts with '>'`},
+	{"12 ab", `number "12" 0, ident "ab" 3`},
+	{"12ab", `offset 0: no token starts with '1'`},
+	{"12.", `number "12" 0, . "." 2`},
+}
+
+// TestScan checks the tokens the Scanner finds for scanTests.
+func TestScan(t *testing.T) {
+	tokens, _, err := ReadTokens(strings.NewReader(scanTokens), "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScanner(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range scanTests {
+		lexemes, err := s.Scan(test.in)
+		var got []string
+		for _, l := range lexemes {
+			if l.Token.name != "EOF" {
+				got = append(got, fmt.Sprintf("%s %q %d", l.Token.value, l.Text, l.Offset))
+			}
+		}
+		out := strings.Join(got, ", ")
+		if err != nil {
+			if out != "" {
+				out += "; "
+			}
+			out += err.Error()
+		}
+		if out != test.want {
+			t.Errorf("%q: got %s, want %s", test.in, out, test.want)
+		}
+	}
+}
+
+func TestDisplayNames(t *testing.T) {
+	checkReadTokens(t, []readTest{
+		{"symbols:\n  LBrace { \"opening brace\"\n  ElseIf 'else if' \"else if\"\n",
+			"LBrace { \"opening brace\"\nElseIf else if \"else if\""},
+		{"symbols:\n  \"brace\"\n", "x:2: display name \"brace\" doesn't follow a token"},
+		{"symbols:\n  LBrace { \"\"\n", "x:2: bad display name \"\""},
+		{"symbols:\n  LBrace { \"a\" \"b\"\n", "x:2: display name \"b\" doesn't follow a token"},
+	})
+}
+
+func TestTrailing(t *testing.T) {
+	checkReadTokens(t, []readTest{
+		{"values:\n  Num number /!.\n  Ident ident /[a-f0-9]\n",
+			"Num number /text=\".\" class=\"\" negate=true\nIdent ident /text=\"\" class=\"af09\" negate=false"},
+		{"symbols:\n  Arrow -> /!>\n", "Arrow -> /text=\">\" class=\"\" negate=true"},
+		{"keywords:\n  If if /!x\n", "x:2: token If can't have trailing context"},
+		{"values:\n  Num number /[9-0]\n", "x:2: bad range 9-0 in trailing context /[9-0]"},
+		{"values:\n  Num number /!\n", "x:2: empty trailing context /!"},
+		{"values:\n  Num number /a /b\n", "x:2: trailing context /b doesn't follow a token"},
+	})
+
+	for _, test := range []struct {
+		word, rest string
+		want       bool
+	}{
+		{"/.", ".5", true},
+		{"/.", "5", false},
+		{"/!.", ".5", false},
+		{"/!.", "", true},
+		{"/..", ".", false},
+		{"/[0-9]", "7", true},
+		{"/[0-9]", "", false},
+		{"/[a-cx]", "x", true},
+		{"/[a-cx]", "d", false},
+		{"/![a-c]", "d", true},
+		{"/![a-c]", "", true},
+	} {
+		c, err := parseTrailing(test.word)
+		if err != nil {
+			t.Errorf("%s: %s", test.word, err)
+			continue
+		}
+		if got := c.matches(test.rest); got != test.want {
+			t.Errorf("%s matches %q = %v, want %v", test.word, test.rest, got, test.want)
+		}
+	}
+}
+
+// tokenizerDriver is the main package built around the Tokenizer of
+// scanTokens, which prints the tokens of each line of its input in
+// the form of scanTests.
+const tokenizerDriver = `package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		t := NewTokenizer(strings.NewReader(s.Text()))
+		var toks []string
+		for t.Next() {
+			// Symbols have no text, being their value.
+			name, text := TokNames[t.Tok().Id], t.Tok().Text
+			if text == "" {
+				text = name
+			}
+			toks = append(toks, fmt.Sprintf("%s %q %d", name, text, t.Offset()))
+		}
+		out := strings.Join(toks, ", ")
+		if err := t.Err(); err != nil {
+			if out != "" {
+				out += "; "
+			}
+			out += err.Error()
+		}
+		fmt.Println(out)
+	}
+}
+`
+
+// TestTokenizer builds the Tokenizer of scanTokens into a program and
+// checks it reads the tokens the Scanner finds, backing up its stream
+// over several bytes where a longer symbol doesn't match.  It's
+// skipped in short mode.
+func TestTokenizer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs; skipped in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go tool to build with")
+	}
+	code, err := Main("x", &Options{Input: strings.NewReader(scanTokens), Tokenizer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for name, src := range map[string]string{"lex.go": string(code), "main.go": tokenizerDriver} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bin := filepath.Join(dir, "tokenize")
+	build := exec.Command(goTool, "build", "-o", bin, "lex.go", "main.go")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "GO111MODULE=off")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building generated code: %s\n%s", err, out)
+	}
+
+	var in []string
+	for _, test := range scanTests {
+		in = append(in, test.in)
+	}
+	run := exec.Command(bin)
+	run.Stdin = strings.NewReader(strings.Join(in, "\n") + "\n")
+	out, err := run.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != len(scanTests) {
+		t.Fatalf("got %d lines of output, want %d:\n%s", len(lines), len(scanTests), out)
+	}
+	for i, test := range scanTests {
+		if lines[i] != test.want {
+			t.Errorf("%q: got %s, want %s", test.in, lines[i], test.want)
+		}
+	}
+}
+
+func TestPackageLine(t *testing.T) {
+	checkReadTokens(t, []readTest{
+		{"package calc\nsymbols:\n  Semi ;\n", "Semi ;"},
+		{"package 1x\n", "x:1: bad package declaration \"package 1x\""},
+		{"package a\npackage b\n", "x:2: bad package declaration \"package b\""},
+	})
+}
+
+// TestSpecials checks that the special tokens are added around the
+// declared ones.
+func TestSpecials(t *testing.T) {
+	var names []string
+	for _, tok := range addSpecials([]*Token{{name: "Num", value: "number"}}) {
+		names = append(names, tok.name)
+	}
+	if got, want := strings.Join(names, " "), "None EOF Num Error"; got != want {
+		t.Errorf("tokens = %s, want %s", got, want)
+	}
+}
+
+func TestNewlines(t *testing.T) {
+	checkReadTokens(t, []readTest{
+		{"newlines collapse\nsymbols:\n  Semi ;\n", "Semi ;\nNewline \n \"newline\""},
+		{"newlines each\nsymbols:\n  Semi ;\n", "Semi ;\nNewline \n \"newline\""},
+		{"newlines sometimes\n", "x:1: bad newlines declaration \"newlines sometimes\""},
+	})
+}
+
+func TestModes(t *testing.T) {
+	checkReadTokens(t, []readTest{
+		{"symbols:\n  Dollar $\nmode text\nvalues:\n  Text text\nmode str\nsymbols:\n  Quote \"\n",
+			"Dollar $\nText text mode=text\nQuote \" mode=str"},
+		{"mode text\nmode text\n", "x:2: mode text is declared twice"},
+		{"mode a b\n", "x:1: bad mode declaration \"mode a b\""},
+		{"mode text\nsymbols:\n", "x: mode text has no tokens"},
+	})
+}
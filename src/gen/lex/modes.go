@@ -0,0 +1,160 @@
+package lex
+
+// Lexer modes, for languages whose tokens depend on where in the
+// input they are, such as templates: text with expressions embedded
+// between {{ and }}, whose tokens only mean something inside the
+// braces.
+//
+// The tokens declared after a line like
+//   mode text
+// in a tokens file are lexed only in the text mode, and those before
+// any mode line in the default mode.  Each mode has its own lex and
+// scan functions, lexText and scanText for the text mode, and
+// scanMode(r, mode) calls the one for the mode named, "" being the
+// default.  The parser says which mode its next token is in; see
+// LexMode in the lr package.  Token values must still be unique
+// across modes, and keywords, specials and newline tokens belong to
+// the default mode, though an ident in any mode finds the keywords.
+// A mode with a text token, such as
+//   mode text
+//   values:
+//     Text text
+// doesn't skip white space, as it's part of the text.
+
+import (
+	"strconv"
+	"strings"
+
+	"gen/codegen"
+)
+
+// tokenModes returns the lexer modes of tokens other than the default
+// mode, in the order they're declared.
+func tokenModes(tokens []*Token) []string {
+	var modes []string
+	seen := make(map[string]bool)
+	for _, t := range tokens {
+		if t.mode != "" && !seen[t.mode] {
+			seen[t.mode] = true
+			modes = append(modes, t.mode)
+		}
+	}
+	return modes
+}
+
+// modeTokens returns the tokens of tokens lexed in mode.
+func modeTokens(tokens []*Token, mode string) []*Token {
+	var in []*Token
+	for _, t := range tokens {
+		if t.mode == mode {
+			in = append(in, t)
+		}
+	}
+	return in
+}
+
+// isTextMode reports whether tokens, those of a mode, include a text
+// token, so that the mode doesn't skip white space.
+func isTextMode(tokens []*Token) bool {
+	for _, t := range tokens {
+		if t.block == BlockValue && t.value == "text" {
+			return true
+		}
+	}
+	return false
+}
+
+// modeFunc returns the name of the function for mode of the kind
+// named by prefix, as in lexText for the lex function of the text
+// mode, or just lex for the default mode.
+func modeFunc(prefix, mode string) string {
+	if mode == "" {
+		return prefix
+	}
+	return prefix + strings.ToUpper(mode[:1]) + mode[1:]
+}
+
+// writeModes writes the lex and scan functions of each of modes, the
+// scanMode function choosing among them, and skipSpace, which skips
+// the white space before a token of a mode.  Newlines are only tokens
+// in the default mode, and white space elsewhere.
+func writeModes(w *codegen.Writer, tokens []*Token, modes []string, intern, newlines bool) error {
+	for _, mode := range modes {
+		in := modeTokens(tokens, mode)
+		w.Line("")
+		w.Linef("// %s is lex for the %s mode.", modeFunc("lex", mode), mode)
+		w.Linef("func %s(r ByteReader) TokenId {", modeFunc("lex", mode))
+		if sm := newMachine(in, false); sm.next != nil {
+			sm.writeSwitch(w, true, 0, failNone)
+		} else {
+			w.Line(`if r.Next() == 0 {
+	return tEOF
+}
+r.Back(1)
+return tNone`)
+		}
+		w.Line("}")
+
+		w.Line("")
+		space := spaceCond(false)
+		if isTextMode(in) {
+			space = ""
+		}
+		w.Linef("// %s is scan for the %s mode.", modeFunc("scan", mode), mode)
+		if err := writeScanFunc(w, mode, in, intern, space); err != nil {
+			return err
+		}
+	}
+
+	w.Line("")
+	w.Line(`// scanMode is scan for the lexer mode named by mode, "" being the
+// default mode.  It panics if there's no such mode.
+func scanMode(r ByteReader, mode string) Tok {
+	switch mode {
+	case "":
+		return scan(r)`)
+	for _, mode := range modes {
+		w.Linef("case %s:", strconv.Quote(mode))
+		w.Linef("return %s(r)", modeFunc("scan", mode))
+	}
+	w.Line(`}
+	panic("unknown lexer mode " + strconv.Quote(mode))
+}`)
+
+	var text []string
+	if isTextMode(modeTokens(tokens, "")) {
+		text = append(text, `""`)
+	}
+	for _, mode := range modes {
+		if isTextMode(modeTokens(tokens, mode)) {
+			text = append(text, strconv.Quote(mode))
+		}
+	}
+	w.Line("")
+	w.Line(`// skipSpace skips the white space before a token of the lexer mode
+// named by mode.
+func skipSpace(r ByteReader, mode string) {`)
+	if len(text) > 0 {
+		w.Linef("switch mode {")
+		w.Linef("case %s:", strings.Join(text, ", "))
+		w.Line("// White space is part of the text.")
+		w.Line("return")
+		w.Line("}")
+	}
+	w.Line("c := r.Next()")
+	if newlines {
+		w.Line(`if mode == "" {`)
+		w.Linef("for %s {", spaceCond(true))
+		w.Line("c = r.Next()")
+		w.Line("}")
+		w.Line("r.Back(1)")
+		w.Line("return")
+		w.Line("}")
+	}
+	w.Linef("for %s {", spaceCond(false))
+	w.Line(`c = r.Next()
+	}
+	r.Back(1)
+}`)
+	return nil
+}
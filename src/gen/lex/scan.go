@@ -0,0 +1,170 @@
+package lex
+
+// Lexing by interpreting a tokens file, for trying out a grammar
+// without generating and building its lexer.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lexeme is a token found in the input by a Scanner.
+type Lexeme struct {
+	// Token is the token matched.
+	Token *Token
+	// Text is the input matched, which starts at byte Offset.
+	Text   string
+	Offset int
+}
+
+// Scanner lexes input as the lexer generated from its tokens would,
+// though more slowly, by interpreting them.
+type Scanner struct {
+	sm *symM
+	// byName holds the tokens by name, for those the machine accepts.
+	byName   map[string]*Token
+	keywords map[string]*Token
+	values   []*Token
+	eof      *Token
+	// newlines is set when newlines are tokens, not white space, and
+	// text when white space is part of text tokens.
+	newlines bool
+	text     bool
+}
+
+// NewScanner returns a Scanner for tokens, as read by ReadTokens.  It
+// lexes only the tokens of the default lexer mode.
+func NewScanner(tokens []*Token) (*Scanner, error) {
+	tokens = addSpecials(modeTokens(tokens, ""))
+	s := &Scanner{
+		sm:       newMachine(tokens, false),
+		byName:   make(map[string]*Token),
+		keywords: make(map[string]*Token),
+	}
+	for _, t := range tokens {
+		s.byName[t.name] = t
+		switch {
+		case t.block == BlockKeyword:
+			s.keywords[t.value] = t
+		case t.block == BlockValue:
+			if _, ok := valueKinds[t.value]; !ok {
+				return nil, fmt.Errorf("token %s has unknown value kind %q", t.name, t.value)
+			}
+			s.values = append(s.values, t)
+			s.text = s.text || t.value == "text"
+		case t.name == "EOF":
+			s.eof = t
+		case t.value == "\n":
+			s.newlines = true
+		}
+	}
+	return s, nil
+}
+
+// Scan lexes input, returning its tokens followed by EOF.
+func (s *Scanner) Scan(input string) ([]Lexeme, error) {
+	space := " \t\n\r"
+	switch {
+	case s.text:
+		space = ""
+	case s.newlines:
+		space = " \t\r"
+	}
+	var lexemes []Lexeme
+	for pos := 0; ; {
+		for pos < len(input) && strings.IndexByte(space, input[pos]) >= 0 {
+			pos++
+		}
+		if pos == len(input) {
+			return append(lexemes, Lexeme{Token: s.eof, Offset: pos}), nil
+		}
+		t, n := s.symbol(input, pos)
+		if t == nil {
+			t, n = s.value(input, pos)
+		}
+		if t == nil {
+			return lexemes, fmt.Errorf("offset %d: no token starts with %q", pos, input[pos])
+		}
+		lexemes = append(lexemes, Lexeme{Token: t, Text: input[pos : pos+n], Offset: pos})
+		pos += n
+	}
+}
+
+// symbol matches the longest symbol or word symbol at pos that's in
+// its context, returning it and its length, or nil if there's none.
+func (s *Scanner) symbol(input string, pos int) (*Token, int) {
+	// The states of the machine passed through, by length.
+	states := []*symM{s.sm}
+	for sm := s.sm; pos+len(states)-1 < len(input); {
+		if sm = sm.next[input[pos+len(states)-1]]; sm == nil {
+			break
+		}
+		states = append(states, sm)
+	}
+	for n := len(states) - 1; n > 0; n-- {
+		sm := states[n]
+		end := pos + n
+		if sm.accept == "" ||
+			sm.word && end < len(input) && isWordByte(input[end]) ||
+			sm.context != nil && !sm.context.matches(input[end:]) {
+			continue
+		}
+		return s.byName[sm.accept], n
+	}
+	return nil, 0
+}
+
+// value matches a value-bearing token at pos, trying the kinds of
+// value in the order of the tokens, as the scan function does.
+func (s *Scanner) value(input string, pos int) (*Token, int) {
+	c := input[pos]
+	for _, t := range s.values {
+		end := pos
+		switch t.value {
+		case "ident":
+			if c != '_' && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80) {
+				continue
+			}
+			for end < len(input) && isWordByte(input[end]) {
+				end++
+			}
+			if kw := s.keywords[input[pos:end]]; kw != nil {
+				return kw, end - pos
+			}
+		case "number":
+			for end < len(input) && input[end] >= '0' && input[end] <= '9' {
+				end++
+			}
+		case "string":
+			if c != '"' {
+				continue
+			}
+			for end++; end < len(input) && input[end] != '"' && input[end] != '\n'; end++ {
+				if input[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(input) || input[end] != '"' {
+				return nil, 0
+			}
+			end++
+		case "text":
+			for end++; end < len(input); end++ {
+				if sym, _ := s.symbol(input, end); sym != nil {
+					break
+				}
+			}
+		}
+		if end == pos || t.context != nil && !t.context.matches(input[end:]) {
+			continue
+		}
+		return t, end - pos
+	}
+	return nil, 0
+}
+
+// isWordByte reports whether c may be part of an identifier.
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' || c >= 0x80
+}
@@ -0,0 +1,140 @@
+package lex
+
+import "gen/codegen"
+
+// writeTokenizer writes the Tokenizer type, which reads the tokens of
+// an io.Reader one at a time with the scan function.  If preamble is
+// set, it first skips the input's preamble, and if newlines is set,
+// newlines aren't skipped as white space.  If modes is set, the lexer
+// has modes, and the Tokenizer reads each token in the one its Mode
+// field names.
+func writeTokenizer(w *codegen.Writer, preamble, newlines, modes bool) {
+	w.Line(`// streamReader is a ByteReader over an io.Reader.  It keeps the bytes
+// read since the start of the current token, so the lexer can back up
+// over them.
+type streamReader struct {
+	r   *bufio.Reader
+	buf []byte
+	// pos is the reading position in buf, and offset the input offset
+	// of buf[0].
+	pos    int
+	offset int
+	// err is the first error reading r, other than io.EOF.
+	err error
+}
+
+func (s *streamReader) Next() byte {
+	if s.pos == len(s.buf) {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			if err != io.EOF && s.err == nil {
+				s.err = err
+			}
+			c = 0
+		}
+		s.buf = append(s.buf, c)
+	}
+	s.pos++
+	return s.buf[s.pos-1]
+}
+
+func (s *streamReader) Back(n int) {
+	s.pos -= n
+}
+
+func (s *streamReader) Offset() int {
+	return s.offset + s.pos
+}
+
+// mark drops the bytes read so far, starting a new token.
+func (s *streamReader) mark() {
+	s.offset += s.pos
+	s.buf = append(s.buf[:0], s.buf[s.pos:]...)
+	s.pos = 0
+}
+
+// Tokenizer reads the tokens of an input one at a time, skipping
+// whitespace, as in
+//   t := NewTokenizer(r)
+//   for t.Next() {
+//     tok := t.Tok()
+//     ...
+//   }
+//   if err := t.Err(); err != nil {
+//     ...
+//   }
+type Tokenizer struct {`)
+	if modes {
+		w.Line(`// Mode is the lexer mode Next reads the next token in, "" being
+	// the default mode.  A parser gives the mode it expects with its
+	// LexMode method.
+	Mode string
+`)
+	}
+	w.Line(`r      streamReader
+	tok    Tok
+	offset int
+	done   bool
+	err    error
+}
+
+// NewTokenizer returns a Tokenizer reading from r.
+func NewTokenizer(r io.Reader) *Tokenizer {
+	t := &Tokenizer{r: streamReader{r: bufio.NewReader(r)}}`)
+	if preamble {
+		w.Line("skipPreamble(&t.r)")
+	}
+	w.Line(`return t
+}
+
+// Next reads the next token, returning false at the end of the input
+// or on an error.
+func (t *Tokenizer) Next() bool {
+	if t.done {
+		return false
+	}`)
+	if modes {
+		w.Line("skipSpace(&t.r, t.Mode)")
+	} else {
+		w.Line("c := t.r.Next()")
+		w.Linef("for %s {", spaceCond(newlines))
+		w.Line(`c = t.r.Next()
+	}
+	t.r.Back(1)`)
+	}
+	w.Line(`t.r.mark()
+	t.offset = t.r.Offset()`)
+	if modes {
+		w.Line("t.tok = scanMode(&t.r, t.Mode)")
+	} else {
+		w.Line("t.tok = scan(&t.r)")
+	}
+	w.Line(`switch {
+	case t.r.err != nil:
+		t.err = t.r.err
+	case t.tok.Id == tNone:
+		t.err = fmt.Errorf("offset %d: no token starts with %q", t.offset, t.r.Next())
+	case t.tok.Id != tEOF:
+		return true
+	}
+	t.done = true
+	return false
+}
+
+// Tok returns the token read by the last call to Next.
+func (t *Tokenizer) Tok() Tok {
+	return t.tok
+}
+
+// Offset returns the input offset of the start of the token read by
+// the last call to Next.
+func (t *Tokenizer) Offset() int {
+	return t.offset
+}
+
+// Err returns the error that stopped Next, if any.  It returns nil
+// when Next stopped at the end of the input.
+func (t *Tokenizer) Err() error {
+	return t.err
+}`)
+}
@@ -0,0 +1,86 @@
+package lex
+
+// Support for sharing one set of token definitions between the lexer
+// and the parser, or between several tools, by generating them into a
+// package of their own.
+//
+// The token package declares what a lexer otherwise does: the TokenId
+// type, the token IDs, TokNames and the other tables, and if there
+// are values, the Tok type and its constructors.  The IDs are
+// exported as TFoo rather than tFoo.  A lexer generated with
+// Options.TokenPackage set imports the package and aliases its
+// declarations, so that the lexer code is the same either way, and a
+// parser can use the package's Tok as its token type.
+
+import (
+	"fmt"
+	"path"
+
+	"gen/codegen"
+)
+
+// TokensMain generates the token package for the tokens file infile,
+// to be imported by lexers generated with the same options.  The
+// package's name is the last element of opts.TokenPackage.
+func TokensMain(infile string, opts *Options) ([]byte, error) {
+	if opts.TokenPackage == "" {
+		return nil, fmt.Errorf("the token package needs an import path")
+	}
+	f, err := loadTokens(infile, opts)
+	if err != nil {
+		return nil, err
+	}
+	tokens := f.tokens
+
+	w := &codegen.Writer{}
+	w.Linef("// Package %s holds the tokens of %s, shared by the lexer and", path.Base(opts.TokenPackage), path.Base(infile))
+	w.Line("// the parser.")
+	w.Linef("package %s", path.Base(opts.TokenPackage))
+	w.Line("")
+	w.Line("// TokenId identifies a kind of token.")
+	w.Line("type TokenId int")
+	w.Line("")
+	writeTokenIds(w, tokens, "T")
+	w.Line("")
+	writeTokenNames(w, tokens)
+	w.Line("")
+	writeTokenDisplay(w, tokens)
+	w.Line("")
+	writeTokenLookup(w, tokens, "T")
+	w.Line("")
+	writeKeywords(w, tokens, "T")
+	w.Line("")
+	writeBlockPredicates(w, tokens, "T")
+	if hasValues(tokens) {
+		w.Line("")
+		writeTok(w)
+		writeConstructors(w, tokens, "T")
+	}
+
+	w.FixImports()
+	if opts.Raw {
+		return w.Unformatted(), nil
+	}
+	code, err := w.Fmt()
+	if err != nil {
+		return nil, err
+	}
+	return codegen.Stamp(code, infile), nil
+}
+
+// writeTokenAliases writes the declarations a lexer refers to in
+// place of those of the token package pkg.
+func writeTokenAliases(w *codegen.Writer, tokens []*Token, pkg string) {
+	w.Linef("// The tokens are declared in package %s, shared with the parser.", pkg)
+	w.Line("const (")
+	for _, t := range tokens {
+		w.Linef("t%s = %s.T%s", t.name, pkg, t.name)
+	}
+	w.Line(")")
+	w.Line("")
+	w.Linef("var Keywords = %s.Keywords", pkg)
+	if hasValues(tokens) {
+		w.Line("")
+		w.Linef("type Tok = %s.Tok", pkg)
+	}
+}
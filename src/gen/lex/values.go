@@ -0,0 +1,228 @@
+package lex
+
+import (
+	"fmt"
+
+	"gen/codegen"
+)
+
+// valueKinds are the kinds of value-bearing token the generated
+// scanner knows how to read, as named in the "values:" block.  Each is
+// formatted with the token's name and the expression converting buf
+// to the token's text, then with the code going before and after the
+// return of the token to check its trailing context, if any, and last
+// with the name of the lex function of the token's mode.
+var valueKinds = map[string]string{
+	// ident reads a run of identifier bytes, checking for keywords.
+	"ident": `if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80 {
+	var buf []byte
+	for ; isWordByte(c); c = r.Next() {
+		buf = append(buf, c)
+	}
+	r.Back(1)
+	if id, ok := Keywords[string(buf)]; ok {
+		return Tok{Id: id}
+	}
+	%[3]sreturn Tok{Id: t%[1]s, Text: %[2]s}%[4]s
+}`,
+	// number reads a run of decimal digits.
+	"number": `if c >= '0' && c <= '9' {
+	var buf []byte
+	for ; c >= '0' && c <= '9'; c = r.Next() {
+		buf = append(buf, c)
+	}
+	r.Back(1)
+	%[3]sreturn Tok{Id: t%[1]s, Text: %[2]s}%[4]s
+}`,
+	// string reads a double-quoted string, keeping the quotes and
+	// any backslash escapes as written.
+	"string": `if c == '"' {
+	buf := []byte{c}
+	for {
+		c = r.Next()
+		if c == 0 || c == '\n' {
+			r.Back(1)
+			return Tok{Id: tNone, Text: string(buf)}
+		}
+		buf = append(buf, c)
+		if c == '\\' {
+			buf = append(buf, r.Next())
+		} else if c == '"' {
+			%[3]sreturn Tok{Id: t%[1]s, Text: %[2]s}%[4]s
+		}
+	}
+}`,
+	// text reads a run of any bytes up to one that starts a symbol of
+	// the token's mode, for the text around the islands of a
+	// template-like language.  Modes with a text token don't skip
+	// white space, which is part of the text.
+	"text": `if c != 0 {
+	buf := []byte{c}
+	for {
+		start := r.Offset()
+		if %[5]s(r) != tNone {
+			r.Back(r.Offset() - start)
+			break
+		}
+		buf = append(buf, r.Next())
+	}
+	%[3]sreturn Tok{Id: t%[1]s, Text: %[2]s}%[4]s
+}`,
+}
+
+// hasValues reports whether any tokens carry values.
+func hasValues(tokens []*Token) bool {
+	for _, t := range tokens {
+		if t.block == BlockValue {
+			return true
+		}
+	}
+	return false
+}
+
+// writeIntern writes the intern function, which returns the text of
+// an identifier, sharing storage with earlier identifiers of the same
+// text.  The table is read far more often than written, so lookups
+// only take a read lock.
+func writeIntern(w *codegen.Writer) {
+	w.Line(`// internTable holds the text of the identifiers scanned so far.
+var internTable = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// intern returns buf as a string, shared with any identifier of the
+// same text scanned before.
+func intern(buf []byte) string {
+	internTable.RLock()
+	s, ok := internTable.m[string(buf)]
+	internTable.RUnlock()
+	if ok {
+		return s
+	}
+	internTable.Lock()
+	defer internTable.Unlock()
+	if s, ok := internTable.m[string(buf)]; ok {
+		return s
+	}
+	s = string(buf)
+	internTable.m[s] = s
+	return s
+}`)
+}
+
+// writeTok writes the Tok type, the tokens scan returns.
+func writeTok(w *codegen.Writer) {
+	w.Line(`// Tok is a lexed token.  Text is only set for tokens that carry a
+// value, so other tokens are lexed without allocating.
+type Tok struct {
+	Id   TokenId
+	Text string
+}
+`)
+}
+
+// writeScan writes the scan function, which reads a whole token
+// including the text of value-bearing tokens.  If intern is set,
+// identifiers' text is interned.  If newlines is set, newlines aren't
+// skipped as white space.
+func writeScan(w *codegen.Writer, tokens []*Token, intern, newlines bool) error {
+	if isTextMode(tokens) {
+		w.Line(`// scan reads the next token, which may be white space, as that's
+// part of the text.  It returns tNone for input that doesn't start any
+// token.`)
+		return writeScanFunc(w, "", tokens, intern, "")
+	}
+	w.Line(`// scan reads the next token, skipping whitespace.  It returns tNone
+// for input that doesn't start any token.`)
+	return writeScanFunc(w, "", tokens, intern, spaceCond(newlines))
+}
+
+// writeScanFunc writes the scan function of the given lexer mode,
+// reading the value-bearing tokens among tokens after trying the
+// mode's lex function.  It skips the white space matching the
+// condition space, or none if space is empty.
+func writeScanFunc(w *codegen.Writer, mode string, tokens []*Token, intern bool, space string) error {
+	lexFunc := modeFunc("lex", mode)
+	w.Linef("func %s(r ByteReader) Tok {", modeFunc("scan", mode))
+	if space != "" {
+		w.Line("c := r.Next()")
+		w.Linef("for %s {", space)
+		w.Line(`c = r.Next()
+	}
+	r.Back(1)`)
+	}
+	w.Linef("if id := %s(r); id != tNone {", lexFunc)
+	w.Line("return Tok{Id: id}")
+	w.Line("}")
+	if space != "" {
+		w.Line("c = r.Next()")
+	} else {
+		w.Line("c := r.Next()")
+	}
+	for _, t := range tokens {
+		if t.block != BlockValue {
+			continue
+		}
+		code, ok := valueKinds[t.value]
+		if !ok {
+			return fmt.Errorf("token %s has unknown value kind %q", t.name, t.value)
+		}
+		text := "string(buf)"
+		if intern && t.value == "ident" {
+			text = "intern(buf)"
+		}
+		before, after := trailingFallback(t)
+		w.Linef(code, t.name, text, before, after, lexFunc)
+	}
+	w.Line(`r.Back(1)
+	return Tok{Id: tNone}
+}`)
+	return nil
+}
+
+// trailingFallback returns the code going before and after the return
+// of t in the scan function to check its trailing context.  Out of
+// context, it gives back the token's text but for its first byte,
+// which c holds, so that the next kind of value can try it.
+func trailingFallback(t *Token) (before, after string) {
+	if t.context == nil {
+		return "", ""
+	}
+	after = `
+}
+// Not in its trailing context.
+r.Back(len(buf) - 1)
+c = buf[0]`
+	if t.value == "string" {
+		after += "\nbreak"
+	}
+	return t.context.check(false) + "\n", after
+}
+
+// writeConstructors writes functions making tokens, for code such as
+// rule actions and tests that needs tokens of its own: NewTok, taking
+// a token's value, and a New function for each kind of value-bearing
+// token, taking its text.  Token IDs are prefixed by tp, as in
+// writeTokenIds.
+func writeConstructors(w *codegen.Writer, tokens []*Token, tp string) {
+	w.Line(`// NewTok returns the token with the given value, as in NewTok(";").
+// It panics if no token has the value.
+func NewTok(value string) Tok {
+	id, ok := TokIds[value]
+	if !ok {
+		panic("no token has the value " + strconv.Quote(value))
+	}
+	return Tok{Id: id}
+}`)
+	for _, t := range tokens {
+		if t.block != BlockValue {
+			continue
+		}
+		w.Line("")
+		w.Linef("// New%[1]s returns a %[2]s%[1]s token with the given text.", t.name, tp)
+		w.Linef("func New%[1]s(text string) Tok {", t.name)
+		w.Linef("return Tok{Id: %s%s, Text: text}", tp, t.name)
+		w.Line("}")
+	}
+}
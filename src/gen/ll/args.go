@@ -0,0 +1,101 @@
+package ll
+
+// Support for rules taking arguments.
+//
+// A rule function's parameters are the rule's, and a pattern passes
+// their arguments after the rule's name, as in E=expr(0) for
+//   func (p *parser) expr(minPrec int) Node
+// Like the rest of a pattern word, the arguments can't hold spaces, so
+// several are written like expr(a,b).  The number of arguments must
+// match, and literal arguments must suit the basic types of their
+// parameters; other mistakes are left to the compiler.  Tokens take no
+// arguments.
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// param is a parameter of a rule function.
+type param struct {
+	name, typ string
+}
+
+// gatherParams records the parameters of the rule function fn.
+func (pg *PGen) gatherParams(fn *ast.FuncDecl) {
+	var params []param
+	for _, field := range fn.Type.Params.List {
+		typ := nodeString(pg.fset, field.Type)
+		if len(field.Names) == 0 {
+			params = append(params, param{typ: typ})
+		}
+		for _, name := range field.Names {
+			params = append(params, param{name: name.Name, typ: typ})
+		}
+	}
+	pg.params[fn.Name.Name] = params
+}
+
+// callArgs checks the arguments pat passes against the parameters of
+// the rule it calls, returning them as the text of a call's argument
+// list, or "" for a token.
+func (pg *PGen) callArgs(pat *Pat) (string, error) {
+	var args []ast.Expr
+	if pat.args != "" {
+		e, err := parser.ParseExpr("f" + pat.args)
+		call, ok := e.(*ast.CallExpr)
+		if err != nil || !ok {
+			return "", fmt.Errorf("bad arguments %s to %s", pat.args, pat.rulename)
+		}
+		args = call.Args
+	}
+
+	params, isRule := pg.params[pat.rulename]
+	if !isRule || pg.cg.IsTerminal(pat.rulename) {
+		if len(args) > 0 {
+			return "", fmt.Errorf("token %s takes no arguments", pat.rulename)
+		}
+		return "", nil
+	}
+	if len(args) != len(params) {
+		var want []string
+		for _, p := range params {
+			want = append(want, strings.TrimSpace(p.name+" "+p.typ))
+		}
+		noun := "arguments"
+		if len(params) == 1 {
+			noun = "argument"
+		}
+		return "", fmt.Errorf("rule %s takes %d %s (%s), not %d", pat.rulename, len(params), noun, strings.Join(want, ", "), len(args))
+	}
+	var texts []string
+	for i, arg := range args {
+		if lit, ok := arg.(*ast.BasicLit); ok && !litSuits(lit.Kind, params[i].typ) {
+			return "", fmt.Errorf("argument %s to %s isn't of type %s", lit.Value, pat.rulename, params[i].typ)
+		}
+		texts = append(texts, nodeString(token.NewFileSet(), arg))
+	}
+	return "(" + strings.Join(texts, ", ") + ")", nil
+}
+
+// litSuits reports whether a literal of kind may be given for a
+// parameter of type typ, if typ is a basic type.
+func litSuits(kind token.Token, typ string) bool {
+	switch typ {
+	case "string":
+		return kind == token.STRING
+	case "bool":
+		return false
+	case "float32", "float64":
+		return kind == token.INT || kind == token.FLOAT || kind == token.CHAR
+	case "int", "int8", "int16", "int32", "int64", "rune",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr", "byte":
+		return kind == token.INT || kind == token.CHAR
+	case "complex64", "complex128":
+		return kind != token.STRING
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package ll
+
+// Support for limiting how deeply the rules of a parser may recurse,
+// since input nested deeply enough would otherwise overflow the stack,
+// a fatal error.
+//
+// A doc comment line "//gen:depth N" on the parser's struct type, with
+// the tok field of //gen:helpers, adds a depth field to it counting the
+// rules in progress.  Each rule method then panics with a *ParseError
+// when entered with N already in progress, which the parser's caller
+// may recover like the panics of syntax errors.  N defaults to 10000.
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+
+	"gen/codegen"
+)
+
+const defaultMaxDepth = 10000
+
+// depthGuard describes the depth limit of a parser.
+type depthGuard struct {
+	*parserType
+	max int
+}
+
+// findDepthGuard looks for the parser type marked //gen:depth in f,
+// returning nil if there's none.
+func (pg *PGen) findDepthGuard(f *ast.File) (*depthGuard, error) {
+	pt, arg, err := pg.findParser(f, "depth")
+	if err != nil || pt == nil {
+		return nil, err
+	}
+	max := defaultMaxDepth
+	if arg != "" {
+		if max, err = strconv.Atoi(arg); err != nil || max <= 0 {
+			return nil, pg.errorf(pt.pos, "//gen:depth needs a positive limit, not %q", arg)
+		}
+	}
+	for _, decl := range f.Decls {
+		if ts := typeNamed(decl, "ParseError"); ts != nil {
+			return nil, pg.errorf(ts.Pos(), "ParseError is generated by //gen:depth")
+		}
+	}
+	for _, field := range pt.st.Fields.List {
+		for _, name := range field.Names {
+			if name.Name == "depth" {
+				return nil, pg.errorf(name.Pos(), "%s.depth is generated by //gen:depth", pt.recv)
+			}
+		}
+	}
+	return &depthGuard{parserType: pt, max: max}, nil
+}
+
+// typeNamed returns the spec of decl declaring the type name, if any.
+func typeNamed(decl ast.Decl, name string) *ast.TypeSpec {
+	d, ok := decl.(*ast.GenDecl)
+	if !ok || d.Tok != token.TYPE {
+		return nil
+	}
+	for _, spec := range d.Specs {
+		if ts := spec.(*ast.TypeSpec); ts.Name.Name == name {
+			return ts
+		}
+	}
+	return nil
+}
+
+// guardDepth adds the depth field to the parser type, and the check
+// of the depth to the start of each of its rule methods in f.
+func (pg *PGen) guardDepth(f *ast.File, g *depthGuard) {
+	g.st.Fields.List = append(g.st.Fields.List, &ast.Field{
+		Names: []*ast.Ident{ast.NewIdent("depth")},
+		Type:  ast.NewIdent("int"),
+	})
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil || recvName(fn) != g.recv || pg.rules[fn.Name.Name] == nil {
+			continue
+		}
+		names := fn.Recv.List[0].Names
+		if len(names) == 0 || names[0].Name == "_" {
+			continue
+		}
+		p := names[0].Name
+		guard := mustParseStmts(pg.fset, fmt.Sprintf(`%[1]s.depth++
+defer func() { %[1]s.depth-- }()
+if %[1]s.depth > %[2]d {
+	panic(&ParseError{Rule: %[3]q, Tok: %[1]s.tok, Message: "nesting too deep"})
+}`, p, g.max, fn.Name.Name))
+		fn.Body.List = append(guard, fn.Body.List...)
+	}
+}
+
+// mustParseStmts converts a string to a list of statements, panicking
+// on failure.  Their positions are in fset, so that they print with the
+// line breaks of src.
+func mustParseStmts(fset *token.FileSet, src string) []ast.Stmt {
+	f, err := parser.ParseFile(fset, "", "package p\nfunc f() {\n"+src+"\n}", 0)
+	if err != nil {
+		panic(err)
+	}
+	return f.Decls[0].(*ast.FuncDecl).Body.List
+}
+
+// writeParseError writes the ParseError type the depth guard panics
+// with.
+func writeParseError(w *codegen.Writer, g *depthGuard) {
+	w.Linef(`
+// ParseError reports input the parser gave up on, in the rule Rule at
+// the token Tok.
+type ParseError struct {
+	Rule    string
+	Tok     %s
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%%s: %%s at %%v", e.Rule, e.Message, e.Tok)
+}`, g.tokType)
+}
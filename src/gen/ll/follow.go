@@ -0,0 +1,164 @@
+package ll
+
+// Support for deciding when a syntax switch takes its %empty case.
+//
+// The %empty case of a switch matches the tokens that may follow the
+// rule, its follow set, rather than any token the other cases don't
+// take, so that input the rule can't be followed by is reported where
+// it's found.  Any rule may be called by hand to parse a whole input,
+// so the end of input, the terminal EOF, follows every rule.
+//
+// What follows a switch is only known when it ends its function, with
+// nothing after it but return statements, so that it's followed by
+// what follows the function's rule.  A switch nested in other
+// statements, or with code after it, may not have an %empty case, and
+// its cases may not end with a rule that can match nothing.
+
+import "sort"
+
+// FollowSet maps each rule to the terminals that may follow it.
+type FollowSet map[string]map[string]bool
+
+// firstOf returns the terminals that may begin the symbols of pattern,
+// and whether they all may match nothing.
+func (pg *PGen) firstOf(pattern []*Pat, nullable map[string]bool) (map[string]bool, bool) {
+	first := make(map[string]bool)
+	for _, pat := range pattern {
+		fs, ok := pg.firsts[pat.rulename]
+		if !ok || pg.cg.IsTerminal(pat.rulename) {
+			first[pat.rulename] = true
+			return first, false
+		}
+		for tok := range fs {
+			first[tok] = true
+		}
+		if !nullable[pat.rulename] {
+			return first, false
+		}
+	}
+	return first, true
+}
+
+// nullable returns the rules that may match nothing.
+func (pg *PGen) nullable() map[string]bool {
+	nullable := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for name, rule := range pg.rules {
+			if nullable[name] {
+				continue
+			}
+			for _, arm := range rule.arms {
+				empty := !arm.oneOf
+				for _, pat := range arm.pattern {
+					n := nullable[pat.rulename] && !pg.cg.IsTerminal(pat.rulename)
+					if arm.oneOf {
+						empty = empty || n
+					} else {
+						empty = empty && n
+					}
+				}
+				if empty {
+					nullable[name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return nullable
+}
+
+// gatherFollows computes the follow set of each rule from the first
+// sets, which must have been gathered already.
+func (pg *PGen) gatherFollows() error {
+	nullable := pg.nullable()
+	follows := make(FollowSet)
+	for name := range pg.rules {
+		follows[name] = map[string]bool{"EOF": true}
+	}
+	add := func(name string, toks map[string]bool) bool {
+		added := false
+		for tok := range toks {
+			if !follows[name][tok] {
+				follows[name][tok] = true
+				added = true
+			}
+		}
+		return added
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for name, rule := range pg.rules {
+			if rule.fn != name && rule.ends && pg.rules[rule.fn] != nil {
+				changed = add(name, follows[rule.fn]) || changed
+			}
+
+			// The patterns of internal arms come after the rule itself.
+			self := &Pat{rulename: name}
+			var patterns [][]*Pat
+			for _, arm := range rule.arms {
+				if arm.oneOf {
+					for _, pat := range arm.pattern {
+						patterns = append(patterns, []*Pat{pat})
+					}
+				} else {
+					patterns = append(patterns, arm.pattern)
+				}
+			}
+			for _, arm := range rule.internalArms {
+				patterns = append(patterns, append([]*Pat{self}, arm.pattern...))
+			}
+
+			for _, pattern := range patterns {
+				for i, pat := range pattern {
+					if pg.rules[pat.rulename] == nil {
+						continue
+					}
+					first, empty := pg.firstOf(pattern[i+1:], nullable)
+					changed = add(pat.rulename, first) || changed
+					if !empty {
+						continue
+					}
+					if !rule.ends && nullable[pat.rulename] {
+						return pg.errorf(rule.pos, "%s may match nothing at the end of a case of a switch that doesn't end %s, so what follows it isn't known", pat.rulename, rule.fn)
+					}
+					changed = add(pat.rulename, follows[name]) || changed
+				}
+			}
+		}
+	}
+
+	if pg.trace != nil {
+		pg.trace.Println("follows:")
+		for name, follow := range follows {
+			pg.trace.Println(name, sortedKeys(follow))
+		}
+	}
+	pg.follows = follows
+	return nil
+}
+
+// emptyCase returns the tokens the %empty case of rule matches: those
+// that may follow it.  A token that also begins another case of the
+// switch is an error, unless that case is guarded by a predicate and
+// so comes first.
+func (pg *PGen) emptyCase(rulename string) ([]string, error) {
+	toks := sortedKeys(pg.follows[rulename])
+	for _, tok := range toks {
+		if via, ok := pg.firsts[rulename][tok]; ok && !pg.guarded[rulename][via] {
+			return nil, pg.errorf(pg.rules[rulename].pos, "rule %q may be followed by %s, which also begins its %s case", rulename, tok, via)
+		}
+	}
+	return toks, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
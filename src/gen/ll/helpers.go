@@ -0,0 +1,171 @@
+package ll
+
+// Support for generating the expect and match methods the parser's
+// rules call, which otherwise must be written by hand.
+//
+// A doc comment line "//gen:helpers" on the parser's struct type asks
+// for them, as in
+//   //gen:helpers TokenId
+//   type parser struct {
+//   	tok Tok
+//   	...
+//   }
+// The struct's tok field holds the current token, whose type the
+// helpers are written for, and the argument is the type of token ids,
+// defaulting to the TokenId of a lexer generated by gen lex.  The
+// parser must have a next method reading the next token into tok.
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+
+	"gen/codegen"
+)
+
+// helpers describes the helper methods to generate.
+type helpers struct {
+	*parserType
+	// idType is the type of token ids.
+	idType string
+}
+
+// parserType is a parser's struct type, marked by a directive.
+type parserType struct {
+	// recv is the name of the type.
+	recv string
+	// tokType is the type of its tok field, the current token.
+	tokType string
+	st      *ast.StructType
+	pos     token.Pos
+}
+
+// directive looks in a doc comment for a line like "//gen:name arg",
+// returning the arg.
+func directive(doc *ast.CommentGroup, name string) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	prefix := "//gen:" + name
+	for _, c := range doc.List {
+		if !strings.HasPrefix(c.Text, prefix) {
+			continue
+		}
+		arg := c.Text[len(prefix):]
+		if arg == "" || arg[0] == ' ' || arg[0] == '\t' {
+			return strings.TrimSpace(arg), true
+		}
+	}
+	return "", false
+}
+
+// findParser looks for the parser type marked with the directive
+// //gen:name in f, returning it and the directive's argument, or nil if
+// there's none.
+func (pg *PGen) findParser(f *ast.File, name string) (*parserType, string, error) {
+	var found *parserType
+	var arg string
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || d.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range d.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if doc == nil && len(d.Specs) == 1 {
+				doc = d.Doc
+			}
+			a, ok := directive(doc, name)
+			if !ok {
+				continue
+			}
+			if found != nil {
+				return nil, "", pg.errorf(ts.Pos(), "//gen:%s given for both %s and %s", name, found.recv, ts.Name.Name)
+			}
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				return nil, "", pg.errorf(ts.Pos(), "//gen:%s needs a struct type", name)
+			}
+			var tokType ast.Expr
+			for _, field := range st.Fields.List {
+				for _, n := range field.Names {
+					if n.Name == "tok" {
+						tokType = field.Type
+					}
+				}
+			}
+			if tokType == nil {
+				return nil, "", pg.errorf(ts.Pos(), "//gen:%s needs a tok field holding the current token", name)
+			}
+			found = &parserType{recv: ts.Name.Name, tokType: nodeString(pg.fset, tokType), st: st, pos: ts.Pos()}
+			arg = a
+		}
+	}
+	return found, arg, nil
+}
+
+// recvName returns the name of the receiver type of the method fn, or
+// "" if fn isn't a method.
+func recvName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return ""
+	}
+	recv := fn.Recv.List[0].Type
+	if star, ok := recv.(*ast.StarExpr); ok {
+		recv = star.X
+	}
+	if id, ok := recv.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// findHelpers looks for the parser type marked //gen:helpers in f,
+// returning nil if there's none.
+func (pg *PGen) findHelpers(f *ast.File) (*helpers, error) {
+	pt, idType, err := pg.findParser(f, "helpers")
+	if err != nil || pt == nil {
+		return nil, err
+	}
+	if idType == "" {
+		idType = "TokenId"
+	}
+	found := &helpers{parserType: pt, idType: idType}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || (fn.Name.Name != "expect" && fn.Name.Name != "match") {
+			continue
+		}
+		if recvName(fn) == found.recv {
+			return nil, pg.errorf(fn.Pos(), "%s.%s is generated by //gen:helpers", found.recv, fn.Name.Name)
+		}
+	}
+	return found, nil
+}
+
+// writeHelpers writes the expect and match methods, which compare the
+// current token's id found by tokenId.
+func writeHelpers(w *codegen.Writer, h *helpers, tokenId string) {
+	w.Linef(`
+// expect consumes the current token, which must have the given id,
+// returning it.  Any other token is a syntax error.
+func (p *%[1]s) expect(id %[3]s) %[2]s {
+	tok := p.tok
+	if %[4]s != id {
+		panic(fmt.Sprintf("expected %%v, got %%v", id, tok))
+	}
+	p.next()
+	return tok
+}
+
+// match reports whether the current token has the given id, consuming
+// it if so.
+func (p *%[1]s) match(id %[3]s) bool {
+	if %[4]s != id {
+		return false
+	}
+	p.next()
+	return true
+}`, h.recv, h.tokType, h.idType, tokenId)
+}
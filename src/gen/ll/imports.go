@@ -0,0 +1,48 @@
+package ll
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// addImports adds to f the imports of the packages the generated code
+// refers to, in pg.imports, that f doesn't already import under their
+// own names.  The file's other imports are kept as they are.
+func (pg *PGen) addImports(f *ast.File) {
+	for _, path := range sortedKeys(pg.imports) {
+		addImport(f, path)
+	}
+}
+
+// addImport adds an import of path to f, unless it already has one
+// using the package's own name.
+func addImport(f *ast.File, path string) {
+	name := path[strings.LastIndex(path, "/")+1:]
+	lit := strconv.Quote(path)
+	for _, imp := range f.Imports {
+		if imp.Path.Value == lit && (imp.Name == nil || imp.Name.Name == name) {
+			return
+		}
+	}
+	spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: lit}}
+	f.Imports = append(f.Imports, spec)
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || d.Tok != token.IMPORT {
+			continue
+		}
+		if !d.Lparen.IsValid() {
+			d.Lparen = d.TokPos
+			d.Rparen = d.End()
+		}
+		d.Specs = append(d.Specs, spec)
+		return
+	}
+	// Place a new declaration right after the package clause, ahead of
+	// any comments, which are printed by position.
+	spec.Path.ValuePos = f.Name.End()
+	decl := &ast.GenDecl{TokPos: f.Name.End(), Tok: token.IMPORT, Specs: []ast.Spec{spec}}
+	f.Decls = append([]ast.Decl{decl}, f.Decls...)
+}
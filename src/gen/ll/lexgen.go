@@ -0,0 +1,42 @@
+package ll
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"gen/codegen"
+)
+
+// LexCodeGen is the CodeGen of the command line, for parsers reading
+// the tokens of a lexer generated by gen lex.  Symbols starting with
+// an upper-case letter, like Number, are tokens, matched by their ids
+// like tNumber and consumed by p.expect(tNumber); others are rules,
+// which are methods of the parser p, called as p.expr(args).  The
+// parser holds the current token in p.tok.
+type LexCodeGen struct {
+	// Log, if non-nil, receives the log of the generation process.
+	Log codegen.Logger
+}
+
+func (LexCodeGen) IsTerminal(token string) bool {
+	r, _ := utf8.DecodeRuneInString(token)
+	return unicode.IsUpper(r)
+}
+
+func (LexCodeGen) GenMatch(token string) string {
+	return "t" + token
+}
+
+func (cg LexCodeGen) GenExpect(token string, args string) string {
+	if cg.IsTerminal(token) {
+		return "p.expect(t" + token + ")"
+	}
+	if args == "" {
+		args = "()"
+	}
+	return "p." + token + args
+}
+
+func (cg LexCodeGen) Trace() codegen.Logger {
+	return cg.Log
+}
@@ -1,15 +1,18 @@
 package ll
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/printer"
 	"go/token"
-	"log"
-	"os"
+	"io"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"gen/codegen"
 )
 
 type CodeGen interface {
@@ -18,6 +21,19 @@ type CodeGen interface {
 	GenExpect(token string, args string) string
 }
 
+// TokenIdGen may be implemented by a CodeGen whose tokens don't
+// identify themselves with an Id field, to give the expression that
+// syntax switches compare the GenMatch expressions against.
+type TokenIdGen interface {
+	GenTokenId() string
+}
+
+// Tracer may be implemented by a CodeGen to have Main log the first
+// sets of the rules to the Logger it gives, if non-nil.
+type Tracer interface {
+	Trace() codegen.Logger
+}
+
 // Pat represents a single node in a syntax list.
 // E.g. in `foo A=bar ;`, there are three Pats, and the second one has
 // varname "A" and rulename "bar".
@@ -37,9 +53,19 @@ type Arm struct {
 
 	// body is the code to execute upon matching.
 	body *[]ast.Stmt
+
+	// guarded is set if the arm has a predicate, which lets it share
+	// first tokens with the arms after it.
+	guarded bool
 }
 
 type Rule struct {
+	// pos is where the rule was first found.
+	pos token.Pos
+
+	// fn is the name of the function the rule is in.
+	fn string
+
 	// arms are the possible matches that should fire this rule.
 	arms []*Arm
 
@@ -49,26 +75,90 @@ type Rule struct {
 	//   expr := number
 	//         | expr + number
 	internalArms []*Arm
+
+	// ends is set if the rule's syntax() call or switch ends its
+	// function, so that what follows the function follows the rule.
+	ends bool
 }
 
 type FirstSet map[string]map[string]string
 type PGen struct {
-	cg     CodeGen
-	rules  map[string]*Rule
-	firsts FirstSet
+	cg      CodeGen
+	fset    *token.FileSet
+	rules   map[string]*Rule
+	firsts  FirstSet
+	follows FollowSet
+	// params holds the parameters of each function, by name.
+	params map[string][]param
+	// imports holds the paths of the packages the generated code
+	// refers to.
+	imports map[string]bool
+	// guarded holds, by rule, the first symbols of arms with
+	// predicates, whose first tokens may overlap other arms'.
+	guarded map[string]map[string]bool
+	// preds holds the predicates of syntax cases given by a when()
+	// call at the start of their bodies.
+	preds map[*ast.CaseClause]ast.Expr
+	// trace, if non-nil, receives the log of the generation process.
+	trace codegen.Logger
+}
+
+// errorf returns an error prefixed with the source position of pos.
+func (pg *PGen) errorf(pos token.Pos, format string, a ...interface{}) error {
+	return fmt.Errorf("%s: %s", pg.fset.Position(pos), fmt.Sprintf(format, a...))
+}
+
+// whenCall returns the condition of s if it's a call when(cond).
+func whenCall(s ast.Stmt) (ast.Expr, bool) {
+	es, ok := s.(*ast.ExprStmt)
+	if !ok {
+		return nil, false
+	}
+	e, ok := es.X.(*ast.CallExpr)
+	if !ok {
+		return nil, false
+	}
+	if f, ok := e.Fun.(*ast.Ident); !ok || f.Name != "when" || len(e.Args) != 1 {
+		return nil, false
+	}
+	return e.Args[0], true
+}
+
+// tokenId returns the expression for the id of the current token.
+func (pg *PGen) tokenId() ast.Expr {
+	if g, ok := pg.cg.(TokenIdGen); ok {
+		return MustParse(g.GenTokenId())
+	}
+	return MustParse("p.tok.Id")
+}
+
+// nodeString prints an ast node.
+func nodeString(fset *token.FileSet, n ast.Node) string {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, n); err != nil {
+		panic(err)
+	}
+	return buf.String()
 }
 
 // MustParse converts a string to an ast.Expr, panicing on failure.
 func MustParse(x string) ast.Expr {
-	//log.Println("parse:", x)
-	e, err := parser.ParseExpr(x)
+	e, err := parseExpr(x)
 	if err != nil {
-		panic(fmt.Errorf("when parsing %q: %s", x, err))
+		panic(err)
 	}
-	//ast.Print(nil, e)
 	return e
 }
 
+// parseExpr converts a string to an ast.Expr.
+func parseExpr(x string) (ast.Expr, error) {
+	e, err := parser.ParseExpr(x)
+	if err != nil {
+		return nil, fmt.Errorf("when parsing %q: %s", x, err)
+	}
+	return e, nil
+}
+
 // GenDecl generates a "x, y := z" statement.
 func GenDecl(vars []string, expr ast.Expr) ast.Stmt {
 	var lhs []ast.Expr
@@ -83,13 +173,29 @@ func GenDecl(vars []string, expr ast.Expr) ast.Stmt {
 	}
 }
 
-func parsePattern(input string) (pattern []*Pat, oneOf bool) {
+// isEpsilon reports whether a pattern word is one of the ways of
+// writing the empty pattern: e, or %empty or ε as in lr grammars.
+func isEpsilon(word string) bool {
+	return word == "e" || word == "%empty" || word == "ε"
+}
+
+func parsePattern(input string) (pattern []*Pat, oneOf bool, err error) {
 	re := regexp.MustCompile(`^(?:([^=])=)?(\S+?)(\(.*\))?$`)
 
-	words := strings.Split(input[1:len(input)-1], " ")
+	text := input[1 : len(input)-1]
+	if text == "" {
+		return nil, false, fmt.Errorf("empty pattern; write %%empty for one matching nothing")
+	}
+	words := strings.Split(text, " ")
 
 	for i, word := range words {
 		match := re.FindStringSubmatch(word)
+		if match == nil {
+			return nil, false, fmt.Errorf("bad symbol %q in pattern %s; patterns are separated by single spaces", word, input)
+		}
+		if isEpsilon(word) && len(words) > 1 {
+			return nil, false, fmt.Errorf("%s must be the whole pattern, in %s", word, input)
+		}
 
 		pat := &Pat{varname: match[1], rulename: match[2], args: match[3]}
 
@@ -101,14 +207,17 @@ func parsePattern(input string) (pattern []*Pat, oneOf bool) {
 	}
 
 	// epsilon is handled specially.
-	if len(pattern) == 1 && pattern[0].rulename == "e" {
+	if len(pattern) == 1 && isEpsilon(pattern[0].rulename) {
 		pattern = nil
 	}
 
 	return
 }
 
-func isSyntaxCall(s ast.Stmt) (pattern string, ok bool) {
+// isSyntaxCall returns the pattern if s is a call to syntax("...").
+// It returns an error if s calls syntax with anything other than a
+// single string literal.
+func (pg *PGen) isSyntaxCall(s ast.Stmt) (pattern string, ok bool, err error) {
 	es, ok := s.(*ast.ExprStmt)
 	if !ok {
 		return
@@ -119,15 +228,17 @@ func isSyntaxCall(s ast.Stmt) (pattern string, ok bool) {
 	}
 	f, ok := e.Fun.(*ast.Ident)
 	if !ok || f.Name != "syntax" {
-		return
+		return "", false, nil
 	}
 
 	if len(e.Args) != 1 {
-		return
+		return "", false, pg.errorf(e.Pos(), "syntax() takes a single pattern string")
 	}
-	pattern = e.Args[0].(*ast.BasicLit).Value
-	ok = true
-	return
+	lit, ok := e.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false, pg.errorf(e.Args[0].Pos(), "syntax() pattern must be a string literal")
+	}
+	return lit.Value, true, nil
 }
 
 func isSyntaxSwitch(s ast.Stmt) (sw *ast.SwitchStmt) {
@@ -144,132 +255,291 @@ func isSyntaxSwitch(s ast.Stmt) (sw *ast.SwitchStmt) {
 	return n
 }
 
-func (pg *PGen) gatherFunc(n *ast.FuncDecl) {
+func (pg *PGen) gatherFunc(n *ast.FuncDecl) error {
 	if n.Body == nil || len(n.Body.List) < 1 {
-		return
+		return nil
 	}
-	syntax, ok := isSyntaxCall(n.Body.List[0])
+	syntax, ok, err := pg.isSyntaxCall(n.Body.List[0])
 	if !ok {
-		return
+		return err
 	}
 	n.Body.List = n.Body.List[1:]
 
 	name := n.Name.Name
 	rule := pg.rules[name]
 	if rule == nil {
-		rule = &Rule{}
+		rule = &Rule{pos: n.Pos(), fn: name, ends: true}
 		pg.rules[name] = rule
 	}
 
 	arm := &Arm{body: &n.Body.List}
-	arm.pattern, arm.oneOf = parsePattern(syntax)
+	if arm.pattern, arm.oneOf, err = parsePattern(syntax); err != nil {
+		return pg.errorf(n.Pos(), "%s", err)
+	}
 	if arm.oneOf {
-		panic("notimpl")
+		return pg.errorf(n.Pos(), "oneOf is only supported in syntax switches")
+	}
+	if len(n.Body.List) > 0 {
+		if _, ok := whenCall(n.Body.List[0]); ok {
+			return pg.errorf(n.Body.List[0].Pos(), "when() is only supported in syntax switches")
+		}
 	}
 	rule.arms = append(rule.arms, arm)
+	return nil
 }
 
-func addDefaultToSwitch(context string, n *ast.SwitchStmt) {
+func (pg *PGen) addDefaultToSwitch(context string, n *ast.SwitchStmt) {
+	pg.imports["fmt"] = true
 	expr := fmt.Sprintf(`panic(fmt.Sprintf("%s: didn't expect %%s", p.tok))`, context)
 	stmt := &ast.ExprStmt{X: MustParse(expr)}
 	def := &ast.CaseClause{Body: []ast.Stmt{stmt}}
 	n.Body.List = append(n.Body.List, def)
 }
 
-func (pg *PGen) gatherSwitch(curfunc *ast.FuncDecl, indexInFunc int, n *ast.SwitchStmt) {
-	n.Tag = MustParse("p.tok.Id")
-
-	rulename := curfunc.Name.Name
-	var rule *Rule
-	if indexInFunc > 0 {
-		rulename = fmt.Sprintf("%s%d", rulename, indexInFunc)
+// gatherSwitch gathers the arms of the syntax switch n of curfunc,
+// found at path, the indexes of the statements leading to it.  The
+// first switch in a function without a syntax() call of its own, however
+// deeply nested, is the function's rule; any other switch is a rule
+// named after its path, like expr.1.0.  ends is set if the switch ends
+// the function, which only a switch with an %empty case must.
+//
+// Cases starting with a call of the function itself, like
+// "A=expr Plus B=term" in expr, are left recursion, which is parsed by
+// a loop returned to follow the switch, continuing the value built by
+// the other cases in the function's named result.  The loop binds the
+// variable of the call, A, to the result, and returns once no case
+// continues it.
+//
+// A switch without a default case gets one panicking on the
+// unexpected token.  The switch may give its own default case instead,
+// as for error-tolerant parsing, and a "//gen:nodefault" line in the
+// function's doc comment leaves its switches without one, falling
+// through to the code after them.
+func (pg *PGen) gatherSwitch(curfunc *ast.FuncDecl, path string, n *ast.SwitchStmt, ends bool) (ast.Stmt, error) {
+	n.Tag = pg.tokenId()
+
+	fn := curfunc.Name.Name
+	rulename := fn
+	if pg.rules[rulename] != nil {
+		rulename += "." + path
 	}
-	rule = pg.rules[rulename]
+	rule := pg.rules[rulename]
 	if rule == nil {
-		rule = &Rule{}
+		rule = &Rule{pos: n.Pos(), fn: curfunc.Name.Name, ends: ends}
 		pg.rules[rulename] = rule
 	}
 
-	hasDefault := false
 	var internalCases []ast.Stmt
 	var newBody []ast.Stmt
+	hasDefault := false
 	for _, s := range n.Body.List {
 		c := s.(*ast.CaseClause)
 		arm := &Arm{list: &c.List, body: &c.Body}
-		syntax := c.List[0].(*ast.BasicLit).Value
-		arm.pattern, arm.oneOf = parsePattern(syntax)
+		if c.List == nil {
+			hasDefault = true
+			newBody = append(newBody, s)
+			continue
+		}
+		if len(c.List) != 1 {
+			return nil, pg.errorf(c.Pos(), "syntax case must have a single pattern string")
+		}
+		lit, ok := c.List[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return nil, pg.errorf(c.List[0].Pos(), "syntax case pattern must be a string literal")
+		}
+		syntax := lit.Value
+		var err error
+		if arm.pattern, arm.oneOf, err = parsePattern(syntax); err != nil {
+			return nil, pg.errorf(lit.Pos(), "%s", err)
+		}
+		if arm.pattern == nil && !ends {
+			return nil, pg.errorf(lit.Pos(), "the %%empty case needs its switch to end %s, so that what follows it is known", curfunc.Name.Name)
+		}
+		if len(c.Body) > 0 {
+			if cond, ok := whenCall(c.Body[0]); ok {
+				if arm.pattern == nil {
+					return nil, pg.errorf(c.Body[0].Pos(), "when() can't guard the %%empty case")
+				}
+				pg.preds[c] = cond
+				c.Body = c.Body[1:]
+				arm.guarded = true
+			}
+		}
 
-		if len(arm.pattern) > 0 && arm.pattern[0].rulename == curfunc.Name.Name {
+		if len(arm.pattern) > 0 && arm.pattern[0].rulename == fn {
+			if err := pg.bindSelf(curfunc, arm.pattern[0], c); err != nil {
+				return nil, err
+			}
 			arm.pattern = arm.pattern[1:]
 			rule.internalArms = append(rule.internalArms, arm)
 			internalCases = append(internalCases, c)
 		} else {
-			if arm.pattern == nil {
-				hasDefault = true
-			}
 			rule.arms = append(rule.arms, arm)
 			newBody = append(newBody, s)
 		}
 	}
 	n.Body.List = newBody
 
-	if !hasDefault {
-		addDefaultToSwitch(curfunc.Name.Name, n)
+	if _, ok := directive(curfunc.Doc, "nodefault"); !ok && !hasDefault {
+		pg.addDefaultToSwitch(curfunc.Name.Name, n)
 	}
 
-	if internalCases != nil {
-		sw := &ast.SwitchStmt{
-			Tag:  MustParse("p.tok.Id"),
-			Body: &ast.BlockStmt{List: internalCases},
-		}
+	if internalCases == nil {
+		return nil, nil
+	}
+	sw := &ast.SwitchStmt{
+		Tag:  pg.tokenId(),
+		Body: &ast.BlockStmt{List: internalCases},
+	}
 
-		def := &ast.CaseClause{Body: []ast.Stmt{&ast.ReturnStmt{}}}
-		sw.Body.List = append(sw.Body.List, def)
+	def := &ast.CaseClause{Body: []ast.Stmt{&ast.ReturnStmt{}}}
+	sw.Body.List = append(sw.Body.List, def)
+
+	return &ast.ForStmt{Body: &ast.BlockStmt{List: []ast.Stmt{sw}}}, nil
+}
 
-		f := &ast.ForStmt{Body: &ast.BlockStmt{List: []ast.Stmt{sw}}}
-		curfunc.Body.List = append(curfunc.Body.List, f)
-		//curfunc.Body.List = append(curfunc.Body.List, &ast.ReturnStmt{})
+// bindSelf checks that curfunc can loop over the left-recursive case c,
+// returning its result with a bare return, and binds the variable of
+// self, the case's call of the function, to that result.
+func (pg *PGen) bindSelf(curfunc *ast.FuncDecl, self *Pat, c *ast.CaseClause) error {
+	var results []*ast.Ident
+	if r := curfunc.Type.Results; r != nil {
+		for _, field := range r.List {
+			if len(field.Names) == 0 {
+				return pg.errorf(c.Pos(), "left-recursive %s needs named results, which its loop returns", curfunc.Name.Name)
+			}
+			results = append(results, field.Names...)
+		}
+	}
+	if self.varname == "" {
+		return nil
+	}
+	if len(results) != 1 {
+		return pg.errorf(c.Pos(), "%s=%s needs %s to have a single result, the value so far", self.varname, self.rulename, curfunc.Name.Name)
 	}
+	bind := GenDecl([]string{self.varname}, ast.NewIdent(results[0].Name))
+	c.Body = append([]ast.Stmt{bind}, c.Body...)
+	return nil
 }
 
-func (pg *PGen) gatherFuncs(f *ast.File) {
+func (pg *PGen) gatherFuncs(f *ast.File) error {
 	pg.rules = make(map[string]*Rule)
-	var curfunc *ast.FuncDecl
-	indexInFunc := 0
-
-	ast.Inspect(f, func(an ast.Node) bool {
-		switch n := an.(type) {
-		case *ast.FuncDecl:
-			curfunc = n
-			indexInFunc = 0
-			pg.gatherFunc(n)
+	pg.params = make(map[string][]param)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		pg.gatherParams(fn)
+		if err := pg.gatherFunc(fn); err != nil {
+			return err
+		}
+		if err := pg.gatherStmts(fn, &fn.Body.List, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gatherStmts gathers the syntax switches in list, which is found at
+// path in curfunc, however deeply they're nested in other statements.
+// The loops of left-recursive switches are added to list after them.
+func (pg *PGen) gatherStmts(curfunc *ast.FuncDecl, list *[]ast.Stmt, path string) error {
+	var out []ast.Stmt
+	for i, s := range *list {
+		out = append(out, s)
+		p := strconv.Itoa(i)
+		if path != "" {
+			p = path + "." + p
+		}
+		// A labeled statement is gathered in place, so that a loop
+		// follows it rather than the label's statement.
+		stmt := s
+		for l, ok := stmt.(*ast.LabeledStmt); ok; l, ok = stmt.(*ast.LabeledStmt) {
+			stmt = l.Stmt
+		}
+		var lists []*[]ast.Stmt
+		switch s := stmt.(type) {
+		case *ast.BlockStmt:
+			lists = append(lists, &s.List)
+		case *ast.IfStmt:
+			lists = append(lists, &s.Body.List)
+			if s.Else != nil {
+				lists = append(lists, &[]ast.Stmt{s.Else})
+			}
+		case *ast.ForStmt:
+			lists = append(lists, &s.Body.List)
+		case *ast.RangeStmt:
+			lists = append(lists, &s.Body.List)
 		case *ast.SwitchStmt:
-			sw := isSyntaxSwitch(n)
-			if sw != nil {
-				pg.gatherSwitch(curfunc, indexInFunc, n)
+			clauses := s.Body.List
+			if isSyntaxSwitch(s) != nil {
+				ends := path == "" && onlyReturns((*list)[i+1:])
+				loop, err := pg.gatherSwitch(curfunc, p, s, ends)
+				if err != nil {
+					return err
+				}
+				if loop != nil {
+					out = append(out, loop)
+				}
+			}
+			for _, c := range clauses {
+				lists = append(lists, &c.(*ast.CaseClause).Body)
+			}
+		case *ast.TypeSwitchStmt:
+			for _, c := range s.Body.List {
+				lists = append(lists, &c.(*ast.CaseClause).Body)
+			}
+		case *ast.SelectStmt:
+			for _, c := range s.Body.List {
+				lists = append(lists, &c.(*ast.CommClause).Body)
 			}
-			indexInFunc++
 		}
-		return true
-	})
+		for j, l := range lists {
+			lp := p
+			if len(lists) > 1 {
+				lp += "." + strconv.Itoa(j)
+			}
+			if err := pg.gatherStmts(curfunc, l, lp); err != nil {
+				return err
+			}
+		}
+	}
+	*list = out
+	return nil
+}
+
+// onlyReturns reports whether list holds nothing but return
+// statements, as may follow the switch ending a function.
+func onlyReturns(list []ast.Stmt) bool {
+	for _, s := range list {
+		if _, ok := s.(*ast.ReturnStmt); !ok {
+			return false
+		}
+	}
+	return true
 }
 
 func (pg *PGen) dumpFirsts(fs FirstSet) {
 	for name, firsts := range fs {
-		log.Println(name)
+		pg.trace.Println(name)
 		for tok, via := range firsts {
-			log.Println(" ", "given", tok, "use rule", via)
+			pg.trace.Println(" ", "given", tok, "use rule", via)
 		}
 	}
 }
 
-func (pg *PGen) gatherFirsts() {
+func (pg *PGen) gatherFirsts() error {
 	firsts := make(FirstSet)
 
+	guarded := make(map[string]map[string]bool)
+	pg.guarded = guarded
+
 	// Initialize by grabbing the first pats from each arm of each rule.
 	// Given A -> w1 w2 | B w3
 	// build A -> {w1:w1, B:B}
 	for name, rule := range pg.rules {
+		guarded[name] = make(map[string]bool)
 		first := firsts[name]
 		if first == nil {
 			first = make(map[string]string)
@@ -281,6 +551,9 @@ func (pg *PGen) gatherFirsts() {
 				for _, pat := range arm.pattern {
 					target := pat.rulename
 					first[target] = target
+					if arm.guarded {
+						guarded[name][target] = true
+					}
 					if !arm.oneOf {
 						break
 					}
@@ -289,7 +562,9 @@ func (pg *PGen) gatherFirsts() {
 		}
 	}
 
-	//pg.dumpFirsts(firsts)
+	if pg.trace != nil {
+		pg.dumpFirsts(firsts)
+	}
 
 	// Recursively expand references to nonterminals.
 	// Given A -> {w1:w1, B:B}
@@ -307,8 +582,11 @@ func (pg *PGen) gatherFirsts() {
 					continue
 				}
 				for oname := range other {
-					if _, hasEntry := fs[oname]; hasEntry {
-						log.Fatalf("rule %q has multiple syntax for %s", rulename, oname)
+					if prev, hasEntry := fs[oname]; hasEntry {
+						if guarded[rulename][prev] || guarded[rulename][via] {
+							continue
+						}
+						return pg.errorf(pg.rules[rulename].pos, "rule %q has multiple syntax for %s", rulename, oname)
 					}
 					fs[oname] = via
 				}
@@ -318,26 +596,38 @@ func (pg *PGen) gatherFirsts() {
 		}
 	}
 
-	//pg.dumpFirsts(firsts)
+	if pg.trace != nil {
+		pg.trace.Println("expanded:")
+		pg.dumpFirsts(firsts)
+	}
 
 	pg.firsts = firsts
+	return nil
 }
 
-func (pg *PGen) genArm(arm *Arm) {
+func (pg *PGen) genArm(rulename string, arm *Arm) error {
 	var stmts []ast.Stmt
 	if !arm.oneOf {
 		for _, pat := range arm.pattern {
 			tok := string(pat.rulename)
-			expr := MustParse(pg.cg.GenExpect(tok, pat.args))
+			args, err := pg.callArgs(pat)
+			if err != nil {
+				return pg.errorf(pg.rules[rulename].pos, "%s", err)
+			}
+			expr, err := parseExpr(pg.cg.GenExpect(tok, args))
+			if err != nil {
+				return err
+			}
 			trace := false
 			if trace {
+				pg.imports["log"] = true
 				stmts = append(stmts, &ast.ExprStmt{
-					MustParse("log.Println(\"entering\", \"" + tok + "\")")})
+					X: MustParse("log.Println(\"entering\", \"" + tok + "\")")})
 			}
 			if pat.varname != "" {
 				stmts = append(stmts, GenDecl([]string{pat.varname}, expr))
 			} else {
-				stmts = append(stmts, &ast.ExprStmt{expr})
+				stmts = append(stmts, &ast.ExprStmt{X: expr})
 			}
 		}
 	}
@@ -351,42 +641,157 @@ func (pg *PGen) genArm(arm *Arm) {
 		if arm.pattern != nil {
 			for _, pat := range arm.pattern {
 				tok := pat.rulename
+				toks := []string{tok}
 				if fs, ok := pg.firsts[tok]; ok {
+					toks = nil
 					for t := range fs {
-						list = append(list, MustParse(pg.cg.GenMatch(string(t))))
+						toks = append(toks, t)
 					}
-				} else {
-					list = append(list, MustParse(pg.cg.GenMatch(string(tok))))
+				}
+				for _, t := range toks {
+					e, err := parseExpr(pg.cg.GenMatch(t))
+					if err != nil {
+						return err
+					}
+					list = append(list, e)
 				}
 				if !arm.oneOf {
 					break
 				}
 			}
+		} else {
+			toks, err := pg.emptyCase(rulename)
+			if err != nil {
+				return err
+			}
+			for _, t := range toks {
+				e, err := parseExpr(pg.cg.GenMatch(t))
+				if err != nil {
+					return err
+				}
+				list = append(list, e)
+			}
 		}
 		*arm.list = list
 	}
 	*arm.body = stmts
+	return nil
 }
 
-func Pgen(cg CodeGen, infile string) {
+// Main generates a recursive descent parser from the syntax functions
+// of infile, or if in is non-nil of the source read from it, returning
+// its formatted source.
+func Main(cg CodeGen, infile string, in io.Reader) ([]byte, error) {
 	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, infile, nil, parser.ParseComments)
+	f, err := parser.ParseFile(fset, infile, in, parser.ParseComments)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	pg := PGen{cg: cg}
-	pg.gatherFuncs(f)
-	pg.gatherFirsts()
+	pg := PGen{
+		cg:      cg,
+		fset:    fset,
+		preds:   make(map[*ast.CaseClause]ast.Expr),
+		imports: make(map[string]bool),
+	}
+	if t, ok := cg.(Tracer); ok {
+		pg.trace = t.Trace()
+	}
+	h, err := pg.findHelpers(f)
+	if err != nil {
+		return nil, err
+	}
+	depth, err := pg.findDepthGuard(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := pg.gatherFuncs(f); err != nil {
+		return nil, err
+	}
+	if err := pg.gatherFirsts(); err != nil {
+		return nil, err
+	}
+	if err := pg.gatherFollows(); err != nil {
+		return nil, err
+	}
 
-	for _, rule := range pg.rules {
+	for name, rule := range pg.rules {
 		for _, arm := range rule.arms {
-			pg.genArm(arm)
+			if err := pg.genArm(name, arm); err != nil {
+				return nil, err
+			}
 		}
 		for _, arm := range rule.internalArms {
-			pg.genArm(arm)
+			if err := pg.genArm(name, arm); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	printer.Fprint(os.Stdout, fset, f)
+	pg.guardSwitches(f)
+	if depth != nil {
+		pg.guardDepth(f, depth)
+	}
+	if h != nil || depth != nil {
+		pg.imports["fmt"] = true
+	}
+	pg.addImports(f)
+
+	w := &codegen.Writer{}
+	if err := printer.Fprint(w, fset, f); err != nil {
+		return nil, err
+	}
+	if h != nil {
+		writeHelpers(w, h, nodeString(fset, pg.tokenId()))
+	}
+	if depth != nil {
+		writeParseError(w, depth)
+	}
+	code, err := w.Fmt()
+	if err != nil {
+		return nil, err
+	}
+	return codegen.Stamp(code, infile), nil
+}
+
+// guardSwitches rewrites the syntax switches with predicates, which
+// compare the token id in their tags, as tagless switches checking
+// the predicates along with the id.  The cases are tried in order, so
+// a guarded case may overlap those after it.
+func (pg *PGen) guardSwitches(f *ast.File) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		sw, ok := n.(*ast.SwitchStmt)
+		if !ok || sw.Tag == nil {
+			return true
+		}
+		guarded := false
+		for _, s := range sw.Body.List {
+			guarded = guarded || pg.preds[s.(*ast.CaseClause)] != nil
+		}
+		if !guarded {
+			return true
+		}
+		tag := sw.Tag
+		sw.Tag = nil
+		for _, s := range sw.Body.List {
+			c := s.(*ast.CaseClause)
+			if len(c.List) == 0 {
+				continue
+			}
+			var cond ast.Expr
+			for _, e := range c.List {
+				eq := &ast.BinaryExpr{X: tag, Op: token.EQL, Y: e}
+				if cond == nil {
+					cond = eq
+				} else {
+					cond = &ast.BinaryExpr{X: cond, Op: token.LOR, Y: eq}
+				}
+			}
+			if pred := pg.preds[c]; pred != nil {
+				cond = &ast.BinaryExpr{X: &ast.ParenExpr{X: cond}, Op: token.LAND, Y: &ast.ParenExpr{X: pred}}
+			}
+			c.List = []ast.Expr{cond}
+		}
+		return true
+	})
 }
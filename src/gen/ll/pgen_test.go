@@ -0,0 +1,236 @@
+package ll
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// calcGrammar is a grammar of sums, whose rules pass on an argument,
+// for a parser with generated helpers and a depth limit.
+const calcGrammar = `package calc
+
+//gen:helpers
+//gen:depth 4
+type parser struct {
+	tok  Tok
+	toks []Tok
+}
+
+func (p *parser) next() {
+	p.tok, p.toks = p.toks[0], p.toks[1:]
+}
+
+func (p *parser) expr(scale int) int {
+	syntax("A=term(scale) B=rest(scale)")
+	return A + B
+}
+
+func (p *parser) rest(scale int) int {
+	switch syntax {
+	case "Plus A=term(scale) B=rest(scale)":
+		return A + B
+	case "%empty":
+		return 0
+	}
+	return 0
+}
+
+func (p *parser) term(scale int) int {
+	syntax("N=Num")
+	return scale * len(N.Text)
+}
+`
+
+// generate runs Main on src, returning its output or error as text.
+func generate(src string) string {
+	out, err := Main(LexCodeGen{}, "x.go", strings.NewReader(src))
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// edit is a change to a grammar, replacing the first old in it with
+// new, and a string found in Main's output for the result, or in its
+// error.
+type edit struct {
+	old, new, want string
+}
+
+// checkEdits checks the output of Main for grammar with each of edits
+// made to it.
+func checkEdits(t *testing.T, grammar string, edits []edit) {
+	t.Helper()
+	for _, e := range edits {
+		got := generate(strings.Replace(grammar, e.old, e.new, 1))
+		if !strings.Contains(got, e.want) {
+			t.Errorf("%q: got %s, want %s", e.new, got, e.want)
+		}
+	}
+}
+
+func TestHelpers(t *testing.T) {
+	checkEdits(t, calcGrammar, []edit{
+		{"", "", "func (p *parser) expect(id TokenId) Tok {"},
+		{"", "", "func (p *parser) match(id TokenId) bool {"},
+		{"", "", "N := p.expect(tNum)"},
+		{"//gen:helpers", "//gen:helpers Kind", "func (p *parser) expect(id Kind) Tok {"},
+		{"tok  Tok", "tk  Tok", "x.go:5:6: //gen:helpers needs a tok field holding the current token"},
+		{"func (p *parser) next", "func (p *parser) match() {}\n\nfunc (p *parser) next",
+			"x.go:10:1: parser.match is generated by //gen:helpers"},
+	})
+}
+
+func TestArgs(t *testing.T) {
+	checkEdits(t, calcGrammar, []edit{
+		{"A=term(scale) B=rest", "A=term(2) B=rest", "A := p.term(2)"},
+		{"A=term(scale) B=rest", "A=term('x') B=rest", "A := p.term('x')"},
+		{"A=term(scale) B=rest", "A=term B=rest", "x.go:14:1: rule term takes 1 argument (scale int), not 0"},
+		{"A=term(scale) B=rest", "A=term(1,2) B=rest", "x.go:14:1: rule term takes 1 argument (scale int), not 2"},
+		{"A=term(scale) B=rest", "A=term(1.5) B=rest", "x.go:14:1: argument 1.5 to term isn't of type int"},
+		{"A=term(scale) B=rest", "A=term(1;2) B=rest", "x.go:14:1: bad arguments (1;2) to term"},
+		{"Plus A=term", "Plus(1) A=term", "x.go:20:2: token Plus takes no arguments"},
+		{"term(scale int)", "term(scale, n int)", "x.go:14:1: rule term takes 2 arguments (scale int, n int), not 1"},
+	})
+}
+
+func TestDepth(t *testing.T) {
+	checkEdits(t, calcGrammar, []edit{
+		{"", "", "if p.depth > 4 {"},
+		{"", "", "type ParseError struct {"},
+		{"//gen:depth 4", "//gen:depth", "if p.depth > 10000 {"},
+		{"//gen:depth 4", "//gen:depth 0", `x.go:5:6: //gen:depth needs a positive limit, not "0"`},
+		{"//gen:depth 4", "//gen:depth x", `x.go:5:6: //gen:depth needs a positive limit, not "x"`},
+		{"toks []Tok", "toks []Tok\n\tdepth int", "x.go:8:2: parser.depth is generated by //gen:depth"},
+		{"func (p *parser) next", "type ParseError struct{}\n\nfunc (p *parser) next", "x.go:10:6: ParseError is generated by //gen:depth"},
+	})
+}
+
+func TestAddImport(t *testing.T) {
+	checkEdits(t, calcGrammar, []edit{
+		{"", "", "package calc\n\nimport \"fmt\"\n"},
+		{"package calc\n", "package calc\n\nimport \"os\"\n", "import (\n\t\"fmt\"\n\t\"os\"\n)"},
+	})
+
+	for _, test := range []struct {
+		src, path string
+		// want is the file's imports after adding path.
+		want string
+	}{
+		{"package p", "fmt", `import "fmt"`},
+		{`package p; import "os"`, "fmt", "import (\n\t\"os\"\n\t\"fmt\"\n)"},
+		{"package p\nimport (\n\t\"os\"\n)", "fmt", "import (\n\t\"os\"\n\t\"fmt\"\n)"},
+		{`package p; import "fmt"`, "fmt", `import "fmt"`},
+		{`package p; import fmt "fmt"`, "fmt", `import fmt "fmt"`},
+		{`package p; import f "fmt"`, "fmt", "import (\n\tf \"fmt\"\n\t\"fmt\"\n)"},
+		{`package p; import "a/b"`, "a/b", `import "a/b"`},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "x.go", test.src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addImport(f, test.path)
+		got := nodeString(fset, f)
+		got = strings.TrimSpace(got[strings.Index(got, "\n"):])
+		if got != test.want {
+			t.Errorf("%q plus %s:\ngot  %s\nwant %s", test.src, test.path, got, test.want)
+		}
+	}
+}
+
+// listGrammar has a rule that may match nothing, whose %empty case is
+// taken on the tokens that may follow it.
+const listGrammar = `package p
+
+type parser struct {
+	tok Tok
+	ok  bool
+}
+
+func (p *parser) paren() int {
+	syntax("LParen L=list RParen")
+	return L
+}
+
+func (p *parser) list() int {
+	switch syntax {
+	case "Item N=list":
+		return N + 1
+	case "%empty":
+	}
+	return 0
+}
+`
+
+func TestFollow(t *testing.T) {
+	checkEdits(t, listGrammar, []edit{
+		{"", "", "case tEOF, tRParen:"},
+		{`case "%empty":`, "case \"RParen N=list\":\n\t\treturn N\n\tcase \"%empty\":",
+			`x.go:14:2: rule "list" may be followed by RParen, which also begins its RParen case`},
+		{`case "%empty":`, "case \"RParen N=list\":\n\t\twhen(p.ok)\n\t\treturn N\n\tcase \"%empty\":",
+			"case (p.tok.Id == tRParen) && (p.ok):"},
+		{"\treturn 0\n}\n", "\tp.ok = true\n\treturn 0\n}\n",
+			"x.go:17:7: the %empty case needs its switch to end list, so that what follows it is known"},
+		{"\tswitch syntax {\n\tcase \"Item N=list\":\n\t\treturn N + 1\n\tcase \"%empty\":\n\t}",
+			"\tif p.ok {\n\t\tswitch syntax {\n\t\tcase \"Item N=list\":\n\t\t\treturn N + 1\n\t\tcase \"%empty\":\n\t\t}\n\t}",
+			"x.go:18:8: the %empty case needs its switch to end list, so that what follows it is known"},
+		{`	syntax("LParen L=list RParen")`, "\tif p.ok {\n\t\tswitch syntax {\n\t\tcase \"LParen L=list\":\n\t\t\treturn L\n\t\t}\n\t}",
+			"x.go:10:3: list may match nothing at the end of a case of a switch that doesn't end paren, so what follows it isn't known"},
+	})
+}
+
+// exprGrammar has a left-recursive rule, given by a switch nested in
+// an if statement, which another rule calls.
+const exprGrammar = `package p
+
+type parser struct {
+	tok Tok
+}
+
+func (p *parser) expr() (v int) {
+	if p.tok.Id != tEOF {
+		switch syntax {
+		case "N=Num":
+			v = len(N.Text)
+		case "A=expr Plus N=Num":
+			v = A + len(N.Text)
+		}
+	}
+	return v
+}
+
+func (p *parser) stmt() int {
+	switch syntax {
+	case "Let E=expr":
+		return E
+	case "E=expr":
+		return E
+	}
+	return 0
+}
+`
+
+func TestLeftRecursion(t *testing.T) {
+	out := generate(exprGrammar)
+	for _, want := range []string{
+		"case tNum:\n\t\tE := p.expr()",
+		"\t\tfor {\n\t\t\tswitch p.tok.Id {\n\n\t\t\tcase tPlus:",
+		"N := p.expect(tNum)\n\t\t\t\tA := v\n",
+		"\t\t\tdefault:\n\t\t\t\treturn\n\t\t\t}\n\t\t}\n\n\t}\n\treturn v\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+
+	checkEdits(t, exprGrammar, []edit{
+		{"(v int)", "int", "x.go:12:3: left-recursive expr needs named results, which its loop returns"},
+		{"(v int)", "(v, w int)", "x.go:12:3: A=expr needs expr to have a single result, the value so far"},
+		{"A=expr", "expr", "\t\t\t\tN := p.expect(tNum)\n\n\t\t\t\tv = A"},
+		{"case \"E=expr\":\n\t\treturn E\n\t}", "case \"E=expr\":\n\t\treturn E\n\t}\n\tswitch syntax {\n\tcase \"Num\":\n\tcase \"E=expr\":\n\t}",
+			`x.go:26:2: rule "stmt.1" has multiple syntax for Num`},
+	})
+}
@@ -0,0 +1,258 @@
+package lr
+
+// Advice on which of gen's backends to write a grammar's parser with:
+// the lr parser generated from the grammar, or the ll recursive
+// descent parser generated from syntax functions of the same rules.
+//
+// The grammar, written for lr, is analyzed as each backend would take
+// it, and for each the changes it would need are listed, one per
+// problem.  The ll backend parses a rule like expr -> expr + term as a
+// loop, so only left recursion through other rules is a problem, and
+// its rules must be told apart by their first tokens, or when they can
+// match nothing, by the tokens that can follow them.  The lr backend
+// needs a table free of conflicts.
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// advice is a change a backend needs to handle a grammar.
+type advice struct {
+	pos token.Position
+	msg string
+}
+
+// Advise analyzes the grammar in infile, or read from in if it's
+// non-nil, for the ll and lr backends, returning a report of the
+// changes each would need and which to use.
+func Advise(infile string, in io.Reader) ([]byte, error) {
+	params, rules, err := parse(infile, &Options{Input: in})
+	if err != nil {
+		return nil, err
+	}
+	g := &Grammar{rules: rules}
+	if params.Tokens != "" {
+		if err := g.LoadTokens(filepath.Join(params.srcDir, params.Tokens)); err != nil {
+			return nil, err
+		}
+	}
+	ComputeActions(g, nil)
+	first := g.First(nil)
+	follow := g.Follow(first)
+	llAdvice := adviseLL(g, first, follow)
+	lrAdvice := adviseLR(g)
+
+	buf := &bytes.Buffer{}
+	section := func(backend string, advice []advice) {
+		if len(advice) == 0 {
+			fmt.Fprintf(buf, "%s: handles the grammar as it is\n", backend)
+			return
+		}
+		fmt.Fprintf(buf, "%s: needs %s:\n", backend, counted(len(advice), "change"))
+		for _, a := range advice {
+			fmt.Fprintf(buf, "  %s: %s\n", a.pos, a.msg)
+		}
+	}
+	section("ll", llAdvice)
+	section("lr", lrAdvice)
+
+	switch {
+	case len(llAdvice) == 0 && len(lrAdvice) == 0:
+		fmt.Fprintln(buf, "use either backend")
+	case len(llAdvice) == 0:
+		fmt.Fprintln(buf, "use ll, or make the changes lr needs")
+	case len(lrAdvice) == 0:
+		fmt.Fprintln(buf, "use lr, or make the changes ll needs")
+	case len(llAdvice) < len(lrAdvice):
+		fmt.Fprintln(buf, "neither backend handles the grammar as it is; ll needs fewer changes")
+	default:
+		fmt.Fprintln(buf, "neither backend handles the grammar as it is; lr needs fewer changes")
+	}
+	return buf.Bytes(), nil
+}
+
+// adviseLL returns the changes the ll backend needs to handle g, given
+// its first and follow sets.
+func adviseLL(g *Grammar, first, follow SymbolMap) []advice {
+	var out []advice
+	alts := make(map[string][]*Rule)
+	var nonterminals []string
+	for _, rule := range g.rules {
+		if alts[rule.symbol] == nil {
+			nonterminals = append(nonterminals, rule.symbol)
+		}
+		alts[rule.symbol] = append(alts[rule.symbol], rule)
+	}
+
+	// Left recursion is a problem unless it's a rule's own first
+	// symbol, which ll parses as a loop.  Each recursive group is
+	// reported once, at its first rule.
+	left := make(map[string][]string)
+	for _, rule := range g.rules {
+		for i, sym := range rule.pattern {
+			if g.nonterminals.Has(sym) && (i > 0 || sym != rule.symbol) {
+				left[rule.symbol] = append(left[rule.symbol], sym)
+			}
+			if !g.nullable.Has(sym) {
+				break
+			}
+		}
+	}
+	recursive := make(map[string]bool)
+	for _, comp := range components(nonterminals, left) {
+		sym := comp[0]
+		if !reaches(left, sym, sym) {
+			continue
+		}
+		for _, s := range comp {
+			recursive[s] = true
+		}
+		if len(comp) == 1 {
+			out = append(out, advice{alts[sym][0].pos, fmt.Sprintf(
+				"%s is left-recursive behind symbols that can match nothing; make %s the first symbol of its rule, which ll parses as a loop",
+				sym, sym)})
+			continue
+		}
+		out = append(out, advice{alts[sym][0].pos, fmt.Sprintf(
+			"%s are left-recursive through each other; substitute the rules of %s into those of %s, making the recursion direct, which ll parses as a loop",
+			strings.Join(comp, ", "), strings.Join(comp[1:], ", "), sym)})
+	}
+
+	for _, sym := range nonterminals {
+		if recursive[sym] {
+			continue
+		}
+		// The rules starting with sym itself are loops, taken after
+		// one of the others while their rest begins with the next
+		// token, so those are told apart from each other.
+		var base, loops []*Rule
+		for _, rule := range alts[sym] {
+			if len(rule.pattern) > 0 && rule.pattern[0] == sym {
+				loops = append(loops, rule)
+			} else {
+				base = append(base, rule)
+			}
+		}
+		out = append(out, adviseAlternatives(g, first, follow, base, 0)...)
+		out = append(out, adviseAlternatives(g, first, follow, loops, 1)...)
+	}
+	return out
+}
+
+// adviseAlternatives returns the changes the ll backend needs to tell
+// apart rules, alternatives of the same nonterminal, by the next token
+// after the first skip symbols of their patterns.
+func adviseAlternatives(g *Grammar, first, follow SymbolMap, rules []*Rule, skip int) []advice {
+	var out []advice
+	for i, r1 := range rules {
+		f1, null1 := g.firstOf(first, r1.pattern[skip:])
+		for _, r2 := range rules[i+1:] {
+			f2, null2 := g.firstOf(first, r2.pattern[skip:])
+			if c := common(f1, f2); c != "" {
+				n := 0
+				for n < len(r1.pattern) && n < len(r2.pattern) && r1.pattern[n] == r2.pattern[n] {
+					n++
+				}
+				fix := "expand the rules they begin with until they begin with the same tokens, and factor those out, or guard the first with when()"
+				if n > skip {
+					fix = fmt.Sprintf("factor out their common start, %s, putting what follows it in a rule of its own",
+						strings.Join(r1.pattern[:n], " "))
+				}
+				out = append(out, advice{r2.pos, fmt.Sprintf("%s and %s both begin with %s; %s",
+					r1.Show("->", -1), r2.Show("->", -1), c, fix)})
+				continue
+			}
+			if null1 && null2 {
+				out = append(out, advice{r2.pos, fmt.Sprintf("%s and %s both match nothing; drop one",
+					r1.Show("->", -1), r2.Show("->", -1))})
+				continue
+			}
+			empty, other, f := r1, r2, f2
+			if null2 {
+				empty, other, f = r2, r1, f1
+			} else if !null1 {
+				continue
+			}
+			if c := common(f, follow[empty.symbol]); c != "" {
+				out = append(out, advice{other.pos, fmt.Sprintf(
+					"%s begins with %s, which can also follow %s when %s matches nothing; guard %s with when(), or move what follows %s into its rules",
+					other.Show("->", -1), c, empty.symbol, empty.Show("->", -1), other.Show("->", -1), empty.symbol)})
+			}
+		}
+	}
+	return out
+}
+
+// adviseLR returns the changes the lr backend needs to handle g, whose
+// actions have been computed: one for each pair of rules in conflict.
+func adviseLR(g *Grammar) []advice {
+	las := newAutomaton(g).lalrLookaheads()
+	var out []advice
+	seen := make(map[string]bool)
+	for _, c := range g.conflicts {
+		var reduces []*Rule
+		shift := false
+		for _, action := range []Action{c.kept, c.dropped} {
+			switch a := action.(type) {
+			case Shift:
+				shift = true
+			case Reduce:
+				reduces = append(reduces, a.rule)
+			}
+		}
+		if len(reduces) == 0 {
+			continue
+		}
+		r := reduces[0]
+		var msg string
+		if shift {
+			// The rule shifting input in the state, r itself if it
+			// does, as for operators, or else the first.
+			var s *Rule
+			for _, item := range g.states[c.state].Sorted(g) {
+				if sym, end := item.NextSym(); !end && (sym == c.input || sym == c.class) && (s == nil || item.rule == r) {
+					s = item.rule
+				}
+			}
+			if s == nil {
+				s = r
+			}
+			msg = fmt.Sprintf("%s and %s conflict on %s", r.Show("->", -1), s.Show("->", -1), c.input)
+			switch la := las[c.state][r]; {
+			case !la.Has(c.input) && !la.Has(c.class):
+				msg += fmt.Sprintf(" only for want of lookaheads; give the uses of %s that %s can't follow a nonterminal of their own",
+					r.symbol, c.input)
+			case len(r.pattern) > 1 && r.pattern[0] == r.symbol && r.pattern[len(r.pattern)-1] == r.symbol:
+				// An operator conflicts with each of the others, but
+				// the change is to the grammar of all of them.
+				msg = fmt.Sprintf("the precedence or associativity of %s is ambiguous; give each level of precedence a nonterminal of its own, as in E -> E + T, T -> T * F",
+					r.Show("->", -1))
+			default:
+				msg += fmt.Sprintf("; guard %s with when(), or restructure its rules so that it's complete where %s can't continue it",
+					r.Show("->", -1), c.input)
+			}
+		} else {
+			if len(reduces) < 2 || reduces[1] == r {
+				continue
+			}
+			msg = fmt.Sprintf("%s and %s both reduce on %s", r.Show("->", -1), reduces[1].Show("->", -1), c.input)
+			if la := las[c.state]; la[r].Has(c.input) && la[reduces[1]].Has(c.input) || la[r].Has(c.class) && la[reduces[1]].Has(c.class) {
+				msg += "; merge them, or guard one with when()"
+			} else {
+				msg += fmt.Sprintf(" only for want of lookaheads; give the uses of %s that %s can't follow a nonterminal of their own",
+					r.symbol, c.input)
+			}
+		}
+		if seen[msg] {
+			continue
+		}
+		seen[msg] = true
+		out = append(out, advice{r.pos, msg})
+	}
+	return out
+}
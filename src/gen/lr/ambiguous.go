@@ -0,0 +1,87 @@
+package lr
+
+// Support for tokens the lexer can't tell apart, which the parser
+// resolves by its state.
+//
+// A grammar's lrAmbiguous maps a terminal the lexer returns to the
+// other terminals it may stand for, as in
+//   var lrAmbiguous = map[string]string{"<": "targs<"}
+// for a language where '<' is less-than but also opens a list of type
+// arguments, which the grammar writes as the terminal targs<.  The
+// lexer only ever returns <, and a parser state taking targs< takes <
+// as it.  For that to be decided by the state alone, no state may
+// take both, which is checked when the parser is generated.  The
+// other terminals needn't be tokens of the tokens file.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// setAmbiguous records the ambiguous terminals given by lrAmbiguous,
+// checking that no terminal stands for another in two ways.
+func (g *Grammar) setAmbiguous(ambiguous map[string]string) error {
+	g.ambiguous = make(map[string][]string)
+	meaning := make(map[string]string)
+	for tok, alts := range ambiguous {
+		for _, alt := range strings.Fields(alts) {
+			if alt == tok || ambiguous[alt] != "" {
+				return fmt.Errorf("lrAmbiguous: %s can't stand for %s, which the lexer returns", tok, alt)
+			}
+			if other, ok := meaning[alt]; ok {
+				return fmt.Errorf("lrAmbiguous: %s is given for both %s and %s", alt, other, tok)
+			}
+			meaning[alt] = tok
+			g.ambiguous[tok] = append(g.ambiguous[tok], alt)
+		}
+		sort.Strings(g.ambiguous[tok])
+	}
+	return nil
+}
+
+// resolveAmbiguous folds the actions of each state on the terminals an
+// ambiguous one stands for into its actions on the ambiguous terminal,
+// which is what the lexer returns.  A state with actions for more than
+// one of them is an error, as the parser couldn't tell which is meant.
+func resolveAmbiguous(g *Grammar, table ActionTable) error {
+	var toks []string
+	for tok := range g.ambiguous {
+		toks = append(toks, tok)
+	}
+	sort.Strings(toks)
+	for _, tok := range toks {
+		for _, alt := range g.ambiguous[tok] {
+			if g.nonterminals.Has(alt) {
+				return fmt.Errorf("lrAmbiguous: %s stands for %s, which isn't a terminal", tok, alt)
+			}
+		}
+	}
+
+	for i, row := range table {
+		for _, tok := range toks {
+			taken := tok
+			action, ok := row[tok]
+			for _, alt := range g.ambiguous[tok] {
+				a, has := row[alt]
+				if !has {
+					continue
+				}
+				if ok {
+					buf := &bytes.Buffer{}
+					g.states[i].Dump(g, log.New(buf, "", 0))
+					return fmt.Errorf("state %d can take %s as both %s (%s) and %s (%s), so the lexer's %s is ambiguous there:\n%s",
+						i, tok, taken, describeAction(action), alt, describeAction(a), tok, strings.TrimSuffix(buf.String(), "\n"))
+				}
+				taken, action, ok = alt, a, true
+				delete(row, alt)
+			}
+			if ok {
+				row[tok] = action
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package lr
+
+// Support for parsing the independent top-level items of an input
+// concurrently.
+//
+// A grammar qualifies if its start rule is a list of items, as in
+//   start -> items
+//   items -> items item
+//   items -> item
+// and some terminals only ever appear as the first symbol of an item.
+// Those terminals mark boundaries where the input may be split, each
+// piece then being a complete input of its own.
+
+import (
+	"fmt"
+	"sort"
+
+	"gen/codegen"
+)
+
+// concurrentSplit checks that the grammar's top level is a list of
+// items, returning the terminals that only begin items.
+func concurrentSplit(g *Grammar) (boundaries []string, err error) {
+	rulesFor := make(map[string][]*Rule)
+	for _, rule := range g.rules {
+		rulesFor[rule.symbol] = append(rulesFor[rule.symbol], rule)
+	}
+	isTerminal := func(sym string) bool { return rulesFor[sym] == nil }
+
+	start := g.rules[0]
+	if len(rulesFor[start.symbol]) != 1 || len(start.pattern) != 1 {
+		return nil, fmt.Errorf("%s: concurrent parsing needs a start rule like %s -> items", start.pos, start.symbol)
+	}
+	list := start.pattern[0]
+
+	// The list must be left recursive over a single item symbol.
+	item := ""
+	for _, rule := range rulesFor[list] {
+		var sym string
+		switch {
+		case len(rule.pattern) == 2 && rule.pattern[0] == list:
+			sym = rule.pattern[1]
+		case len(rule.pattern) == 1:
+			sym = rule.pattern[0]
+		default:
+			return nil, fmt.Errorf("%s: concurrent parsing needs %s to be a list of items", rule.pos, list)
+		}
+		if item != "" && sym != item {
+			return nil, fmt.Errorf("%s: concurrent parsing needs %s to be a list of a single item symbol", rule.pos, list)
+		}
+		item = sym
+	}
+	if item == "" || isTerminal(item) {
+		return nil, fmt.Errorf("%s: concurrent parsing needs %s to be a list of items", start.pos, list)
+	}
+
+	// Find the terminals starting an item that appear nowhere else;
+	// the list and item symbols mustn't either.
+	candidates := make(map[string]bool)
+	for _, rule := range rulesFor[item] {
+		if len(rule.pattern) > 0 && isTerminal(rule.pattern[0]) {
+			candidates[rule.pattern[0]] = true
+		}
+	}
+	for _, rule := range g.rules {
+		for i, sym := range rule.pattern {
+			if (sym == list || sym == item) && rule.symbol != start.symbol && rule.symbol != list {
+				return nil, fmt.Errorf("%s: concurrent parsing needs %s to only appear at the top level", rule.pos, sym)
+			}
+			if candidates[sym] && (i > 0 || rule.symbol != item) {
+				delete(candidates, sym)
+			}
+		}
+	}
+	for sym := range candidates {
+		if members, ok := g.classes[sym]; ok {
+			boundaries = append(boundaries, members...)
+		} else {
+			boundaries = append(boundaries, sym)
+		}
+	}
+	if len(boundaries) == 0 {
+		return nil, fmt.Errorf("%s: concurrent parsing needs a token that only begins %s", start.pos, item)
+	}
+	sort.Strings(boundaries)
+	return boundaries, nil
+}
+
+// writeConcurrent writes the ParseConcurrent function, which splits
+// its input at boundaries and parses the pieces in parallel.  The
+// pieces' results are returned for the caller to merge, as the start
+// rule's result may be of any type.
+func writeConcurrent(w *codegen.Writer, params *Params, resultType string, boundaries []string) {
+	w.Linef("// %sBoundaries are the tokens that only ever begin a top-level item,", params.Prefix)
+	w.Line("// where ParseConcurrent may split its input.")
+	w.Linef("var %sBoundaries = map[string]bool{", params.Prefix)
+	for _, b := range boundaries {
+		w.Linef("%q: true,", b)
+	}
+	w.Line("}")
+	w.Line("")
+	w.Linef(`// %[1]sParseConcurrent splits toks, which must end with the EOF
+// token, into up to n pieces at the start of top-level items, and
+// parses the pieces concurrently.  n below 1 is taken as 1.  It
+// returns the result of parsing each piece, in order: each is the
+// start rule's result for the piece's items alone, which the caller
+// merges, as by appending lists.
+func %[1]sParseConcurrent(toks []%[2]s, n int) ([]%[3]s, error) {
+	if len(toks) == 0 || %[4]s != "EOF" {
+		return nil, fmt.Errorf("input doesn't end with EOF")
+	}
+	end := toks[len(toks)-1]
+	body := toks[:len(toks)-1]
+	if n < 1 {
+		n = 1
+	}
+
+	var pieces [][]%[2]s
+	size := len(body)/n + 1
+	start := 0
+	for i := range body {
+		if i-start >= size && %[1]sBoundaries[%[5]s] {
+			pieces = append(pieces, body[start:i:i])
+			start = i
+		}
+	}
+	pieces = append(pieces, body[start:len(body):len(body)])
+
+	results := make([]%[3]s, len(pieces))
+	errs := make([]error, len(pieces))
+	var wg sync.WaitGroup
+	for i, piece := range pieces {
+		wg.Add(1)
+		go func(i int, piece []%[2]s) {
+			defer wg.Done()
+			p := %[1]sNewParser()
+			if errs[i] = p.ParseTokens(append(piece, end)); errs[i] == nil {
+				results[i] = p.Result()
+			}
+		}(i, piece)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}`, params.Prefix, params.TokenType, resultType, params.TokenIdOf("toks[len(toks)-1]"), params.TokenIdOf("body[i]"))
+}
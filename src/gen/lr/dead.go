@@ -0,0 +1,247 @@
+package lr
+
+// Reporting of the parts of a parse table that can never be used, so
+// that grammar authors can find the alternatives they can delete:
+// the actions dropped in resolving conflicts, the states only they
+// reached, the reductions on lookaheads that can't occur where they
+// are, and the rules never reduced as a result.
+//
+// The table is SLR, so a state reduces on every terminal that can
+// follow the rule's nonterminal anywhere, though in the state's
+// context some of them can't.  A reduction on a terminal is live if
+// in some state the reduction can lead to, the terminal is shifted,
+// or itself reduced by a live reduction.  The states a reduction can
+// lead to are found by going back over the transitions into states,
+// which may take paths the parser can't, so that reductions reported
+// dead are dead, though some dead ones may go unreported.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// deadAnalysis holds what's found about a parse table.
+type deadAnalysis struct {
+	g     *Grammar
+	table ActionTable
+	// reached holds the states reachable from the start state.
+	reached []bool
+	// preds holds the states with transitions into each state.
+	preds [][]int
+	// live holds the reduce actions found to be live, by state and
+	// terminal.
+	live []map[string]bool
+}
+
+// newDeadAnalysis analyzes table, the parse table of g with its
+// conflicts resolved.
+func newDeadAnalysis(g *Grammar, table ActionTable) *deadAnalysis {
+	a := &deadAnalysis{
+		g:       g,
+		table:   table,
+		reached: make([]bool, len(table)),
+		preds:   make([][]int, len(table)),
+		live:    make([]map[string]bool, len(table)),
+	}
+	a.reached[0] = true
+	queue := []int{0}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for _, sym := range sortedSymbols(table[state]) {
+			shift, ok := table[state][sym].(Shift)
+			if !ok {
+				continue
+			}
+			a.preds[shift.state] = append(a.preds[shift.state], state)
+			if !a.reached[shift.state] {
+				a.reached[shift.state] = true
+				queue = append(queue, shift.state)
+			}
+		}
+	}
+	for state := range table {
+		a.live[state] = make(map[string]bool)
+	}
+
+	// Reductions are live by the states they lead to, so find them
+	// until no more turn up.
+	for changed := true; changed; {
+		changed = false
+		for state, row := range table {
+			if !a.reached[state] {
+				continue
+			}
+			for tok, action := range row {
+				reduce, ok := action.(Reduce)
+				if !ok || g.nonterminals.Has(tok) || a.live[state][tok] {
+					continue
+				}
+				if a.reduceLive(state, tok, reduce) {
+					a.live[state][tok] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return a
+}
+
+// sortedSymbols returns the symbols row has actions for, sorted.
+func sortedSymbols(row map[string]Action) []string {
+	var syms []string
+	for sym := range row {
+		syms = append(syms, sym)
+	}
+	sort.Strings(syms)
+	return syms
+}
+
+// back returns the states from which n transitions lead to state.
+func (a *deadAnalysis) back(state, n int) []int {
+	return statesBack(a.preds, state, n)
+}
+
+// takes reports whether state is known to take tok: to shift it, or
+// to reduce on it live.
+func (a *deadAnalysis) takes(state int, tok string) bool {
+	switch a.table[state][tok].(type) {
+	case Shift:
+		return true
+	case Reduce:
+		return a.live[state][tok]
+	}
+	return false
+}
+
+// reduceLive reports whether reduce, state's action on tok, is found
+// to be live given what's known so far.
+func (a *deadAnalysis) reduceLive(state int, tok string, reduce Reduce) bool {
+	if reduce.rule == a.g.rules[0] {
+		return true
+	}
+	switch o := reduce.otherwise.(type) {
+	case Shift:
+		return true
+	case Reduce:
+		if a.reduceLive(state, tok, o) {
+			return true
+		}
+	}
+	for _, p := range a.back(state, len(reduce.rule.pattern)) {
+		next, ok := a.table[p][reduce.rule.symbol].(Shift)
+		if ok && a.takes(next.state, tok) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadReport returns a report of what in table, the parse table of g
+// with its conflicts resolved, can never be used.
+func deadReport(g *Grammar, table ActionTable) []byte {
+	a := newDeadAnalysis(g, table)
+	buf := &bytes.Buffer{}
+	section := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(buf, "%s:\n", title)
+		for _, line := range lines {
+			fmt.Fprintf(buf, "  %s\n", line)
+		}
+	}
+
+	// reduced records how each rule is reduced: "live" by a live
+	// action, or otherwise the reason none is.
+	reduced := make(map[*Rule]string)
+	mark := func(rule *Rule, how string) {
+		if reduced[rule] != "live" && reduced[rule] != "dropped" {
+			reduced[rule] = how
+		}
+	}
+
+	var lines []string
+	for _, c := range g.conflicts {
+		if !a.reached[c.state] {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("state %d on %s: %s is dead, as the state will %s",
+			c.state, c.input, describeAction(c.dropped), describeAction(c.kept)))
+		if r, ok := c.dropped.(Reduce); ok {
+			mark(r.rule, "dropped")
+		}
+	}
+	section("actions dropped in resolving conflicts", lines)
+
+	lines = nil
+	for state, row := range table {
+		if !a.reached[state] {
+			// The state is named by its first kernel item.
+			items := g.states[state].Sorted(g)
+			item := items[0]
+			for _, it := range items {
+				if it.pos > 0 {
+					item = it
+					break
+				}
+			}
+			lines = append(lines, fmt.Sprintf("state %d: %s", state, item.rule.Show("->", item.pos)))
+			for _, action := range row {
+				if r, ok := action.(Reduce); ok {
+					mark(r.rule, "unreachable")
+				}
+			}
+			continue
+		}
+		for _, tok := range sortedSymbols(row) {
+			r, ok := row[tok].(Reduce)
+			if !ok || g.nonterminals.Has(tok) {
+				continue
+			}
+			if !a.live[state][tok] {
+				mark(r.rule, "lookahead")
+				continue
+			}
+			reduced[r.rule] = "live"
+			for o, ok := r.otherwise.(Reduce); ok; o, ok = o.otherwise.(Reduce) {
+				reduced[o.rule] = "live"
+			}
+		}
+	}
+	section("states reached only by dropped actions", lines)
+
+	lines = nil
+	for state, row := range table {
+		if !a.reached[state] {
+			continue
+		}
+		for _, tok := range sortedSymbols(row) {
+			if r, ok := row[tok].(Reduce); ok && !g.nonterminals.Has(tok) && !a.live[state][tok] {
+				lines = append(lines, fmt.Sprintf("state %d on %s: %s is dead, as no state it leads to takes %s",
+					state, tok, describeAction(r), tok))
+			}
+		}
+	}
+	section("reductions on lookaheads that can't occur", lines)
+
+	reasons := map[string]string{
+		"dropped":     "its reductions are dropped in resolving conflicts",
+		"unreachable": "it's only reduced in states reached by dropped actions",
+		"lookahead":   "it's only reduced on lookaheads that can't occur",
+		"":            "no state reduces by it",
+	}
+	lines = nil
+	for _, rule := range g.rules[1:] {
+		if how := reduced[rule]; how != "live" {
+			lines = append(lines, fmt.Sprintf("%s: %s: %s", rule.pos, rule.Show("->", -1), reasons[how]))
+		}
+	}
+	section("rules never reduced", lines)
+
+	if buf.Len() == 0 {
+		fmt.Fprintln(buf, "no dead actions or rules")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,151 @@
+package lr
+
+// Generation of a command-line driver for a grammar's language.
+
+import (
+	"fmt"
+	"go/build"
+	"go/token"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gen/codegen"
+)
+
+// driverTemplate is the driver's source, formatted with the package's
+// name and import spec, the parser's prefix and token type, and the
+// code printing the tree as an s-expression, and then with the code
+// setting the lexer mode of the next token, for grammars with modes.
+const driverTemplate = `// Command %[1]s parses a file of the %[1]s language, reporting syntax
+// errors with their positions, and prints the parse tree.
+//
+// It was written by gen lr -driver as a starting point, to be edited
+// freely; gen doesn't overwrite it.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	%[2]s
+)
+
+var asJSON = flag.Bool("json", false, "print the tree as JSON rather than an s-expression")
+
+// position returns the line and column of offset in src.
+func position(src []byte, offset int) (line, col int) {
+	line = 1 + bytes.Count(src[:offset], []byte("\n"))
+	col = offset - bytes.LastIndexByte(src[:offset], '\n')
+	return line, col
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %[1]s [-json] FILE\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	t := %[1]s.NewTokenizer(bytes.NewReader(src))
+	p := %[1]s.New%[3]sParser()
+	// offset is that of the token being parsed, for placing errors.
+	offset := 0
+	err = p.ParseFunc(func() %[4]s {
+		%[6]st.Next()
+		offset = t.Offset()
+		return %[1]s.NewToken(t.Tok(), offset)
+	})
+	if t.Err() != nil {
+		err = t.Err()
+	}
+	if err != nil {
+		line, col := position(src, min(offset, len(src)))
+		fmt.Fprintf(os.Stderr, "%%s:%%d:%%d: %%s\n", path, line, col, err)
+		os.Exit(1)
+	}
+
+	result := p.Result()
+	if *asJSON {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%%s\n", data)
+		return
+	}
+	%[5]s
+}
+`
+
+// writeDriver writes the source of a command reading a file of the
+// language, with the lexer generated with -tokenizer, parsing it and
+// printing the tree, for the parser generated for the package in dir.
+// The command imports the package, so the package can't be main and
+// the parser's names must be exported.  The package must also declare
+//
+//	func NewToken(tok Tok, offset int) TokenType
+//
+// making a token of the parser's exported token type from one of the
+// lexer's and its offset in the input.
+func writeDriver(w *codegen.Writer, dir string, params *Params, grammar *Grammar) error {
+	switch {
+	case params.Package == "main":
+		return fmt.Errorf("the driver imports the parser's package, which can't be main")
+	case params.Prefix != "" && !token.IsExported(params.Prefix):
+		return fmt.Errorf("the driver needs the parser's names exported, but they have the prefix %q; set lrPrefix", params.Prefix)
+	case params.Context != "":
+		return fmt.Errorf("the driver can't make the context the parser's rules need")
+	}
+	tokenType := strings.TrimPrefix(params.TokenType, "*")
+	if !token.IsIdentifier(tokenType) || !token.IsExported(tokenType) {
+		return fmt.Errorf("the driver needs an exported token type of the parser's package, not %s", params.TokenType)
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	bp, err := build.ImportDir(abs, build.FindOnly)
+	if err != nil {
+		return err
+	}
+	if bp.ImportPath == "" || bp.ImportPath == "." {
+		return fmt.Errorf("can't determine import path of %s", abs)
+	}
+
+	pkg := params.Package
+	spec := strconv.Quote(bp.ImportPath)
+	if path.Base(bp.ImportPath) != pkg {
+		spec = pkg + " " + spec
+	}
+	qualified := pkg + "." + tokenType
+	if strings.HasPrefix(params.TokenType, "*") {
+		qualified = "*" + qualified
+	}
+	dump := "fmt.Printf(\"%v\\n\", result)"
+	if buildsTree(grammar.rules) {
+		dump = fmt.Sprintf("%s.%sDumpTree(os.Stdout, result)", pkg, params.Prefix)
+	}
+	mode := ""
+	if hasModes(grammar.rules) {
+		mode = "t.Mode = p.LexMode()\n"
+	}
+	w.Linef(driverTemplate, pkg, spec, params.Prefix, qualified, dump, mode)
+	return nil
+}
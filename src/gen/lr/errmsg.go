@@ -0,0 +1,153 @@
+package lr
+
+// Custom messages for parse errors.
+//
+// The grammar's messages are attached to the parser states they apply
+// to, giving a table consulted when the parser meets a token it can't
+// accept, keyed by state and then by token, with "" for any token.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gen/codegen"
+)
+
+// parseErrorPoint parses a key of the lrErrors map, like
+//   stmt -> ID = . expr on ;
+// into the rule and position it names, and the token if any.
+func parseErrorPoint(grammar *Grammar, key string) (rule *Rule, pos int, tok string, err error) {
+	fields := strings.Fields(key)
+	if n := len(fields); n >= 2 && fields[n-2] == "on" {
+		tok = fields[n-1]
+		fields = fields[:n-2]
+	}
+	if len(fields) < 2 || fields[1] != "->" {
+		return nil, 0, "", fmt.Errorf("lrErrors: %q isn't a rule like x -> a . b", key)
+	}
+	pos = -1
+	var pattern []string
+	for _, sym := range fields[2:] {
+		if sym == "." || sym == middot {
+			pos = len(pattern)
+		} else {
+			pattern = append(pattern, sym)
+		}
+	}
+	if pos < 0 {
+		return nil, 0, "", fmt.Errorf("lrErrors: %q needs a . marking the point of the error", key)
+	}
+	for _, r := range grammar.rules {
+		if r.symbol == fields[0] && strings.Join(r.pattern, " ") == strings.Join(pattern, " ") {
+			return r, pos, tok, nil
+		}
+	}
+	return nil, 0, "", fmt.Errorf("lrErrors: %q matches no rule", key)
+}
+
+// errorMessages builds the table of messages for the parser's states,
+// from the lrErrors points, which take precedence, and the //gen:expect
+// messages of the nonterminals the states' kernel items expect.
+func errorMessages(grammar *Grammar, params *Params) (map[int]map[string]string, error) {
+	type point struct {
+		rule *Rule
+		pos  int
+	}
+	points := make(map[point]map[string]string)
+	var keys []string
+	for key := range params.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		rule, pos, tok, err := parseErrorPoint(grammar, key)
+		if err != nil {
+			return nil, err
+		}
+		p := point{rule, pos}
+		if points[p] == nil {
+			points[p] = make(map[string]string)
+		}
+		points[p][tok] = params.Errors[key]
+	}
+	expects := make(map[string]string)
+	for _, rule := range grammar.rules {
+		if rule.expect != "" {
+			expects[rule.symbol] = rule.expect
+		}
+	}
+
+	msgs := make(map[int]map[string]string)
+	add := func(state int, tok, msg string) {
+		if msgs[state] == nil {
+			msgs[state] = make(map[string]string)
+		}
+		if _, ok := msgs[state][tok]; !ok {
+			msgs[state][tok] = msg
+		}
+	}
+	for state, set := range grammar.states {
+		items := set.Sorted(grammar)
+		for _, item := range items {
+			for tok, msg := range points[point{item.rule, item.pos}] {
+				add(state, tok, msg)
+			}
+		}
+		for _, item := range items {
+			// Only the kernel items say what the state is for; the
+			// others are just their expansions.
+			if item.pos == 0 && item.rule != grammar.rules[0] {
+				continue
+			}
+			if sym, end := item.NextSym(); !end && expects[sym] != "" {
+				add(state, "", "expected "+expects[sym])
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// writeErrorMessages writes the table of error messages.
+func writeErrorMessages(w *codegen.Writer, params *Params, msgs map[int]map[string]string) {
+	var states []int
+	for state := range msgs {
+		states = append(states, state)
+	}
+	sort.Ints(states)
+
+	w.Linef("// %sErrorMessages gives the grammar's messages for parse errors, by", params.Prefix)
+	w.Line(`// parser state and then token, with "" for any token.`)
+	w.Linef("var %sErrorMessages = map[int]map[string]string{", params.Prefix)
+	for _, state := range states {
+		var toks []string
+		for tok := range msgs[state] {
+			toks = append(toks, tok)
+		}
+		sort.Strings(toks)
+		w.Linef("%d: {", state)
+		for _, tok := range toks {
+			w.Linef("%q: %q,", tok, msgs[state][tok])
+		}
+		w.Line("},")
+	}
+	w.Line("}")
+}
+
+// writeDisplayNames writes the table of the terminals' names as shown
+// to users, for those that differ from the terminal.
+func writeDisplayNames(w *codegen.Writer, params *Params, display map[string]string) {
+	var terms []string
+	for term := range display {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	w.Linef("// %sDisplayNames gives the names of terminals as shown in error", params.Prefix)
+	w.Line("// messages, where they differ from the terminal.")
+	w.Linef("var %sDisplayNames = map[string]string{", params.Prefix)
+	for _, term := range terms {
+		w.Linef("%q: %q,", term, display[term])
+	}
+	w.Line("}")
+}
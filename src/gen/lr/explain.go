@@ -0,0 +1,107 @@
+package lr
+
+// Explanation of how a grammar parses an input, step by step.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// dump writes t as an indented tree, a node per line.
+func (t *tree) dump(buf *bytes.Buffer, indent string) {
+	if t.rule == nil {
+		fmt.Fprintf(buf, "%s%s\n", indent, t.term)
+		return
+	}
+	fmt.Fprintf(buf, "%s%s\n", indent, t.rule.symbol)
+	for _, kid := range t.kids {
+		kid.dump(buf, indent+"  ")
+	}
+}
+
+// Explain parses input with the table of the grammar in infile, built
+// in memory as for Repl, and returns the steps of the parse, showing
+// the stack of states and the rest of the input before each shift or
+// reduction, followed by the parse tree.  The input is lexed with the
+// grammar's lrTokens, or without one, read as terminals separated by
+// white space.  If the grammar rejects the input, the steps up to the
+// error are returned with the error.
+func Explain(infile string, opts *Options, input string) ([]byte, error) {
+	ip, err := newInterp(infile, opts, "")
+	if err != nil {
+		return nil, err
+	}
+	toks, err := ip.lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STACK\tINPUT\tACTION")
+	step := func(stack []int, rest []inputToken, action string) {
+		var states, texts []string
+		for _, state := range stack {
+			states = append(states, strconv.Itoa(state))
+		}
+		for _, tok := range rest {
+			texts = append(texts, tok.text)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.Join(states, " "), strings.Join(texts, " "), action)
+	}
+
+	stack := []int{0}
+	var trees []*tree
+	for i := 0; ; {
+		state := stack[len(stack)-1]
+		tok := toks[i]
+		switch a := ip.table[state][tok.id].(type) {
+		case Shift:
+			step(stack, toks[i:], fmt.Sprintf("shift %d", a.state))
+			stack = append(stack, a.state)
+			trees = append(trees, &tree{term: tok.text})
+			i++
+			continue
+		case Reduce:
+			n := len(a.rule.pattern)
+			t := &tree{rule: a.rule, kids: append([]*tree(nil), trees[len(trees)-n:]...)}
+			trees = append(trees[:len(trees)-n], t)
+			if a.rule == ip.g.rules[0] {
+				step(stack, toks[i:], "accept, reducing "+a.rule.Show("->", -1))
+				tw.Flush()
+				buf.WriteString("\n")
+				t.dump(buf, "")
+				return buf.Bytes(), nil
+			}
+			next, ok := ip.table[stack[len(stack)-n-1]][a.rule.symbol].(Shift)
+			if !ok {
+				return nil, fmt.Errorf("bad next state after reducing %s", a.rule.symbol)
+			}
+			step(stack, toks[i:], fmt.Sprintf("reduce %s, goto %d", a.rule.Show("->", -1), next.state))
+			stack = append(stack[:len(stack)-n], next.state)
+			continue
+		}
+		tw.Flush()
+		return buf.Bytes(), fmt.Errorf("unexpected %s in state %d; expected one of %s", tok.text, state, strings.Join(ip.expected(state), ", "))
+	}
+}
+
+// expected returns the terminals state has actions for, sorted.
+func (in *interp) expected(state int) []string {
+	var toks []string
+	for sym := range in.table[state] {
+		if in.g.nonterminals.Has(sym) || sym == "error" {
+			continue
+		}
+		if name, ok := in.g.display[sym]; ok {
+			sym = name
+		}
+		toks = append(toks, sym)
+	}
+	sort.Strings(toks)
+	return toks
+}
@@ -0,0 +1,155 @@
+package lr
+
+// Conversion of grammars to other notations.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"gen/codegen"
+)
+
+// isWord reports whether a terminal looks like a name, e.g. "id",
+// rather than literal text, e.g. "+".
+func isWord(sym string) bool {
+	for i, r := range sym {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return sym != ""
+}
+
+// symbolOrder returns the grammar's nonterminals in the order they're
+// first defined, and the rules for each.
+func (g *Grammar) symbolOrder() ([]string, map[string][]*Rule) {
+	var order []string
+	bySymbol := make(map[string][]*Rule)
+	for _, rule := range g.rules {
+		if bySymbol[rule.symbol] == nil {
+			order = append(order, rule.symbol)
+		}
+		bySymbol[rule.symbol] = append(bySymbol[rule.symbol], rule)
+	}
+	return order, bySymbol
+}
+
+// terminalOrder returns the grammar's terminals in the order they're
+// first used.
+func (g *Grammar) terminalOrder() []string {
+	var terms []string
+	seen := make(SymbolSet)
+	for _, rule := range g.rules {
+		for _, sym := range rule.pattern {
+			if g.terminals.Has(sym) && !seen.Has(sym) {
+				seen.Add(sym)
+				terms = append(terms, sym)
+			}
+		}
+	}
+	return terms
+}
+
+// writeAlternatives writes the rules for each nonterminal as
+//   name <def> alt1 <or> alt2 ... <end>
+// with each symbol in the patterns mapped through sym, and empty
+// patterns written as empty.
+func (g *Grammar) writeAlternatives(w *codegen.Writer, def, or, end, empty string, sym func(string) string) {
+	order, bySymbol := g.symbolOrder()
+	for _, name := range order {
+		for i, rule := range bySymbol[name] {
+			var syms []string
+			for _, s := range rule.pattern {
+				syms = append(syms, sym(s))
+			}
+			if len(syms) == 0 && empty != "" {
+				syms = append(syms, empty)
+			}
+			sep := or
+			if i == 0 {
+				sep = sym(name) + " " + def
+			}
+			w.Linef("%s %s", sep, strings.Join(syms, " "))
+		}
+		w.Line(end)
+		w.Line("")
+	}
+}
+
+func exportEBNF(w *codegen.Writer, g *Grammar) {
+	g.writeAlternatives(w, "=", "  |", "  .", "", func(s string) string {
+		if g.terminals.Has(s) {
+			return fmt.Sprintf("%q", s)
+		}
+		return s
+	})
+}
+
+func exportANTLR(w *codegen.Writer, g *Grammar, name string) {
+	w.Linef("grammar %s;", name)
+	w.Line("")
+	g.writeAlternatives(w, ":", "  |", "  ;", "", func(s string) string {
+		switch {
+		case !g.terminals.Has(s):
+			return s
+		case isWord(s):
+			// ANTLR token names are capitalized.
+			return strings.ToUpper(s)
+		default:
+			return "'" + strings.Replace(s, "'", "\\'", -1) + "'"
+		}
+	})
+}
+
+func exportYacc(w *codegen.Writer, g *Grammar) {
+	// Multi-character literals need declared names in yacc.
+	names := make(map[string]string)
+	for i, term := range g.terminalOrder() {
+		switch {
+		case isWord(term):
+			names[term] = strings.ToUpper(term)
+			w.Linef("%%token %s", names[term])
+		case len(term) == 1:
+			names[term] = fmt.Sprintf("'%s'", term)
+		default:
+			names[term] = fmt.Sprintf("T%d", i)
+			w.Linef("%%token %s %q", names[term], term)
+		}
+	}
+	w.Line("")
+	w.Line("%%")
+	w.Line("")
+	g.writeAlternatives(w, ":", "  |", "  ;", "%empty", func(s string) string {
+		if name, ok := names[s]; ok {
+			return name
+		}
+		return s
+	})
+}
+
+// Export converts the grammar in infile, or read from in if it's
+// non-nil, to another notation, one of "ebnf" (the default), "antlr",
+// or "yacc".  Only the syntax is converted; rule code is dropped.
+func Export(infile string, in io.Reader, format string) ([]byte, error) {
+	params, rules, err := parse(infile, &Options{Input: in})
+	if err != nil {
+		return nil, err
+	}
+	g := &Grammar{rules: rules}
+	g.CollectSymbols(nil)
+
+	w := &codegen.Writer{}
+	switch format {
+	case "ebnf", "":
+		exportEBNF(w, g)
+	case "antlr":
+		exportANTLR(w, g, params.Package)
+	case "yacc":
+		exportYacc(w, g)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	return w.Raw(), nil
+}
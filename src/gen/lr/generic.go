@@ -0,0 +1,69 @@
+package lr
+
+// runtimeImport is the import path of the package generic parsers
+// are built on.
+const runtimeImport = "gen/lr/runtime"
+
+// genericTemplate is the parse template used in generic mode, where
+// the parser itself lives in the runtime package and the generated
+// code only supplies the tables.
+const genericTemplate = `
+package {{.Package}}
+
+{{.Header}}
+
+import (
+	{{if .Trace}}"log"{{end}}
+	{{if .Concurrent}}"fmt"
+	"sync"{{end}}
+
+	lrrt "` + runtimeImport + `"
+)
+
+{{.Helpers}}
+
+// $Parser manages the parsing process.
+type $Parser = lrrt.Parser[{{.ResultType}}, {{.TokenType}}]
+
+{{if .Arena}}
+// $Arena allocates the nodes of trees built by rules without code.
+type $Arena = lrrt.Arena
+{{end}}
+
+{{if .Tree}}
+// $DumpTree writes a tree built by rules without code as an indented
+// s-expression.
+var $DumpTree = lrrt.DumpTree
+{{end}}
+
+{{if .Listener}}
+// $Span is the range of tokens matched by a rule.
+type $Span = lrrt.Span[{{.TokenType}}]
+
+// $Listener is notified around each reduction the parser makes.
+type $Listener = lrrt.Listener[{{.TokenType}}]
+{{end}}
+
+{{if .Context}}
+// $NewParser constructs a new $Parser, ready for input, whose rules
+// run with the given context.
+func $NewParser(ctx {{.Context}}) *$Parser {
+{{else}}
+// $NewParser constructs a new $Parser, ready for input.
+func $NewParser() *$Parser {
+{{end -}}
+	p := lrrt.NewParser[{{.ResultType}}, {{.TokenType}}]({{if .Context}}$NewRules(ctx){{else}}$Rules{{end}}, $Actions)
+	{{if .Trace}}p.Trace = log.Default(){{end}}
+	{{if .Recover}}p.Recover = true{{end}}
+	p.Defaults = $Defaults
+	{{- if .Predicates}}
+	p.Predicates, p.Fallbacks = {{if .Context}}$NewPredicates(ctx){{else}}$Predicates{{end}}, $Fallbacks
+	{{- end}}
+	{{if .Messages}}p.Messages = $ErrorMessages{{end}}
+	{{if .Display}}p.DisplayNames = $DisplayNames{{end}}
+	{{- if .LexModes}}
+	p.LexModes = $LexModes
+	{{- end}}
+	return p
+}
+`
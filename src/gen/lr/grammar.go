@@ -2,7 +2,12 @@ package lr
 
 import (
 	"fmt"
+	"go/token"
+	"os"
+	"sort"
 	"strings"
+
+	"gen/lex"
 )
 
 // Terminology:
@@ -18,6 +23,14 @@ type SymbolSet map[string]bool
 
 func (ss SymbolSet) Add(s string)      { ss[s] = true }
 func (ss SymbolSet) Has(s string) bool { return ss[s] }
+func (ss SymbolSet) Sorted() []string {
+	var syms []string
+	for s := range ss {
+		syms = append(syms, s)
+	}
+	sort.Strings(syms)
+	return syms
+}
 func (ss SymbolSet) Merge(other SymbolSet) bool {
 	l := len(ss)
 	for k := range other {
@@ -31,15 +44,13 @@ type SymbolMap map[string]SymbolSet
 
 func (sm SymbolMap) Dump(log Logger, label string) {
 	log.Println(label + ":")
-	for sym, set := range sm {
-		var setStr string
-		for s := range set {
-			if len(setStr) > 0 {
-				setStr += " "
-			}
-			setStr += s
-		}
-		log.Printf("  %s: %s\n", sym, setStr)
+	var syms []string
+	for sym := range sm {
+		syms = append(syms, sym)
+	}
+	sort.Strings(syms)
+	for _, sym := range syms {
+		log.Printf("  %s: %s\n", sym, strings.Join(sm[sym].Sorted(), " "))
 	}
 }
 
@@ -51,12 +62,41 @@ type Rule struct {
 	symbol  string
 	// The rule type; "*Expr" in the above.
 	typ     string
+	// The results of the rule's code as written in a function
+	// signature, and whether they include an error.  These are just
+	// "*Expr" and false in the above, but a rule function like
+	//   func exp() (e *Expr, err error)
+	// has "(e *Expr, err error)" and true.
+	results string
+	hasErr  bool
+	// For a rule written as a method, the receiver's name and type,
+	// as in "c" and "*Ctx" for
+	//   func (c *Ctx) exp() *Expr
+	recv     string
+	recvType string
 	// The pattern of symbols; ["num", "+", "num"] in the above.
 	pattern []string
 	// The pattern of variable names; ["A", "", "B"] in the above.
 	vars    []string
+	// The terminals of the pattern written as quoted literals.
+	literals []string
 	// The code to run on matching; "return A+B" in the above.
 	code    string
+	// Where the rule and its code were found in the input.
+	pos     token.Position
+	codePos token.Position
+	// The message for a parse error where the rule's symbol was
+	// expected, from a //gen:expect comment.
+	expect string
+	// The predicate from a when() call following the rule's syntax(),
+	// if any: an expression that must hold for the parser to reduce
+	// by the rule.
+	pred string
+	// The lexer mode of the rule's terminals, from a //gen:lexer
+	// comment, or "" for the default mode.
+	mode string
+	// Whether the rule is a pass-through rule marked //gen:inline.
+	inline bool
 }
 
 func (r *Rule) Show(arrow string, mark int) string {
@@ -68,6 +108,10 @@ func (r *Rule) Show(arrow string, mark int) string {
 		if i == mark {
 			str += middot + " "
 		}
+		if strings.ContainsAny(pat, "\n\r\t") {
+			// Keep the rule on one line.
+			pat = quoteLiteral(pat)
+		}
 		str += pat
 	}
 	if mark == len(r.pattern) {
@@ -79,9 +123,72 @@ func (r *Rule) Show(arrow string, mark int) string {
 // Grammar is a collection of rules.
 type Grammar struct {
 	rules        []*Rule
+	// numbered holds the rules in the order of their IDs in the
+	// generated parser, which is that of rules unless a rule ID file
+	// says otherwise.
+	numbered     []*Rule
 	symbols      SymbolSet
 	terminals    SymbolSet
 	nonterminals SymbolSet
+	// classes maps the names of token classes to their members.
+	classes      map[string][]string
+	// ambiguous maps terminals the lexer returns to the others they
+	// may stand for; see ambiguous.go.
+	ambiguous    map[string][]string
+	// display maps terminals to their names as shown to users, where
+	// the tokens file gives them one other than their value.
+	display      map[string]string
+	// conflicts are those found computing the actions.
+	conflicts    []conflict
+	// states holds the item sets of the parser states, numbered as
+	// in the action table.
+	states       []ItemSet
+	// nullable holds the nonterminals that can match nothing.
+	nullable     SymbolSet
+}
+
+// LoadTokens loads the tokens file at path, so that its token classes
+// can be used as terminals and its display names in error messages,
+// and checks that the rules' quoted literals are the values of its
+// tokens and their lexer modes those of its tokens.
+func (g *Grammar) LoadTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tokens, classes, err := lex.ReadTokens(f, path)
+	if err != nil {
+		return err
+	}
+	g.classes = make(map[string][]string)
+	for _, class := range classes {
+		g.classes[class.Name] = class.Members
+	}
+
+	values := make(SymbolSet)
+	g.display = make(map[string]string)
+	for _, tok := range tokens {
+		values.Add(tok.Value())
+		if tok.Display() != tok.Value() {
+			g.display[tok.Value()] = tok.Display()
+		}
+	}
+	// The terminals an ambiguous token stands for aren't tokens.
+	for _, alts := range g.ambiguous {
+		for _, alt := range alts {
+			values.Add(alt)
+		}
+	}
+	for _, rule := range g.rules {
+		for _, lit := range rule.literals {
+			if !values.Has(lit) {
+				return fmt.Errorf("%s: no token in %s has the value %q", rule.pos, path, lit)
+			}
+		}
+	}
+	return checkModes(g.rules, tokens, path)
 }
 
 // CollectSymbols walks all the rules to collect all symbols and label
@@ -103,19 +210,39 @@ func (g *Grammar) CollectSymbols(trace Logger) {
 		}
 	}
 
-	var terms []string
-	for term := range g.terminals {
-		terms = append(terms, term)
-	}
 	if trace != nil {
-		trace.Printf("terminals: %s\n", strings.Join(terms, " "))
+		trace.Printf("terminals: %s\n", strings.Join(g.terminals.Sorted(), " "))
 	}
 }
 
+// Nullable computes the set of nonterminals that can match nothing,
+// through rules with empty patterns.
+func (g *Grammar) Nullable() SymbolSet {
+	nullable := make(SymbolSet)
+	for changed := true; changed; {
+		changed = false
+		for _, rule := range g.rules {
+			if nullable.Has(rule.symbol) {
+				continue
+			}
+			all := true
+			for _, sym := range rule.pattern {
+				all = all && nullable.Has(sym)
+			}
+			if all {
+				nullable.Add(rule.symbol)
+				changed = true
+			}
+		}
+	}
+	return nullable
+}
+
 // First computes the "first" set: for each symbol, the first terminals
 // in all its expansions.
 func (g *Grammar) First(trace Logger) SymbolMap {
 	g.CollectSymbols(trace)
+	g.nullable = g.Nullable()
 
 	first := make(SymbolMap)
 
@@ -125,14 +252,20 @@ func (g *Grammar) First(trace Logger) SymbolMap {
 		first[sym].Add(sym)
 	}
 
-	// Fill with grammar's first outputs.
+	// Fill with grammar's first outputs, looking past the symbols
+	// that can match nothing.
 	for _, rule := range g.rules {
 		set := first[rule.symbol]
 		if set == nil {
 			set = make(SymbolSet)
 			first[rule.symbol] = set
 		}
-		set.Add(rule.pattern[0])
+		for _, sym := range rule.pattern {
+			set.Add(sym)
+			if !g.nullable.Has(sym) {
+				break
+			}
+		}
 	}
 
 	// Iterate until stable.
@@ -169,15 +302,20 @@ func (g *Grammar) Follow(first SymbolMap) SymbolMap {
 					set = make(SymbolSet)
 					follow[patSym] = set
 				}
-				if i+1 < len(rule.pattern) {
-					nextSym := rule.pattern[i+1]
-					// TODO: I originally wrote this and it worked -- why?
-					// It didn't even make use of first?
-					// set.Add(nextSym)
+				// Whatever can begin the rest of the pattern follows,
+				// as does what follows the rule if the rest can match
+				// nothing.
+				rest := true
+				for _, nextSym := range rule.pattern[i+1:] {
 					if set.Merge(first[nextSym]) {
 						changed = true
 					}
-				} else {
+					if !g.nullable.Has(nextSym) {
+						rest = false
+						break
+					}
+				}
+				if rest {
 					if set.Merge(follow[rule.symbol]) {
 						changed = true
 					}
@@ -187,3 +325,27 @@ func (g *Grammar) Follow(first SymbolMap) SymbolMap {
 	}
 	return follow
 }
+
+// CheckTypes warns about rules whose values won't have their declared
+// types at parse time, which would otherwise surface as failed type
+// assertions in the generated parser.  It logs the warnings to warn,
+// doing nothing if it's nil.
+func (g *Grammar) CheckTypes(warn Logger) {
+	if warn == nil {
+		return
+	}
+	first := make(map[string]*Rule)
+	for _, rule := range g.rules {
+		if f := first[rule.symbol]; f == nil {
+			first[rule.symbol] = rule
+		} else if f.typ != rule.typ {
+			warn.Printf("%s: %s has type %s here but %s at %s",
+				rule.pos, rule.symbol, rule.typ, f.typ, f.pos)
+		}
+
+		if rule.code == "" && len(rule.pattern) > 1 && rule.typ != "[]interface{}" {
+			warn.Printf("%s: rule without code produces []interface{}, not %s",
+				rule.pos, rule.typ)
+		}
+	}
+}
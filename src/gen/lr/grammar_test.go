@@ -0,0 +1,136 @@
+package lr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testGrammar builds a grammar from rules written like "E -> E + T",
+// the first being the start rule.  A rule with nothing after the
+// arrow matches nothing.
+func testGrammar(rules ...string) *Grammar {
+	g := &Grammar{}
+	for _, r := range rules {
+		words := strings.Fields(r)
+		g.rules = append(g.rules, &Rule{symbol: words[0], pattern: words[2:]})
+	}
+	return g
+}
+
+// dragon41 is the expression grammar (4.1) of Aho, Lam, Sethi and
+// Ullman's Compilers, augmented with a start rule.
+var dragon41 = []string{
+	"S -> E",
+	"E -> E + T",
+	"E -> T",
+	"T -> T * F",
+	"T -> F",
+	"F -> ( E )",
+	"F -> id",
+}
+
+// dragon428 is the same language without left recursion (4.28), whose
+// E' and T' match nothing.
+var dragon428 = []string{
+	"S -> E",
+	"E -> T E'",
+	"E' -> + T E'",
+	"E' ->",
+	"T -> F T'",
+	"T' -> * F T'",
+	"T' ->",
+	"F -> ( E )",
+	"F -> id",
+}
+
+// terminalSets returns the terminals of each set of sm, as sorted
+// space-separated strings.
+func terminalSets(g *Grammar, sm SymbolMap) map[string]string {
+	out := make(map[string]string)
+	for sym, set := range sm {
+		if !g.nonterminals.Has(sym) {
+			continue
+		}
+		var terms []string
+		for _, s := range set.Sorted() {
+			if g.terminals.Has(s) || s == "EOF" {
+				terms = append(terms, s)
+			}
+		}
+		out[sym] = strings.Join(terms, " ")
+	}
+	return out
+}
+
+func TestFirstFollow(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		nullable string
+		first    map[string]string
+		follow   map[string]string
+	}{
+		{
+			name:  "dragon 4.1",
+			rules: dragon41,
+			first: map[string]string{
+				"S": "( id", "E": "( id", "T": "( id", "F": "( id",
+			},
+			follow: map[string]string{
+				"S": "EOF",
+				"E": ") + EOF",
+				"T": ") * + EOF",
+				"F": ") * + EOF",
+			},
+		},
+		{
+			name:     "dragon 4.28",
+			rules:    dragon428,
+			nullable: "E' T'",
+			first: map[string]string{
+				"S": "( id", "E": "( id", "E'": "+",
+				"T": "( id", "T'": "*", "F": "( id",
+			},
+			follow: map[string]string{
+				"S":  "EOF",
+				"E":  ") EOF",
+				"E'": ") EOF",
+				"T":  ") + EOF",
+				"T'": ") + EOF",
+				"F":  ") * + EOF",
+			},
+		},
+		{
+			name: "nullable chain",
+			rules: []string{
+				"S -> A B c",
+				"A -> a",
+				"A ->",
+				"B -> A",
+			},
+			nullable: "A B",
+			first: map[string]string{
+				"S": "a c", "A": "a", "B": "a",
+			},
+			follow: map[string]string{
+				"S": "EOF",
+				"A": "a c",
+				"B": "c",
+			},
+		},
+	}
+	for _, test := range tests {
+		g := testGrammar(test.rules...)
+		first := g.First(nil)
+		if got := strings.Join(g.nullable.Sorted(), " "); got != test.nullable {
+			t.Errorf("%s: nullable = %q, want %q", test.name, got, test.nullable)
+		}
+		if got := terminalSets(g, first); !reflect.DeepEqual(got, test.first) {
+			t.Errorf("%s: first = %v, want %v", test.name, got, test.first)
+		}
+		if got := terminalSets(g, g.Follow(first)); !reflect.DeepEqual(got, test.follow) {
+			t.Errorf("%s: follow = %v, want %v", test.name, got, test.follow)
+		}
+	}
+}
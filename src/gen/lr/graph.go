@@ -1,14 +1,13 @@
 package lr
 
 import (
-	"os"
 	"strings"
-	
+
 	"gen/codegen"
 )
 
-// Graph prints a graphviz graph of a parser state machine.
-func Graph(grammar *Grammar, actions ActionTable) {
+// Graph returns a graphviz graph of a parser state machine.
+func Graph(grammar *Grammar, actions ActionTable) []byte {
 	ruleIds := make(map[*Rule]int)
 	for i, rule := range grammar.rules {
 		ruleIds[rule] = i
@@ -35,9 +34,5 @@ func Graph(grammar *Grammar, actions ActionTable) {
 		}
 	}
 	w.Line("}")
-	
-	_, err := os.Stdout.Write(w.Raw())
-	if err != nil {
-		panic(err)
-	}
+	return w.Raw()
 }
@@ -0,0 +1,89 @@
+package lr
+
+// Inlining of pass-through rules, which spares the parser a reduction
+// per node for chains of them, such as
+//   expr -> term, term -> factor, factor -> primary
+// in expression grammars.
+//
+// A rule A -> B marked //gen:inline only passes B's value through, so
+// the parser may as well take B as A without reducing.  Where a
+// transition on B leads to a state that does nothing but reduce by
+// the rule, it's redirected to the state that reducing would lead to,
+// the transition on A from the same state.  The state reducing is then
+// left unreached, and dropped by Minimize.  States where B may also be
+// followed by more of a longer rule, such as expr -> term where term
+// continues as term * factor, still reduce.
+//
+// As the reductions by inlined rules aren't made, a Listener isn't
+// told of them, and the value of B must already be of A's type.
+
+import "fmt"
+
+// inlineTarget returns the inline rule that row does nothing but
+// reduce by, if any.
+func inlineTarget(row map[string]Action) *Rule {
+	var rule *Rule
+	for _, action := range row {
+		reduce, ok := action.(Reduce)
+		if !ok || !reduce.rule.inline || reduce.otherwise != nil || rule != nil && reduce.rule != rule {
+			return nil
+		}
+		rule = reduce.rule
+	}
+	return rule
+}
+
+// inlineRules redirects the transitions of table into states that only
+// reduce by inline rules, returning the number redirected.  It's an
+// error for an inline rule to change the type of the value it passes
+// through, given that terminals' values are of type tokenType.
+func inlineRules(g *Grammar, table ActionTable, tokenType string) (int, error) {
+	types := make(map[string]string)
+	for _, rule := range g.rules {
+		types[rule.symbol] = rule.typ
+	}
+	for _, rule := range g.rules {
+		if !rule.inline {
+			continue
+		}
+		typ, ok := types[rule.pattern[0]]
+		if !ok {
+			typ = tokenType
+		}
+		if typ != rule.typ {
+			return 0, fmt.Errorf("%s: inline rule %s passes through a %s as a %s", rule.pos, rule.Show("->", -1), typ, rule.typ)
+		}
+	}
+
+	// Redirecting may leave a transition leading to another such
+	// state, so repeat until none does.  A cycle of inline rules
+	// would go on forever, so stop after as many rounds as there are
+	// states.
+	redirected := 0
+	for round := 0; round < len(table); round++ {
+		changed := false
+		for _, row := range table {
+			for sym, action := range row {
+				shift, ok := action.(Shift)
+				if !ok {
+					continue
+				}
+				rule := inlineTarget(table[shift.state])
+				if rule == nil || rule == g.rules[0] {
+					continue
+				}
+				next, ok := row[rule.symbol].(Shift)
+				if !ok || next.state == shift.state {
+					continue
+				}
+				row[sym] = next
+				redirected++
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return redirected, nil
+}
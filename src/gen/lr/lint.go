@@ -0,0 +1,193 @@
+package lr
+
+// Checks of a grammar for style and safety problems that don't stop
+// it from generating a parser.
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gen/lex"
+)
+
+// Lint checks the grammar in infile, or read from in if it's non-nil,
+// for rules that only forward to another rule, alternatives that
+// differ in one optional token, right recursion, tokens that are
+// declared but unused, and rule code that ignores its bound variables.
+// It returns a report of the problems found, and a non-nil error along
+// with it if there were any.
+func Lint(infile string, in io.Reader) ([]byte, error) {
+	params, rules, err := parse(infile, &Options{Input: in})
+	if err != nil {
+		return nil, err
+	}
+	g := &Grammar{rules: rules}
+	g.CollectSymbols(nil)
+
+	type problem struct {
+		pos token.Position
+		msg string
+	}
+	var problems []problem
+	warn := func(pos token.Position, format string, a ...interface{}) {
+		problems = append(problems, problem{pos, fmt.Sprintf(format, a...)})
+	}
+
+	rulesFor := make(map[string][]*Rule)
+	for _, rule := range rules {
+		rulesFor[rule.symbol] = append(rulesFor[rule.symbol], rule)
+	}
+	for _, rule := range rules {
+		lintForwarding(g, rule, rulesFor[rule.symbol], warn)
+		lintRightRecursion(rule, warn)
+	}
+	for _, rule := range rules {
+		for _, other := range rulesFor[rule.symbol] {
+			if i := optionalSymbol(other.pattern, rule.pattern); i >= 0 && g.terminals.Has(other.pattern[i]) {
+				warn(other.pos, "rules for %s differ only in whether %s is present; consider an optional %s?",
+					rule.symbol, other.pattern[i], other.pattern[i])
+			}
+		}
+	}
+	if err := lintVars(rules, warn); err != nil {
+		return nil, err
+	}
+	if params.Tokens != "" {
+		if err := lintTokens(g, filepath.Join(params.srcDir, params.Tokens), warn); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if len(problems) == 0 {
+		buf.WriteString("no issues found\n")
+		return buf.Bytes(), nil
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		a, b := problems[i].pos, problems[j].pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Line < b.Line
+	})
+	for _, p := range problems {
+		fmt.Fprintf(buf, "%s: %s\n", p.pos, p.msg)
+	}
+	return buf.Bytes(), fmt.Errorf("%s found", counted(len(problems), "problem"))
+}
+
+// lintForwarding warns about a nonterminal whose only rule matches
+// another nonterminal and returns its value unchanged, which could be
+// inlined.
+func lintForwarding(g *Grammar, rule *Rule, alts []*Rule, warn func(token.Position, string, ...interface{})) {
+	if rule == g.rules[0] || len(alts) != 1 || len(rule.pattern) != 1 || !g.nonterminals.Has(rule.pattern[0]) {
+		return
+	}
+	if rule.vars[0] != "" && strings.TrimSpace(rule.code) == "return "+rule.vars[0] {
+		warn(rule.pos, "%s only forwards %s; consider using %s in its place", rule.symbol, rule.pattern[0], rule.pattern[0])
+	}
+}
+
+// lintRightRecursion warns about a rule that ends with its own
+// symbol.  The parser can only reduce such rules once it has seen the
+// whole list, so its stack grows with the length of the input.
+func lintRightRecursion(rule *Rule, warn func(token.Position, string, ...interface{})) {
+	n := len(rule.pattern)
+	if n < 2 || rule.pattern[n-1] != rule.symbol {
+		return
+	}
+	warn(rule.pos, "%s is right recursive, so the parse stack grows with the length of the list; consider %s -> %s %s",
+		rule.symbol, rule.symbol, rule.symbol, strings.Join(rule.pattern[:n-1], " "))
+}
+
+// optionalSymbol returns the index of the symbol of long which, if
+// removed, leaves short, or -1 if there's no such symbol.
+func optionalSymbol(long, short []string) int {
+	if len(long) != len(short)+1 {
+		return -1
+	}
+	i := 0
+	for i < len(short) && long[i] == short[i] {
+		i++
+	}
+	for j := i; j < len(short); j++ {
+		if long[j+1] != short[j] {
+			return -1
+		}
+	}
+	return i
+}
+
+// lintVars warns about rule code that ignores some of the variables
+// its pattern binds, which also keeps the generated code from
+// compiling.  Alternatives sharing their code are checked once.
+func lintVars(rules []*Rule, warn func(token.Position, string, ...interface{})) error {
+	checked := make(map[token.Position]bool)
+	for _, rule := range rules {
+		if checked[rule.codePos] {
+			continue
+		}
+		checked[rule.codePos] = true
+
+		used := make(map[string]bool)
+		if rule.code != "" {
+			src := "package p\nfunc _() {\n" + rule.code + "\n}\n"
+			f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+			if err != nil {
+				return fmt.Errorf("%s: %s", rule.codePos, err)
+			}
+			ast.Inspect(f, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					used[id.Name] = true
+				}
+				return true
+			})
+		}
+		for i, v := range rule.vars {
+			if v != "" && !used[v] {
+				warn(rule.pos, "%s binds %s=%s but its code doesn't use %s", rule.symbol, v, rule.pattern[i], v)
+			}
+		}
+	}
+	return nil
+}
+
+// lintTokens warns about the tokens declared in the tokens file at
+// path that the grammar never uses, directly or through a class.
+func lintTokens(g *Grammar, path string, warn func(token.Position, string, ...interface{})) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tokens, classes, err := lex.ReadTokens(f, path)
+	if err != nil {
+		return err
+	}
+
+	used := make(SymbolSet)
+	for term := range g.terminals {
+		used.Add(term)
+	}
+	for _, class := range classes {
+		if g.terminals.Has(class.Name) {
+			for _, member := range class.Members {
+				used.Add(member)
+			}
+		}
+	}
+	for _, tok := range tokens {
+		if tok.Block() != lex.BlockSpecial && !used.Has(tok.Value()) {
+			warn(token.Position{Filename: path}, "token %s (%q) is never used by the grammar", tok.Name(), tok.Value())
+		}
+	}
+	return nil
+}
@@ -1,15 +1,7 @@
 package lr
 
-import (
-	"log"
-	"os"
-)
+import "gen/codegen"
 
-// Logger wraps the standard log package in an interface.
-type Logger interface {
-	Println(v ...interface{})
-	Printf(format string, v ...interface{})
-}
-
-// log is a global Logger that is used in all logging statements.
-var traceLog = log.New(os.Stderr, "", log.Lshortfile)
+// Logger is the interface of the loggers generation reports to, which
+// a *log.Logger satisfies.
+type Logger = codegen.Logger
@@ -0,0 +1,507 @@
+package lr
+
+// Metrics of a grammar, for the report: its size and shape, and the
+// classes of parser that can handle it, for deciding between the ll
+// and lr backends and for tracking the grammar's complexity over time.
+//
+// The classes are those of the grammar as written, before predicates,
+// precedence or the other ways conflicts are resolved:
+//   LL(1)   the ll backend can parse it without backtracking
+//   LR(0)   no state needs a lookahead to decide what to do
+//   SLR(1)  the lr backend's tables have no conflicts
+//   LALR(1) an LALR generator's tables would have none, so that a
+//           grammar that's LALR(1) but not SLR(1) has conflicts here
+//           only for want of the lookaheads of each state
+// The LALR(1) lookaheads are found on the same states as the SLR ones,
+// those of the LR(0) automaton, by going back over the transitions
+// into states as in dead.go.  Every transition into a state is on the
+// same symbol, so that going back from a state after the pattern of a
+// rule finds just the states the rule's nonterminal is taken from.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// automaton is the LR(0) automaton of a grammar, with every transition
+// between its states, including those dropped in resolving conflicts.
+type automaton struct {
+	g *Grammar
+	// trans holds the transitions out of each state, by symbol.
+	trans []map[string]int
+	// preds holds the states with transitions into each state.
+	preds [][]int
+	// complete holds the rules each state has a complete item of.
+	complete [][]*Rule
+}
+
+// newAutomaton returns the automaton of g's states, as computed by
+// ComputeActions.
+func newAutomaton(g *Grammar) *automaton {
+	ids := make(map[*Rule]int)
+	for i, rule := range g.rules {
+		ids[rule] = i
+	}
+	key := func(set ItemSet) string {
+		var items []string
+		for item := range set {
+			items = append(items, fmt.Sprintf("%d.%d", ids[item.rule], item.pos))
+		}
+		sort.Strings(items)
+		return strings.Join(items, " ")
+	}
+	states := make(map[string]int)
+	for state, set := range g.states {
+		states[key(set)] = state
+	}
+
+	a := &automaton{
+		g:        g,
+		trans:    make([]map[string]int, len(g.states)),
+		preds:    make([][]int, len(g.states)),
+		complete: make([][]*Rule, len(g.states)),
+	}
+	symbols := g.symbols.Sorted()
+	for state, set := range g.states {
+		a.trans[state] = make(map[string]int)
+		for _, sym := range symbols {
+			next, ok := states[key(set.Goto(g, sym))]
+			if !ok {
+				continue
+			}
+			a.trans[state][sym] = next
+			a.preds[next] = append(a.preds[next], state)
+		}
+		for _, item := range set.Sorted(g) {
+			if _, end := item.NextSym(); end {
+				a.complete[state] = append(a.complete[state], item.rule)
+			}
+		}
+	}
+	return a
+}
+
+// statesBack returns the states from which n transitions lead to
+// state, given the states with transitions into each state.
+func statesBack(preds [][]int, state, n int) []int {
+	states := map[int]bool{state: true}
+	for ; n > 0; n-- {
+		prev := make(map[int]bool)
+		for s := range states {
+			for _, p := range preds[s] {
+				prev[p] = true
+			}
+		}
+		states = prev
+	}
+	var list []int
+	for s := range states {
+		list = append(list, s)
+	}
+	sort.Ints(list)
+	return list
+}
+
+// lalrLookaheads returns the LALR(1) lookaheads of the complete items
+// of each state, by rule.  A state reduces by a rule on the terminals
+// that the states it leads to shift, or themselves reduce on.  The
+// start rule is reduced on EOF.
+func (a *automaton) lalrLookaheads() []map[*Rule]SymbolSet {
+	las := make([]map[*Rule]SymbolSet, len(a.complete))
+	for state, rules := range a.complete {
+		las[state] = make(map[*Rule]SymbolSet)
+		for _, rule := range rules {
+			las[state][rule] = make(SymbolSet)
+			if rule == a.g.rules[0] {
+				las[state][rule].Add("EOF")
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for state, rules := range a.complete {
+			for _, rule := range rules {
+				if rule == a.g.rules[0] {
+					continue
+				}
+				la := las[state][rule]
+				for _, p := range statesBack(a.preds, state, len(rule.pattern)) {
+					next, ok := a.trans[p][rule.symbol]
+					if !ok {
+						continue
+					}
+					for sym := range a.trans[next] {
+						if !a.g.nonterminals.Has(sym) && !la.Has(sym) {
+							la.Add(sym)
+							changed = true
+						}
+					}
+					for _, other := range las[next] {
+						if la.Merge(other) {
+							changed = true
+						}
+					}
+				}
+			}
+		}
+	}
+	return las
+}
+
+// conflicts returns the number of states and terminals with more than
+// one action, given the lookaheads on which each state reduces by a
+// rule.  The start rule's reduction is the accepting of EOF.
+func (a *automaton) conflicts(lookaheads func(state int, rule *Rule) SymbolSet) int {
+	n := 0
+	for state, rules := range a.complete {
+		actions := make(map[string]int)
+		for sym := range a.trans[state] {
+			if !a.g.nonterminals.Has(sym) {
+				actions[sym]++
+			}
+		}
+		for _, rule := range rules {
+			for sym := range lookaheads(state, rule) {
+				if !a.g.nonterminals.Has(sym) {
+					actions[sym]++
+				}
+			}
+		}
+		for _, count := range actions {
+			if count > 1 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// lr0 returns the number of states that need a lookahead: those that
+// reduce by a rule and also shift a terminal or reduce by another.
+func (a *automaton) lr0() int {
+	n := 0
+	for state, rules := range a.complete {
+		reduces := 0
+		for _, rule := range rules {
+			if rule != a.g.rules[0] {
+				reduces++
+			}
+		}
+		shifts := false
+		for sym := range a.trans[state] {
+			shifts = shifts || !a.g.nonterminals.Has(sym)
+		}
+		if reduces > 1 || reduces == 1 && (shifts || len(rules) > 1) {
+			n++
+		}
+	}
+	return n
+}
+
+// firstOf returns the terminals that can begin pattern, and whether
+// it can match nothing.
+func (g *Grammar) firstOf(first SymbolMap, pattern []string) (SymbolSet, bool) {
+	set := make(SymbolSet)
+	for _, sym := range pattern {
+		for s := range first[sym] {
+			if !g.nonterminals.Has(s) {
+				set.Add(s)
+			}
+		}
+		if !g.nullable.Has(sym) {
+			return set, false
+		}
+	}
+	return set, true
+}
+
+// common returns the symbols in both a and b, joined for messages.
+func common(a, b SymbolSet) string {
+	var syms []string
+	for _, sym := range a.Sorted() {
+		if b.Has(sym) {
+			syms = append(syms, sym)
+		}
+	}
+	return strings.Join(syms, " ")
+}
+
+// ll1 returns why g isn't LL(1), or "" if it is, given its left-
+// recursive nonterminals.  It is if it isn't left-recursive and each
+// of its nonterminals' alternatives can be chosen by the next token:
+// no two of them can begin with the same terminal, and if one can
+// match nothing, no other can begin with a terminal that can follow
+// the nonterminal.
+func (g *Grammar) ll1(first, follow SymbolMap, left []string) string {
+	if len(left) > 0 {
+		return fmt.Sprintf("%s is left-recursive", left[0])
+	}
+	alts := make(map[string][]*Rule)
+	var symbols []string
+	for _, rule := range g.rules {
+		if alts[rule.symbol] == nil {
+			symbols = append(symbols, rule.symbol)
+		}
+		alts[rule.symbol] = append(alts[rule.symbol], rule)
+	}
+	for _, sym := range symbols {
+		rules := alts[sym]
+		for i, r1 := range rules {
+			f1, null1 := g.firstOf(first, r1.pattern)
+			for _, r2 := range rules[i+1:] {
+				f2, null2 := g.firstOf(first, r2.pattern)
+				if c := common(f1, f2); c != "" {
+					return fmt.Sprintf("%s and %s both begin with %s", r1.Show("->", -1), r2.Show("->", -1), c)
+				}
+				if null1 && null2 {
+					return fmt.Sprintf("%s and %s both match nothing", r1.Show("->", -1), r2.Show("->", -1))
+				}
+				// Of the two, empty can match nothing, and other
+				// mustn't begin with what follows.
+				empty, other, f := r1, r2, f2
+				if null2 {
+					empty, other, f = r2, r1, f1
+				} else if !null1 {
+					continue
+				}
+				if c := common(f, follow[sym]); c != "" {
+					return fmt.Sprintf("%s matches nothing, and %s begins with %s, which can follow %s",
+						empty.Show("->", -1), other.Show("->", -1), c, sym)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// components returns the strongly connected components of the graph
+// of nonterminals with edges to each of those in edges, in the order
+// of nodes, each a list of nonterminals in that order.
+func components(nodes []string, edges map[string][]string) [][]string {
+	index := make(map[string]int)
+	low := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var comps [][]string
+	var visit func(v string)
+	visit = func(v string) {
+		index[v] = len(index)
+		low[v] = index[v]
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range edges[v] {
+			if _, ok := index[w]; !ok {
+				visit(w)
+				if low[w] < low[v] {
+					low[v] = low[w]
+				}
+			} else if onStack[w] && index[w] < low[v] {
+				low[v] = index[w]
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		var comp []string
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			comp = append(comp, w)
+			if w == v {
+				break
+			}
+		}
+		comps = append(comps, comp)
+	}
+	for _, v := range nodes {
+		if _, ok := index[v]; !ok {
+			visit(v)
+		}
+	}
+
+	order := make(map[string]int)
+	for i, v := range nodes {
+		order[v] = i
+	}
+	for _, comp := range comps {
+		sort.Slice(comp, func(i, j int) bool { return order[comp[i]] < order[comp[j]] })
+	}
+	sort.Slice(comps, func(i, j int) bool { return order[comps[i][0]] < order[comps[j][0]] })
+	return comps
+}
+
+// counted returns n with noun, made plural if n isn't 1.
+func counted(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// reaches reports whether there's a path of one or more edges from
+// one nonterminal to another.
+func reaches(edges map[string][]string, from, to string) bool {
+	seen := make(map[string]bool)
+	queue := []string{from}
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		for _, w := range edges[v] {
+			if w == to {
+				return true
+			}
+			if !seen[w] {
+				seen[w] = true
+				queue = append(queue, w)
+			}
+		}
+	}
+	return false
+}
+
+// metricsReport returns the part of the report on g, whose actions
+// have been computed, that measures it and classifies it.
+func metricsReport(g *Grammar) []byte {
+	first := g.First(nil)
+	follow := g.Follow(first)
+
+	// The nonterminals, in the order of their first rules, each with
+	// edges to those in its patterns, and left edges to those that can
+	// begin them.
+	var nonterminals []string
+	alts := make(map[string]int)
+	edges := make(map[string][]string)
+	left := make(map[string][]string)
+	longest := g.rules[0]
+	for _, rule := range g.rules {
+		if alts[rule.symbol] == 0 {
+			nonterminals = append(nonterminals, rule.symbol)
+		}
+		alts[rule.symbol]++
+		if len(rule.pattern) > len(longest.pattern) {
+			longest = rule
+		}
+		leading := true
+		for _, sym := range rule.pattern {
+			if g.nonterminals.Has(sym) {
+				edges[rule.symbol] = append(edges[rule.symbol], sym)
+				if leading {
+					left[rule.symbol] = append(left[rule.symbol], sym)
+				}
+			}
+			leading = leading && g.nullable.Has(sym)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "grammar:")
+	fmt.Fprintf(buf, "  %s, %s, %s, %s\n", counted(len(g.rules), "rule"),
+		counted(len(nonterminals), "nonterminal"), counted(len(g.terminals), "terminal"), counted(len(g.states), "state"))
+	fmt.Fprintf(buf, "  longest rule: %d symbols, %s\n", len(longest.pattern), longest.Show("->", -1))
+	most := nonterminals[0]
+	for _, sym := range nonterminals[1:] {
+		if alts[sym] > alts[most] {
+			most = sym
+		}
+	}
+	fmt.Fprintf(buf, "  alternatives: %.1f per nonterminal, at most %d, of %s\n",
+		float64(len(g.rules))/float64(len(nonterminals)), alts[most], most)
+
+	// The depth is that of the nesting of nonterminals, counting each
+	// recursive group as one, from the start symbol down.
+	comps := components(nonterminals, edges)
+	comp := make(map[string]int)
+	for i, c := range comps {
+		for _, sym := range c {
+			comp[sym] = i
+		}
+	}
+	depth := make(map[int]int)
+	var measure func(c int) int
+	measure = func(c int) int {
+		if d, ok := depth[c]; ok {
+			return d
+		}
+		d := 0
+		for _, sym := range comps[c] {
+			for _, next := range edges[sym] {
+				if comp[next] != c {
+					if n := measure(comp[next]); n > d {
+						d = n
+					}
+				}
+			}
+		}
+		depth[c] = d + 1
+		return d + 1
+	}
+	fmt.Fprintf(buf, "  depth: %d\n", measure(comp[g.rules[0].symbol]))
+
+	var leftRec []string
+	var cycles []string
+	for _, c := range comps {
+		recursive := len(c) > 1 || reaches(edges, c[0], c[0])
+		if !recursive {
+			continue
+		}
+		var leftIn []string
+		for _, sym := range c {
+			if reaches(left, sym, sym) {
+				leftIn = append(leftIn, sym)
+			}
+		}
+		leftRec = append(leftRec, leftIn...)
+		cycle := strings.Join(c, ", ")
+		if len(leftIn) > 0 {
+			cycle += " (left-recursive: " + strings.Join(leftIn, ", ") + ")"
+		}
+		cycles = append(cycles, cycle)
+	}
+	if len(cycles) == 0 {
+		fmt.Fprintln(buf, "  recursion: none")
+	} else {
+		fmt.Fprintln(buf, "  recursion:")
+		for _, cycle := range cycles {
+			fmt.Fprintf(buf, "    %s\n", cycle)
+		}
+	}
+
+	a := newAutomaton(g)
+	slr := a.conflicts(func(state int, rule *Rule) SymbolSet {
+		if rule == g.rules[0] {
+			return SymbolSet{"EOF": true}
+		}
+		return follow[rule.symbol]
+	})
+	las := a.lalrLookaheads()
+	lalr := a.conflicts(func(state int, rule *Rule) SymbolSet { return las[state][rule] })
+	class := func(name, why string) {
+		if why == "" {
+			fmt.Fprintf(buf, "  %s: yes\n", name)
+		} else {
+			fmt.Fprintf(buf, "  %s: no, as %s\n", name, why)
+		}
+	}
+	fmt.Fprintln(buf, "class:")
+	class("LL(1)", g.ll1(first, follow, leftRec))
+	lr0 := ""
+	if n := a.lr0(); n > 0 {
+		lr0 = fmt.Sprintf("%s need a lookahead", counted(n, "state"))
+	}
+	class("LR(0)", lr0)
+	conflicts := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return fmt.Sprintf("its tables have %s", counted(n, "conflict"))
+	}
+	class("SLR(1)", conflicts(slr))
+	class("LALR(1)", conflicts(lalr))
+	if slr > 0 && lalr == 0 {
+		fmt.Fprintln(buf, "  the grammar is LALR(1) but not SLR(1), so its conflicts here are for want of lookaheads")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,185 @@
+package lr
+
+// Shrinking of the parse table by dropping and merging states.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Minimize drops the states of table that can't be reached from the
+// start state, which conflict resolution can leave behind, and merges
+// states that behave identically: those with the same reductions,
+// error messages and lexer modes, whose shifts lead to states that are
+// themselves merged.  The start state remains state 0, and the others
+// keep their relative order.
+func Minimize(grammar *Grammar, table ActionTable, params *Params) (ActionTable, error) {
+	msgs, err := errorMessages(grammar, params)
+	if err != nil {
+		return nil, err
+	}
+	modes, err := stateModes(grammar)
+	if err != nil {
+		return nil, err
+	}
+	ruleIndex := make(map[*Rule]int)
+	for i, rule := range grammar.rules {
+		ruleIndex[rule] = i
+	}
+
+	// Find the reachable states, in order.
+	reached := make([]bool, len(table))
+	reached[0] = true
+	queue := []int{0}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for _, action := range table[state] {
+			remapShifts(action, func(next int) int {
+				if !reached[next] {
+					reached[next] = true
+					queue = append(queue, next)
+				}
+				return next
+			})
+		}
+	}
+	var live []int
+	for state, ok := range reached {
+		if ok {
+			live = append(live, state)
+		}
+	}
+
+	// Partition the states by what they do other than where they shift
+	// to, then refine the partition by the classes of the states they
+	// shift to until it stops changing.
+	class := make([]int, len(table))
+	classes := 0
+	partition := func(key func(state int) string) {
+		ids := make(map[string]int)
+		for _, state := range live {
+			k := key(state)
+			id, ok := ids[k]
+			if !ok {
+				id = len(ids)
+				ids[k] = id
+			}
+			class[state] = id
+		}
+		classes = len(ids)
+	}
+	partition(func(state int) string {
+		var parts []string
+		for sym, action := range table[state] {
+			switch a := action.(type) {
+			case Shift:
+				parts = append(parts, fmt.Sprintf("%q:s", sym))
+			case Reduce:
+				part := fmt.Sprintf("%q:r%d", sym, ruleIndex[a.rule])
+				switch o := a.otherwise.(type) {
+				case Shift:
+					part += "/s"
+				case Reduce:
+					part += fmt.Sprintf("/r%d", ruleIndex[o.rule])
+				}
+				parts = append(parts, part)
+			}
+		}
+		for tok, msg := range msgs[state] {
+			parts = append(parts, fmt.Sprintf("%q:m%q", tok, msg))
+		}
+		if mode, ok := modes[state]; ok {
+			parts = append(parts, fmt.Sprintf("mode:%q", mode))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, " ")
+	})
+	for {
+		prev := classes
+		prevClass := append([]int(nil), class...)
+		partition(func(state int) string {
+			parts := []string{fmt.Sprint(prevClass[state])}
+			for sym, action := range table[state] {
+				remapShifts(action, func(next int) int {
+					parts = append(parts, fmt.Sprintf("%q:%d", sym, prevClass[next]))
+					return next
+				})
+			}
+			sort.Strings(parts[1:])
+			return strings.Join(parts, " ")
+		})
+		if classes == prev {
+			break
+		}
+	}
+
+	// Number the merged states by their first member, and build their
+	// rows from it.
+	renumber := make([]int, len(table))
+	first := make(map[int]int)
+	var order []int
+	for _, state := range live {
+		n, ok := first[class[state]]
+		if !ok {
+			n = len(order)
+			first[class[state]] = n
+			order = append(order, state)
+		}
+		renumber[state] = n
+	}
+	out := make(ActionTable, len(order))
+	for to, from := range order {
+		row := make(map[string]Action)
+		for sym, action := range table[from] {
+			row[sym] = remapShifts(action, func(state int) int { return renumber[state] })
+		}
+		out[to] = row
+	}
+	if grammar.states != nil {
+		states := make([]ItemSet, len(order))
+		for to, from := range order {
+			states[to] = grammar.states[from]
+		}
+		grammar.states = states
+	}
+	return out, nil
+}
+
+// defaultReductions gives the states whose every terminal leads to the
+// same reduction a default action, stored under the empty terminal in
+// place of their terminal entries.  The parser then reduces without
+// looking at the token, leaving any error to be found in the state it
+// reaches.  States with error messages of their own keep their
+// entries, so that their messages are still used, as do the state
+// accepting the input and states where a predicate's failure leads
+// to another action.
+func defaultReductions(grammar *Grammar, table ActionTable, msgs map[int]map[string]string) {
+	for state, row := range table {
+		if msgs[state] != nil {
+			continue
+		}
+		var rule *Rule
+		for sym, action := range row {
+			if grammar.nonterminals.Has(sym) {
+				continue
+			}
+			reduce, ok := action.(Reduce)
+			if !ok || reduce.rule == grammar.rules[0] || reduce.otherwise != nil || rule != nil && reduce.rule != rule {
+				rule = nil
+				break
+			}
+			rule = reduce.rule
+		}
+		if rule == nil {
+			continue
+		}
+		for sym := range row {
+			if !grammar.nonterminals.Has(sym) {
+				delete(row, sym)
+			}
+		}
+		row[""] = Reduce{rule: rule}
+	}
+}
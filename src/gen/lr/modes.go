@@ -0,0 +1,194 @@
+package lr
+
+// Lexer modes, for languages with islands of one syntax in another,
+// such as templates: text with expressions embedded between {{ and }}.
+//
+// A rule function marked //gen:lexer NAME has the terminals of its
+// rules lexed in the NAME mode of the lrTokens file, as described in
+// the lex package's modes.go, and other rules have theirs lexed in the
+// default mode.  Each parser state is then in the mode of the rules
+// whose terminals it can shift, which must agree, and the parser's
+// LexMode method returns the mode of the state its next token will be
+// shifted in, for the lexer to read the token in, as in
+//   t.Mode = p.LexMode()
+//   t.Next()
+// with a Tokenizer, as the driver written by -driver does.
+//
+// A terminal closing an island is lexed in the mode of the rule it's
+// in, so it takes a rule of the island's mode of its own, as in
+//   //gen:lexer text
+//   func part() []interface{} { syntax(`text | {{ expr close`) }
+//   func close() []interface{} { syntax(`}}`) }
+// where the text mode holds the tokens text and {{, and the default
+// mode }} and the tokens of expressions.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"gen/codegen"
+	"gen/lex"
+)
+
+// hasModes reports whether any of rules has a lexer mode.
+func hasModes(rules []*Rule) bool {
+	for _, rule := range rules {
+		if rule.mode != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// modeName returns mode as shown in messages.
+func modeName(mode string) string {
+	if mode == "" {
+		return "the default mode"
+	}
+	return "the " + mode + " mode"
+}
+
+// checkModes checks that the lexer modes of rules are modes of tokens,
+// read from the tokens file at path, and that their terminals are
+// tokens of their modes.  Keywords and specials, which the lexer finds
+// in any mode, are left alone.
+func checkModes(rules []*Rule, tokens []*lex.Token, path string) error {
+	if !hasModes(rules) {
+		return nil
+	}
+	modes := map[string]bool{"": true}
+	tokenMode := make(map[string]string)
+	for _, tok := range tokens {
+		modes[tok.Mode()] = true
+		if tok.Block() != lex.BlockKeyword && tok.Block() != lex.BlockSpecial {
+			tokenMode[tok.Value()] = tok.Mode()
+		}
+	}
+	for _, rule := range rules {
+		if !modes[rule.mode] {
+			return fmt.Errorf("%s: %s has no lexer mode %s", rule.pos, path, rule.mode)
+		}
+		for _, sym := range rule.pattern {
+			if mode, ok := tokenMode[sym]; ok && mode != rule.mode {
+				return fmt.Errorf("%s: %s is a token of %s, but the rule's terminals are lexed in %s",
+					rule.pos, sym, modeName(mode), modeName(rule.mode))
+			}
+		}
+	}
+	return nil
+}
+
+// stateModes returns the lexer mode of each state that can shift a
+// terminal, that of the rules of its items that shift one, or nil if
+// no rule has a mode.  A state whose items shift the terminals of two
+// modes is an error, as the lexer couldn't know which to read.
+func stateModes(g *Grammar) (map[int]string, error) {
+	if !hasModes(g.rules) {
+		return nil, nil
+	}
+	modes := make(map[int]string)
+	for state, set := range g.states {
+		var shifter *Rule
+		for _, item := range set.Sorted(g) {
+			sym, end := item.NextSym()
+			if end || g.nonterminals.Has(sym) || sym == "error" {
+				continue
+			}
+			if shifter == nil {
+				shifter = item.rule
+				modes[state] = item.rule.mode
+				continue
+			}
+			if item.rule.mode != shifter.mode {
+				buf := &bytes.Buffer{}
+				set.Dump(g, log.New(buf, "", 0))
+				return nil, fmt.Errorf("state %d shifts terminals of both %s, for %s, and %s, for %s:\n%s",
+					state, modeName(shifter.mode), shifter.symbol, modeName(item.rule.mode), item.rule.symbol,
+					strings.TrimSuffix(buf.String(), "\n"))
+			}
+		}
+	}
+	return modes, nil
+}
+
+// lexModes returns the lexer modes of the states of table, after its
+// default reductions, by which the parser finds the mode of its next
+// token.  The states that shift terminals have the modes stateModes
+// gives them.  The parser follows the default reduction of a state
+// that has one to the state it leads to, so such states are left out,
+// and any others, which only reduce by the next token, take the mode
+// of the rules they reduce by, if they agree, and otherwise are left
+// out, to be read in the default mode.
+func lexModes(g *Grammar, table ActionTable) (map[int]string, error) {
+	modes, err := stateModes(g)
+	if modes == nil || err != nil {
+		return nil, err
+	}
+	for state, row := range table {
+		if _, ok := modes[state]; ok {
+			continue
+		}
+		if _, ok := row[""]; ok {
+			continue
+		}
+		reducing := make(map[string]bool)
+		for _, action := range row {
+			if reduce, ok := action.(Reduce); ok {
+				reducing[reduce.rule.mode] = true
+			}
+		}
+		if len(reducing) == 1 {
+			for mode := range reducing {
+				modes[state] = mode
+			}
+		}
+	}
+	return modes, nil
+}
+
+// writeLexModes writes the table of the states' lexer modes, and for
+// parsers other than generic ones, the LexMode method reading it.
+func writeLexModes(w *codegen.Writer, params *Params, modes map[int]string) {
+	var states []int
+	for state := range modes {
+		states = append(states, state)
+	}
+	sort.Ints(states)
+
+	w.Linef("// %sLexModes gives the lexer mode of the next token in each parser", params.Prefix)
+	w.Line(`// state that decides it, with "" for the default mode.`)
+	w.Linef("var %sLexModes = map[int]string{", params.Prefix)
+	for _, state := range states {
+		w.Linef("%d: %q,", state, modes[state])
+	}
+	w.Line("}")
+	if params.Generic {
+		return
+	}
+
+	w.Line("")
+	w.Line(`// LexMode returns the lexer mode the parser expects its next token
+// in, "" being the default mode, for the lexer to read the token in.`)
+	w.Linef("func (p *%sParser) LexMode() string {", params.Prefix)
+	w.Linef(`// The mode is that of the state the default reductions, which
+	// don't depend on the token, lead to.
+	stack := p.stack
+	for {
+		state := stack[len(stack)-1]
+		if mode, ok := %sLexModes[state]; ok {
+			return mode
+		}
+		action := p.defaults[state]
+		if action == 0 {
+			return ""
+		}
+		rule := p.rules[-action]
+		n := len(stack) - len(rule.pattern)
+		next := int(p.actions[stack[n-1]][rule.symbol])
+		stack = append(append([]int(nil), stack[:n]...), next)
+	}
+}`, params.Prefix)
+}
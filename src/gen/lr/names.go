@@ -0,0 +1,268 @@
+package lr
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// generatedComment marks files written by older versions of the
+// generator; newer ones carry the standard "Code generated" header.
+const generatedComment = "this file generated, do not edit"
+
+// dataVar is the name of the reduce functions' parameter holding the
+// values matched by the rule's pattern.
+const dataVar = "lrData"
+
+// contextVar is the name of the parameter holding the context value
+// for rules written as methods.
+const contextVar = "lrContext"
+
+// declaredNames counts the declarations of each top-level identifier
+// of the Go source src, other than methods, init and _.
+func declaredNames(src []byte) (map[string]int, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]int)
+	add := func(id *ast.Ident) {
+		if id.Name != "_" && id.Name != "init" {
+			names[id.Name]++
+		}
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				add(d.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					add(spec.Name)
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						add(name)
+					}
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// punctNames spell out common punctuation terminals in identifiers.
+var punctNames = map[string]string{
+	"+": "Plus", "-": "Minus", "*": "Star", "/": "Slash", "%": "Percent",
+	"=": "Assign", "==": "Eq", "!=": "Ne", "<": "Lt", "<=": "Le",
+	">": "Gt", ">=": "Ge", "!": "Not", "&": "And", "|": "Or",
+	"&&": "AndAnd", "||": "OrOr", "^": "Caret", "~": "Tilde",
+	"(": "LParen", ")": "RParen", "[": "LBrack", "]": "RBrack",
+	"{": "LBrace", "}": "RBrace", ",": "Comma", ";": "Semi",
+	":": "Colon", ".": "Dot", "?": "Question", "@": "At", "#": "Hash",
+}
+
+// identWord converts a grammar symbol into a capitalized word usable
+// in an identifier, or "" if it has no reasonable spelling.
+func identWord(sym string) string {
+	if name, ok := punctNames[sym]; ok {
+		return name
+	}
+	var word []rune
+	upper := true
+	for _, r := range sym {
+		switch {
+		case r == '_':
+			upper = true
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if upper {
+				r = unicode.ToUpper(r)
+				upper = false
+			}
+			word = append(word, r)
+		default:
+			return ""
+		}
+	}
+	return string(word)
+}
+
+// reduceFuncName returns the name of the function holding the code of
+// the rule whose ID constant is named constName, in generic mode.
+func reduceFuncName(params *Params, constName string) string {
+	return params.Prefix + "Reduce" + strings.TrimPrefix(constName, "Rule")
+}
+
+// ruleConstNames returns names for the IDs of rules, as used for the
+// generated constants.  A rule is named after its symbol, followed by
+// the words of its pattern if the symbol has several rules, as in
+// RuleExprExprPlusTerm.  Names that would still clash get the rule's
+// index appended.
+func ruleConstNames(rules []*Rule) []string {
+	count := make(map[string]int)
+	for _, rule := range rules {
+		count[rule.symbol]++
+	}
+	names := make([]string, len(rules))
+	used := make(map[string]int)
+	for i, rule := range rules {
+		name := "Rule" + identWord(rule.symbol)
+		if count[rule.symbol] > 1 {
+			for j, pat := range rule.pattern {
+				word := identWord(pat)
+				if word == "" {
+					word = fmt.Sprintf("Sym%d", j)
+				}
+				name += word
+			}
+		}
+		names[i] = name
+		used[name]++
+	}
+	for i, name := range names {
+		if used[name] > 1 {
+			names[i] = fmt.Sprintf("%s%d", name, i)
+		}
+	}
+	return names
+}
+
+// isGenerated reports whether f carries the generated file marker.
+func isGenerated(f *ast.File) bool {
+	if ast.IsGenerated(f) {
+		return true
+	}
+	for _, cg := range f.Comments {
+		if strings.Contains(cg.Text(), generatedComment) {
+			return true
+		}
+	}
+	return false
+}
+
+// generatedFrom returns the base name of the input gen generated the
+// file f from, or "" if it wasn't generated by gen.
+func generatedFrom(f *ast.File) string {
+	const prefix = "Code generated by gen "
+	for _, cg := range f.Comments {
+		if cg.Pos() > f.Package {
+			break
+		}
+		text := cg.Text()
+		if !strings.HasPrefix(text, prefix) {
+			continue
+		}
+		i := strings.Index(text, " from ")
+		j := strings.Index(text, ". DO NOT EDIT.")
+		if i >= 0 && j > i {
+			return text[i+len(" from ") : j]
+		}
+	}
+	return ""
+}
+
+// checkCollisions returns an error if src, the generated code, declares
+// an identifier that's also declared by one of the Go files in dir,
+// which make up the package the code lands in, other than the
+// grammar's and generated ones, or by a helper copied from the grammar.
+func checkCollisions(dir string, params *Params, src []byte) error {
+	generated, err := declaredNames(src)
+	if err != nil {
+		return fmt.Errorf("parsing generated code: %s", err)
+	}
+	// The helpers' declarations are in src too, so a helper collides
+	// if its name is declared twice.
+	for _, kept := range params.kept {
+		if generated[kept.name] > 1 {
+			return fmt.Errorf("%s: %s collides with generated identifier; set lrPrefix or rename it to avoid it",
+				kept.pos, kept.name)
+		}
+		delete(generated, kept.name)
+	}
+
+	filter := func(fi os.FileInfo) bool {
+		name := fi.Name()
+		if isGrammarFile(filepath.Join(dir, name), params) {
+			return false
+		}
+		return !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".")
+	}
+
+	// Files that fail to parse are skipped; they'll fail the build
+	// regardless of what we generate.
+	fset := token.NewFileSet()
+	pkgs, _ := parser.ParseDir(fset, dir, filter, parser.ParseComments)
+	pkg := pkgs[params.Package]
+	if pkg == nil {
+		return nil
+	}
+
+	var files []string
+	for name := range pkg.Files {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		f := pkg.Files[name]
+		if isGenerated(f) {
+			continue
+		}
+		var collisions []*ast.Object
+		for name, obj := range f.Scope.Objects {
+			if generated[name] > 0 {
+				collisions = append(collisions, obj)
+			}
+		}
+		if len(collisions) == 0 {
+			continue
+		}
+		sort.Slice(collisions, func(i, j int) bool { return collisions[i].Pos() < collisions[j].Pos() })
+		obj := collisions[0]
+		return fmt.Errorf("%s: %s collides with generated identifier; set lrPrefix to avoid it",
+			fset.Position(obj.Pos()), obj.Name)
+	}
+	return nil
+}
+
+// isGrammarFile reports whether path is one of the grammar's files.
+func isGrammarFile(path string, params *Params) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, f := range params.srcFiles {
+		if f == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVars verifies that the variables bound by each rule's pattern
+// are distinct and don't clash with names used by the generated code.
+func checkVars(rules []*Rule) error {
+	for _, rule := range rules {
+		seen := make(map[string]bool)
+		for _, v := range rule.vars {
+			if v == "" {
+				continue
+			}
+			if v == dataVar || v == contextVar {
+				return fmt.Errorf("%s: variable name %s is reserved for generated code", rule.pos, v)
+			}
+			if seen[v] {
+				return fmt.Errorf("%s: variable %s bound more than once", rule.pos, v)
+			}
+			seen[v] = true
+		}
+	}
+	return nil
+}
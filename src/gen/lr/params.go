@@ -0,0 +1,257 @@
+package lr
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Params controls parameters to the generation process.
+type Params struct {
+	// Prefix is inserted as a prefix on all types; useful to prevent
+	// inter-file conflicts.  It defaults to the grammar file's name.
+	Prefix string
+	// Package is the package name for the output.
+	Package string
+	// Header is extra code inserted after the import declaration.
+	Header string
+	// Helpers is code copied verbatim from the grammar file, inserted
+	// after the output's imports.
+	Helpers string
+	// TokenType is the name of the type of tokens passed to the
+	// generation function.
+	TokenType string
+	// TokenId is the selector giving the terminal symbol of a token:
+	// a method call like ParseId(), the default, or a field like Kind.
+	// TokenIdType is the type it returns, "string" or "int"; an int is
+	// an index into TokenNames, the name of a []string of terminal
+	// symbols, which defaults to the lexer's TokNames.
+	TokenId     string
+	TokenIdType string
+	TokenNames  string
+	// Tokens is the path, relative to the grammar's package directory,
+	// of a tokens file whose token classes may be used as terminals.
+	Tokens string
+	// Trace specifies whether to log the parse as it happens.
+	Trace bool
+	// Generic specifies whether to generate a parser built on the
+	// generic runtime package, rather than a standalone one.
+	Generic bool
+	// Recover specifies whether the parser should recover from panics
+	// in rule code, returning them as errors.  The errors give the
+	// lookahead token's Pos if its type has one, and the token itself
+	// otherwise.
+	Recover bool
+	// TypeCheck specifies whether to type check the generated code
+	// against the rest of the output package before writing it.
+	TypeCheck bool
+	// Context is the receiver type of rules written as methods, if
+	// any.
+	Context string
+	// Listener specifies whether to generate a Listener interface,
+	// notified around each reduction.
+	Listener bool
+	// Arena specifies whether the parser may allocate the trees built
+	// by rules without code from an Arena, which its Release frees.
+	Arena bool
+	// Concurrent specifies whether to generate ParseConcurrent, which
+	// parses the top-level items of the input in parallel.
+	Concurrent bool
+	// Strict specifies whether problems in the grammar file that are
+	// normally warnings should be errors.
+	Strict bool
+	// Introspect specifies whether to generate lists of the grammar's
+	// symbols and the size of its action table, so that programs can
+	// describe their own grammar.
+	Introspect bool
+	// Excerpt specifies whether syntax errors should quote the line
+	// of the input they're on, given by the parser's SetInput.  It
+	// needs tokens whose Pos is their byte offset in the input.
+	Excerpt bool
+	// Errors maps points in the grammar, written as rules with a "."
+	// marking the point and optionally followed by "on" and a token,
+	// to the messages for parse errors there.
+	Errors map[string]string
+	// Ambiguous maps terminals the lexer returns to the other
+	// terminals, separated by spaces, that each may stand for, which
+	// the parser tells apart by its state; see ambiguous.go.
+	Ambiguous map[string]string
+
+	// srcPackage is the package name declared by the grammar file.
+	srcPackage string
+	// srcDir is the directory of the package the grammar belongs to,
+	// and srcFiles the absolute paths of the files it was read from.
+	srcDir   string
+	srcFiles []string
+	// kept holds the declarations copied into Helpers.
+	kept []keptDecl
+}
+
+// keptDecl is a declaration copied from the grammar into the output.
+type keptDecl struct {
+	name string
+	pos  token.Position
+}
+
+// defaultPrefix derives a type prefix from the name of the grammar
+// file, so that e.g. "expr.go" produces types like "exprParser".
+func defaultPrefix(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	var prefix []rune
+	for _, r := range name {
+		if unicode.IsLetter(r) || (len(prefix) > 0 && (unicode.IsDigit(r) || r == '_')) {
+			prefix = append(prefix, r)
+		}
+	}
+	if len(prefix) > 0 {
+		prefix[0] = unicode.ToLower(prefix[0])
+	}
+	return string(prefix)
+}
+
+// paramConsts maps the names of the constants a grammar may declare
+// to the Params fields they set.
+var paramConsts = map[string]func(p *Params) interface{}{
+	"lrPrefix":      func(p *Params) interface{} { return &p.Prefix },
+	"lrTokenType":   func(p *Params) interface{} { return &p.TokenType },
+	"lrTokenId":     func(p *Params) interface{} { return &p.TokenId },
+	"lrTokenIdType": func(p *Params) interface{} { return &p.TokenIdType },
+	"lrTokenNames":  func(p *Params) interface{} { return &p.TokenNames },
+	"lrTokens":      func(p *Params) interface{} { return &p.Tokens },
+	"lrTrace":       func(p *Params) interface{} { return &p.Trace },
+	"lrGeneric":     func(p *Params) interface{} { return &p.Generic },
+	"lrRecover":     func(p *Params) interface{} { return &p.Recover },
+	"lrTypeCheck":   func(p *Params) interface{} { return &p.TypeCheck },
+	"lrListener":    func(p *Params) interface{} { return &p.Listener },
+	"lrArena":       func(p *Params) interface{} { return &p.Arena },
+	"lrConcurrent":  func(p *Params) interface{} { return &p.Concurrent },
+	"lrStrict":      func(p *Params) interface{} { return &p.Strict },
+	"lrIntrospect":  func(p *Params) interface{} { return &p.Introspect },
+	"lrExcerpt":     func(p *Params) interface{} { return &p.Excerpt },
+	"lrErrors":      func(p *Params) interface{} { return &p.Errors },
+	"lrAmbiguous":   func(p *Params) interface{} { return &p.Ambiguous },
+}
+
+// FromConsts sets the parameters given by a const or var declaration
+// of a grammar file, such as
+//
+//	const lrPrefix = "expr"
+//
+// It returns warnings, prefixed with their positions, about the
+// parts of the declaration it couldn't use.
+func (p *Params) FromConsts(fset *token.FileSet, d *ast.GenDecl) []string {
+	diag := &diagnostics{fset: fset}
+	p.fromConsts(d, diag)
+	var warnings []string
+	for _, w := range diag.warnings {
+		warnings = append(warnings, w.message)
+	}
+	return warnings
+}
+
+func (p *Params) fromConsts(d *ast.GenDecl, diag *diagnostics) {
+	for _, spec := range d.Specs {
+		vs, ok := spec.(*ast.ValueSpec)
+		if !ok {
+			diag.warn(spec.Pos(), "unused spec")
+			continue
+		}
+		for i, name := range vs.Names {
+			field, ok := paramConsts[name.Name]
+			if !ok || i >= len(vs.Values) {
+				diag.warn(name.Pos(), "unknown parameter")
+				continue
+			}
+			switch f := field(p).(type) {
+			case *string:
+				if str, ok := literalString(vs.Values[i], diag); ok {
+					*f = str
+				}
+			case *bool:
+				if b, ok := literalBool(vs.Values[i], diag); ok {
+					*f = b
+				}
+			case *map[string]string:
+				if m, ok := literalMap(vs.Values[i], diag); ok {
+					*f = m
+				}
+			}
+		}
+	}
+}
+
+// SetDefaults fills in the parameters left unset, for a grammar read
+// from path.  It's called before FromConsts, so that a grammar may
+// still set a parameter to its zero value, as with an empty lrPrefix.
+func (p *Params) SetDefaults(path string) {
+	if p.Prefix == "" {
+		p.Prefix = defaultPrefix(path)
+	}
+	if p.TokenType == "" {
+		p.TokenType = "Token"
+	}
+	if p.TokenId == "" {
+		p.TokenId = "ParseId()"
+	}
+	if p.TokenIdType == "" {
+		p.TokenIdType = "string"
+	}
+	if p.TokenNames == "" {
+		p.TokenNames = "TokNames"
+	}
+}
+
+// Validate checks that the parameters can be used to generate a
+// parser.
+func (p *Params) Validate() error {
+	if p.Prefix != "" && !isIdentPrefix(p.Prefix) {
+		return fmt.Errorf("prefix %q isn't a valid start of a Go identifier", p.Prefix)
+	}
+	if !token.IsIdentifier(p.Package) {
+		return fmt.Errorf("package name %q isn't a valid Go identifier", p.Package)
+	}
+	if _, err := parser.ParseExpr(p.TokenType); err != nil {
+		return fmt.Errorf("token type %q isn't a Go type", p.TokenType)
+	}
+	if _, err := parser.ParseExpr(p.TokenIdOf("tok")); err != nil {
+		return fmt.Errorf("token id %q isn't a Go selector", p.TokenId)
+	}
+	if p.TokenIdType != "string" && p.TokenIdType != "int" {
+		return fmt.Errorf("token id type %q isn't string or int", p.TokenIdType)
+	}
+	if p.Generic && p.TokenIdOf("tok") != "tok.ParseId()" {
+		return fmt.Errorf("generic parsers need tokens with a ParseId method")
+	}
+	if p.Generic && p.Excerpt {
+		return fmt.Errorf("generic parsers can't quote the input in errors")
+	}
+	if p.Concurrent && p.Context != "" {
+		return fmt.Errorf("concurrent parsing can't share the context of method rules")
+	}
+	return nil
+}
+
+// isIdentPrefix reports whether s may begin a Go identifier.
+func isIdentPrefix(s string) bool {
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// TokenIdOf returns the expression giving the terminal symbol of the
+// token tok, which may be a token or a pointer to one.
+func (p *Params) TokenIdOf(tok string) string {
+	id := tok + "." + p.TokenId
+	if p.TokenIdType == "int" {
+		return p.TokenNames + "[" + id + "]"
+	}
+	return id
+}
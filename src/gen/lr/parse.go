@@ -1,58 +1,96 @@
 package lr
 
 // Functions for parsing Go source code, decorated with syntax(...) calls,
-// into a set of grammar rules.
+// into a set of grammar rules.  The format of grammar files is described
+// in README.
 
 import (
 	"bytes"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+
+	"gen/codegen"
 )
 
-// Params controls parameters to the generation process.
-type Params struct {
-	// Prefix is inserted as a prefix on all types; useful to prevent
-	// inter-file conflicts.
-	Prefix string
-	// Package is the package name for the output.
-	Package string
-	// Header is extra code inserted after the import declaration.
-	Header string
-	// TokenType is the name of the type of tokens passed to the
-	// generation function.
-	TokenType string
-	// Trace specifies whether to log the parse as it happens.
-	Trace bool
+// diagnostics collects the warnings found while parsing a grammar
+// file, so that strict mode can turn them into errors once all the
+// parameters are known.
+type diagnostics struct {
+	fset     *token.FileSet
+	warnings []diagnostic
+}
+
+type diagnostic struct {
+	message string
+	// strictOnly is set for problems only reported in strict mode.
+	strictOnly bool
+}
+
+func (d *diagnostics) add(pos token.Pos, message string, strictOnly bool) {
+	d.warnings = append(d.warnings, diagnostic{
+		message:    fmt.Sprintf("%s: %s", d.fset.Position(pos), message),
+		strictOnly: strictOnly,
+	})
 }
 
-func warn(fset *token.FileSet, pos token.Pos, message string) {
-	fmt.Fprintf(os.Stderr, "%s: %s\n", fset.Position(pos), message)
+func (d *diagnostics) warn(pos token.Pos, message string) {
+	d.add(pos, message, false)
 }
 
-// parsePattern parses a pattern string, which looks like
-//   A=expr + B=expr
-// into a list of patterns ["expr", "+", "expr"] and
-// variable names ["A", "", "B"].
-func parsePattern(patternStr string) ([]string, []string) {
-	pattern := strings.Split(patternStr, " ")
-	vars := make([]string, len(pattern))
-	for i, pat := range pattern {
-		if len(pat) > 2 && pat[0] != '\'' && pat[1] == '=' {
-			vars[i] = pat[0:1]
-			pattern[i] = pat[2:]
+// flush reports the collected warnings, either to warn, if it's
+// non-nil, or if strict, as a single error.
+func (d *diagnostics) flush(strict bool, warn Logger) error {
+	var messages []string
+	for _, w := range d.warnings {
+		if strict || !w.strictOnly {
+			messages = append(messages, w.message)
 		}
 	}
-	return pattern, vars
+	if strict && len(messages) > 0 {
+		return fmt.Errorf("%s", strings.Join(messages, "\n"))
+	}
+	if warn != nil {
+		for _, m := range messages {
+			warn.Println(m)
+		}
+	}
+	return nil
+}
+
+// directive looks in a doc comment for a line like "//gen:name arg",
+// returning the arg.
+func directive(doc *ast.CommentGroup, name string) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	prefix := "//gen:" + name
+	for _, c := range doc.List {
+		if !strings.HasPrefix(c.Text, prefix) {
+			continue
+		}
+		arg := c.Text[len(prefix):]
+		if arg == "" || arg[0] == ' ' || arg[0] == '\t' {
+			return strings.TrimSpace(arg), true
+		}
+	}
+	return "", false
 }
 
 // isSyntaxCall analyzes an ast.Stmt and returns (true, "...") if the
-// statement is the special call to syntax("...").
-func isSyntaxCall(s ast.Stmt) (matched bool, pattern string) {
+// statement is the special call to syntax("..."), along with the
+// pattern's literal.  It returns an error if the statement calls
+// syntax with anything other than a single string literal.
+func isSyntaxCall(fset *token.FileSet, s ast.Stmt) (matched bool, pattern string, lit *ast.BasicLit, err error) {
 	es, ok := s.(*ast.ExprStmt)
 	if !ok {
 		return
@@ -67,11 +105,41 @@ func isSyntaxCall(s ast.Stmt) (matched bool, pattern string) {
 	}
 
 	if len(e.Args) != 1 {
+		err = fmt.Errorf("%s: syntax() takes a single pattern string", fset.Position(e.Pos()))
+		return
+	}
+	lit, ok = e.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		err = fmt.Errorf("%s: syntax() pattern must be a string literal", fset.Position(e.Args[0].Pos()))
 		return
 	}
-	arg := e.Args[0].(*ast.BasicLit).Value
+	pattern, err = strconv.Unquote(lit.Value)
+	if err != nil {
+		err = fmt.Errorf("%s: bad pattern string: %s", fset.Position(lit.Pos()), err)
+		return
+	}
+	return true, pattern, lit, nil
+}
 
-	return true, arg[1 : len(arg)-1]
+// isWhenCall reports whether s is a call when(cond), giving the
+// predicate of the rules of the syntax() call it follows, and returns
+// cond.
+func isWhenCall(fset *token.FileSet, s ast.Stmt) (cond ast.Expr, matched bool, err error) {
+	es, ok := s.(*ast.ExprStmt)
+	if !ok {
+		return
+	}
+	e, ok := es.X.(*ast.CallExpr)
+	if !ok {
+		return
+	}
+	if f, ok := e.Fun.(*ast.Ident); !ok || f.Name != "when" {
+		return
+	}
+	if len(e.Args) != 1 {
+		return nil, false, fmt.Errorf("%s: when() takes a single condition", fset.Position(e.Pos()))
+	}
+	return e.Args[0], true, nil
 }
 
 // astStr converts an ast node to its textual code representation.
@@ -84,121 +152,444 @@ func astStr(fset *token.FileSet, n interface{}) string {
 	return string(buf.Bytes())
 }
 
-func literalString(e ast.Expr, fset *token.FileSet) (string, bool) {
+func literalString(e ast.Expr, diag *diagnostics) (string, bool) {
 	lit, ok := e.(*ast.BasicLit)
 	if !ok {
-		warn(fset, e.Pos(), "expected literal value")
+		diag.warn(e.Pos(), "expected literal value")
 		return "", false
 	}
 	if lit.Kind != token.STRING {
-		warn(fset, e.Pos(), "expected string")
+		diag.warn(e.Pos(), "expected string")
 		return "", false
 	}
 	return lit.Value[1 : len(lit.Value)-1], true
 }
 
-func processDecl(d *ast.GenDecl, fset *token.FileSet, params *Params) {
+func literalBool(e ast.Expr, diag *diagnostics) (bool, bool) {
+	if ident, ok := e.(*ast.Ident); ok {
+		switch ident.Name {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	}
+	diag.warn(e.Pos(), "expected bool")
+	return false, false
+}
+
+// literalMap extracts a map[string]string composite literal.
+func literalMap(e ast.Expr, diag *diagnostics) (map[string]string, bool) {
+	lit, ok := e.(*ast.CompositeLit)
+	if !ok {
+		diag.warn(e.Pos(), "expected map literal")
+		return nil, false
+	}
+	m := make(map[string]string)
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			diag.warn(elt.Pos(), "expected key: value")
+			return nil, false
+		}
+		k, ok := literalString(kv.Key, diag)
+		if !ok {
+			return nil, false
+		}
+		v, ok := literalString(kv.Value, diag)
+		if !ok {
+			return nil, false
+		}
+		m[k] = v
+	}
+	return m, true
+}
+
+func processDecl(d *ast.GenDecl, diag *diagnostics, params *Params) {
 	if d.Tok == token.IMPORT {
-		params.Header += astStr(fset, d)
+		// Each import is added once, as the files of a grammar
+		// directory may share them.
+		for _, spec := range d.Specs {
+			imp := "import " + astStr(diag.fset, spec) + "\n"
+			if !strings.Contains(params.Header, imp) {
+				params.Header += imp
+			}
+		}
 		return
 	}
 
-	if d.Tok != token.CONST {
-		warn(fset, d.Pos(), "unused decl")
+	if d.Tok != token.CONST && d.Tok != token.VAR {
+		diag.warn(d.Pos(), "unused decl")
 		return
 	}
+	params.fromConsts(d, diag)
+}
 
-	for _, spec := range d.Specs {
-		vs, ok := spec.(*ast.ValueSpec)
-		if !ok {
-			warn(fset, spec.Pos(), "unused spec")
-			continue
-		}
-		for i := range vs.Names {
-			switch vs.Names[i].Name {
-			case "lrPrefix":
-				if str, ok := literalString(vs.Values[i], fset); ok {
-					params.Prefix = str
-				}
-			case "lrTokenType":
-				if str, ok := literalString(vs.Values[i], fset); ok {
-					params.TokenType = str
-				}
-			case "lrTrace":
-				if ident, ok := vs.Values[i].(*ast.Ident); ok {
-					switch ident.Name {
-					case "true":
-						params.Trace = true
-					case "false":
-						params.Trace = false
-					default:
-						warn(fset, vs.Values[i].Pos(), "expected bool")
-					}
-				} else {
-					warn(fset, vs.Names[i].Pos(), "expected bool")
-				}
-			default:
-				warn(fset, vs.Names[i].Pos(), "unknown parameter")
+// ruleResults examines the results of a rule function, which must be
+// either a single value or a value and an error.  It returns the type
+// of the value, the results as written in a function signature, and
+// whether there's an error result.
+func ruleResults(fn *ast.FuncDecl, fset *token.FileSet) (typ, sig string, hasErr bool, err error) {
+	var types []ast.Expr
+	if fn.Type.Results != nil {
+		for _, field := range fn.Type.Results.List {
+			n := len(field.Names)
+			if n == 0 {
+				n = 1
+			}
+			for i := 0; i < n; i++ {
+				types = append(types, field.Type)
 			}
 		}
 	}
+
+	switch len(types) {
+	case 2:
+		if id, isIdent := types[1].(*ast.Ident); !isIdent || id.Name != "error" {
+			err = fmt.Errorf("%s: second result of a rule must be an error", fset.Position(types[1].Pos()))
+			return
+		}
+		hasErr = true
+	case 1:
+	default:
+		err = fmt.Errorf("%s: rule must return a value and optionally an error", fset.Position(fn.Pos()))
+		return
+	}
+
+	typ = astStr(fset, types[0])
+	sig = strings.TrimPrefix(astStr(fset, &ast.FuncType{
+		Params:  &ast.FieldList{},
+		Results: fn.Type.Results,
+	}), "func() ")
+	return typ, sig, hasErr, nil
+}
+
+// sameVars reports whether two variable lists bind the same names.
+func sameVars(a, b []string) bool {
+	names := make(map[string]int)
+	for _, v := range a {
+		if v != "" {
+			names[v]++
+		}
+	}
+	for _, v := range b {
+		if v != "" {
+			names[v]--
+		}
+	}
+	for _, n := range names {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 // processFunction analyzes a single func ast, extracting rules (and code)
-// from it.
-func processFunction(fn *ast.FuncDecl, fset *token.FileSet, rules *[]*Rule) {
-	var rule *Rule
+// from it.  It reports whether the function contained any rules.
+func processFunction(fn *ast.FuncDecl, diag *diagnostics, rules *[]*Rule) (bool, error) {
+	fset := diag.fset
+	symbol := fn.Name.Name
+	if name, ok := directive(fn.Doc, "rule"); ok {
+		if !token.IsIdentifier(name) && !token.IsKeyword(name) {
+			return false, fmt.Errorf("%s: //gen:rule needs a nonterminal name", fset.Position(fn.Pos()))
+		}
+		symbol = name
+	}
+	expect, _ := directive(fn.Doc, "expect")
+	mode, _ := directive(fn.Doc, "lexer")
+	if mode != "" && !token.IsIdentifier(mode) {
+		return false, fmt.Errorf("%s: //gen:lexer needs a lexer mode name", fset.Position(fn.Pos()))
+	}
+	_, inline := directive(fn.Doc, "inline")
+	inlined := false
+	var typ, sig string
+	var hasErr bool
+	var recv, recvType string
+	if fn.Recv != nil && len(fn.Recv.List) > 0 {
+		field := fn.Recv.List[0]
+		recvType = astStr(fset, field.Type)
+		if len(field.Names) > 0 {
+			recv = field.Names[0].Name
+		}
+	}
+	// alts holds the rules for the alternatives of the current
+	// syntax() call, which all share its code.
+	var alts []*Rule
 	var code []ast.Stmt
+	finish := func() {
+		for _, rule := range alts {
+			rule.code = astStr(fset, code)
+			if len(code) > 0 {
+				rule.codePos = fset.Position(code[0].Pos())
+			}
+			if inline && len(rule.pattern) == 1 && len(code) == 0 && rule.pred == "" {
+				rule.inline = true
+				inlined = true
+			}
+			*rules = append(*rules, rule)
+		}
+	}
 	for _, stmt := range fn.Body.List {
-		if match, patternStr := isSyntaxCall(stmt); match {
-			if rule != nil {
-				rule.code = astStr(fset, code)
-				*rules = append(*rules, rule)
+		match, patternStr, lit, err := isSyntaxCall(fset, stmt)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			if alts != nil {
+				finish()
+			} else {
+				if typ, sig, hasErr, err = ruleResults(fn, fset); err != nil {
+					return false, err
+				}
 			}
 
-			pattern, vars := parsePattern(patternStr)
-			rule = &Rule{
-				symbol:  fn.Name.Name,
-				typ:     astStr(fset, fn.Type.Results.List[0].Type),
-				pattern: pattern,
-				vars:    vars,
+			patterns, err := parsePattern(patternStr)
+			if err != nil {
+				return false, fmt.Errorf("%s: %s", patternPos(fset, lit, err.(*patternError).offset), err)
+			}
+			alts = nil
+			for _, alt := range patterns {
+				if len(alts) > 0 && !sameVars(alts[0].vars, alt.vars) {
+					return false, fmt.Errorf("%s: alternatives must bind the same variables", fset.Position(stmt.Pos()))
+				}
+				alts = append(alts, &Rule{
+					symbol:   symbol,
+					typ:      typ,
+					results:  sig,
+					hasErr:   hasErr,
+					recv:     recv,
+					recvType: recvType,
+					pattern:  alt.pattern,
+					vars:     alt.vars,
+					literals: alt.literals,
+					pos:      fset.Position(stmt.Pos()),
+					expect:   expect,
+					mode:     mode,
+				})
 			}
 			code = nil
+		} else if cond, ok, err := isWhenCall(fset, stmt); err != nil {
+			return false, err
+		} else if ok {
+			if alts == nil || len(code) > 0 || alts[0].pred != "" {
+				return false, fmt.Errorf("%s: when() must directly follow syntax()", fset.Position(stmt.Pos()))
+			}
+			for _, rule := range alts {
+				rule.pred = astStr(fset, cond)
+			}
 		} else {
 			code = append(code, stmt)
 		}
 	}
 
-	if rule != nil {
-		rule.code = astStr(fset, code)
-		*rules = append(*rules, rule)
+	if alts == nil {
+		return false, nil
 	}
-	return
+	finish()
+	if inline && !inlined {
+		return false, fmt.Errorf("%s: //gen:inline needs a rule passing a single symbol through, without code or a predicate", fset.Position(fn.Pos()))
+	}
+	return true, nil
 }
 
-// Parse loads a go source file and extracts all the Rules from it.
+// grammarFiles returns the files making up the grammar at path, which
+// is either a single file or a directory whose .go files (other than
+// tests) all hold parts of the grammar.  The files of a directory are
+// in name order, so the start rule comes from the first of them.
+//
+// Files in a directory are skipped if their build constraints aren't
+// satisfied by tags, or if their names match the exclude pattern, so
+// that variants of a grammar can live alongside each other.
+//
+// A grammar directory isn't a buildable package, so like a single
+// grammar file it's conventionally hidden from the go tool with a
+// leading "_", as in calc/_grammar/.  Its files belong to the package
+// of the enclosing directory, which is returned as dir.
+func grammarFiles(path string, tags []string, exclude string) (dir string, files []string, isDir bool, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if !fi.IsDir() {
+		return filepath.Dir(path), []string{path}, false, nil
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", nil, false, err
+	}
+	ctxt := build.Default
+	ctxt.BuildTags = tags
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".go") ||
+			strings.HasSuffix(name, "_test.go") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if exclude != "" {
+			matched, err := filepath.Match(exclude, name)
+			if err != nil {
+				return "", nil, false, fmt.Errorf("bad exclude pattern %q: %s", exclude, err)
+			}
+			if matched {
+				continue
+			}
+		}
+		// MatchFile ignores files starting with "_", which grammar
+		// files often do, so check the constraints under another name.
+		file := filepath.Join(path, name)
+		ctxt.OpenFile = func(string) (io.ReadCloser, error) {
+			return os.Open(file)
+		}
+		match, err := ctxt.MatchFile(path, "x"+name)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if match {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return "", nil, false, fmt.Errorf("%s: no grammar files", path)
+	}
+	return filepath.Dir(filepath.Clean(path)), files, true, nil
+}
+
+// Parse loads a go source file, or all those in a directory, and
+// extracts all the Rules from it.
 func Parse(path string) (params *Params, rules []*Rule, err error) {
+	return parse(path, &Options{})
+}
+
+// parse is Parse with the options of Main that affect reading the
+// grammar: its input, strict mode, logging, and the selection of a
+// directory's files.
+func parse(path string, opts *Options) (params *Params, rules []*Rule, err error) {
+	dir, paths, isDir := filepath.Dir(path), []string{path}, false
+	if opts.Input == nil {
+		if dir, paths, isDir, err = grammarFiles(path, opts.Tags, opts.Exclude); err != nil {
+			return
+		}
+	}
 	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, path, nil, 0)
-	if err != nil {
-		return
+	var files []*ast.File
+	for _, path := range paths {
+		f, err := parser.ParseFile(fset, path, opts.Input, parser.ParseComments)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isDir && isGenerated(f) {
+			continue
+		}
+		if len(files) > 0 && f.Name.Name != files[0].Name.Name {
+			return nil, nil, fmt.Errorf("%s: package %s differs from %s in %s",
+				fset.Position(f.Name.Pos()), f.Name.Name, files[0].Name.Name,
+				fset.Position(files[0].Pos()).Filename)
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("%s: no grammar files", path)
 	}
 
 	params = &Params{
-		Package:   f.Name.Name,
-		TokenType: "Token",
+		Prefix:     opts.Prefix,
+		Package:    files[0].Name.Name,
+		TokenType:  opts.TokenType,
+		srcPackage: files[0].Name.Name,
+		srcDir:     dir,
+	}
+	params.SetDefaults(path)
+	for _, f := range files {
+		abs, err := filepath.Abs(fset.Position(f.Pos()).Filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		params.srcFiles = append(params.srcFiles, abs)
+	}
+	diag := &diagnostics{fset: fset}
+	for _, f := range files {
+		if err = parseFile(f, fset, diag, params, &rules); err != nil {
+			return
+		}
+	}
+	for _, rule := range rules {
+		if rule.recvType == "" {
+			continue
+		}
+		if params.Context == "" {
+			params.Context = rule.recvType
+		} else if rule.recvType != params.Context {
+			err = fmt.Errorf("%s: rule receiver %s differs from earlier %s", rule.pos, rule.recvType, params.Context)
+			return
+		}
+	}
+	if err = diag.flush(opts.Strict || params.Strict, opts.log().At(codegen.LevelWarn)); err != nil {
+		return
+	}
+	if opts.Package != "" {
+		params.Package = opts.Package
+	}
+	if err = params.Validate(); err != nil {
+		err = fmt.Errorf("%s: %s", path, err)
+		return
+	}
+	if len(rules) == 0 {
+		err = fmt.Errorf("%s: no rules found", path)
+	}
+
+	return
+}
+
+// parseFile extracts the parameters, rules and helpers from one file
+// of a grammar.
+func parseFile(f *ast.File, fset *token.FileSet, diag *diagnostics, params *Params, rules *[]*Rule) (err error) {
+	keep := func(n ast.Node) {
+		params.Helpers += astStr(fset, &printer.CommentedNode{Node: n, Comments: f.Comments}) + "\n\n"
+		kept := keptDecl{pos: fset.Position(n.Pos())}
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			kept.name = n.Name.Name
+		case *ast.GenDecl:
+			for _, spec := range n.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					kept.name = spec.Name.Name
+				case *ast.ValueSpec:
+					kept.name = spec.Names[0].Name
+				}
+				if kept.name != "" {
+					break
+				}
+			}
+		}
+		params.kept = append(params.kept, kept)
 	}
 	ast.Inspect(f, func(an ast.Node) bool {
 		switch n := an.(type) {
 		case *ast.GenDecl:
-			processDecl(n, fset, params)
+			if _, ok := directive(n.Doc, "keep"); ok || n.Tok == token.TYPE {
+				keep(n)
+			} else {
+				processDecl(n, diag, params)
+			}
 			return false // don't examine children
 		case *ast.FuncDecl:
-			processFunction(n, fset, &rules)
+			if err != nil {
+				return false
+			}
+			if _, ok := directive(n.Doc, "keep"); ok {
+				keep(n)
+				return false
+			}
+			var found bool
+			if found, err = processFunction(n, diag, rules); err == nil && !found {
+				diag.add(n.Pos(), fmt.Sprintf("function %s has no syntax() call", n.Name.Name), true)
+				keep(n)
+			}
 			return false // don't examine children
 		}
 		return true // visit children
 	})
-
-	return
+	return err
 }
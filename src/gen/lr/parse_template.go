@@ -3,20 +3,22 @@ package lr
 const parseTemplate = `
 package {{.Package}}
 
-// this file generated, do not edit
-
 {{.Header}}
 
 import (
 	"fmt"
+	{{if .Tree}}"io"{{end}}
 	{{if .Trace}}"log"{{end}}
+	{{if .Concurrent}}"sync"{{end}}
 )
 
+{{.Helpers}}
+
 // $Rule is a rule of the grammar.
 type $Rule struct {
 	symbol  string
 	pattern []string
-	reduce  func(data []interface{}) interface{}
+	reduce  func(data []interface{}) (interface{}, error)
 }
 
 // Action is an entry in the action table.
@@ -31,19 +33,115 @@ type $Action int
 // table[state][token] => action to take on token from state.
 type $ActionTable []map[string]$Action
 
+{{if .Listener}}
+// $Span is the range of tokens matched by a rule.
+type $Span struct {
+	// First and Last are the first and last tokens matched; both are
+	// zero if the rule matched nothing.
+	First, Last {{.TokenType}}
+}
+
+// $Listener is notified around each reduction the parser makes.
+type $Listener interface {
+	// EnterRule is called before the code of the rule with the given
+	// ID runs on the tokens in span.
+	EnterRule(rule int, span $Span)
+	// ExitRule is called after the code of the rule has run.
+	ExitRule(rule int, span $Span)
+}
+{{end}}
+
+{{if .Arena}}
+// $Arena allocates the nodes of trees built by rules without code in
+// large chunks, to spare the garbage collector.  An $Arena may be
+// shared by the parsers of successive parses, but not by concurrent
+// ones.
+type $Arena struct {
+	chunks [][]interface{}
+	// next is the chunk being allocated from, and used the number of
+	// its slots allocated.
+	next, used int
+}
+
+func (a *$Arena) alloc(n int) []interface{} {
+	for a.next < len(a.chunks) && len(a.chunks[a.next])-a.used < n {
+		a.next++
+		a.used = 0
+	}
+	if a.next == len(a.chunks) {
+		size := 4096
+		if n > size {
+			size = n
+		}
+		a.chunks = append(a.chunks, make([]interface{}, size))
+	}
+	s := a.chunks[a.next][a.used : a.used+n : a.used+n]
+	a.used += n
+	return s
+}
+
+// Release makes the memory of the arena available for reuse.  Trees
+// built from it must no longer be used.
+func (a *$Arena) Release() {
+	for i := 0; i <= a.next && i < len(a.chunks); i++ {
+		c := a.chunks[i]
+		for j := range c {
+			c[j] = nil
+		}
+	}
+	a.next, a.used = 0, 0
+}
+{{end}}
+
 // $Parser manages the parsing process.
 type $Parser struct {
-	actions $ActionTable
-	stack   []int
+	{{if .Arena}}
+	// Arena, if non-nil, allocates the nodes of built trees.
+	Arena *$Arena
+	{{end}}
+	{{if .Listener}}
+	// Listener, if non-nil, is notified around each reduction.
+	Listener $Listener
+	spans    []$Span
+	{{end}}
+	{{if .Recovery}}
+	// Errors holds the syntax errors the parser has recovered from.
+	Errors []error
+	// recovering is set after recovering from an error until the next
+	// token is shifted; until then tokens that don't fit are dropped.
+	recovering bool
+	{{end}}
+	{{- if .Excerpt}}
+	// input is the input set by SetInput, if any.
+	input []byte
+	{{- end}}
+	rules    []*$Rule
+	{{- if .Predicates}}
+	predicates map[int]func(data []interface{}) bool
+	{{- end}}
+	actions  $ActionTable
+	defaults []$Action
+	stack    []int
 	data    []interface{}
 }
 
+{{if .Context}}
+// $NewParser constructs a new $Parser, ready for input, whose rules
+// run with the given context.
+func $NewParser(ctx {{.Context}}) *$Parser {
+{{else}}
 // $NewParser constructs a new $Parser, ready for input.
 func $NewParser() *$Parser {
+{{end -}}
 	return &$Parser{
-		actions: $Actions,
-		stack:   []int{0},
-		data:    []interface{}{},
+		rules:    {{if .Context}}$NewRules(ctx){{else}}$Rules{{end}},
+		{{- if .Predicates}}
+		predicates: {{if .Context}}$NewPredicates(ctx){{else}}$Predicates{{end}},
+		{{- end}}
+		actions:  $Actions,
+		defaults: $Defaults,
+		stack:    []int{0},
+		data:     []interface{}{},
 	}
 }
 
@@ -54,12 +152,41 @@ func (p *$Parser) Parse(tok *{{.TokenType}}) (bool, error) {
 		{{if .Trace}}
 		log.Println("")
 		log.Printf("stack:%v, data:%v\n", p.stack, p.data)
-		log.Printf("tok:%v\n", tok.ParseId())
+		log.Printf("tok:%v\n", {{.TokenIdOf "tok"}})
+		{{end}}
+		action, ok := p.action(p.stack[len(p.stack)-1], {{.TokenIdOf "tok"}})
+		{{if .Predicates}}
+		// A rule whose predicate fails gives way to the fallback
+		// action, if there is one; without one the token is unexpected.
+		for ok && action < 0 {
+			pred := p.predicates[int(-action)]
+			if pred == nil || pred(p.data[len(p.data)-len(p.rules[-action].pattern):]) {
+				break
+			}
+			action, ok = $Fallbacks[p.stack[len(p.stack)-1]][{{.TokenIdOf "tok"}}]
+		}
 		{{end}}
-		action, ok := p.actions[p.stack[len(p.stack)-1]][tok.ParseId()]
 		if !ok {
+			{{if .Trace}}
 			log.Println(p.actions[p.stack[len(p.stack)-1]])
-			return false, fmt.Errorf("unexpected token: %v", tok)
+			{{end}}
+			{{if .Recovery}}
+			if p.recovering {
+				if {{.TokenIdOf "tok"}} == "EOF" {
+					return false, errors.Join(p.Errors...)
+				}
+				// Drop the token.
+				return false, nil
+			}
+			err := p.unexpected(tok)
+			if p.recoverFrom(tok) {
+				p.Errors = append(p.Errors, err)
+				continue
+			}
+			return false, err
+			{{else}}
+			return false, p.unexpected(tok)
+			{{end}}
 		}
 
 		if action > 0 {
@@ -71,32 +198,70 @@ func (p *$Parser) Parse(tok *{{.TokenType}}) (bool, error) {
 			{{end}}
 			p.data = append(p.data, *tok)
 			p.stack = append(p.stack, nextState)
+			{{if .Listener}}
+			p.spans = append(p.spans, $Span{*tok, *tok})
+			{{end}}
+			{{if .Recovery}}
+			p.recovering = false
+			{{end}}
 
 			// Ready for another token.
 			return false, nil
 
 		} else if action <= 0 {
 			// To reduce, we pop off the matching pattern from the stacks.
-			rule := $Rules[-action]
+			rule := p.rules[-action]
 			{{if .Trace}}
 			log.Printf("input %v => reduce %s -> %s\n", tok, rule.pattern, rule.symbol)
 			{{end}}
 			popCount := len(rule.pattern)
 
+			{{if .Listener}}
+			var span $Span
+			if popCount > 0 {
+				span.First = p.spans[len(p.spans)-popCount].First
+				span.Last = p.spans[len(p.spans)-1].Last
+			}
+			if p.Listener != nil {
+				p.Listener.EnterRule(int(-action), span)
+			}
+			{{end}}
+
 			// Update the data stack via the reduce function if available.
 			oldData := p.data[len(p.data)-popCount:]
 			var newData interface{}
 			if rule.reduce != nil {
-				newData = rule.reduce(oldData)
-			} else if popCount == 1 {
-				newData = oldData[0]
+				var err error
+				{{if .Recover}}
+				newData, err = p.reduce(rule, oldData, tok)
+				{{else}}
+				newData, err = rule.reduce(oldData)
+				{{end}}
+				if err != nil {
+					return false, err
+				}
 			} else {
+				{{if .Arena}}
+				var s []interface{}
+				if p.Arena != nil {
+					s = p.Arena.alloc(popCount)
+				} else {
+					s = make([]interface{}, popCount)
+				}
+				{{else}}
 				s := make([]interface{}, popCount)
+				{{end}}
 				copy(s, oldData)
 				newData = s
 			}
 			p.data = p.data[0 : len(p.data)-popCount]
 			p.data = append(p.data, newData)
+			{{if .Listener}}
+			if p.Listener != nil {
+				p.Listener.ExitRule(int(-action), span)
+			}
+			p.spans = append(p.spans[:len(p.spans)-popCount], span)
+			{{end}}
 
 			p.stack = p.stack[0 : len(p.stack)-popCount]
 
@@ -110,7 +275,7 @@ func (p *$Parser) Parse(tok *{{.TokenType}}) (bool, error) {
 			action, ok = p.actions[state][rule.symbol]
 			if !ok || action <= 0 {
 				// TODO: better error here; can it actually happen?
-				panic(fmt.Errorf("parse error near %s: bad next state", tok.Pos))
+				{{if .TokenPos}}panic(fmt.Errorf("parse error near %v: bad next state", tok.Pos)){{else}}panic(fmt.Errorf("parse error near %v: bad next state", tok)){{end}}
 			}
 
 			p.stack = append(p.stack, int(action))
@@ -118,4 +283,263 @@ func (p *$Parser) Parse(tok *{{.TokenType}}) (bool, error) {
 	}
 }
 
+{{if .Recover}}
+// $ParseError reports a panic in the code of a rule.
+type $ParseError struct {
+	// Rule is the symbol of the rule that panicked.
+	Rule string
+	// Token is the lookahead token at the time.
+	Token {{.TokenType}}
+	// Value is the value passed to panic.
+	Value interface{}
+}
+
+func (e *$ParseError) Error() string {
+	{{if .TokenPos}}return fmt.Sprintf("%v: panic in %s: %v", e.Token.Pos, e.Rule, e.Value){{else}}return fmt.Sprintf("panic in %s at %v: %v", e.Rule, e.Token, e.Value){{end}}
+}
+
+// reduce calls the reduce function of rule, converting a panic into
+// a $ParseError.
+func (p *$Parser) reduce(rule *$Rule, data []interface{}, tok *{{.TokenType}}) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &$ParseError{Rule: rule.symbol, Token: *tok, Value: r}
+		}
+	}()
+	return rule.reduce(data)
+}
+{{end}}
+
+{{if .Tree}}
+// $DumpTree writes tree, as built by rules without code, as an
+// indented s-expression.  Tokens are written using their String
+// method if they have one, and otherwise as their terminal symbol.
+func $DumpTree(w io.Writer, tree interface{}) error {
+	var dump func(tree interface{}, indent string) string
+	dump = func(tree interface{}, indent string) string {
+		switch t := tree.(type) {
+		case []interface{}:
+			sep := " "
+			for _, c := range t {
+				if _, ok := c.([]interface{}); ok {
+					sep = "\n" + indent + "  "
+					break
+				}
+			}
+			str := "("
+			for i, c := range t {
+				if i > 0 {
+					str += sep
+				}
+				str += dump(c, indent+"  ")
+			}
+			return str + ")"
+		case fmt.Stringer:
+			return fmt.Sprintf("%q", t.String())
+		case {{.TokenType}}:
+			return {{.TokenIdOf "t"}}
+		}
+		return fmt.Sprint(tree)
+	}
+	_, err := io.WriteString(w, dump(tree, "")+"\n")
+	return err
+}
+{{end}}
+
+{{if .Excerpt}}
+// SetInput gives the parser the input its tokens come from, so that
+// syntax errors quote the line of the input they're on.  The tokens'
+// Pos must be their byte offset in src.
+func (p *$Parser) SetInput(src []byte) {
+	p.input = src
+}
+
+// quote adds to err the line of the input holding tok, with a caret
+// under tok, if the parser has the input.
+func (p *$Parser) quote(err error, tok *{{.TokenType}}) error {
+	offset := int(tok.Pos)
+	if p.input == nil || offset < 0 || offset > len(p.input) {
+		return err
+	}
+	start := bytes.LastIndexByte(p.input[:offset], '\n') + 1
+	end := bytes.IndexByte(p.input[offset:], '\n')
+	if end < 0 {
+		end = len(p.input)
+	} else {
+		end += offset
+	}
+	line := strings.TrimSuffix(string(p.input[start:end]), "\r")
+	// Indent the caret with the tabs of the line and a space for each
+	// other character, so that it lines up under tok.
+	var indent []rune
+	for _, r := range string(p.input[start:offset]) {
+		if r != '\t' {
+			r = ' '
+		}
+		indent = append(indent, r)
+	}
+	return fmt.Errorf("%w\n\t%s\n\t%s^", err, line, string(indent))
+}
+{{end}}
+
+// unexpected returns the error for a token the parser can't accept:
+// the grammar's message for the situation if it has one, or else the
+// list of the terminals it expected.
+func (p *$Parser) unexpected(tok *{{.TokenType}}) {{if .Excerpt}}(err error){{else}}error{{end}} {
+	{{- if .Excerpt}}
+	defer func() {
+		err = p.quote(err, tok)
+	}()
+	{{- end}}
+	{{if .Messages}}
+	msgs := $ErrorMessages[p.stack[len(p.stack)-1]]
+	if msg, ok := msgs[{{.TokenIdOf "tok"}}]; ok {
+		return fmt.Errorf("unexpected token %v: %s", tok, msg)
+	} else if msg, ok := msgs[""]; ok {
+		return fmt.Errorf("unexpected token %v: %s", tok, msg)
+	}
+	{{end}}
+	expected := p.Completions()
+	{{if .Display}}
+	for i, term := range expected {
+		if name, ok := $DisplayNames[term]; ok {
+			expected[i] = name
+		}
+	}
+	{{end}}
+	return fmt.Errorf("unexpected token: %v; expected one of %s", tok, strings.Join(expected, ", "))
+}
+
+{{if .Recovery}}
+// recoverFrom handles a syntax error at tok by popping states until
+// one can shift the error terminal, as matched by the grammar's error
+// rules, and shifting it with tok as its value.  It reports whether
+// there was such a state.
+func (p *$Parser) recoverFrom(tok *{{.TokenType}}) bool {
+	depth := len(p.stack) - 1
+	for ; depth >= 0; depth-- {
+		if action, ok := p.actions[p.stack[depth]]["error"]; ok && action > 0 {
+			break
+		}
+	}
+	if depth < 0 {
+		return false
+	}
+	popCount := len(p.stack) - 1 - depth
+	p.data = p.data[:len(p.data)-popCount]
+	p.stack = p.stack[:depth+1]
+	{{if .Listener}}
+	p.spans = append(p.spans[:len(p.spans)-popCount], $Span{*tok, *tok})
+	{{end}}
+	p.data = append(p.data, *tok)
+	p.stack = append(p.stack, int(p.actions[p.stack[depth]]["error"]))
+	p.recovering = true
+	return true
+}
+{{end}}
+
+// Completions returns the terminals the parser can accept next, given
+// the input so far, sorted.  As the parser's state includes the
+// expansions of the nonterminals it expects, these include the
+// terminals that can begin them.
+func (p *$Parser) Completions() []string {
+	nonterminals := make(map[string]bool)
+	for _, rule := range p.rules {
+		nonterminals[rule.symbol] = true
+	}
+	// The terminals are those of the state the default reductions,
+	// which don't depend on the token, lead to.
+	stack := append([]int(nil), p.stack...)
+	for {
+		action := p.defaults[stack[len(stack)-1]]
+		if action == 0 {
+			break
+		}
+		rule := p.rules[-action]
+		stack = stack[:len(stack)-len(rule.pattern)]
+		stack = append(stack, int(p.actions[stack[len(stack)-1]][rule.symbol]))
+	}
+	var toks []string
+	for tok := range p.actions[stack[len(stack)-1]] {
+		if !nonterminals[tok] && tok != "error" && p.accepts(tok) {
+			toks = append(toks, tok)
+		}
+	}
+	sort.Strings(toks)
+	return toks
+}
+
+// action returns the action of state on the terminal tok: the
+// state's default reduction, if it has one, or its entry for tok.
+func (p *$Parser) action(state int, tok string) ($Action, bool) {
+	if action := p.defaults[state]; action != 0 {
+		return action, true
+	}
+	action, ok := p.actions[state][tok]
+	return action, ok
+}
+
+// accepts reports whether the terminal tok can be shifted or accepted
+// next, simulating the reductions it causes on a copy of the stack.
+func (p *$Parser) accepts(tok string) bool {
+	stack := append([]int(nil), p.stack...)
+	for {
+		action, ok := p.action(stack[len(stack)-1], tok)
+		if !ok {
+			return false
+		} else if action >= 0 {
+			return true
+		}
+		rule := p.rules[-action]
+		stack = stack[:len(stack)-len(rule.pattern)]
+		next, ok := p.actions[stack[len(stack)-1]][rule.symbol]
+		if !ok || next <= 0 {
+			return false
+		}
+		stack = append(stack, int(next))
+	}
+}
+
+// ParseFunc runs a complete parse, pulling tokens from next until the
+// input is accepted or an error occurs.
+func (p *$Parser) ParseFunc(next func() {{.TokenType}}) error {
+	for {
+		tok := next()
+		done, err := p.Parse(&tok)
+		if err != nil {
+			return err
+		}
+		if done {
+			return {{if .Recovery}}errors.Join(p.Errors...){{else}}nil{{end}}
+		}
+	}
+}
+
+// ParseTokens runs a complete parse over toks, which must include the
+// token that ends the input.
+func (p *$Parser) ParseTokens(toks []{{.TokenType}}) error {
+	for i := range toks {
+		done, err := p.Parse(&toks[i])
+		if err != nil {
+			return err
+		}
+		if done {
+			return {{if .Recovery}}errors.Join(p.Errors...){{else}}nil{{end}}
+		}
+	}
+	return fmt.Errorf("unexpected end of tokens")
+}
+
+{{if .Arena}}
+// Release frees the result of the parse once it's no longer needed,
+// making the memory of the parser's Arena, if it has one, available
+// for reuse.  Neither the parser nor its result may be used after.
+func (p *$Parser) Release() {
+	if p.Arena != nil {
+		p.Arena.Release()
+	}
+	p.data = nil
+}
+{{end}}
+
 `
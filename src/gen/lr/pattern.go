@@ -0,0 +1,220 @@
+package lr
+
+// Parsing of the pattern strings passed to syntax(...).
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strings"
+	"unicode/utf8"
+)
+
+// patternError is an error at an offset within a pattern string.
+type patternError struct {
+	offset int
+	msg    string
+}
+
+func (e *patternError) Error() string { return e.msg }
+
+// alternative is one alternative of a pattern: its symbols, the
+// names of the variables bound to them, "" for none, and which of the
+// symbols were written as quoted literals.
+type alternative struct {
+	pattern  []string
+	vars     []string
+	literals []string
+}
+
+// patternWord is a word of a pattern string, found at offset.
+type patternWord struct {
+	text   string
+	offset int
+}
+
+// isEmptyMarker reports whether a pattern word is one of the ways of
+// writing the empty pattern, %empty or ε.
+func isEmptyMarker(word string) bool {
+	return word == "%empty" || word == "ε"
+}
+
+// scanPattern splits a pattern string into words at runs of white
+// space.  A quoted literal like 'else if' is kept whole, white space
+// and all; within one, \' and \\ stand for a quote and a backslash,
+// and \n for a newline.
+func scanPattern(s string) ([]patternWord, error) {
+	var words []patternWord
+	start := -1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if start >= 0 {
+				words = append(words, patternWord{s[start:i], start})
+				start = -1
+			}
+			continue
+		case start < 0:
+			start = i
+		}
+		if c != '\'' {
+			continue
+		}
+		quote := i
+		for i++; i < len(s) && s[i] != '\''; i++ {
+			if s[i] == '\\' {
+				i++
+			}
+		}
+		if i >= len(s) {
+			return nil, &patternError{quote, "unterminated quoted literal"}
+		}
+	}
+	if start >= 0 {
+		words = append(words, patternWord{s[start:], start})
+	}
+	return words, nil
+}
+
+// unquoteLiteral returns the value of a quoted literal as scanned by
+// scanPattern.
+func unquoteLiteral(w patternWord) (string, error) {
+	text := w.text
+	if len(text) < 2 || text[len(text)-1] != '\'' {
+		return "", &patternError{w.offset, fmt.Sprintf("quoted literal %s must be a word of its own", text)}
+	}
+	var value []byte
+	for i := 1; i < len(text)-1; i++ {
+		if text[i] == '\\' {
+			i++
+			if text[i] == 'n' {
+				value = append(value, '\n')
+				continue
+			}
+		}
+		value = append(value, text[i])
+	}
+	if len(value) == 0 {
+		return "", &patternError{w.offset, "empty quoted literal"}
+	}
+	return string(value), nil
+}
+
+// quoteLiteral returns a terminal as it must be written in a pattern:
+// as is, unless it would be taken for something else, in which case
+// quoted.
+func quoteLiteral(term string) string {
+	if term != "|" && !isEmptyMarker(term) && !strings.ContainsAny(term, "'= \t\n\r") {
+		return term
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`).Replace(term) + "'"
+}
+
+// parsePattern parses a pattern string, which looks like
+//   A=expr + B=term | B=term
+// into its alternatives, here the symbols [expr + term] binding the
+// variables [A "" B] and the symbols [term] binding [B].  The empty
+// pattern must be written explicitly, as %empty or ε, so that an empty
+// alternative is an error rather than a rule matching nothing.
+func parsePattern(s string) ([]alternative, error) {
+	var alts []alternative
+	var cur alternative
+	empty := false // whether cur is written as %empty
+	start := 0
+	finish := func() error {
+		if len(cur.pattern) == 0 && !empty {
+			return &patternError{start, "empty alternative; write %empty for one matching nothing"}
+		}
+		alts = append(alts, cur)
+		cur, empty = alternative{}, false
+		return nil
+	}
+
+	words, err := scanPattern(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range words {
+		switch {
+		case w.text == "|":
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			start = w.offset
+			continue
+		case isEmptyMarker(w.text) || empty:
+			if empty || len(cur.pattern) > 0 {
+				return nil, &patternError{w.offset, "%empty must be the whole alternative"}
+			}
+			empty = true
+			continue
+		}
+		sym, name, literal, err := parseWord(w)
+		if err != nil {
+			return nil, err
+		}
+		cur.pattern = append(cur.pattern, sym)
+		cur.vars = append(cur.vars, name)
+		if literal {
+			cur.literals = append(cur.literals, sym)
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return alts, nil
+}
+
+// parseWord parses a word of a pattern, a symbol optionally bound to a
+// variable as in A=expr.  The symbol may be a quoted literal, as in
+// A='else if', standing for the terminal with that value.
+func parseWord(w patternWord) (sym, name string, literal bool, err error) {
+	text := w.text
+	i := strings.IndexByte(text, '=')
+	if q := strings.IndexByte(text, '\''); q >= 0 && q < i {
+		i = -1
+	}
+	if i > 0 && token.IsIdentifier(text[:i]) {
+		name = text[:i]
+		if utf8.RuneCountInString(name) != 1 {
+			return "", "", false, &patternError{w.offset, fmt.Sprintf("variable names must currently be a single letter, got %q", name)}
+		}
+		if i+1 == len(text) {
+			return "", "", false, &patternError{w.offset + i + 1, fmt.Sprintf("missing symbol after %s=", name)}
+		}
+		w = patternWord{text[i+1:], w.offset + i + 1}
+	}
+	if strings.IndexByte(w.text, '\'') < 0 {
+		return w.text, name, false, nil
+	}
+	if w.text[0] != '\'' {
+		return "", "", false, &patternError{w.offset + strings.IndexByte(w.text, '\''), fmt.Sprintf("quoted literal in %s must be a word of its own", w.text)}
+	}
+	sym, err = unquoteLiteral(w)
+	if err != nil {
+		return "", "", false, err
+	}
+	return sym, name, true, nil
+}
+
+// patternPos returns the position of the byte at offset in the string
+// held by lit.  It's exact for raw strings, and close enough for
+// others.
+func patternPos(fset *token.FileSet, lit *ast.BasicLit, offset int) token.Position {
+	pos := fset.Position(lit.Pos())
+	pos.Column++ // the opening quote
+	value := lit.Value[1 : len(lit.Value)-1]
+	if offset > len(value) {
+		offset = len(value)
+	}
+	for _, r := range value[:offset] {
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column += utf8.RuneLen(r)
+		}
+	}
+	return pos
+}
@@ -2,11 +2,14 @@ package lr
 
 import (
 	"fmt"
+	"io"
+	"path/filepath"
 	"sort"
 	"strings"
 	"text/template"
 
 	"gen/codegen"
+	"gen/lex"
 )
 
 // Action is an entry in the action table, indicating which way to transition
@@ -22,6 +25,24 @@ type Shift struct {
 // Reducing to the root rule means the input is accepted.
 type Reduce struct {
 	rule *Rule
+	// otherwise, for a rule with a predicate, is the action to take
+	// instead when the predicate fails, or nil to fail the parse.
+	otherwise Action
+}
+
+// remapShifts returns action with the states it shifts to, including
+// those of a Reduce's otherwise action, mapped through renumber.
+func remapShifts(action Action, renumber func(state int) int) Action {
+	switch a := action.(type) {
+	case Shift:
+		return Shift{state: renumber(a.state)}
+	case Reduce:
+		if a.otherwise != nil {
+			a.otherwise = remapShifts(a.otherwise, renumber)
+		}
+		return a
+	}
+	return action
 }
 
 // ActionTable maps parser states to rows; each row maps tokens to actions.
@@ -76,8 +97,29 @@ func (is ItemSet) Equals(os ItemSet) bool {
 	return true
 }
 
-func (is ItemSet) Dump(log Logger) {
+// Sorted returns the items in the order of their rules in the
+// grammar, so that iterating over them is deterministic.
+func (is ItemSet) Sorted(grammar *Grammar) []Item {
+	ruleIds := make(map[*Rule]int)
+	for i, rule := range grammar.rules {
+		ruleIds[rule] = i
+	}
+	var items []Item
 	for item := range is {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if ruleIds[a.rule] != ruleIds[b.rule] {
+			return ruleIds[a.rule] < ruleIds[b.rule]
+		}
+		return a.pos < b.pos
+	})
+	return items
+}
+
+func (is ItemSet) Dump(grammar *Grammar, log Logger) {
+	for _, item := range is.Sorted(grammar) {
 		log.Println(" ", item.rule.Show("->", item.pos))
 	}
 }
@@ -125,6 +167,57 @@ func (is ItemSet) Goto(grammar *Grammar, x string) ItemSet {
 	return out
 }
 
+// conflict is a clash between two actions for the same state and
+// input, found building the parse table.
+type conflict struct {
+	state int
+	input string
+	// class is the token class through which input was reached, if
+	// any.
+	class string
+	// kept is the action the table has, and dropped the other.
+	kept, dropped Action
+}
+
+// describeAction describes an action for people.
+func describeAction(a Action) string {
+	switch a := a.(type) {
+	case Shift:
+		return fmt.Sprintf("shift to state %d", a.state)
+	case Reduce:
+		if a.otherwise != nil {
+			return "reduce " + a.rule.Show("->", -1) + " if its predicate holds, else " + describeAction(a.otherwise)
+		}
+		return "reduce " + a.rule.Show("->", -1)
+	}
+	return fmt.Sprint(a)
+}
+
+// isPredicated reports whether action reduces by a rule with a
+// predicate.
+func isPredicated(action Action) bool {
+	reduce, ok := action.(Reduce)
+	return ok && reduce.rule.pred != ""
+}
+
+// reportConflicts logs the conflicts found by ComputeActions, along
+// with the items of the states they're in.
+func reportConflicts(grammar *Grammar, log Logger) {
+	for _, c := range grammar.conflicts {
+		input := c.input
+		if c.class != "" {
+			input += " (in class " + c.class + ")"
+		}
+		log.Printf("conflict in state %d on input %s: %s, not %s\n",
+			c.state, input, describeAction(c.kept), describeAction(c.dropped))
+		grammar.states[c.state].Dump(grammar, log)
+	}
+}
+
+// ComputeActions builds the SLR parse table for grammar, whose first
+// rule is the start rule.  Conflicts are resolved in favor of reducing
+// by the latest rule, and recorded in the grammar.  With a non-nil
+// trace it logs the follow sets and the item set of each state.
 func ComputeActions(grammar *Grammar, trace Logger) ActionTable {
 	first := grammar.First(trace)
 	follow := grammar.Follow(first)
@@ -140,13 +233,15 @@ func ComputeActions(grammar *Grammar, trace Logger) ActionTable {
 	states[0].Closure(grammar)
 
 	// Construct the parsing states list by computing goto() for each
-	// state and terminal.
+	// state and terminal.  Everything is visited in a fixed order so
+	// that the states are numbered the same way on every run.
+	symbols := grammar.symbols.Sorted()
 	for i := 0; i < len(states); i++ {
 		set := states[i]
 		actions := make(map[string]Action)
 		allActions = append(allActions, actions)
 
-		for term := range grammar.symbols {
+		for _, term := range symbols {
 			c := set.Goto(grammar, term)
 			if c.Empty() {
 				continue
@@ -172,106 +267,485 @@ func ComputeActions(grammar *Grammar, trace Logger) ActionTable {
 	// Add a reduce action for all items that have consumed the full rule.
 	for i, set := range states {
 		actions := allActions[i]
-		for item := range set {
+		for _, item := range set.Sorted(grammar) {
 			if _, end := item.NextSym(); !end {
 				// Still more terminals on this item.
 				continue
 			}
 
 			f := follow[item.rule.symbol]
-			for term := range f {
+			for _, term := range f.Sorted() {
+				// A rule with a predicate is tried first, giving way
+				// to the action it conflicts with when it fails.
+				if prev, ok := actions[term].(Reduce); ok && prev.rule.pred != "" && prev.otherwise == nil && item.rule.pred == "" {
+					prev.otherwise = Reduce{rule: item.rule}
+					actions[term] = prev
+					continue
+				}
+				if prev := actions[term]; prev != nil && item.rule.pred != "" && !isPredicated(prev) {
+					actions[term] = Reduce{rule: item.rule, otherwise: prev}
+					continue
+				}
 				if actions[term] != nil {
-					// TODO: don't use traceLog
-					traceLog.Println("reduce conflict!")
-					set.Dump(traceLog)
-					traceLog.Printf("in state %d on input %s, %#v vs %v", i, term, actions[term], item.rule)
+					grammar.conflicts = append(grammar.conflicts, conflict{
+						state: i, input: term,
+						kept: Reduce{rule: item.rule}, dropped: actions[term],
+					})
 				}
 				actions[term] = Reduce{rule: item.rule}
 			}
 		}
 	}
 
+	// Expand token classes into their members.  An action given for
+	// a member directly takes precedence over one via its class.
+	var classes []string
+	for class := range grammar.classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for i, actions := range allActions {
+		for _, class := range classes {
+			members := grammar.classes[class]
+			action, ok := actions[class]
+			if !ok {
+				continue
+			}
+			delete(actions, class)
+			for _, member := range members {
+				if other := actions[member]; other != nil {
+					if other != action {
+						grammar.conflicts = append(grammar.conflicts, conflict{
+							state: i, input: member, class: class,
+							kept: other, dropped: action,
+						})
+					}
+					continue
+				}
+				actions[member] = action
+			}
+		}
+	}
+
+	grammar.states = states
 	if trace != nil {
 		for i, set := range states {
 			trace.Printf("set %d:\n", i)
-			set.Dump(trace)
+			set.Dump(grammar, trace)
 		}
 	}
 
 	return allActions
 }
 
-func writeTables(w *codegen.Writer, params *Params, grammar *Grammar, table ActionTable) {
+// writeIntrospection writes the lists of the grammar's symbols and the
+// size of its action table.  Together with RuleNames and the Symbol
+// and Pattern of each rule, they describe the grammar.
+func writeIntrospection(w *codegen.Writer, params *Params, grammar *Grammar, table ActionTable) {
+	w.Linef("// %sTerminals lists the grammar's terminal symbols, sorted.", params.Prefix)
+	w.Linef("var %sTerminals = %#v", params.Prefix, grammar.terminals.Sorted())
+	w.Line("")
+
+	var nonterminals []string
+	seen := make(map[string]bool)
+	for _, rule := range grammar.rules {
+		if !seen[rule.symbol] {
+			seen[rule.symbol] = true
+			nonterminals = append(nonterminals, rule.symbol)
+		}
+	}
+	w.Linef("// %sNonterminals lists the grammar's nonterminal symbols, in the", params.Prefix)
+	w.Line("// order they're first defined.")
+	w.Linef("var %sNonterminals = %#v", params.Prefix, nonterminals)
+	w.Line("")
+
+	w.Linef("// %sStates is the number of parser states, the rows of %sActions.", params.Prefix, params.Prefix)
+	w.Linef("const %sStates = %d", params.Prefix, len(table))
+}
+
+// buildsTree reports whether any rule has neither code nor a single
+// value to pass through, and so produces a []interface{} of the
+// values it matched.
+func buildsTree(rules []*Rule) bool {
+	for _, rule := range rules {
+		if strings.TrimSpace(rule.code) == "" && len(rule.pattern) != 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTables writes the rule and action tables, returning the
+// location of each rule's reduce function in the output.
+func writeTables(w *codegen.Writer, params *Params, grammar *Grammar, table ActionTable) []actionSpan {
+	var spans []actionSpan
 	types := make(map[string]string)
 	for _, rule := range grammar.rules {
 		types[rule.symbol] = rule.typ
 	}
+	// symType gives the type of the value matched by a pattern symbol.
+	symType := func(sym string) string {
+		if typ, ok := types[sym]; ok {
+			return typ
+		}
+		return params.TokenType
+	}
 
 	ruleIds := make(map[*Rule]int)
 
-	w.Linef(`var %sRules = []*%sRule{`, params.Prefix, params.Prefix)
-	for i, rule := range grammar.rules {
+	w.Linef("// Rule IDs, the indexes of the rules in %sRules.", params.Prefix)
+	w.Line("const (")
+	for i, name := range ruleConstNames(grammar.numbered) {
+		w.Linef("%s%s = %d // %s", params.Prefix, name, i, grammar.numbered[i].Show("->", -1))
+	}
+	w.Line(")")
+	w.Line("")
+	w.Linef("// %sRuleNames gives the production of each rule, by rule ID.", params.Prefix)
+	w.Linef("var %sRuleNames = []string{", params.Prefix)
+	for _, rule := range grammar.numbered {
+		w.Linef("%q,", rule.Show("->", -1))
+	}
+	w.Line("}")
+	w.Line("")
+
+	ruleType := fmt.Sprintf("*%sRule", params.Prefix)
+	if params.Generic {
+		ruleType = "lrrt.Rule"
+	}
+	if params.Context != "" {
+		// Rules written as methods close over the context, so the
+		// rules are built per context value.
+		w.Linef("// %sNewRules returns the grammar's rules, whose code runs with the", params.Prefix)
+		w.Line("// given context.")
+		w.Linef("func %sNewRules(%s %s) []%s {", params.Prefix, contextVar, params.Context, ruleType)
+		w.Linef("return []%s{", ruleType)
+	} else {
+		w.Linef(`var %sRules = []%s{`, params.Prefix, ruleType)
+	}
+	// In generic mode, the code of each rule is a function of its own,
+	// taking the values it binds as typed parameters, which the rule's
+	// Reduce calls.
+	var reduceFuncs []*Rule
+	constNames := ruleConstNames(grammar.numbered)
+	for i, rule := range grammar.numbered {
 		ruleIds[rule] = i
 		w.Linef(`{%q, %#v,`, rule.symbol, rule.pattern)
-		if rule.code != "" {
-			w.Line("func(data []interface{}) interface{} {")
+		code := strings.Trim(rule.code, " \t\n")
+		if params.Generic && code != "" {
+			span := actionSpan{rule: rule, start: w.Lines() + 1}
+			var args []string
+			if rule.recvType != "" {
+				args = append(args, contextVar)
+			}
 			for j, varname := range rule.vars {
 				if varname != "" {
-					typ := types[rule.pattern[j]]
-					if typ == "" {
-						typ = params.TokenType
-					}
-					w.Linef("%s := data[%d].(%s)", varname, j, typ)
+					args = append(args, fmt.Sprintf("%s[%d].(%s)", dataVar, j, symType(rule.pattern[j])))
+				}
+			}
+			w.Linef("func(%s []interface{}) (interface{}, error) {", dataVar)
+			call := fmt.Sprintf("%s(%s)", reduceFuncName(params, constNames[i]), strings.Join(args, ", "))
+			if rule.hasErr {
+				w.Linef("return %s", call)
+			} else {
+				w.Linef("return %s, nil", call)
+			}
+			w.Line("},")
+			w.Line(`},`)
+			span.end = w.Lines()
+			span.code = span.end + 1
+			spans = append(spans, span)
+			reduceFuncs = append(reduceFuncs, rule)
+			continue
+		}
+		if code == "" && len(rule.pattern) == 1 {
+			// Pass the single matched value through as the rule's value.
+			code = fmt.Sprintf("return %s[0].(%s)", dataVar, symType(rule.pattern[0]))
+			if rule.hasErr {
+				code += ", nil"
+			}
+		}
+		if code != "" {
+			span := actionSpan{rule: rule, start: w.Lines() + 1}
+			w.Linef("func(%s []interface{}) (interface{}, error) {", dataVar)
+			for j, varname := range rule.vars {
+				if varname != "" {
+					w.Linef("%s := %s[%d].(%s)", varname, dataVar, j, symType(rule.pattern[j]))
 				}
 			}
-			w.Line(strings.Trim(rule.code, " \t\n"))
+			// The code runs in a function of its own, so its returns
+			// are converted to the rule's type.
+			// A method's receiver becomes a parameter of that function.
+			args := ""
+			if rule.recvType != "" {
+				w.Linef("return func(%s %s) %s {", rule.recv, rule.recvType, rule.results)
+				args = contextVar
+			} else {
+				w.Linef("return func() %s {", rule.results)
+			}
+			span.code = w.Lines() + 1
+			w.Line(code)
+			if rule.hasErr {
+				w.Linef("}(%s)", args)
+			} else {
+				w.Linef("}(%s), nil", args)
+			}
 			w.Line("},")
+			span.end = w.Lines()
+			spans = append(spans, span)
 		} else {
 			w.Line("nil,")
 		}
 		w.Line(`},`)
 	}
 	w.Line(`}`)
+	if params.Context != "" {
+		w.Line(`}`)
+	}
 
 	w.Line("")
 
-	w.Linef(`var %sActions = %sActionTable{`, params.Prefix, params.Prefix)
-	for _, state := range table {
+	for _, rule := range reduceFuncs {
+		i := ruleIds[rule]
+		span := actionSpan{rule: rule, start: w.Lines() + 1}
+		var args []string
+		if rule.recvType != "" {
+			args = append(args, rule.recv+" "+rule.recvType)
+		}
+		for j, varname := range rule.vars {
+			if varname != "" {
+				args = append(args, varname+" "+symType(rule.pattern[j]))
+			}
+		}
+		w.Linef("// %s computes the value of the rule %s.", reduceFuncName(params, constNames[i]), rule.Show("->", -1))
+		w.Linef("func %s(%s) %s {", reduceFuncName(params, constNames[i]), strings.Join(args, ", "), rule.results)
+		span.code = w.Lines() + 1
+		w.Line(strings.Trim(rule.code, " \t\n"))
+		w.Line("}")
+		span.end = w.Lines()
+		spans = append(spans, span)
+		w.Line("")
+	}
+
+	if params.Generic {
+		w.Linef(`var %sActions = lrrt.ActionTable{`, params.Prefix)
+	} else {
+		w.Linef(`var %sActions = %sActionTable{`, params.Prefix, params.Prefix)
+	}
+	encode := func(action Action) int {
+		switch a := action.(type) {
+		case Shift:
+			return a.state
+		case Reduce:
+			return -ruleIds[a.rule]
+		}
+		panic("unhandled case")
+	}
+	fallbacks := make(map[int][]string)
+	for i, state := range table {
 		w.Line(`{`)
 		var keys []string
 		for k := range state {
-			keys = append(keys, k)
+			if k != "" {
+				keys = append(keys, k)
+			}
 		}
 		sort.Strings(keys)
 		for _, tok := range keys {
 			action := state[tok]
-			var str string
-			switch a := action.(type) {
-			case Shift:
-				str = fmt.Sprintf("%d", a.state)
-			case Reduce:
-				str = fmt.Sprintf("%d", -ruleIds[a.rule])
-			default:
-				panic("unhandled case")
+			w.Linef(`%q: %d,`, tok, encode(action))
+			if reduce, ok := action.(Reduce); ok && reduce.otherwise != nil {
+				fallbacks[i] = append(fallbacks[i], fmt.Sprintf("%q: %d,", tok, encode(reduce.otherwise)))
 			}
-			w.Linef(`%q: %s,`, tok, str)
 		}
 		w.Line(`},`)
 	}
 	w.Line(`}`)
+	w.Line("")
+
+	if hasPredicates(grammar) {
+		writePredicates(w, params, grammar, ruleIds, symType, &spans)
+		w.Line("")
+		actionType := params.Prefix + "Action"
+		if params.Generic {
+			actionType = "lrrt.Action"
+		}
+		w.Linef("// %sFallbacks gives, by state and token, the action to take when the", params.Prefix)
+		w.Line("// predicate of the rule the action table reduces by fails.")
+		w.Linef("var %sFallbacks = map[int]map[string]%s{", params.Prefix, actionType)
+		var states []int
+		for state := range fallbacks {
+			states = append(states, state)
+		}
+		sort.Ints(states)
+		for _, state := range states {
+			w.Linef("%d: {", state)
+			for _, line := range fallbacks[state] {
+				w.Line(line)
+			}
+			w.Line("},")
+		}
+		w.Line("}")
+		w.Line("")
+	}
+
+	// Default reductions are written as a row of their own, so that
+	// the parser can take them without looking up the token.
+	w.Linef("// %sDefaults gives the reduction each state makes whatever the next", params.Prefix)
+	w.Line("// token, or 0 if it has none; the state's actions are then only gotos.")
+	if params.Generic {
+		w.Linef(`var %sDefaults = []lrrt.Action{`, params.Prefix)
+	} else {
+		w.Linef(`var %sDefaults = []%sAction{`, params.Prefix, params.Prefix)
+	}
+	line := ""
+	for i, state := range table {
+		action := 0
+		if reduce, ok := state[""].(Reduce); ok {
+			action = -ruleIds[reduce.rule]
+		}
+		line += fmt.Sprintf("%d, ", action)
+		if (i+1)%16 == 0 || i == len(table)-1 {
+			w.Line(strings.TrimSpace(line))
+			line = ""
+		}
+	}
+	w.Line(`}`)
+
+	return spans
+}
+
+// Options controls Main beyond what the grammar itself specifies.
+type Options struct {
+	// Input, if non-nil, is read in place of the grammar file, whose
+	// name then only identifies the input in messages; the grammar's
+	// package directory is taken to be the one the name is in.
+	Input io.Reader
+	// Verbose enables logging of the generation process, as if Level
+	// were codegen.LevelDebug.
+	Verbose bool
+	// Level is the least severity of the messages logged: at
+	// codegen.LevelError, the warnings about the grammar and the
+	// conflicts in its parse table are left out.
+	Level codegen.Level
+	// Log, if non-nil, receives the log, which otherwise goes to
+	// stderr.
+	Log Logger
+	// Package, if non-empty, overrides the output package name.
+	Package string
+	// Prefix and TokenType, if non-empty, are the defaults for a
+	// grammar that doesn't set lrPrefix or lrTokenType.
+	Prefix    string
+	TokenType string
+	// Dir, if non-empty, names the directory of the output package,
+	// which may differ from the grammar's.
+	Dir string
+	// Profile, if non-empty, is the path of a token corpus used to
+	// order the parser's states; see Profile.
+	Profile string
+	// Strict makes the grammar's warnings errors, as if it set
+	// lrStrict.
+	Strict bool
+	// Tags are the build tags used to select the files of a grammar
+	// directory, and Exclude, if non-empty, a pattern matching the
+	// names of files to leave out.
+	Tags    []string
+	Exclude string
+	// RuleIds, if non-nil, holds the contents of a rule ID file, by
+	// which Main numbers the rules so that their IDs stay the same as
+	// the grammar changes; see ruleids.go.  Main replaces it with the
+	// numbering of the generated parser, to be saved for next time.
+	RuleIds *[]byte
+	// Stats, if non-nil, is filled in with statistics about the
+	// generated parser.
+	Stats *Stats
+	// Lexer, if non-nil, has Main also generate the lexer for the
+	// grammar's tokens file (see Params.Tokens) with these options,
+	// combining it and the parser into a single file.
+	Lexer *lex.Options
+	// Templates, if non-empty, is a directory of templates replacing
+	// the built-in ones: parse.tmpl for the parser, or generic.tmpl in
+	// generic mode.
+	Templates string
+	// Graph requests a graphviz graph of the parser's states in place
+	// of the parser.
+	Graph bool
+	// Raw skips formatting the output, returning the unformatted
+	// source for debugging; see codegen.Writer.Unformatted.  It can't
+	// be used with Lexer or Actions.
+	Raw bool
+	// Actions, if non-nil, receives the rules of the grammar, with the
+	// code of their actions, as a separate source file.  The output
+	// then holds only the parser and its tables, so that changes to
+	// the tables don't touch the file of actions.
+	Actions *[]byte
+	// Driver, if non-nil, receives the source of a command parsing
+	// files of the language and printing their trees, to go in a
+	// directory of its own; see writeDriver.
+	Driver *[]byte
+	// Report, if non-nil, receives a report measuring the grammar and
+	// classifying it, see metrics.go, and of the parts of the parse
+	// table that can never be used, and the rules never reduced as a
+	// result; see dead.go.
+	Report *[]byte
 }
 
-func Main(infile string, verbose bool) ([]byte, error) {
-	var trace Logger
-	if verbose {
-		trace = traceLog
+// log returns the Log that opts describe.
+func (opts *Options) log() *codegen.Log {
+	level := opts.Level
+	if opts.Verbose {
+		level = codegen.LevelDebug
 	}
+	return codegen.NewLog(opts.Log, level)
+}
+
+// ConflictError reports problems in the structure of a grammar: the
+// conflicts in its parse table, which strict mode disallows, or the
+// problems found by Prove.
+type ConflictError struct {
+	Path     string
+	Problems int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s found", e.Path, counted(e.Problems, "problem"))
+}
+
+// Stats describes the size of a generated parser.
+type Stats struct {
+	// Rules and States count the grammar's rules and the parser's
+	// states.
+	Rules, States int
+	// Actions counts the entries in the action table.
+	Actions int
+	// Conflicts counts the conflicts resolved in building the table.
+	Conflicts int
+	// Bytes is the size of the generated code.
+	Bytes int
+}
+
+// Main generates a parser from the grammar in infile, which may be a
+// file or a directory of files.
+func Main(infile string, opts *Options) ([]byte, error) {
+	lg := opts.log()
+	trace := lg.At(codegen.LevelDebug)
 
-	params, rules, err := Parse(infile)
+	params, rules, err := parse(infile, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	dir := opts.Dir
+	if dir == "" {
+		dir = params.srcDir
+	}
+	if err := relocate(dir, params, rules); err != nil {
+		return nil, err
+	}
+
+	if err := checkVars(rules); err != nil {
+		return nil, err
+	}
+
 	if trace != nil {
 		trace.Println("loaded rule table")
 		for i, rule := range rules {
@@ -280,26 +754,231 @@ func Main(infile string, verbose bool) ([]byte, error) {
 	}
 
 	g := &Grammar{rules:rules}
+	if err := g.setAmbiguous(params.Ambiguous); err != nil {
+		return nil, fmt.Errorf("%s: %s", infile, err)
+	}
+	g.CheckTypes(lg.At(codegen.LevelWarn))
+	g.numbered = g.rules
+	if opts.RuleIds != nil {
+		if g.numbered, err = numberRules(g, *opts.RuleIds); err != nil {
+			return nil, err
+		}
+	}
+	if params.Tokens != "" {
+		if err := g.LoadTokens(filepath.Join(params.srcDir, params.Tokens)); err != nil {
+			return nil, err
+		}
+	}
 	actions := ComputeActions(g, trace)
+	if warn := lg.At(codegen.LevelWarn); warn != nil {
+		reportConflicts(g, warn)
+	}
+	if err := resolveAmbiguous(g, actions); err != nil {
+		return nil, fmt.Errorf("%s: %s", infile, err)
+	}
+	if (opts.Strict || params.Strict) && len(g.conflicts) > 0 {
+		return nil, &ConflictError{Path: infile, Problems: len(g.conflicts)}
+	}
+	if opts.Report != nil {
+		*opts.Report = append(metricsReport(g), deadReport(g, actions)...)
+	}
+	inlined, err := inlineRules(g, actions, params.TokenType)
+	if err != nil {
+		return nil, err
+	}
+	if trace != nil && inlined > 0 {
+		trace.Printf("inlined %d transitions\n", inlined)
+	}
+	unminimized := len(actions)
+	if actions, err = Minimize(g, actions, params); err != nil {
+		return nil, err
+	}
+	if trace != nil {
+		trace.Printf("minimized %d states to %d\n", unminimized, len(actions))
+	}
+	var boundaries []string
+	if params.Concurrent {
+		if boundaries, err = concurrentSplit(g); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Profile != "" {
+		if actions, err = Profile(g, actions, opts.Profile); err != nil {
+			return nil, err
+		}
+	}
+	msgs, err := errorMessages(g, params)
+	if err != nil {
+		return nil, err
+	}
+	defaultReductions(g, actions, msgs)
+	modes, err := lexModes(g, actions)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", infile, err)
+	}
 
-	// Graph(g, actions)
-	// return
+	if opts.Graph {
+		return Graph(g, actions), nil
+	}
 
 	w := &codegen.Writer{}
-	tmpl := template.Must(template.New("parse").Parse(
-		strings.Replace(parseTemplate, "$", params.Prefix, -1)))
-	tmpl.Execute(w, params)
+	name, text := "parse.tmpl", parseTemplate
+	if params.Generic {
+		name, text = "generic.tmpl", genericTemplate
+	}
+	if text, err = codegen.Template(opts.Templates, name, text); err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("parse").Parse(strings.Replace(text, "$", params.Prefix, -1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	err = tmpl.Execute(w, struct {
+		*Params
+		ResultType string
+		Tree       bool
+		Messages   bool
+		Recovery   bool
+		Display    bool
+		Predicates bool
+		LexModes   bool
+		TokenPos   bool
+	}{params, g.rules[0].typ, buildsTree(g.rules), len(msgs) > 0, g.terminals.Has("error"), len(g.display) > 0, hasPredicates(g), modes != nil, tokenHasPos(dir, params)})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
 
-	w.Line("// Result returns the final result of a successful parse.")
-	w.Linef("func (p *%sParser) Result() %s {", params.Prefix, g.rules[0].typ)
-	w.Linef("return p.data[0].(%s)", g.rules[0].typ)
-	w.Line("}")
+	if !params.Generic {
+		w.Line("// Result returns the final result of a successful parse.")
+		w.Linef("func (p *%sParser) Result() %s {", params.Prefix, g.rules[0].typ)
+		w.Linef("return p.data[0].(%s)", g.rules[0].typ)
+		w.Line("}")
+	}
+
+	spans := writeTables(w, params, g, actions)
+	if params.Concurrent {
+		w.Line("")
+		writeConcurrent(w, params, g.rules[0].typ, boundaries)
+	}
+	if params.Introspect {
+		w.Line("")
+		writeIntrospection(w, params, g, actions)
+	}
+	if len(msgs) > 0 {
+		w.Line("")
+		writeErrorMessages(w, params, msgs)
+	}
+	if len(g.display) > 0 {
+		w.Line("")
+		writeDisplayNames(w, params, g.display)
+	}
+	if modes != nil {
+		w.Line("")
+		writeLexModes(w, params, modes)
+	}
 
-	writeTables(w, params, g, actions)
+	// The template leaves the imports of packages other than fmt,
+	// such as sort, to FixImports, so that they don't clash with
+	// imports of the same packages by the grammar.
+	w.FixImports()
+	if err := checkCollisions(dir, params, w.Raw()); err != nil {
+		return nil, err
+	}
+	if params.TypeCheck {
+		if err := typeCheck(w.Raw(), dir, params, spans); err != nil {
+			return nil, err
+		}
+	} else {
+		checkBindings(w.Raw(), dir, params, spans, lg.At(codegen.LevelWarn))
+	}
 
+	if opts.Raw {
+		if opts.Lexer != nil {
+			return nil, fmt.Errorf("unformatted output can't be combined with the lexer")
+		}
+		if opts.Actions != nil {
+			return nil, fmt.Errorf("unformatted output can't be split from the actions")
+		}
+		return w.Unformatted(), nil
+	}
 	code, err := w.Fmt()
 	if err != nil {
-		return nil, fmt.Errorf("error formatting code: %s\ncode: %s\n", err, w.Raw())
+		return nil, err
+	}
+	if opts.Actions != nil {
+		rules := make(map[string]bool)
+		for _, name := range []string{"Rules", "NewRules", "Predicates", "NewPredicates"} {
+			rules[params.Prefix+name] = true
+		}
+		if params.Generic {
+			for _, name := range ruleConstNames(g.numbered) {
+				rules[reduceFuncName(params, name)] = true
+			}
+		}
+		var actions []byte
+		if code, actions, err = codegen.Split(code, rules); err != nil {
+			return nil, err
+		}
+		*opts.Actions = codegen.Stamp(actions, infile)
+	}
+	if opts.Lexer != nil {
+		if code, err = combineLexer(code, params, opts.Lexer); err != nil {
+			return nil, err
+		}
+		if err := checkCollisions(dir, params, code); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Driver != nil {
+		dw := &codegen.Writer{}
+		if err := writeDriver(dw, dir, params, g); err != nil {
+			return nil, err
+		}
+		if *opts.Driver, err = dw.Fmt(); err != nil {
+			return nil, err
+		}
+	}
+	code = codegen.Stamp(code, infile)
+	if opts.RuleIds != nil {
+		*opts.RuleIds = formatRuleIds(g.numbered)
+	}
+	if opts.Stats != nil {
+		*opts.Stats = Stats{
+			Rules:     len(g.rules),
+			States:    len(actions),
+			Conflicts: len(g.conflicts),
+			Bytes:     len(code),
+		}
+		for _, state := range actions {
+			opts.Stats.Actions += len(state)
+		}
 	}
 	return code, nil
 }
+
+// combineLexer generates the lexer for the grammar's tokens file and
+// merges it with the parser code into a single file.
+func combineLexer(code []byte, params *Params, opts *lex.Options) ([]byte, error) {
+	if params.Tokens == "" {
+		return nil, fmt.Errorf("generating a combined lexer and parser needs lrTokens set")
+	}
+	// The lexer goes in the parser's package, and reads the tokens
+	// file named by the grammar.
+	lexOpts := *opts
+	lexOpts.Package = params.Package
+	lexOpts.Input = nil
+	lexCode, err := lex.Main(filepath.Join(params.srcDir, params.Tokens), &lexOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &codegen.Writer{}
+	w.Linef("package %s", params.Package)
+	w.Line("")
+	w.Linef("// %s", generatedComment)
+	w.Line("")
+	if err := w.Merge(code, lexCode); err != nil {
+		return nil, err
+	}
+	return w.Fmt()
+}
@@ -0,0 +1,815 @@
+package lr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const reproGrammar = `package calc
+
+func start() int {
+	syntax(` + "`S=expr`" + `)
+	return S
+}
+
+func expr() int {
+	syntax(` + "`A=expr + B=term`" + `)
+	return A + B
+
+	syntax(` + "`A=expr - B=term`" + `)
+	return A - B
+
+	syntax(` + "`B=term`" + `)
+	return B
+}
+
+func term() int {
+	syntax(` + "`A=term * B=factor`" + `)
+	return A * B
+
+	syntax(` + "`B=factor`" + `)
+	return B
+}
+
+func factor() int {
+	syntax(` + "`( E=expr )`" + `)
+	return E
+
+	syntax(` + "`N=num`" + `)
+	return len(N.Text)
+}
+`
+
+// TestReproducible checks that generating a parser gives the same
+// output every time, wherever the grammar lives.
+func TestReproducible(t *testing.T) {
+	var want []byte
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(t.TempDir(), "_grammar.go")
+		if err := os.WriteFile(path, []byte(reproGrammar), 0666); err != nil {
+			t.Fatal(err)
+		}
+		code, err := Main(path, &Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			want = code
+		} else if !bytes.Equal(code, want) {
+			t.Fatalf("run %d generated different output:\n%s\nfirst run:\n%s", i, code, want)
+		}
+	}
+}
+
+// TestCollisions checks that identifiers the generated code declares
+// are reported where the package or the grammar's helpers declare them
+// too.
+func TestCollisions(t *testing.T) {
+	for _, test := range []struct {
+		file, helper, want string
+	}{
+		{"var grammarParser int", "", "user.go:3:5: grammarParser collides"},
+		// Rule ID constants are named after the grammar's rules.
+		{"const grammarRuleStart = 0", "", "user.go:3:7: grammarRuleStart collides"},
+		{"type grammarAction struct{}", "", "user.go:3:6: grammarAction collides"},
+		{"", "func grammarRuleNames() {}", "_grammar.go:35:1: grammarRuleNames collides"},
+		{"var parser int", "", ""},
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "_grammar.go")
+		if err := os.WriteFile(path, []byte(reproGrammar+"\n"+test.helper+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "user.go"), []byte("package calc\n\n"+test.file+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Main(path, &Options{})
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%q: %s", test.file, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q %q: error %v, want %q", test.file, test.helper, err, test.want)
+		}
+	}
+}
+
+// stmtGrammar has rule code using statements beyond a single return:
+// defers, early returns of several values and declarations of types.
+const stmtGrammar = `package calc
+
+import "fmt"
+
+const lrTypeCheck = true
+
+func start() int {
+	syntax(` + "`L=list`" + `)
+	total := 0
+	defer func() { total = 0 }()
+	for _, n := range L {
+		total += n
+	}
+	return total
+}
+
+func list() ([]int, error) {
+	syntax(` + "`L=list N=num`" + `)
+	type item struct {
+		n  int
+		ok bool
+	}
+	it := item{len(N.Text), N.Text != "0"}
+	if !it.ok {
+		return nil, fmt.Errorf("zero at %d", len(L))
+	}
+	return append(L, it.n), nil
+
+	syntax(` + "`N=num`" + `)
+	type ints []int
+	return ints{len(N.Text)}, nil
+}
+`
+
+// TestActionStatements checks that rule code using any statement
+// compiles in both kinds of parser.
+func TestActionStatements(t *testing.T) {
+	for _, generic := range []string{"false", "true"} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "_grammar.go")
+		grammar := stmtGrammar + "\nconst lrGeneric = " + generic + "\n"
+		if err := os.WriteFile(path, []byte(grammar), 0666); err != nil {
+			t.Fatal(err)
+		}
+		token := "package calc\n\ntype Token struct {\n\tId, Text string\n\tPos      int\n}\n\nfunc (t Token) ParseId() string { return t.Id }\n"
+		if err := os.WriteFile(filepath.Join(dir, "token.go"), []byte(token), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Main(path, &Options{}); err != nil {
+			t.Errorf("generic %s: %s", generic, err)
+		}
+	}
+}
+
+// TestRecoverPos checks that panics in rule code are reported at the
+// lookahead token's Pos only if tokens have one.
+func TestRecoverPos(t *testing.T) {
+	for _, test := range []struct {
+		token, want string
+	}{
+		{"type Token struct{ Id, Text string; Pos int }", "e.Token.Pos"},
+		{"type Token struct{ Id, Text string }", "panic in %s at %v"},
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "_grammar.go")
+		grammar := reproGrammar + "\nconst lrRecover = true\nconst lrTypeCheck = true\n"
+		if err := os.WriteFile(path, []byte(grammar), 0666); err != nil {
+			t.Fatal(err)
+		}
+		token := "package calc\n\n" + test.token + "\n\nfunc (t Token) ParseId() string { return t.Id }\n"
+		if err := os.WriteFile(filepath.Join(dir, "token.go"), []byte(token), 0666); err != nil {
+			t.Fatal(err)
+		}
+		code, err := Main(path, &Options{})
+		if err != nil {
+			t.Errorf("%s: %s", test.token, err)
+		} else if !bytes.Contains(code, []byte(test.want)) {
+			t.Errorf("%s: output lacks %q", test.token, test.want)
+		}
+	}
+}
+
+// TestAlternativeVars checks that alternatives of one syntax() call
+// binding different variables, which their shared code could use
+// unbound, are an error.
+func TestAlternativeVars(t *testing.T) {
+	grammar := strings.Replace(reproGrammar, "`A=expr - B=term`", "`A=expr - B=term | B=term`", 1)
+	path := filepath.Join(t.TempDir(), "_grammar.go")
+	if err := os.WriteFile(path, []byte(grammar), 0666); err != nil {
+		t.Fatal(err)
+	}
+	want := "_grammar.go:12:2: alternatives must bind the same variables"
+	if _, err := Main(path, &Options{}); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error %v, want %q", err, want)
+	}
+}
+
+// bindingGrammar binds a rule of type *Foo where its code needs a
+// []Foo, and passes that rule's value through as a []Foo.
+const bindingGrammar = `package calc
+
+type Foo struct{ n int }
+
+func start() int {
+	syntax(` + "`F=foo`" + `)
+	var fs []Foo = F
+	return len(fs)
+
+	syntax(` + "`L=list`" + `)
+	return len(L)
+}
+
+func list() []Foo {
+	syntax(` + "`foo`" + `)
+}
+
+func foo() *Foo {
+	syntax(` + "`N=num`" + `)
+	return &Foo{len(N.Text)}
+}
+`
+
+// TestBindingTypes checks that values of rules used as types they
+// don't have are reported at the rules binding them.
+func TestBindingTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "_grammar.go")
+	if err := os.WriteFile(path, []byte(bindingGrammar), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := Main(path, &Options{Log: log.New(&buf, "", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"_grammar.go:6:2: F is bound to foo, of type *Foo, which its use on line 7 doesn't fit: cannot use F",
+		"_grammar.go:15:2: list passes through the value of foo, of type *Foo, which doesn't fit its type []Foo",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("warnings lack %q:\n%s", want, buf.String())
+		}
+	}
+
+	// Tokens embedding the lexer's, which isn't generated yet, have
+	// unknown fields, which aren't mismatches.
+	dir := t.TempDir()
+	path = filepath.Join(dir, "_grammar.go")
+	if err := os.WriteFile(path, []byte(reproGrammar), 0666); err != nil {
+		t.Fatal(err)
+	}
+	token := "package calc\n\ntype Token struct {\n\tTok\n\tPos int\n}\n"
+	if err := os.WriteFile(filepath.Join(dir, "token.go"), []byte(token), 0666); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := Main(path, &Options{Log: log.New(&buf, "", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("unexpected warnings:\n%s", buf.String())
+	}
+}
+
+// formatTable formats each row of table as its sorted entries, such
+// as "id:s5" for a shift to state 5 and "+:r2" for a reduction by the
+// rule with index 2.
+func formatTable(g *Grammar, table ActionTable) []string {
+	ruleIds := make(map[*Rule]int)
+	for i, rule := range g.rules {
+		ruleIds[rule] = i
+	}
+	var rows []string
+	for _, row := range table {
+		var entries []string
+		for sym, action := range row {
+			switch a := action.(type) {
+			case Shift:
+				entries = append(entries, fmt.Sprintf("%s:s%d", sym, a.state))
+			case Reduce:
+				entries = append(entries, fmt.Sprintf("%s:r%d", sym, ruleIds[a.rule]))
+			}
+		}
+		sort.Strings(entries)
+		rows = append(rows, strings.Join(entries, " "))
+	}
+	return rows
+}
+
+// formatItems formats the items of set, in grammar order.
+func formatItems(g *Grammar, set ItemSet) []string {
+	var items []string
+	for _, item := range set.Sorted(g) {
+		items = append(items, item.rule.Show("->", item.pos))
+	}
+	return items
+}
+
+// TestComputeActions checks the SLR table of the dragon book's
+// expression grammar, which has the 12 states of its figure 4.31,
+// numbered in the order of the symbols leading to them.
+func TestComputeActions(t *testing.T) {
+	g := testGrammar(dragon41...)
+	table := ComputeActions(g, nil)
+
+	wantItems := [][]string{
+		{"S -> · E", "E -> · E + T", "E -> · T", "T -> · T * F", "T -> · F", "F -> · ( E )", "F -> · id"},
+		{"E -> · E + T", "E -> · T", "T -> · T * F", "T -> · F", "F -> · ( E )", "F -> ( · E )", "F -> · id"},
+		{"S -> E ·", "E -> E · + T"},
+		{"T -> F ·"},
+		{"E -> T ·", "T -> T · * F"},
+		{"F -> id ·"},
+		{"E -> E · + T", "F -> ( E · )"},
+		{"E -> E + · T", "T -> · T * F", "T -> · F", "F -> · ( E )", "F -> · id"},
+		{"T -> T * · F", "F -> · ( E )", "F -> · id"},
+		{"F -> ( E ) ·"},
+		{"E -> E + T ·", "T -> T · * F"},
+		{"T -> T * F ·"},
+	}
+	wantTable := []string{
+		"(:s1 E:s2 F:s3 T:s4 id:s5",
+		"(:s1 E:s6 F:s3 T:s4 id:s5",
+		"+:s7 EOF:r0",
+		"):r4 *:r4 +:r4 EOF:r4",
+		"):r2 *:s8 +:r2 EOF:r2",
+		"):r6 *:r6 +:r6 EOF:r6",
+		"):s9 +:s7",
+		"(:s1 F:s3 T:s10 id:s5",
+		"(:s1 F:s11 id:s5",
+		"):r5 *:r5 +:r5 EOF:r5",
+		"):r1 *:s8 +:r1 EOF:r1",
+		"):r3 *:r3 +:r3 EOF:r3",
+	}
+
+	if len(g.states) != len(wantItems) {
+		t.Fatalf("got %d states, want %d", len(g.states), len(wantItems))
+	}
+	for i, set := range g.states {
+		if got := formatItems(g, set); !reflect.DeepEqual(got, wantItems[i]) {
+			t.Errorf("state %d items = %q, want %q", i, got, wantItems[i])
+		}
+	}
+	if got := formatTable(g, table); !reflect.DeepEqual(got, wantTable) {
+		t.Errorf("table =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(wantTable, "\n"))
+	}
+	if len(g.conflicts) != 0 {
+		t.Errorf("got conflicts %v, want none", g.conflicts)
+	}
+}
+
+// TestConflicts checks that an ambiguous grammar's conflicts are
+// resolved by reducing, and recorded.
+func TestConflicts(t *testing.T) {
+	g := testGrammar("S -> E", "E -> E + E", "E -> id")
+	table := ComputeActions(g, nil)
+
+	if len(g.conflicts) != 1 {
+		t.Fatalf("got %d conflicts, want 1", len(g.conflicts))
+	}
+	c := g.conflicts[0]
+	if got := formatItems(g, g.states[c.state]); !reflect.DeepEqual(got, []string{"E -> E · + E", "E -> E + E ·"}) {
+		t.Errorf("conflict in state with items %q", got)
+	}
+	if c.input != "+" || c.kept != (Reduce{rule: g.rules[1]}) {
+		t.Errorf("conflict on %s keeps %s, want reduce on +", c.input, describeAction(c.kept))
+	}
+	if _, ok := c.dropped.(Shift); !ok {
+		t.Errorf("conflict drops %s, want a shift", describeAction(c.dropped))
+	}
+	if table[c.state]["+"] != c.kept {
+		t.Errorf("table has %s, want the kept action", describeAction(table[c.state]["+"]))
+	}
+}
+
+// TestPredicates checks that a rule with a predicate resolves its
+// conflict by falling back to the other action.
+func TestPredicates(t *testing.T) {
+	g := testGrammar("S -> E", "E -> E + E", "E -> id")
+	g.rules[1].pred = "ok"
+	table := ComputeActions(g, nil)
+
+	if len(g.conflicts) != 0 {
+		t.Fatalf("got %d conflicts, want none", len(g.conflicts))
+	}
+	found := false
+	for _, row := range table {
+		if reduce, ok := row["+"].(Reduce); ok && reduce.rule == g.rules[1] {
+			found = true
+			if _, ok := reduce.otherwise.(Shift); !ok {
+				t.Errorf("reduce on + falls back to %s, want a shift", describeAction(reduce.otherwise))
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no state reduces by %s on +", g.rules[1].Show("->", -1))
+	}
+}
+
+// TestAmbiguous checks that a terminal standing for another is taken
+// as it where the state has only the other, and that a state taking
+// both is an error.
+func TestAmbiguous(t *testing.T) {
+	g := testGrammar("S -> x", "x -> v id T id", "x -> id < id")
+	if err := g.setAmbiguous(map[string]string{"<": "T"}); err != nil {
+		t.Fatal(err)
+	}
+	table := ComputeActions(g, nil)
+	if err := resolveAmbiguous(g, table); err != nil {
+		t.Fatal(err)
+	}
+	shifts := 0
+	for _, row := range table {
+		if _, ok := row["T"]; ok {
+			t.Errorf("table still has an action on T: %v", row)
+		}
+		if _, ok := row["<"].(Shift); ok {
+			shifts++
+		}
+	}
+	if shifts != 2 {
+		t.Errorf("%d states shift <, want 2", shifts)
+	}
+
+	g = testGrammar("S -> x", "x -> id T id", "x -> id < id")
+	g.setAmbiguous(map[string]string{"<": "T"})
+	table = ComputeActions(g, nil)
+	if err := resolveAmbiguous(g, table); err == nil || !strings.Contains(err.Error(), "x -> id · T id") {
+		t.Errorf("got error %v, want one showing the ambiguous state", err)
+	}
+}
+
+// TestLexModes checks that states take the lexer modes of the rules
+// shifting their terminals, and that the terminals of two modes can't
+// share a state.
+func TestLexModes(t *testing.T) {
+	g := testGrammar("S -> T", "T -> T P", "T -> P", "P -> text", "P -> { E C", "C -> }", "E -> id")
+	for _, rule := range g.rules {
+		if rule.symbol == "T" || rule.symbol == "P" {
+			rule.mode = "text"
+		}
+	}
+	table := ComputeActions(g, nil)
+	defaultReductions(g, table, nil)
+	modes, err := lexModes(g, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbrace := table[0]["{"].(Shift).state
+	rbrace := table[table[lbrace]["E"].(Shift).state]["}"].(Shift).state
+	if modes[0] != "text" {
+		t.Errorf("state 0 has mode %q, want text", modes[0])
+	}
+	if mode, ok := modes[lbrace]; !ok || mode != "" {
+		t.Errorf("state after { has mode %q, %v, want the default", mode, ok)
+	}
+	if mode, ok := modes[rbrace]; ok {
+		t.Errorf("state after } has mode %q, want it to follow its default reduction", mode)
+	}
+
+	g = testGrammar("S -> P", "P -> text", "P -> E", "E -> id")
+	g.rules[1].mode, g.rules[2].mode = "text", "text"
+	ComputeActions(g, nil)
+	if _, err := stateModes(g); err == nil || !strings.Contains(err.Error(), "E -> · id") {
+		t.Errorf("got error %v, want one showing the mixed state", err)
+	}
+}
+
+// TestInline checks that transitions into a state only reducing by an
+// inline rule go where the reduction would lead instead.
+func TestInline(t *testing.T) {
+	g := testGrammar(dragon41...)
+	g.rules[4].inline = true // T -> F
+	table := ComputeActions(g, nil)
+	n, err := inlineRules(g, table, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// F is taken as T after (, + and at the start; not after *,
+	// where F ends T -> T * F.
+	if n != 3 {
+		t.Errorf("redirected %d transitions, want 3", n)
+	}
+	for _, state := range []int{0, 1} {
+		if table[state]["F"] != table[state]["T"] {
+			t.Errorf("state %d goes to %v on F, want %v as on T", state, table[state]["F"], table[state]["T"])
+		}
+	}
+	if table[8]["F"] != (Shift{11}) {
+		t.Errorf("state 8 goes to %v on F, want state 11", table[8]["F"])
+	}
+
+	g.rules[4].typ = "Factor"
+	if _, err := inlineRules(g, ComputeActions(g, nil), ""); err == nil {
+		t.Error("inlining a rule changing the value's type succeeded")
+	}
+}
+
+// TestDeadReport checks the report of what a dangling else leaves dead.
+func TestDeadReport(t *testing.T) {
+	g := testGrammar("S -> s", "s -> if id then s", "s -> if id then s else s", "s -> id")
+	table := ComputeActions(g, nil)
+	report := string(deadReport(g, table))
+	for _, want := range []string{
+		"shift to state 7 is dead, as the state will reduce s -> if id then s",
+		"state 7: s -> if id then s else · s",
+		"reduce s -> id is dead, as no state it leads to takes else",
+		"s -> if id then s else s: it's only reduced in states reached by dropped actions",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report lacks %q:\n%s", want, report)
+		}
+	}
+
+	g = testGrammar(dragon41...)
+	if report := string(deadReport(g, ComputeActions(g, nil))); report != "no dead actions or rules\n" {
+		t.Errorf("report for a grammar without conflicts is\n%s", report)
+	}
+}
+
+// TestMetricsReport checks the measures and classes of grammars in the
+// report.
+func TestMetricsReport(t *testing.T) {
+	for _, test := range []struct {
+		rules []string
+		want  []string
+	}{
+		{dragon41, []string{
+			"7 rules, 4 nonterminals",
+			"E, T, F (left-recursive: E, T)",
+			"LL(1): no, as E is left-recursive",
+			"LR(0): no, as 2 states need a lookahead",
+			"SLR(1): yes",
+		}},
+		{[]string{"S -> s", "s -> a s", "s -> b", "s ->"}, []string{
+			"longest rule: 2 symbols, s -> a s",
+			"alternatives: 2.0 per nonterminal, at most 3, of s",
+			"depth: 2",
+			"LL(1): yes",
+		}},
+		// The classic grammar of assignments that's LALR(1) but not
+		// SLR(1), as = follows R in S -> L = R, though not where the
+		// parser has read an L.
+		{[]string{"T -> S", "S -> L = R", "S -> R", "L -> * R", "L -> id", "R -> L"}, []string{
+			"SLR(1): no, as its tables have 1 conflict",
+			"LALR(1): yes",
+			"LALR(1) but not SLR(1)",
+		}},
+	} {
+		g := testGrammar(test.rules...)
+		ComputeActions(g, nil)
+		report := string(metricsReport(g))
+		for _, want := range test.want {
+			if !strings.Contains(report, want) {
+				t.Errorf("report lacks %q:\n%s", want, report)
+			}
+		}
+	}
+}
+
+// TestAdvise checks the changes the ll and lr backends are advised to
+// need for grammars.
+func TestAdvise(t *testing.T) {
+	for _, test := range []struct {
+		rules  []string
+		ll, lr []string
+	}{
+		// Direct left recursion is an ll loop.
+		{dragon41, nil, nil},
+		{[]string{"S -> s", "s -> if id then s", "s -> if id then s else s", "s -> id"},
+			[]string{"factor out their common start, if id then s,"},
+			[]string{"guard s -> if id then s with when()"}},
+		{[]string{"S -> e", "e -> e + e", "e -> e * e", "e -> id"},
+			nil,
+			[]string{"of e -> e * e is ambiguous", "of e -> e + e is ambiguous"}},
+		{[]string{"S -> a", "a -> b x", "a -> y", "b -> a z"},
+			[]string{"a, b are left-recursive through each other; substitute the rules of b into those of a"},
+			nil},
+		{[]string{"T -> S", "S -> L = R", "S -> R", "L -> * R", "L -> id", "R -> L"},
+			[]string{"S -> L = R and S -> R both begin with * id"},
+			[]string{"only for want of lookaheads; give the uses of R that = can't follow"}},
+	} {
+		g := testGrammar(test.rules...)
+		ComputeActions(g, nil)
+		first := g.First(nil)
+		for _, backend := range []struct {
+			advice []advice
+			want   []string
+		}{
+			{adviseLL(g, first, g.Follow(first)), test.ll},
+			{adviseLR(g), test.lr},
+		} {
+			var msgs []string
+			for _, a := range backend.advice {
+				msgs = append(msgs, a.msg)
+			}
+			if len(msgs) != len(backend.want) {
+				t.Errorf("%v: advice is %q, want %q", test.rules, msgs, backend.want)
+				continue
+			}
+			for i, want := range backend.want {
+				if !strings.Contains(msgs[i], want) {
+					t.Errorf("%v: advice %q lacks %q", test.rules, msgs[i], want)
+				}
+			}
+		}
+	}
+}
+
+// TestTrace checks that the trace of building a table goes to the
+// logger it's given.
+func TestTrace(t *testing.T) {
+	var buf bytes.Buffer
+	g := testGrammar("S -> E", "E -> E + E", "E -> id")
+	ComputeActions(g, log.New(&buf, "", 0))
+	reportConflicts(g, log.New(&buf, "", 0))
+	for _, want := range []string{"follow set:", "set 0:", "conflict in state"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("trace lacks %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+// TestMinimize checks that unreachable states are dropped and
+// equivalent ones merged.
+func TestMinimize(t *testing.T) {
+	g := testGrammar("S -> x", "x -> a n", "x -> b n")
+	table := ActionTable{
+		{"a": Shift{1}, "b": Shift{2}},
+		{"n": Shift{3}},
+		{"n": Shift{4}},
+		{"EOF": Reduce{rule: g.rules[1]}},
+		{"EOF": Reduce{rule: g.rules[1]}},
+		{"EOF": Reduce{rule: g.rules[0]}},
+	}
+	out, err := Minimize(g, table, &Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a:s1 b:s1", "n:s2", "EOF:r1"}
+	if got := formatTable(g, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("minimized table = %q, want %q", got, want)
+	}
+}
+
+// TestProfile checks that Profile puts the states a corpus enters
+// most first, after the start state, in a table that parses as the
+// original did.
+func TestProfile(t *testing.T) {
+	g := testGrammar(dragon41...)
+	table := ComputeActions(g, nil)
+	start := formatTable(g, table)[0]
+	corpus := []string{"id + id * id", "( id ) * id", "id", "( ( id + id ) )"}
+	path := filepath.Join(t.TempDir(), "corpus")
+	if err := os.WriteFile(path, []byte(strings.Join(corpus, "\n")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := Profile(g, table, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(table) {
+		t.Fatalf("profiled table has %d states, want %d", len(out), len(table))
+	}
+
+	// The start state keeps its actions, which may shift to states
+	// numbered differently.
+	stripStates := func(row string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return -1
+			}
+			return r
+		}, row)
+	}
+	if got := formatTable(g, out)[0]; stripStates(got) != stripStates(start) {
+		t.Errorf("state 0 is %s, was %s", got, start)
+	}
+
+	counts := make([]int, len(out))
+	for _, line := range corpus {
+		if err := simulate(g, out, append(strings.Fields(line), "EOF"), counts); err != nil {
+			t.Errorf("profiled table fails on %q: %s", line, err)
+		}
+	}
+	for i := 2; i < len(counts); i++ {
+		if counts[i] > counts[i-1] {
+			t.Errorf("state %d is entered %d times, more than state %d's %d", i, counts[i], i-1, counts[i-1])
+		}
+	}
+	for _, line := range []string{"id + ( id", "id id"} {
+		if err := simulate(g, out, append(strings.Fields(line), "EOF"), make([]int, len(out))); err == nil {
+			t.Errorf("profiled table parses %q", line)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("id\nid +\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	want := path + ":2: unexpected EOF in state"
+	if _, err := Profile(g, table, path); err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("profiling a bad corpus: error %v, want %s...", err, want)
+	}
+}
+
+func TestNumberRules(t *testing.T) {
+	g := testGrammar(dragon41...)
+	ids := formatRuleIds(g.rules)
+
+	// A new rule takes the next ID, and the rest keep theirs.
+	g = testGrammar("S -> E", "E -> - E", "E -> E + T", "E -> T", "T -> T * F", "T -> F", "F -> ( E )", "F -> id")
+	numbered, err := numberRules(g, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rule := range numbered {
+		got = append(got, strings.TrimSpace(rule.Show("->", -1)))
+	}
+	want := append(append([]string{}, dragon41...), "E -> - E")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after adding a rule got\n%q\nwant\n%q", got, want)
+	}
+
+	// A removed rule's ID goes to the last rule.
+	g = testGrammar("S -> E", "E -> E + T", "T -> T * F", "T -> F", "F -> ( E )", "F -> id")
+	if numbered, err = numberRules(g, ids); err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, rule := range numbered {
+		got = append(got, strings.TrimSpace(rule.Show("->", -1)))
+	}
+	want = []string{"S -> E", "E -> E + T", "F -> id", "T -> T * F", "T -> F", "F -> ( E )"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after removing a rule got\n%q\nwant\n%q", got, want)
+	}
+}
+
+// ambiguousLess is a grammar with a terminal, targs<, that the lexer's
+// < stands for.
+const ambiguousLess = `package p
+
+var lrAmbiguous = map[string]string{"<": "targs<"}
+
+func start(X int) int {
+	syntax(` + "`X=x`" + `)
+	return X
+}
+
+func x() int {
+	syntax(` + "`type ident targs< ident > | ident < ident`" + `)
+	return 0
+}
+`
+
+// TestProve checks that Prove reports the sentences of an ambiguous
+// grammar with their parse trees, finds nothing wrong with the
+// calculator, whose terminals are its lrTokens, or with a grammar
+// whose parser takes the lexer's < for a terminal it stands for, and
+// checks such terminals as Main does.
+func TestProve(t *testing.T) {
+	const ambiguous = `package p
+
+func start(E int) int {
+	syntax(` + "`E=expr`" + `)
+	return E
+}
+
+func expr(A, B int) int {
+	syntax(` + "`A=expr + B=expr`" + `)
+	return A + B
+
+	syntax(` + "`num`" + `)
+	return 1
+}
+`
+	report, err := Prove("x.go", strings.NewReader(ambiguous), 4)
+	want := "ambiguous: num + num + num\n" +
+		"  (start (expr (expr (expr num) + (expr num)) + (expr num)))\n" +
+		"  (start (expr (expr num) + (expr (expr num) + (expr num))))\n"
+	if !strings.Contains(string(report), want) {
+		t.Errorf("report lacks\n%sgot\n%s", want, report)
+	}
+	if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("proving an ambiguous grammar: error %v, want a ConflictError", err)
+	}
+
+	for _, test := range []struct {
+		path, src string
+		depth     int
+	}{
+		{filepath.Join("..", "testdata", "_calc.go"), "", 7},
+		{"x.go", ambiguousLess, 5},
+	} {
+		var in io.Reader
+		if test.src != "" {
+			in = strings.NewReader(test.src)
+		}
+		report, err := Prove(test.path, in, test.depth)
+		if err != nil {
+			t.Errorf("%s: %s\n%s", test.path, err, report)
+		} else if !strings.Contains(string(report), "checked ") || strings.Contains(string(report), "rejected") {
+			t.Errorf("%s: report\n%s", test.path, report)
+		}
+	}
+
+	src := strings.Replace(ambiguousLess, "type ident", "ident", 1)
+	if _, err := Prove("x.go", strings.NewReader(src), 5); err == nil || !strings.Contains(err.Error(), "so the lexer's < is ambiguous there") {
+		t.Errorf("proving a grammar taking < as two terminals in a state: error %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package lr
+
+// Support for generating the parser into a package other than the one
+// holding the grammar.
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// qualifyType rewrites a type expression so that identifiers declared
+// in the grammar's package are qualified with pkg, e.g. "[]*Rule"
+// becomes "[]*ast.Rule".
+func qualifyType(typ, pkg string) (string, error) {
+	fset := token.NewFileSet()
+	e, err := parser.ParseExprFrom(fset, "", typ, 0)
+	if err != nil {
+		return "", fmt.Errorf("parsing type %q: %s", typ, err)
+	}
+
+	// Gather the identifiers that don't name types: package names,
+	// selected fields, and parameter names.
+	skip := make(map[*ast.Ident]bool)
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if x, ok := n.X.(*ast.Ident); ok {
+				skip[x] = true
+			}
+			skip[n.Sel] = true
+		case *ast.Field:
+			for _, name := range n.Names {
+				skip[name] = true
+			}
+		}
+		return true
+	})
+
+	var offsets []int
+	ast.Inspect(e, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || skip[id] || types.Universe.Lookup(id.Name) != nil {
+			return true
+		}
+		if !id.IsExported() {
+			err = fmt.Errorf("type %s in %q is not exported from package %s", id.Name, typ, pkg)
+		}
+		offsets = append(offsets, fset.Position(id.Pos()).Offset)
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Insert from the end so earlier offsets remain valid.
+	sort.Sort(sort.Reverse(sort.IntSlice(offsets)))
+	for _, off := range offsets {
+		typ = typ[:off] + pkg + "." + typ[off:]
+	}
+	return typ, nil
+}
+
+// packageNames returns the names declared at the top level of the Go
+// files of the package in dir that build.Default selects, leaving out
+// the grammar's own files.
+func packageNames(dir string, params *Params) (map[string]bool, error) {
+	bp, err := build.ImportDir(dir, 0)
+	if _, ok := err.(*build.NoGoError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, name := range bp.GoFiles {
+		path := filepath.Join(dir, name)
+		if isGrammarFile(path, params) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for name := range f.Scope.Objects {
+			names[name] = true
+		}
+	}
+	return names, nil
+}
+
+// qualifyCode rewrites the Go code of a rule, statements or with expr
+// set an expression, so that the identifiers in it referring to names,
+// the declarations of the grammar's package, are qualified with pkg.
+// Identifiers declared in the code, or among params, the names of the
+// variables it's given, are left alone, as are the field names of
+// struct literals.
+func qualifyCode(code string, expr bool, params []string, names map[string]bool, pkg string) (string, error) {
+	prefix := "package p\nfunc _("
+	for _, param := range params {
+		prefix += param + " int, "
+	}
+	prefix += ") {\n"
+	if expr {
+		prefix += "_ = "
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", prefix+code+"\n}\n", 0)
+	if err != nil {
+		return "", err
+	}
+
+	// The keys of struct literals are field names, though a map's
+	// may be constants of the package.
+	keys := make(map[*ast.Ident]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		switch lit.Type.(type) {
+		case *ast.MapType, *ast.ArrayType:
+			return true
+		}
+		for _, elt := range lit.Elts {
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				if id, ok := kv.Key.(*ast.Ident); ok {
+					keys[id] = true
+				}
+			}
+		}
+		return true
+	})
+
+	var offsets []int
+	for _, id := range f.Unresolved {
+		if !names[id.Name] || keys[id] {
+			continue
+		}
+		if !id.IsExported() {
+			return "", fmt.Errorf("%s is not exported from package %s", id.Name, pkg)
+		}
+		offsets = append(offsets, fset.Position(id.Pos()).Offset-len(prefix))
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(offsets)))
+	for _, off := range offsets {
+		code = code[:off] + pkg + "." + code[off:]
+	}
+	return code, nil
+}
+
+// relocate adjusts params and rules for output into the package in
+// dir, when that differs from the package holding the grammar.  The
+// generated code imports the grammar's package, and every reference
+// to its declarations, in rule types, the token and context types, and
+// rule code and predicates, is qualified with the package's name.
+// Nothing is copied from the grammar, as helpers copied into the
+// output would be types and functions other than the package's, so
+// helpers must be declared in the package's other files, and exported.
+func relocate(dir string, params *Params, rules []*Rule) error {
+	srcDir, err := filepath.Abs(params.srcDir)
+	if err != nil {
+		return err
+	}
+	dstDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if srcDir == dstDir {
+		return nil
+	}
+	if len(params.kept) > 0 {
+		kept := params.kept[0]
+		return fmt.Errorf("%s: %s would be copied into the parser, in another package than the grammar's; declare it in a file of package %s instead",
+			kept.pos, kept.name, params.srcPackage)
+	}
+
+	bp, err := build.ImportDir(srcDir, build.FindOnly)
+	if err != nil {
+		return err
+	}
+	if bp.ImportPath == "" || bp.ImportPath == "." {
+		return fmt.Errorf("can't determine import path of %s", srcDir)
+	}
+	names, err := packageNames(srcDir, params)
+	if err != nil {
+		return err
+	}
+
+	// srcPkg is the name the grammar's package was declared with, as
+	// opposed to the possibly overridden output package name.
+	srcPkg := params.srcPackage
+	params.Header += fmt.Sprintf("import %s %q\n", srcPkg, bp.ImportPath)
+
+	if params.TokenType, err = qualifyType(params.TokenType, srcPkg); err != nil {
+		return err
+	}
+	if params.Context != "" {
+		if params.Context, err = qualifyType(params.Context, srcPkg); err != nil {
+			return err
+		}
+	}
+	for _, rule := range rules {
+		if rule.typ, err = qualifyType(rule.typ, srcPkg); err != nil {
+			return fmt.Errorf("%s: rule %s: %s", rule.pos, rule.symbol, err)
+		}
+		results, err := qualifyType("func() "+rule.results, srcPkg)
+		if err != nil {
+			return fmt.Errorf("%s: rule %s: %s", rule.pos, rule.symbol, err)
+		}
+		rule.results = strings.TrimPrefix(results, "func() ")
+		if rule.recvType != "" {
+			rule.recvType = params.Context
+		}
+
+		vars := append([]string(nil), rule.vars...)
+		if rule.recv != "" {
+			vars = append(vars, rule.recv)
+		}
+		var declared []string
+		for _, v := range vars {
+			if v != "" {
+				declared = append(declared, v)
+			}
+		}
+		if rule.code, err = qualifyCode(rule.code, false, declared, names, srcPkg); err != nil {
+			return fmt.Errorf("%s: %s", rule.codePos, err)
+		}
+		if rule.pred != "" {
+			if rule.pred, err = qualifyCode(rule.pred, true, declared, names, srcPkg); err != nil {
+				return fmt.Errorf("%s: %s", rule.pos, err)
+			}
+		}
+	}
+	return nil
+}
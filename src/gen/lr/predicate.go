@@ -0,0 +1,81 @@
+package lr
+
+// Support for rules with predicates, given by a when() call after
+// their syntax().  The predicates are written as functions of the
+// matched values, like the rules' reduce functions, and a table of
+// fallbacks gives the action to take in place of a reduction whose
+// predicate fails.
+
+import (
+	"go/ast"
+	"go/parser"
+	"sort"
+
+	"gen/codegen"
+)
+
+// hasPredicates reports whether any rule of g has a predicate.
+func hasPredicates(g *Grammar) bool {
+	for _, rule := range g.rules {
+		if rule.pred != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// writePredicates writes the Predicates table, or the NewPredicates
+// function for rules written as methods, mapping the IDs of rules with
+// predicates to functions checking them.  Each function is recorded in
+// spans, so that type errors in it are reported at its rule.
+func writePredicates(w *codegen.Writer, params *Params, grammar *Grammar, ruleIds map[*Rule]int, symType func(string) string, spans *[]actionSpan) {
+	var rules []*Rule
+	for _, rule := range grammar.rules {
+		if rule.pred != "" {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return ruleIds[rules[i]] < ruleIds[rules[j]] })
+
+	predType := "map[int]func(data []interface{}) bool"
+	if params.Context != "" {
+		w.Linef("// %sNewPredicates returns the predicates of rules given by when(), by", params.Prefix)
+		w.Line("// rule ID, checked with the given context.")
+		w.Linef("func %sNewPredicates(%s %s) %s {", params.Prefix, contextVar, params.Context, predType)
+		w.Linef("return %s{", predType)
+	} else {
+		w.Linef("// %sPredicates holds the predicates of rules given by when(), by rule", params.Prefix)
+		w.Line("// ID.")
+		w.Linef("var %sPredicates = %s{", params.Prefix, predType)
+	}
+	for _, rule := range rules {
+		used := make(map[string]bool)
+		if expr, err := parser.ParseExpr(rule.pred); err == nil {
+			ast.Inspect(expr, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					used[id.Name] = true
+				}
+				return true
+			})
+		}
+		span := actionSpan{rule: rule, start: w.Lines() + 1}
+		w.Linef("%d: func(%s []interface{}) bool {", ruleIds[rule], dataVar)
+		if rule.recv != "" && used[rule.recv] {
+			w.Linef("%s := %s", rule.recv, contextVar)
+		}
+		for j, varname := range rule.vars {
+			if varname != "" && used[varname] {
+				w.Linef("%s := %s[%d].(%s)", varname, dataVar, j, symType(rule.pattern[j]))
+			}
+		}
+		w.Linef("return %s", rule.pred)
+		w.Line("},")
+		span.end = w.Lines()
+		span.code = span.end + 1
+		*spans = append(*spans, span)
+	}
+	w.Line("}")
+	if params.Context != "" {
+		w.Line("}")
+	}
+}
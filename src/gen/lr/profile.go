@@ -0,0 +1,102 @@
+package lr
+
+// Profile-guided ordering of parser states.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// simulate runs the parse of a sequence of terminals over table,
+// counting how often each state is entered.
+func simulate(grammar *Grammar, table ActionTable, input []string, counts []int) error {
+	stack := []int{0}
+	for _, tok := range input {
+		for {
+			state := stack[len(stack)-1]
+			counts[state]++
+			switch a := table[state][tok].(type) {
+			case Shift:
+				stack = append(stack, a.state)
+			case Reduce:
+				if a.rule == grammar.rules[0] {
+					// Accept.
+					return nil
+				}
+				stack = stack[:len(stack)-len(a.rule.pattern)]
+				next, ok := table[stack[len(stack)-1]][a.rule.symbol].(Shift)
+				if !ok {
+					return fmt.Errorf("bad next state after reducing %s", a.rule.symbol)
+				}
+				stack = append(stack, next.state)
+				continue
+			default:
+				return fmt.Errorf("unexpected %s in state %d", tok, state)
+			}
+			break
+		}
+	}
+	return fmt.Errorf("unexpected end of input")
+}
+
+// Profile reorders the states of table by how often they're entered
+// when parsing the corpus at path, hottest first, so that the busiest
+// rows of the generated table sit together.  Each line of the corpus
+// is one input, written as space-separated terminals; the EOF terminal
+// is implied.  The start state always remains state 0.
+func Profile(grammar *Grammar, table ActionTable, path string) (ActionTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	counts := make([]int, len(table))
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		input := strings.Fields(s.Text())
+		if len(input) == 0 {
+			continue
+		}
+		input = append(input, "EOF")
+		if err := simulate(grammar, table, input, counts); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(table)-1)
+	for i := range order {
+		order[i] = i + 1
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+	order = append([]int{0}, order...)
+
+	renumber := make([]int, len(table))
+	for to, from := range order {
+		renumber[from] = to
+	}
+	out := make(ActionTable, len(table))
+	for from, row := range table {
+		newRow := make(map[string]Action)
+		for sym, action := range row {
+			newRow[sym] = remapShifts(action, func(state int) int { return renumber[state] })
+		}
+		out[renumber[from]] = newRow
+	}
+	if grammar.states != nil {
+		states := make([]ItemSet, len(grammar.states))
+		for from, set := range grammar.states {
+			states[renumber[from]] = set
+		}
+		grammar.states = states
+	}
+	return out, nil
+}
@@ -0,0 +1,184 @@
+package lr
+
+// Brute force checking of a grammar for ambiguity.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// maxTrees bounds the number of parse trees Prove enumerates for any
+// one symbol, to keep the search from exploding.
+const maxTrees = 100000
+
+// tree is a parse tree: either a terminal leaf or a rule applied to
+// subtrees.
+type tree struct {
+	term string
+	rule *Rule
+	kids []*tree
+}
+
+// yield appends the terminals at the leaves of t to out.
+func (t *tree) yield(out []string) []string {
+	if t.rule == nil {
+		return append(out, t.term)
+	}
+	for _, kid := range t.kids {
+		out = kid.yield(out)
+	}
+	return out
+}
+
+func (t *tree) String() string {
+	if t.rule == nil {
+		return t.term
+	}
+	var parts []string
+	for _, kid := range t.kids {
+		parts = append(parts, kid.String())
+	}
+	return "(" + t.rule.symbol + " " + strings.Join(parts, " ") + ")"
+}
+
+// enumerator generates all parse trees up to a given depth.
+type enumerator struct {
+	grammar *Grammar
+	memo    map[string][]*tree
+}
+
+// trees returns all trees rooted at sym of at most the given depth.
+func (e *enumerator) trees(sym string, depth int) ([]*tree, error) {
+	if !e.grammar.nonterminals.Has(sym) {
+		return []*tree{{term: sym}}, nil
+	}
+	if depth == 0 {
+		return nil, nil
+	}
+	key := fmt.Sprintf("%s/%d", sym, depth)
+	if ts, ok := e.memo[key]; ok {
+		return ts, nil
+	}
+
+	var out []*tree
+	for _, rule := range e.grammar.rules {
+		if rule.symbol != sym {
+			continue
+		}
+		// Build up the cross product of the pattern's subtrees.
+		partial := [][]*tree{nil}
+		for _, patSym := range rule.pattern {
+			kids, err := e.trees(patSym, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			var next [][]*tree
+			for _, p := range partial {
+				for _, kid := range kids {
+					next = append(next, append(p[:len(p):len(p)], kid))
+				}
+			}
+			partial = next
+			if len(partial) > maxTrees {
+				return nil, fmt.Errorf("more than %d trees for %s at depth %d; try a smaller depth", maxTrees, sym, depth)
+			}
+		}
+		for _, kids := range partial {
+			out = append(out, &tree{rule: rule, kids: kids})
+		}
+	}
+	e.memo[key] = out
+	return out, nil
+}
+
+// Prove enumerates every sentence of the grammar in infile, or read
+// from in if it's non-nil, derivable with parse trees of at most depth
+// levels, and reports sentences with more than one parse tree (the
+// grammar is ambiguous) or that the generated parser rejects (a
+// conflict was resolved badly).  It returns the report and a non-nil
+// error if any problems were found.
+func Prove(infile string, in io.Reader, depth int) ([]byte, error) {
+	params, rules, err := parse(infile, &Options{Input: in})
+	if err != nil {
+		return nil, err
+	}
+	g := &Grammar{rules: rules}
+	if err := g.setAmbiguous(params.Ambiguous); err != nil {
+		return nil, fmt.Errorf("%s: %s", infile, err)
+	}
+	if params.Tokens != "" {
+		if err := g.LoadTokens(filepath.Join(params.srcDir, params.Tokens)); err != nil {
+			return nil, err
+		}
+	}
+	table := ComputeActions(g, nil)
+	buf := &bytes.Buffer{}
+	reportConflicts(g, log.New(buf, "", 0))
+	if err := resolveAmbiguous(g, table); err != nil {
+		return nil, fmt.Errorf("%s: %s", infile, err)
+	}
+	// The parser takes the terminals an ambiguous one stands for as
+	// the one the lexer returns.
+	lexed := make(map[string]string)
+	for tok, alts := range g.ambiguous {
+		for _, alt := range alts {
+			lexed[alt] = tok
+		}
+	}
+
+	e := &enumerator{grammar: g, memo: make(map[string][]*tree)}
+	trees, err := e.trees(g.rules[0].symbol, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the trees by the sentence they derive, keeping the order
+	// of first appearance for stable output.
+	var sentences []string
+	bySentence := make(map[string][]*tree)
+	for _, t := range trees {
+		s := strings.Join(t.yield(nil), " ")
+		if bySentence[s] == nil {
+			sentences = append(sentences, s)
+		}
+		bySentence[s] = append(bySentence[s], t)
+	}
+
+	problems := 0
+	for _, s := range sentences {
+		ts := bySentence[s]
+		if len(ts) > 1 {
+			problems++
+			fmt.Fprintf(buf, "ambiguous: %s\n", s)
+			for _, t := range ts {
+				fmt.Fprintf(buf, "  %s\n", t)
+			}
+		}
+
+		var input []string
+		for _, sym := range strings.Fields(s) {
+			if members := g.classes[sym]; len(members) > 0 {
+				sym = members[0]
+			}
+			if tok, ok := lexed[sym]; ok {
+				sym = tok
+			}
+			input = append(input, sym)
+		}
+		input = append(input, "EOF")
+		if err := simulate(g, table, input, make([]int, len(table))); err != nil {
+			problems++
+			fmt.Fprintf(buf, "rejected: %s: %s\n", s, err)
+		}
+	}
+	fmt.Fprintf(buf, "checked %d sentences from %d trees of depth <= %d\n", len(sentences), len(trees), depth)
+
+	if problems > 0 {
+		return buf.Bytes(), &ConflictError{Path: infile, Problems: problems}
+	}
+	return buf.Bytes(), nil
+}
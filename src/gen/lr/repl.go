@@ -0,0 +1,183 @@
+package lr
+
+// Interactive testing of a grammar against inputs, without generating
+// and building its parser.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gen/codegen"
+	"gen/lex"
+	"gen/lr/runtime"
+)
+
+// interp holds a grammar's parse table built in memory, for running
+// over inputs without generating the parser.
+type interp struct {
+	g     *Grammar
+	table ActionTable
+	// scanner lexes inputs, or if nil, they're taken to be terminals
+	// separated by white space.
+	scanner *lex.Scanner
+}
+
+// newInterp builds the parse table of the grammar in infile, and the
+// scanner for the tokens file at tokens, or if that's empty, the
+// grammar's lrTokens, if it sets one.
+func newInterp(infile string, opts *Options, tokens string) (*interp, error) {
+	lg := opts.log()
+	params, rules, err := parse(infile, opts)
+	if err != nil {
+		return nil, err
+	}
+	if tokens == "" && params.Tokens != "" {
+		tokens = filepath.Join(params.srcDir, params.Tokens)
+	}
+	in := &interp{g: &Grammar{rules: rules}}
+	if err := in.g.setAmbiguous(params.Ambiguous); err != nil {
+		return nil, err
+	}
+	if tokens != "" {
+		f, err := os.Open(tokens)
+		if err != nil {
+			return nil, err
+		}
+		toks, _, err := lex.ReadTokens(f, tokens)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if in.scanner, err = lex.NewScanner(toks); err != nil {
+			return nil, fmt.Errorf("%s: %s", tokens, err)
+		}
+		if err := in.g.LoadTokens(tokens); err != nil {
+			return nil, err
+		}
+	}
+	in.table = ComputeActions(in.g, lg.At(codegen.LevelDebug))
+	if warn := lg.At(codegen.LevelWarn); warn != nil {
+		reportConflicts(in.g, warn)
+	}
+	if err := resolveAmbiguous(in.g, in.table); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// inputToken is a token of an input to an interp.
+type inputToken struct {
+	// id is the terminal the token matches, and text its text.
+	id, text string
+}
+
+func (t inputToken) ParseId() string { return t.id }
+
+func (t inputToken) String() string { return t.text }
+
+// lex splits line into tokens, ending with EOF.
+func (in *interp) lex(line string) ([]inputToken, error) {
+	var toks []inputToken
+	if in.scanner == nil {
+		for _, f := range strings.Fields(line) {
+			toks = append(toks, inputToken{f, f})
+		}
+		return append(toks, inputToken{"EOF", "EOF"}), nil
+	}
+	lexemes, err := in.scanner.Scan(line)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range lexemes {
+		text := l.Text
+		if text == "" {
+			text = l.Token.Display()
+		}
+		toks = append(toks, inputToken{l.Token.Value(), text})
+	}
+	return toks, nil
+}
+
+// replListener prints the reductions of a parse.
+type replListener struct {
+	rules []*Rule
+	out   io.Writer
+}
+
+func (l *replListener) EnterRule(rule int, span runtime.Span[inputToken]) {}
+
+func (l *replListener) ExitRule(rule int, span runtime.Span[inputToken]) {
+	fmt.Fprintf(l.out, "  %s\n", l.rules[rule].Show("->", -1))
+}
+
+// Repl builds the parse table of the grammar in infile in memory and
+// runs it over each line read from in, lexed with the tokens file at
+// tokens, or if that's empty, the grammar's lrTokens.  Without either,
+// a line is read as terminals separated by white space.  For each line
+// it writes to out the reductions made, whether the grammar accepts
+// the line, and if so its parse tree.  The rules' code isn't run, so
+// their predicates are taken to hold.
+func Repl(infile string, opts *Options, tokens string, in io.Reader, out io.Writer) error {
+	ip, err := newInterp(infile, opts, tokens)
+	if err != nil {
+		return err
+	}
+	rules := ip.g.rules
+
+	// The runtime numbers rules by their place in the grammar.
+	ids := make(map[*Rule]int)
+	rtRules := make([]runtime.Rule, len(rules))
+	for i, rule := range rules {
+		ids[rule] = i
+		symbol := rule.symbol
+		rtRules[i] = runtime.Rule{
+			Symbol:  symbol,
+			Pattern: rule.pattern,
+			Reduce: func(data []any) (any, error) {
+				return append([]any{symbol}, data...), nil
+			},
+		}
+	}
+	rtTable := make(runtime.ActionTable, len(ip.table))
+	for i, row := range ip.table {
+		rtTable[i] = make(map[string]runtime.Action)
+		for sym, action := range row {
+			switch a := action.(type) {
+			case Shift:
+				rtTable[i][sym] = runtime.Action(a.state)
+			case Reduce:
+				rtTable[i][sym] = runtime.Action(-ids[a.rule])
+			}
+		}
+	}
+
+	listener := &replListener{rules: rules, out: out}
+	prompt := func() { fmt.Fprint(out, "> ") }
+	s := bufio.NewScanner(in)
+	for prompt(); s.Scan(); prompt() {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		input, err := ip.lex(line)
+		if err != nil {
+			fmt.Fprintf(out, "rejected: %s\n", err)
+			continue
+		}
+		p := runtime.NewParser[[]any, inputToken](rtRules, rtTable)
+		p.Listener = listener
+		p.DisplayNames = ip.g.display
+		if err := p.ParseTokens(input); err != nil {
+			fmt.Fprintf(out, "rejected: %s\n", err)
+			continue
+		}
+		fmt.Fprintln(out, "accepted")
+		runtime.DumpTree(out, p.Result())
+	}
+	fmt.Fprintln(out)
+	return s.Err()
+}
@@ -0,0 +1,95 @@
+package lr
+
+// Support for keeping the IDs of rules stable as a grammar changes.
+//
+// A rule's ID is its index in the generated rule table, and the
+// action table refers to rules by ID, so adding a rule early in a
+// grammar would renumber all the reductions after it.  A rule ID file
+// records the ID of each rule, one per line, as in
+//   3 expr -> expr + term
+// Rules listed in the file keep their IDs; new rules take the IDs of
+// rules that were removed, and then IDs after the others.  The start
+// rule is always rule 0, which the parser accepts on.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// numberRules orders the rules of g by the IDs given in the rule ID
+// file data, returning them in ID order.
+func numberRules(g *Grammar, data []byte) ([]*Rule, error) {
+	// prev maps each production to the IDs it had, in order.
+	prev := make(map[string][]int)
+	size := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || id < 0 || len(fields) < 2 {
+			return nil, fmt.Errorf("rule IDs line %d: expected an ID and a rule", line)
+		}
+		prod := strings.TrimSpace(fields[1])
+		prev[prod] = append(prev[prod], id)
+		size = max(size, id+1)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	numbered := make([]*Rule, max(size, len(g.rules)))
+	numbered[0] = g.rules[0]
+	var added []*Rule
+	for _, rule := range g.rules[1:] {
+		prod := strings.TrimSpace(rule.Show("->", -1))
+		ids := prev[prod]
+		for len(ids) > 0 && (ids[0] == 0 || numbered[ids[0]] != nil) {
+			ids = ids[1:]
+		}
+		if len(ids) == 0 {
+			added = append(added, rule)
+			continue
+		}
+		numbered[ids[0]] = rule
+		prev[prod] = ids[1:]
+	}
+
+	// Fill the IDs of removed rules with the new rules, and then with
+	// the rules from the end.
+	for i := range numbered {
+		if numbered[i] != nil {
+			continue
+		}
+		if len(added) > 0 {
+			numbered[i], added = added[0], added[1:]
+			continue
+		}
+		for j := len(numbered) - 1; j > i; j-- {
+			if numbered[j] != nil {
+				numbered[i], numbered[j] = numbered[j], nil
+				break
+			}
+		}
+	}
+	for len(numbered) > 0 && numbered[len(numbered)-1] == nil {
+		numbered = numbered[:len(numbered)-1]
+	}
+	return append(numbered, added...), nil
+}
+
+// formatRuleIds writes the rule ID file for rules, in ID order.
+func formatRuleIds(rules []*Rule) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Rule IDs kept stable across changes to the grammar by gen lr.\n")
+	for i, rule := range rules {
+		fmt.Fprintf(&buf, "%d %s\n", i, strings.TrimSpace(rule.Show("->", -1)))
+	}
+	return buf.Bytes()
+}
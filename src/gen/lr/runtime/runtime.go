@@ -0,0 +1,485 @@
+// Package runtime is the support code for parsers generated by gen lr
+// in generic mode.  Generated code supplies the tables; this package
+// runs them.
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+// TokenLike is the interface required of tokens.
+type TokenLike interface {
+	// ParseId returns the terminal symbol the token matches.
+	ParseId() string
+}
+
+// Rule is a rule of the grammar.
+type Rule struct {
+	Symbol  string
+	Pattern []string
+	// Reduce computes the rule's value from the values of the
+	// matched pattern.  If nil, the value is a []any of them.
+	// Generated parsers pass them to a function of the rule's code
+	// whose parameters and result have the types of the grammar.
+	Reduce func(data []any) (any, error)
+}
+
+// Action is an entry in the action table.
+// Encoding:
+//
+//	0: accept
+//	n: shift n
+//	-n: reduce n
+//	(errors are not in the map)
+type Action int
+
+// ActionTable holds a parser's precomputed state.
+// table[state][token] => action to take on token from state.
+type ActionTable []map[string]Action
+
+// ParseError reports a panic in the code of a rule.
+type ParseError struct {
+	// Rule is the symbol of the rule that panicked.
+	Rule string
+	// Token is the lookahead token at the time.
+	Token any
+	// Value is the value passed to panic.
+	Value any
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("at %v: panic in %s: %v", e.Token, e.Rule, e.Value)
+}
+
+// Arena allocates the nodes of trees built by rules without code in
+// large chunks, to spare the garbage collector.  An Arena may be shared
+// by the parsers of successive parses, but not by concurrent ones.
+type Arena struct {
+	chunks [][]any
+	// next is the chunk being allocated from, and used the number of
+	// its slots allocated.
+	next, used int
+}
+
+// arenaChunk is the number of slots in each chunk of an Arena.
+const arenaChunk = 4096
+
+func (a *Arena) alloc(n int) []any {
+	for a.next < len(a.chunks) && len(a.chunks[a.next])-a.used < n {
+		a.next++
+		a.used = 0
+	}
+	if a.next == len(a.chunks) {
+		a.chunks = append(a.chunks, make([]any, max(n, arenaChunk)))
+	}
+	s := a.chunks[a.next][a.used : a.used+n : a.used+n]
+	a.used += n
+	return s
+}
+
+// Release makes the memory of the arena available for reuse.  Trees
+// built from it must no longer be used.
+func (a *Arena) Release() {
+	for i := 0; i <= a.next && i < len(a.chunks); i++ {
+		clear(a.chunks[i])
+	}
+	a.next, a.used = 0, 0
+}
+
+// Span is the range of tokens matched by a rule.
+type Span[Tok TokenLike] struct {
+	// First and Last are the first and last tokens matched; both are
+	// zero if the rule matched nothing.
+	First, Last Tok
+}
+
+// Listener is notified around each reduction a Parser makes.
+type Listener[Tok TokenLike] interface {
+	// EnterRule is called before the code of the rule with the given
+	// ID runs on the tokens in span.
+	EnterRule(rule int, span Span[Tok])
+	// ExitRule is called after the code of the rule has run.
+	ExitRule(rule int, span Span[Tok])
+}
+
+// Parser runs a parse of Tok tokens producing a T.
+type Parser[T any, Tok TokenLike] struct {
+	// Trace, if non-nil, logs the parse as it happens.
+	Trace *log.Logger
+	// Recover specifies whether to recover from panics in rule code,
+	// returning them as a *ParseError.
+	Recover bool
+	// Listener, if non-nil, is notified around each reduction.
+	Listener Listener[Tok]
+	// Arena, if non-nil, allocates the nodes of built trees.
+	Arena *Arena
+	// Defaults gives the reduction each state makes whatever the next
+	// token, or 0 if it has none.
+	Defaults []Action
+	// Messages gives the grammar's messages for parse errors, by
+	// parser state and then token, with "" for any token.
+	Messages map[int]map[string]string
+	// DisplayNames gives the names of terminals as shown in error
+	// messages, where they differ from the terminal.
+	DisplayNames map[string]string
+	// LexModes gives the lexer mode of the next token in each state
+	// that decides it, for grammars whose rules have lexer modes.
+	LexModes map[int]string
+	// Predicates gives the predicates of rules, by rule ID, which must
+	// hold for the parser to reduce by them.  When one fails, Fallbacks
+	// gives the action to take instead, by state and token, if any.
+	Predicates map[int]func(data []any) bool
+	Fallbacks  map[int]map[string]Action
+	// Errors holds the syntax errors the parser has recovered from,
+	// for grammars with error rules.
+	Errors []error
+
+	// recovering is set after recovering from an error until the next
+	// token is shifted; until then tokens that don't fit are dropped.
+	recovering bool
+	rules      []Rule
+	actions    ActionTable
+	stack      []int
+	data       []any
+	spans      []Span[Tok]
+}
+
+// NewParser constructs a new Parser from generated tables, ready for
+// input.
+func NewParser[T any, Tok TokenLike](rules []Rule, actions ActionTable) *Parser[T, Tok] {
+	return &Parser[T, Tok]{
+		rules:   rules,
+		actions: actions,
+		stack:   []int{0},
+	}
+}
+
+// reduce calls the reduce function of rule, converting a panic into
+// a ParseError if requested.
+func (p *Parser[T, Tok]) reduce(rule *Rule, data []any, tok Tok) (result any, err error) {
+	if p.Recover {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &ParseError{Rule: rule.Symbol, Token: tok, Value: r}
+			}
+		}()
+	}
+	return rule.Reduce(data)
+}
+
+// Parse processes one token, returning true on a complete parse and
+// false when more input is expected.
+func (p *Parser[T, Tok]) Parse(tok Tok) (bool, error) {
+	for {
+		if p.Trace != nil {
+			p.Trace.Printf("stack:%v, data:%v tok:%v\n", p.stack, p.data, tok.ParseId())
+		}
+		action, ok := p.action(p.stack[len(p.stack)-1], tok.ParseId())
+		// A rule whose predicate fails gives way to the fallback
+		// action, if there is one; without one the token is unexpected.
+		for ok && action < 0 {
+			pred := p.Predicates[int(-action)]
+			if pred == nil || pred(p.data[len(p.data)-len(p.rules[-action].Pattern):]) {
+				break
+			}
+			action, ok = p.Fallbacks[p.stack[len(p.stack)-1]][tok.ParseId()]
+		}
+		if !ok {
+			if p.recovering {
+				if tok.ParseId() == "EOF" {
+					return false, errors.Join(p.Errors...)
+				}
+				// Drop the token.
+				return false, nil
+			}
+			err := p.unexpected(tok)
+			if p.recoverFrom(tok) {
+				p.Errors = append(p.Errors, err)
+				continue
+			}
+			return false, err
+		}
+
+		if action > 0 {
+			// To shift, we consume the current token and put the next
+			// state on the stack.
+			nextState := int(action)
+			if p.Trace != nil {
+				p.Trace.Printf("input %v => shift %#v\n", tok, nextState)
+			}
+			p.data = append(p.data, tok)
+			p.stack = append(p.stack, nextState)
+			p.spans = append(p.spans, Span[Tok]{tok, tok})
+			p.recovering = false
+
+			// Ready for another token.
+			return false, nil
+		}
+
+		// To reduce, we pop off the matching pattern from the stacks.
+		rule := &p.rules[-action]
+		if p.Trace != nil {
+			p.Trace.Printf("input %v => reduce %s -> %s\n", tok, rule.Pattern, rule.Symbol)
+		}
+		popCount := len(rule.Pattern)
+
+		var span Span[Tok]
+		if popCount > 0 {
+			span.First = p.spans[len(p.spans)-popCount].First
+			span.Last = p.spans[len(p.spans)-1].Last
+		}
+		if p.Listener != nil {
+			p.Listener.EnterRule(int(-action), span)
+		}
+
+		// Update the data stack via the reduce function if available.
+		oldData := p.data[len(p.data)-popCount:]
+		var newData any
+		if rule.Reduce != nil {
+			var err error
+			newData, err = p.reduce(rule, oldData, tok)
+			if err != nil {
+				return false, err
+			}
+		} else {
+			var s []any
+			if p.Arena != nil {
+				s = p.Arena.alloc(popCount)
+			} else {
+				s = make([]any, popCount)
+			}
+			copy(s, oldData)
+			newData = s
+		}
+		p.data = p.data[:len(p.data)-popCount]
+		p.data = append(p.data, newData)
+		if p.Listener != nil {
+			p.Listener.ExitRule(int(-action), span)
+		}
+		p.spans = append(p.spans[:len(p.spans)-popCount], span)
+
+		p.stack = p.stack[:len(p.stack)-popCount]
+
+		if action == 0 {
+			// Accept.
+			return true, nil
+		}
+
+		// Advance to the next state.
+		state := p.stack[len(p.stack)-1]
+		action, ok = p.actions[state][rule.Symbol]
+		if !ok || action <= 0 {
+			return false, fmt.Errorf("parse error near %v: bad next state", tok)
+		}
+
+		p.stack = append(p.stack, int(action))
+	}
+}
+
+// unexpected returns the error for a token the parser can't accept:
+// the grammar's message for the situation if it has one, or else the
+// list of the terminals it expected.
+func (p *Parser[T, Tok]) unexpected(tok Tok) error {
+	msgs := p.Messages[p.stack[len(p.stack)-1]]
+	if msg, ok := msgs[tok.ParseId()]; ok {
+		return fmt.Errorf("unexpected token %v: %s", tok, msg)
+	} else if msg, ok := msgs[""]; ok {
+		return fmt.Errorf("unexpected token %v: %s", tok, msg)
+	}
+	expected := p.Completions()
+	for i, term := range expected {
+		if name, ok := p.DisplayNames[term]; ok {
+			expected[i] = name
+		}
+	}
+	return fmt.Errorf("unexpected token: %v; expected one of %s", tok, strings.Join(expected, ", "))
+}
+
+// recoverFrom handles a syntax error at tok by popping states until
+// one can shift the error terminal, as matched by the grammar's error
+// rules, and shifting it with tok as its value.  It reports whether
+// there was such a state.
+func (p *Parser[T, Tok]) recoverFrom(tok Tok) bool {
+	depth := len(p.stack) - 1
+	for ; depth >= 0; depth-- {
+		if action, ok := p.actions[p.stack[depth]]["error"]; ok && action > 0 {
+			break
+		}
+	}
+	if depth < 0 {
+		return false
+	}
+	popCount := len(p.stack) - 1 - depth
+	p.data = append(p.data[:len(p.data)-popCount], tok)
+	p.spans = append(p.spans[:len(p.spans)-popCount], Span[Tok]{tok, tok})
+	p.stack = append(p.stack[:depth+1], int(p.actions[p.stack[depth]]["error"]))
+	p.recovering = true
+	return true
+}
+
+// LexMode returns the lexer mode the parser expects its next token in,
+// "" being the default mode, for the lexer to read the token in.
+func (p *Parser[T, Tok]) LexMode() string {
+	// The mode is that of the state the default reductions, which
+	// don't depend on the token, lead to.
+	stack := p.stack
+	for {
+		state := stack[len(stack)-1]
+		if mode, ok := p.LexModes[state]; ok {
+			return mode
+		}
+		if state >= len(p.Defaults) || p.Defaults[state] == 0 {
+			return ""
+		}
+		rule := &p.rules[-p.Defaults[state]]
+		n := len(stack) - len(rule.Pattern)
+		next := int(p.actions[stack[n-1]][rule.Symbol])
+		stack = append(append([]int(nil), stack[:n]...), next)
+	}
+}
+
+// Completions returns the terminals the parser can accept next, given
+// the input so far, sorted.  As the parser's state includes the
+// expansions of the nonterminals it expects, these include the
+// terminals that can begin them.
+func (p *Parser[T, Tok]) Completions() []string {
+	nonterminals := make(map[string]bool)
+	for _, rule := range p.rules {
+		nonterminals[rule.Symbol] = true
+	}
+	// The terminals are those of the state the default reductions,
+	// which don't depend on the token, lead to.
+	stack := append([]int(nil), p.stack...)
+	for {
+		state := stack[len(stack)-1]
+		if state >= len(p.Defaults) || p.Defaults[state] == 0 {
+			break
+		}
+		rule := &p.rules[-p.Defaults[state]]
+		stack = stack[:len(stack)-len(rule.Pattern)]
+		stack = append(stack, int(p.actions[stack[len(stack)-1]][rule.Symbol]))
+	}
+	var toks []string
+	for tok := range p.actions[stack[len(stack)-1]] {
+		if !nonterminals[tok] && tok != "error" && p.accepts(tok) {
+			toks = append(toks, tok)
+		}
+	}
+	sort.Strings(toks)
+	return toks
+}
+
+// action returns the action of state on the terminal tok: the
+// state's default reduction, if it has one, or its entry for tok.
+func (p *Parser[T, Tok]) action(state int, tok string) (Action, bool) {
+	if state < len(p.Defaults) && p.Defaults[state] != 0 {
+		return p.Defaults[state], true
+	}
+	action, ok := p.actions[state][tok]
+	return action, ok
+}
+
+// accepts reports whether the terminal tok can be shifted or accepted
+// next, simulating the reductions it causes on a copy of the stack.
+func (p *Parser[T, Tok]) accepts(tok string) bool {
+	stack := append([]int(nil), p.stack...)
+	for {
+		action, ok := p.action(stack[len(stack)-1], tok)
+		if !ok {
+			return false
+		} else if action >= 0 {
+			return true
+		}
+		rule := &p.rules[-action]
+		stack = stack[:len(stack)-len(rule.Pattern)]
+		next, ok := p.actions[stack[len(stack)-1]][rule.Symbol]
+		if !ok || next <= 0 {
+			return false
+		}
+		stack = append(stack, int(next))
+	}
+}
+
+// ParseFunc runs a complete parse, pulling tokens from next until the
+// input is accepted or an error occurs.
+func (p *Parser[T, Tok]) ParseFunc(next func() Tok) error {
+	for {
+		done, err := p.Parse(next())
+		if err != nil {
+			return err
+		}
+		if done {
+			return errors.Join(p.Errors...)
+		}
+	}
+}
+
+// ParseTokens runs a complete parse over toks, which must include the
+// token that ends the input.
+func (p *Parser[T, Tok]) ParseTokens(toks []Tok) error {
+	for _, tok := range toks {
+		done, err := p.Parse(tok)
+		if err != nil {
+			return err
+		}
+		if done {
+			return errors.Join(p.Errors...)
+		}
+	}
+	return fmt.Errorf("unexpected end of tokens")
+}
+
+// DumpTree writes tree, as built by rules without code, as an indented
+// s-expression.  Tokens are written using their String method if they
+// have one, and otherwise as their ParseId.
+func DumpTree(w io.Writer, tree any) error {
+	_, err := io.WriteString(w, dumpTree(tree, "")+"\n")
+	return err
+}
+
+func dumpTree(tree any, indent string) string {
+	switch t := tree.(type) {
+	case []any:
+		// Lists of only tokens fit on one line.
+		sep := " "
+		for _, c := range t {
+			if _, ok := c.([]any); ok {
+				sep = "\n" + indent + "  "
+				break
+			}
+		}
+		str := "("
+		for i, c := range t {
+			if i > 0 {
+				str += sep
+			}
+			str += dumpTree(c, indent+"  ")
+		}
+		return str + ")"
+	case fmt.Stringer:
+		return fmt.Sprintf("%q", t.String())
+	case TokenLike:
+		return t.ParseId()
+	}
+	return fmt.Sprint(tree)
+}
+
+// Result returns the final result of a successful parse.
+func (p *Parser[T, Tok]) Result() T {
+	return p.data[0].(T)
+}
+
+// Release frees the result of the parse once it's no longer needed,
+// making the memory of the parser's Arena, if it has one, available
+// for reuse.  Neither the parser nor its result may be used after.
+func (p *Parser[T, Tok]) Release() {
+	if p.Arena != nil {
+		p.Arena.Release()
+	}
+	p.data = nil
+}
@@ -0,0 +1,310 @@
+package lr
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// actionSpan records the lines of the generated output that hold a
+// rule's reduce function.
+type actionSpan struct {
+	rule *Rule
+	// start is the first line of the function, code the first line
+	// of the user's code within it, and end the last line.
+	start, code, end int
+}
+
+// grammarPos maps a line of generated output back to the grammar.
+func grammarPos(spans []actionSpan, line int) (token.Position, bool) {
+	for _, span := range spans {
+		if line < span.start || line > span.end {
+			continue
+		}
+		if line < span.code || !span.rule.codePos.IsValid() {
+			return span.rule.pos, true
+		}
+		pos := span.rule.codePos
+		pos.Line += line - span.code
+		pos.Column = 0
+		return pos, true
+	}
+	return token.Position{}, false
+}
+
+// genName is the file name of the generated code in type checks.
+const genName = "<generated>"
+
+// checkedFiles parses the unformatted generated code src, returning it
+// followed by the other files of the output package in dir.  Files
+// generated from anything but the grammar, such as its lexer, are
+// among them, but not earlier output of the grammar.
+func checkedFiles(fset *token.FileSet, src []byte, dir string, params *Params) ([]*ast.File, error) {
+	filter := func(fi os.FileInfo) bool {
+		name := fi.Name()
+		if isGrammarFile(filepath.Join(dir, name), params) {
+			return false
+		}
+		return strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") &&
+			!strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".")
+	}
+
+	gen, err := parser.ParseFile(fset, genName, src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("parsing generated code: %s", err)
+	}
+	files := []*ast.File{gen}
+
+	grammar := make(map[string]bool)
+	for _, file := range params.srcFiles {
+		grammar[filepath.Base(file)] = true
+	}
+	pkgs, _ := parser.ParseDir(fset, dir, filter, parser.ParseComments)
+	if pkg := pkgs[params.Package]; pkg != nil {
+		for _, f := range pkg.Files {
+			from := generatedFrom(f)
+			if !isGenerated(f) || from != "" && !grammar[from] {
+				files = append(files, f)
+			}
+		}
+	}
+	return files, nil
+}
+
+// typeCheck type checks the unformatted generated code src alongside
+// the other files of the output package in dir, and reports errors in
+// the generated code at their positions in the grammar where possible.
+func typeCheck(src []byte, dir string, params *Params, spans []actionSpan) error {
+	fset := token.NewFileSet()
+	files, err := checkedFiles(fset, src, dir, params)
+	if err != nil {
+		return err
+	}
+
+	// Collect only errors in the generated file; the rest of the
+	// package is the user's business.
+	var errs []string
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error: func(err error) {
+			terr, ok := err.(types.Error)
+			if !ok {
+				errs = append(errs, err.Error())
+				return
+			}
+			pos := terr.Fset.Position(terr.Pos)
+			if pos.Filename != genName {
+				return
+			}
+			if gpos, ok := grammarPos(spans, pos.Line); ok {
+				errs = append(errs, fmt.Sprintf("%s: %s", gpos, terr.Msg))
+			} else {
+				errs = append(errs, fmt.Sprintf("%s: %s", pos, terr.Msg))
+			}
+		},
+	}
+	conf.Check(params.Package, fset, files, nil)
+
+	if len(errs) > 0 {
+		buf := &bytes.Buffer{}
+		buf.WriteString("type errors in generated code:")
+		for _, e := range errs {
+			buf.WriteString("\n" + e)
+		}
+		return fmt.Errorf("%s", buf.String())
+	}
+	return nil
+}
+
+// noImporter fails every import, leaving the imported packages' types
+// invalid, which go/types reports no errors about.
+type noImporter struct{}
+
+func (noImporter) Import(path string) (*types.Package, error) {
+	return nil, fmt.Errorf("not importing %s", path)
+}
+
+// checkBindings warns about the uses of variables in rule code that
+// don't fit the types of the symbols bound to them, and about rules
+// passing through the value of a symbol whose type doesn't fit theirs,
+// both of which the generated code, src, would fail to compile on.
+// Unlike typeCheck, it imports no packages, so that it's quick enough
+// to run on every grammar, and only types declared in the output
+// package are checked.
+func checkBindings(src []byte, dir string, params *Params, spans []actionSpan, warn Logger) {
+	if warn == nil {
+		return
+	}
+	fset := token.NewFileSet()
+	files, err := checkedFiles(fset, src, dir, params)
+	if err != nil {
+		return
+	}
+	spanAt := func(line int) *actionSpan {
+		for i := range spans {
+			if line >= spans[i].start && line <= spans[i].end {
+				return &spans[i]
+			}
+		}
+		return nil
+	}
+
+	var errs []types.Error
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{
+		Importer: noImporter{},
+		Error: func(err error) {
+			if terr, ok := err.(types.Error); ok && terr.Fset.Position(terr.Pos).Filename == genName {
+				errs = append(errs, terr)
+			}
+		},
+	}
+	pkg, _ := conf.Check(params.Package, fset, files, info)
+	qual := types.RelativeTo(pkg)
+
+	// The variables bound by each rule are declared in its function
+	// before its code.
+	bound := make(map[*Rule][]types.Object)
+	for id, obj := range info.Defs {
+		pos := fset.Position(id.Pos())
+		if pos.Filename != genName || obj == nil {
+			continue
+		}
+		if span := spanAt(pos.Line); span != nil && pos.Line < span.code && span.rule.code != "" && !isInvalid(obj.Type()) {
+			for _, v := range span.rule.vars {
+				if v == id.Name {
+					bound[span.rule] = append(bound[span.rule], obj)
+				}
+			}
+		}
+	}
+	for _, terr := range errs {
+		line := fset.Position(terr.Pos).Line
+		span := spanAt(line)
+		if span == nil || line < span.code {
+			continue
+		}
+		for _, obj := range bound[span.rule] {
+			if !mentions(terr.Msg, obj.Name()) {
+				continue
+			}
+			gpos, _ := grammarPos(spans, line)
+			warn.Printf("%s: %s is bound to %s, of type %s, which its use on line %d doesn't fit: %s",
+				span.rule.pos, obj.Name(), boundSymbol(span.rule, obj.Name()), types.TypeString(obj.Type(), qual), gpos.Line, terr.Msg)
+			break
+		}
+	}
+
+	// A rule without code returns the value of its one symbol, which
+	// is asserted to have that symbol's type.
+	ast.Inspect(files[0], func(n ast.Node) bool {
+		lit, ok := n.(*ast.FuncLit)
+		if !ok || len(lit.Body.List) != 1 {
+			return true
+		}
+		ret, ok := lit.Body.List[0].(*ast.ReturnStmt)
+		if !ok || len(ret.Results) == 0 {
+			return true
+		}
+		line := fset.Position(ret.Pos()).Line
+		span := spanAt(line)
+		if span == nil || span.rule.code != "" || line != span.code {
+			return true
+		}
+		sig, ok := info.Types[lit].Type.(*types.Signature)
+		value := info.Types[ret.Results[0]].Type
+		if !ok || sig.Results().Len() == 0 || value == nil || isInvalid(value) {
+			return true
+		}
+		if want := sig.Results().At(0).Type(); !isInvalid(want) && !types.AssignableTo(value, want) {
+			warn.Printf("%s: %s passes through the value of %s, of type %s, which doesn't fit its type %s",
+				span.rule.pos, span.rule.symbol, span.rule.pattern[0], types.TypeString(value, qual), types.TypeString(want, qual))
+		}
+		return true
+	})
+}
+
+// isInvalid reports whether typ is or holds a type that failed to
+// check, such as one from a package that wasn't imported, or embeds
+// one, which leaves its fields and methods unknown.
+func isInvalid(typ types.Type) bool {
+	seen := make(map[types.Type]bool)
+	var invalid func(typ types.Type) bool
+	invalid = func(typ types.Type) bool {
+		if seen[typ] {
+			return false
+		}
+		seen[typ] = true
+		if strings.Contains(typ.String(), "invalid type") {
+			return true
+		}
+		switch t := typ.Underlying().(type) {
+		case *types.Pointer:
+			return invalid(t.Elem())
+		case *types.Struct:
+			for i := 0; i < t.NumFields(); i++ {
+				if f := t.Field(i); f.Embedded() && invalid(f.Type()) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return invalid(typ)
+}
+
+// mentions reports whether msg names the identifier name.
+func mentions(msg, name string) bool {
+	words := strings.FieldsFunc(msg, func(r rune) bool {
+		return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if w == name {
+			return true
+		}
+	}
+	return false
+}
+
+// boundSymbol returns the symbol of rule's pattern bound to the
+// variable v.
+func boundSymbol(rule *Rule, v string) string {
+	for i, name := range rule.vars {
+		if name == v {
+			return rule.pattern[i]
+		}
+	}
+	return ""
+}
+
+// tokenHasPos reports whether the parser's token type, declared by the
+// grammar's helpers or the output package in dir, has a Pos field or
+// method to report errors at.  A type it can't find, as from another
+// package, is assumed to have one.
+func tokenHasPos(dir string, params *Params) bool {
+	fset := token.NewFileSet()
+	src := []byte("package " + params.Package + "\n" + params.Helpers)
+	files, err := checkedFiles(fset, src, dir, params)
+	if err != nil {
+		return true
+	}
+	conf := types.Config{Importer: noImporter{}, Error: func(error) {}}
+	pkg, _ := conf.Check(params.Package, fset, files, nil)
+	obj, ok := pkg.Scope().Lookup(params.TokenType).(*types.TypeName)
+	if !ok || isInvalid(obj.Type()) {
+		return true
+	}
+	pos, _, _ := types.LookupFieldOrMethod(obj.Type(), true, pkg, "Pos")
+	return pos != nil
+}
@@ -0,0 +1,365 @@
+package lr
+
+// Conversion of yacc grammars to annotated Go.
+
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"gen/codegen"
+)
+
+// yaccScanner splits yacc source into the pieces the converter cares
+// about: words, literals, actions, and punctuation.
+type yaccScanner struct {
+	src  string
+	pos  int
+	line int
+}
+
+// next returns the next token of the input, or "" at EOF.
+func (s *yaccScanner) next() (string, error) {
+	for s.pos < len(s.src) {
+		c := s.src[s.pos]
+		switch {
+		case c == '\n':
+			s.line++
+			s.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			s.pos++
+		case strings.HasPrefix(s.src[s.pos:], "/*"):
+			end := strings.Index(s.src[s.pos+2:], "*/")
+			if end < 0 {
+				return "", s.errorf("unterminated comment")
+			}
+			s.skip(end + 4)
+		case strings.HasPrefix(s.src[s.pos:], "//"):
+			end := strings.IndexByte(s.src[s.pos:], '\n')
+			if end < 0 {
+				end = len(s.src) - s.pos
+			}
+			s.pos += end
+		default:
+			return s.token()
+		}
+	}
+	return "", nil
+}
+
+// skip advances over n bytes, counting lines.
+func (s *yaccScanner) skip(n int) string {
+	text := s.src[s.pos : s.pos+n]
+	s.line += strings.Count(text, "\n")
+	s.pos += n
+	return text
+}
+
+func (s *yaccScanner) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("line %d: %s", s.line, fmt.Sprintf(format, a...))
+}
+
+// token scans a token starting at a non-space character.
+func (s *yaccScanner) token() (string, error) {
+	rest := s.src[s.pos:]
+	c := rest[0]
+	switch {
+	case strings.HasPrefix(rest, "%%"), strings.HasPrefix(rest, "%{"),
+		strings.HasPrefix(rest, "%}"):
+		return s.skip(2), nil
+	case c == '\'' || c == '"':
+		for i := 1; i < len(rest); i++ {
+			switch rest[i] {
+			case '\\':
+				i++
+			case c:
+				return s.skip(i + 1), nil
+			case '\n':
+				return "", s.errorf("unterminated literal")
+			}
+		}
+		return "", s.errorf("unterminated literal")
+	case c == '{':
+		depth := 0
+		for i := 0; i < len(rest); i++ {
+			switch rest[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					return s.skip(i + 1), nil
+				}
+			case '\'', '"':
+				q := rest[i]
+				for i++; i < len(rest) && rest[i] != q; i++ {
+					if rest[i] == '\\' {
+						i++
+					}
+				}
+			}
+		}
+		return "", s.errorf("unterminated action")
+	case c == '<':
+		end := strings.IndexByte(rest, '>')
+		if end < 0 {
+			return "", s.errorf("unterminated type")
+		}
+		return s.skip(end + 1), nil
+	case c == '%' || c == '_' || c == '.' || unicode.IsLetter(rune(c)):
+		i := 1
+		for i < len(rest) && (rest[i] == '_' || rest[i] == '.' ||
+			unicode.IsLetter(rune(rest[i])) || unicode.IsDigit(rune(rest[i]))) {
+			i++
+		}
+		return s.skip(i), nil
+	}
+	return s.skip(1), nil
+}
+
+// yaccAlt is one alternative of a yacc rule.
+type yaccAlt struct {
+	syms   []string
+	action string
+}
+
+// yaccRule is all the alternatives for one nonterminal.
+type yaccRule struct {
+	name string
+	alts []*yaccAlt
+}
+
+// yaccSymbol converts a yacc grammar symbol to gen's notation.
+func yaccSymbol(sym string) string {
+	if len(sym) >= 2 && (sym[0] == '\'' || sym[0] == '"') {
+		return quoteLiteral(sym[1 : len(sym)-1])
+	}
+	return sym
+}
+
+// yaccNames returns the names of the functions for rules, which are
+// the rules' own names where those are Go identifiers.  A Go keyword,
+// like type, gets an underscore added, and a name Go doesn't allow,
+// like expr.list, has the characters it doesn't allow replaced by
+// underscores, with more added to keep each function's name unique.
+func yaccNames(rules []*yaccRule) map[string]string {
+	used := make(map[string]bool)
+	for _, rule := range rules {
+		used[rule.name] = true
+	}
+	names := make(map[string]string)
+	for _, rule := range rules {
+		name := rule.name
+		if token.IsIdentifier(name) {
+			names[name] = name
+			continue
+		}
+		name = strings.Map(func(r rune) rune {
+			if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return '_'
+		}, name)
+		if !token.IsIdentifier(name) {
+			name += "_"
+		}
+		for used[name] {
+			name += "_"
+		}
+		used[name] = true
+		names[rule.name] = name
+	}
+	return names
+}
+
+// parseYacc parses the declarations and rules of yacc source,
+// returning the rules, the start symbol if declared, and the
+// precedence declarations.
+func parseYacc(src string) (rules []*yaccRule, start string, prec []string, err error) {
+	s := &yaccScanner{src: src, line: 1}
+
+	// Declarations section.
+	for {
+		tok, err := s.next()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		switch tok {
+		case "":
+			return nil, "", nil, fmt.Errorf("no rules section")
+		case "%{":
+			end := strings.Index(s.src[s.pos:], "%}")
+			if end < 0 {
+				return nil, "", nil, s.errorf("unterminated %%{")
+			}
+			s.skip(end + 2)
+			continue
+		case "%start":
+			if start, err = s.next(); err != nil {
+				return nil, "", nil, err
+			}
+			continue
+		case "%left", "%right", "%nonassoc", "%precedence":
+			// Keep the rest of the line for reference.
+			end := strings.IndexByte(s.src[s.pos:], '\n')
+			if end < 0 {
+				end = len(s.src) - s.pos
+			}
+			prec = append(prec, tok+strings.TrimRight(s.skip(end), " \t\r"))
+			continue
+		case "%union":
+			if _, err := s.next(); err != nil {
+				return nil, "", nil, err
+			}
+			continue
+		}
+		if tok == "%%" {
+			break
+		}
+	}
+
+	// Rules section.
+	var rule *yaccRule
+	var alt *yaccAlt
+	for {
+		tok, err := s.next()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		switch {
+		case tok == "" || tok == "%%":
+			return rules, start, prec, nil
+		case tok == ":":
+			return nil, "", nil, s.errorf("unexpected :")
+		case tok == "|":
+			if rule == nil {
+				return nil, "", nil, s.errorf("unexpected |")
+			}
+			alt = &yaccAlt{}
+			rule.alts = append(rule.alts, alt)
+		case tok == ";":
+			rule, alt = nil, nil
+		case tok == "%prec":
+			if _, err := s.next(); err != nil {
+				return nil, "", nil, err
+			}
+		case tok == "%empty":
+		case tok[0] == '{':
+			if alt == nil {
+				return nil, "", nil, s.errorf("unexpected action")
+			}
+			alt.action = tok
+		default:
+			// A name followed by a colon starts a new rule, even
+			// without a terminating semicolon on the previous one.
+			save, saveLine := s.pos, s.line
+			if next, err := s.next(); err == nil && next == ":" {
+				rule = &yaccRule{name: tok}
+				alt = &yaccAlt{}
+				rule.alts = append(rule.alts, alt)
+				rules = append(rules, rule)
+				continue
+			}
+			s.pos, s.line = save, saveLine
+			if alt == nil {
+				return nil, "", nil, s.errorf("unexpected %s", tok)
+			}
+			alt.syms = append(alt.syms, tok)
+		}
+	}
+}
+
+// Import converts the yacc grammar in infile, or read from in if it's
+// non-nil, to a Go source file of syntax()-annotated rule functions in
+// package pkg.  Rule types and actions don't translate, so the rules
+// return interface{} and the original actions are left as comments to
+// be rewritten by hand.  A rule whose name is a Go keyword keeps it,
+// given by //gen:rule to a function named as by yaccNames; one whose
+// name Go doesn't allow is renamed.
+func Import(infile string, in io.Reader, pkg string) ([]byte, error) {
+	var src []byte
+	var err error
+	if in != nil {
+		src, err = ioutil.ReadAll(in)
+	} else {
+		src, err = ioutil.ReadFile(infile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rules, start, prec, err := parseYacc(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", infile, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s: no rules", infile)
+	}
+
+	// gen takes the first rule as the start rule.
+	if start != "" {
+		for i, rule := range rules {
+			if rule.name == start {
+				copy(rules[1:i+1], rules[:i])
+				rules[0] = rule
+				break
+			}
+		}
+	}
+
+	w := &codegen.Writer{}
+	w.Linef("package %s", pkg)
+	w.Line("")
+	w.Linef("// Converted from %s by gen import.", filepath.Base(infile))
+	if len(prec) > 0 {
+		w.Line("// gen doesn't support precedence declarations; they were:")
+		for _, p := range prec {
+			w.Linef("//   %s", p)
+		}
+	}
+	names := yaccNames(rules)
+	// symbol returns the name of a symbol in the converted rules.
+	symbol := func(sym string) string {
+		if name, ok := names[sym]; ok && !token.IsKeyword(sym) {
+			return name
+		}
+		return yaccSymbol(sym)
+	}
+	for _, rule := range rules {
+		if name := names[rule.name]; name != rule.name && !token.IsKeyword(rule.name) {
+			w.Linef("// %s is renamed %s, a Go identifier.", rule.name, name)
+		}
+	}
+	for _, rule := range rules {
+		w.Line("")
+		if token.IsKeyword(rule.name) {
+			w.Linef("//gen:rule %s", rule.name)
+		}
+		w.Linef("func %s() interface{} {", names[rule.name])
+		for i, alt := range rule.alts {
+			if i > 0 {
+				w.Line("")
+			}
+			var syms []string
+			for _, sym := range alt.syms {
+				syms = append(syms, symbol(sym))
+			}
+			if len(syms) == 0 {
+				syms = append(syms, "%empty")
+			}
+			w.Linef("syntax(`%s`)", strings.Join(syms, " "))
+			if alt.action != "" {
+				w.Line("// TODO: convert action:")
+				for _, line := range strings.Split(alt.action, "\n") {
+					w.Linef("// %s", strings.TrimRight(line, " \t\r"))
+				}
+			}
+			w.Line("return nil")
+		}
+		w.Line("}")
+	}
+	return w.Fmt()
+}
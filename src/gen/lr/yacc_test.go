@@ -0,0 +1,72 @@
+package lr
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const yaccGrammar = `%{
+package calc
+%}
+%token NUM IDENT
+%left '+'
+%start prog
+%%
+expr: expr '+' expr { $$ = $1 + $3 }
+    | NUM
+    | '[' expr.list ']'
+    ;
+prog: stmts ;
+stmts: %empty
+     | stmts stmt
+     ;
+stmt: type '=' expr ';' { fmt.Println("}") }
+    | expr %prec '+' ';'
+    ;
+type: IDENT ;
+expr.list: expr | expr.list ',' expr ;
+`
+
+// TestImport checks the conversion of a yacc grammar, and that gen
+// reads the result as a grammar.
+func TestImport(t *testing.T) {
+	out, err := Import("g.y", strings.NewReader(yaccGrammar), "calc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := string(out)
+	for _, want := range []string{
+		// The %start rule comes first.
+		"//   %left '+'\n// expr.list is renamed expr_list, a Go identifier.\n\nfunc prog() interface{} {\n\tsyntax(`stmts`)",
+		"\tsyntax(`%empty`)\n\treturn nil\n\n\tsyntax(`stmts stmt`)",
+		"\tsyntax(`type '=' expr ;`)\n\t// TODO: convert action:\n\t// { fmt.Println(\"}\") }\n",
+		"\tsyntax(`expr ;`)",
+		"//gen:rule type\nfunc type_() interface{} {",
+		"func expr_list() interface{} {",
+		"\tsyntax(`expr_list , expr`)",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("output lacks %q:\n%s", want, src)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "_grammar.go")
+	if err := os.WriteFile(path, out, 0666); err != nil {
+		t.Fatal(err)
+	}
+	code, err := Main(path, &Options{Log: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(code), `[]string{"IDENT"}`) || !strings.Contains(string(code), `{"type", `) {
+		t.Errorf("the type rule is missing from the parser:\n%s", code)
+	}
+
+	if _, err := Import("g.y", strings.NewReader("%%\nexpr: NUM { \"}\" ;\n"), "calc"); err == nil || err.Error() != "g.y: line 2: unterminated action" {
+		t.Errorf("unterminated action: error %v", err)
+	}
+}
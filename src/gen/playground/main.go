@@ -0,0 +1,76 @@
+//go:build js && wasm
+
+// Command playground is gen built for WebAssembly, for a web page where
+// a grammar is pasted in and the generated code shown as it's edited:
+//
+//	GOOS=js GOARCH=wasm go build -o gen.wasm gen/playground
+//
+// It defines the global JavaScript function
+//
+//	gen(mode, source)
+//
+// which runs the mode, one of lex, lr, ll or graph, on source as if it
+// were the contents of a tokens file or grammar, and returns an object
+// with the output, the log holding any conflicts and warnings, and the
+// error, each a string.  The graph mode gives the graphviz graph of an
+// lr grammar's states.  As there's no package around the source, the
+// modes can't read other files: an lr grammar can't name a tokens file
+// or a profile.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"syscall/js"
+
+	"gen/codegen"
+	"gen/lex"
+	"gen/ll"
+	"gen/lr"
+)
+
+// run runs mode on source, returning the output and what was logged.
+func run(mode, source string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	in := bytes.NewBufferString(source)
+	var out []byte
+	var err error
+	switch mode {
+	case "lex":
+		out, err = lex.Main("tokens", &lex.Options{Input: in})
+	case "lr", "graph":
+		out, err = lr.Main("grammar.go", &lr.Options{
+			Input: in,
+			Level: codegen.LevelWarn,
+			Log:   logger,
+			Graph: mode == "graph",
+		})
+	case "ll":
+		out, err = ll.Main(ll.LexCodeGen{}, "grammar.go", in)
+	default:
+		err = fmt.Errorf("unknown mode %q", mode)
+	}
+	return out, buf.String(), err
+}
+
+func main() {
+	js.Global().Set("gen", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) != 2 {
+			return map[string]interface{}{"error": "gen takes a mode and the source"}
+		}
+		out, logged, err := run(args[0].String(), args[1].String())
+		result := map[string]interface{}{
+			"output": string(out),
+			"log":    logged,
+			"error":  "",
+		}
+		if err != nil {
+			result["error"] = err.Error()
+		}
+		return result
+	}))
+	// Stay alive for the page's calls.
+	select {}
+}
@@ -0,0 +1,233 @@
+// Package scaffold creates a small working language project, as a
+// starting point for new users of gen.
+package scaffold
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gen/lex"
+	"gen/lr"
+)
+
+const tokensFile = `specials:
+  None none
+  EOF EOF
+
+symbols:
+  Plus +
+  Minus -
+  Star *
+  Slash /
+  LParen (
+  RParen )
+
+values:
+  Num number
+`
+
+const grammarFile = `package main
+
+// This is the grammar for the parser, read by gen lr.  The leading
+// underscore in the file name keeps the go tool from compiling it.
+
+import "strconv"
+
+const (
+	lrPrefix      = ""
+	lrTokenType   = "token"
+	lrTokenId     = "Id"
+	lrTokenIdType = "int"
+	lrRecover     = true
+)
+
+func start() int {
+	syntax(` + "`E=expr`" + `)
+	return E
+}
+
+func expr() int {
+	syntax(` + "`A=expr + B=term`" + `)
+	return A + B
+
+	syntax(` + "`A=expr - B=term`" + `)
+	return A - B
+
+	syntax(` + "`term`" + `)
+}
+
+func term() int {
+	syntax(` + "`A=term * B=factor`" + `)
+	return A * B
+
+	syntax(` + "`A=term / B=factor`" + `)
+	return A / B
+
+	syntax(` + "`factor`" + `)
+}
+
+func factor() int {
+	syntax(` + "`N=number`" + `)
+	n, _ := strconv.Atoi(N.Text)
+	return n
+
+	syntax(` + "`( E=expr )`" + `)
+	return E
+}
+`
+
+const readerFile = `package main
+
+// reader implements ByteReader over a string.
+type reader struct {
+	s   string
+	pos int
+}
+
+func (r *reader) Next() byte {
+	if r.pos >= len(r.s) {
+		r.pos++
+		return 0
+	}
+	c := r.s[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *reader) Back(n int) {
+	r.pos -= n
+}
+
+func (r *reader) Offset() int {
+	return r.pos
+}
+
+// token adds a position to the lexer's tokens for the parser, which
+// reads their Id.
+type token struct {
+	Tok
+	Pos int
+}
+`
+
+const mainFile = `// Command %[1]s is a calculator REPL, scaffolded by gen init.
+package main
+
+//go:generate gen -o lex.go lex tokens
+//go:generate gen -o parse.go lr _grammar.go
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// eval parses and evaluates one line of input.
+func eval(line string) (int, error) {
+	r := &reader{s: line}
+	p := NewParser()
+	for {
+		tok := token{Pos: r.Offset()}
+		tok.Tok = scan(r)
+		if tok.Id == tNone {
+			return 0, fmt.Errorf("%%d: unexpected input", tok.Pos)
+		}
+		done, err := p.Parse(&tok)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			return p.Result(), nil
+		}
+	}
+}
+
+func main() {
+	s := bufio.NewScanner(os.Stdin)
+	fmt.Print("> ")
+	for s.Scan() {
+		if n, err := eval(s.Text()); err != nil {
+			fmt.Println("error:", err)
+		} else {
+			fmt.Println(n)
+		}
+		fmt.Print("> ")
+	}
+	fmt.Println()
+}
+`
+
+const testFile = `package main
+
+import "testing"
+
+func TestEval(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want int
+	}{
+		{"1", 1},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+	} {
+		got, err := eval(test.in)
+		if err != nil {
+			t.Errorf("eval(%q): %s", test.in, err)
+		} else if got != test.want {
+			t.Errorf("eval(%q) = %d, want %d", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{"1 +", "1 / 0", "?"} {
+		if _, err := eval(in); err == nil {
+			t.Errorf("eval(%q) succeeded, want error", in)
+		}
+	}
+}
+`
+
+// Init creates a new project in the directory dir, which must not
+// already exist, named after the directory.  It writes a tokens file,
+// a grammar, a REPL and a test, and runs gen to produce the lexer and
+// parser.
+func Init(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	name := filepath.Base(dir)
+
+	files := []struct {
+		name, text string
+	}{
+		{"tokens", tokensFile},
+		{"_grammar.go", grammarFile},
+		{"reader.go", readerFile},
+		{"main.go", fmt.Sprintf(mainFile, name)},
+		{"main_test.go", testFile},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), []byte(f.text), 0666); err != nil {
+			return err
+		}
+	}
+
+	code, err := lex.Main(filepath.Join(dir, "tokens"), &lex.Options{})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "lex.go"), code, 0666); err != nil {
+		return err
+	}
+
+	code, err = lr.Main(filepath.Join(dir, "_grammar.go"), &lr.Options{})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "parse.go"), code, 0666)
+}
@@ -0,0 +1,67 @@
+package calc
+
+import "strconv"
+
+var lrTokens = "calc.tokens"
+
+var lrErrors = map[string]string{
+	"stmt -> let ident = . expr": "expected a value to assign",
+}
+
+// Token is a token of the calculator's input, found at byte offset
+// Pos.
+type Token struct {
+	Kind, Text string
+	Pos        int
+}
+
+func (t Token) ParseId() string { return t.Kind }
+
+func (t Token) String() string {
+	if t.Text != "" {
+		return t.Text
+	}
+	return t.Kind
+}
+
+func start(S int) int {
+	syntax(`S=stmt`)
+	return S
+}
+
+func stmt(E int) int {
+	syntax(`let ident = E=expr | E=expr`)
+	return E
+}
+
+//gen:expect an expression
+func expr(A, B int) int {
+	syntax(`A=expr + B=term`)
+	return A + B
+
+	syntax(`A=expr - B=term`)
+	return A - B
+
+	syntax(`A=term`)
+	return A
+}
+
+func term(A, B int) int {
+	syntax(`A=term * B=factor`)
+	return A * B
+
+	syntax(`A=term / B=factor`)
+	return A / B
+
+	syntax(`A=factor`)
+	return A
+}
+
+func factor(N Token, E int) int {
+	syntax(`N=number`)
+	n, _ := strconv.Atoi(N.Text)
+	return n
+
+	syntax(`'(' E=expr ')'`)
+	return E
+}
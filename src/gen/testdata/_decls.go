@@ -0,0 +1,42 @@
+package decls
+
+import "strconv"
+
+// lrConcurrent generates ParseConcurrent, splitting the input at the
+// let keywords that begin declarations.
+var lrConcurrent = true
+
+// Token is a token of a list of declarations.
+type Token struct {
+	Kind, Text string
+}
+
+func (t Token) ParseId() string { return t.Kind }
+
+func start(L []int) []int {
+	syntax(`L=decls`)
+	return L
+}
+
+func decls(L []int, D int) []int {
+	syntax(`L=decls D=decl`)
+	return append(L, D)
+
+	syntax(`D=decl`)
+	return []int{D}
+}
+
+func decl(E int) int {
+	syntax(`let ident = E=expr ;`)
+	return E
+}
+
+func expr(A int, N Token) int {
+	syntax(`A=expr + N=number`)
+	n, _ := strconv.Atoi(N.Text)
+	return A + n
+
+	syntax(`N=number`)
+	n, _ := strconv.Atoi(N.Text)
+	return n
+}
@@ -0,0 +1,34 @@
+package guard
+
+// Token is a token of a list of statements.
+type Token struct {
+	Kind, Text string
+}
+
+func (t Token) ParseId() string { return t.Kind }
+
+func (t Token) String() string { return t.Text }
+
+func start(L []string) []string {
+	syntax(`L=list`)
+	return L
+}
+
+func list(L []string, S string) []string {
+	syntax(`L=list S=stmt ;`)
+	return append(L, S)
+
+	syntax(`S=stmt ;`)
+	return []string{S}
+}
+
+// stmt rejects the number 0 by a predicate with no action to fall back
+// on, so that the parser recovers from it as from any syntax error.
+func stmt(N Token) string {
+	syntax(`N=number`)
+	when(N.Text != "0")
+	return N.Text
+
+	syntax(`N=error`)
+	return "bad " + N.Text
+}
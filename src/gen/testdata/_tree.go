@@ -0,0 +1,22 @@
+package tree
+
+// lrArena lets the trees of lists be allocated from an Arena.
+var lrArena = true
+
+// Token is a token of a comma-separated list of numbers.
+type Token struct {
+	Kind, Text string
+}
+
+func (t Token) ParseId() string { return t.Kind }
+
+func (t Token) String() string { return t.Text }
+
+func start() []interface{} {
+	syntax(`list`)
+}
+
+func list() []interface{} {
+	syntax(`list , number`)
+	syntax(`[ number ]`)
+}
@@ -0,0 +1,32 @@
+package reloc
+
+func start(E Expr) Expr {
+	syntax(`E=expr`)
+	return E
+}
+
+func expr(A, B Expr) Expr {
+	syntax(`A=expr + B=term`)
+	return NewBinary(Add, A, B)
+
+	syntax(`A=term`)
+	return A
+}
+
+func term(A, B Expr) Expr {
+	syntax(`A=term * B=factor`)
+	return &Binary{Op: Mul, L: A, R: B}
+
+	syntax(`A=factor`)
+	return A
+}
+
+func factor(N Token, E Expr) Expr {
+	syntax(`N=number`)
+	var n Num
+	n.Text = N.Text
+	return n
+
+	syntax(`'(' E=expr ')'`)
+	return E
+}
@@ -0,0 +1,39 @@
+// Package reloc holds the syntax trees of the expressions parsed by
+// the parser generated from _expr.go into another package, for the
+// golden test of relocated parsers.
+package reloc
+
+// Token is a token of an expression, found at byte offset Pos.
+type Token struct {
+	Kind, Text string
+	Pos        int
+}
+
+func (t Token) ParseId() string { return t.Kind }
+
+// Expr is an expression.
+type Expr interface{}
+
+// Num is a number.
+type Num struct {
+	Text string
+}
+
+// Binary is an expression with an operator.
+type Binary struct {
+	Op   Op
+	L, R Expr
+}
+
+// Op is an operator.
+type Op int
+
+const (
+	Add Op = iota
+	Mul
+)
+
+// NewBinary returns the expression applying op to l and r.
+func NewBinary(op Op, l, r Expr) *Binary {
+	return &Binary{Op: op, L: l, R: r}
+}